@@ -7,6 +7,15 @@
 // 	DSF - DSD Stream File
 package audio
 
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
 // Encoding defines the set of possible audio encodings.
 type Encoding int
 
@@ -14,10 +23,55 @@ const (
 	// Direct Stream Digital (DSD) i.e. uncompressed DSD audio.
 	DSD Encoding = iota
 
-	// Direct Stream Transfer (DST) i.e. compressed DSD audio.
+	// Direct Stream Transfer (DST) i.e. compressed DSD audio. The encoded
+	// samples of DST audio are not blocks for each channel in turn but the
+	// DST frames in order, each of 1/75 second of every channel, exactly as
+	// stored in the DST sound data chunk of a DSDIFF file: each frame is a
+	// "DSTF" chunk, with a 4 byte ID, an 8 byte big endian size and the
+	// frame data padded to an even length, optionally followed by a "DSTC"
+	// chunk holding its CRC. The chunk headers keep the boundaries of the
+	// frames, which vary in size. BitsPerSample is 1, BlockSize is unused,
+	// and SampleCount is the number of samples per channel once decoded.
 	DST
 )
 
+// String returns the name of an Encoding e.g. "DSD", or "unknown".
+func (e Encoding) String() string {
+	switch e {
+	case DSD:
+		return "DSD"
+	case DST:
+		return "DST"
+	}
+	return "unknown"
+}
+
+// MarshalText implements encoding.TextMarshaler, so that an Encoding is held by
+// name e.g. in JSON. It is an error to marshal an unknown encoding.
+func (e Encoding) MarshalText() ([]byte, error) {
+	if e != DSD && e != DST {
+		return nil, fmt.Errorf("audio: cannot marshal unknown encoding %d", int(e))
+	}
+	return []byte(e.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting the name of an
+// encoding without regard to case.
+func (e *Encoding) UnmarshalText(text []byte) error {
+	for _, encoding := range []Encoding{DSD, DST} {
+		if strings.EqualFold(string(text), encoding.String()) {
+			*e = encoding
+			return nil
+		}
+	}
+	return fmt.Errorf("audio: unknown encoding %q", text)
+}
+
+// Silence is a byte of DSD silence, the idle pattern of alternating bits, with
+// which the final block for each channel of 1 bit per sample is padded when
+// the samples are rebuilt e.g. by Trim.
+const Silence = 0x69
+
 // Channel defines the set of possible audio channels.
 type Channel int
 
@@ -28,6 +82,10 @@ const (
 	LowFrequency
 	BackLeft
 	BackRight
+	SideLeft
+	SideRight
+	TopCenter
+	BackCenter
 )
 
 // Audio is a set of audio samples of a particular encoding.
@@ -38,7 +96,14 @@ type Audio struct {
 	// The number of channels e.g. 2 for stereo.
 	NumChannels uint
 
-	// The channel order e.g. front left, front right.
+	// The channel order e.g. front left, front right. If not set when encoding
+	// a DSD stream file, the default order for the number of channels is used:
+	//	1: center
+	//	2: front left, front right
+	//	3: front left, front right, center
+	//	4: front left, front right, back left, back right
+	//	5: front left, front right, center, back left, back right
+	//	6: front left, front right, center, low frequency, back left, back right
 	ChannelOrder []Channel
 
 	// The sampling frequency in Hertz.
@@ -50,11 +115,96 @@ type Audio struct {
 	// Block size per channel in bytes.
 	BlockSize uint
 
-	// The encoded audio samples.
+	// The number of samples per channel, excluding the padding of the final
+	// block for each channel.
+	SampleCount uint64
+
+	// The encoded audio samples, which for DSD are blocks of BlockSize bytes
+	// for each channel in turn, and for DST are DST frames as described by
+	// DST.
 	EncodedSamples []byte
 
+	// The encoded audio samples as a sequence of buffers which, concatenated,
+	// hold the same bytes as EncodedSamples would. This avoids one large
+	// allocation for a long recording. If EncodedBlocks is not nil then
+	// EncodedSamples is ignored. See SamplesReader and Samples to read the
+	// samples without regard to which is used.
+	EncodedBlocks [][]byte
+
+	// The encoded audio samples read on demand from e.g. a file rather than
+	// held in memory, which avoids reading a long recording at all until it is
+	// needed. The source of the section must remain open while the samples are
+	// used, see Close. If EncodedSection is not nil then EncodedSamples and
+	// EncodedBlocks are ignored.
+	EncodedSection *io.SectionReader
+
 	// Metadata e.g. an ID3v2 tag.
 	Metadata []byte
+
+	// Tags parsed from the metadata, if requested when decoding, or later by
+	// ParseID3.
+	Tags *Tags
+
+	// The source of an EncodedSection whose samples have since been read into
+	// memory to be changed in place, which is still to be closed by Close.
+	closer io.Closer
+}
+
+// Tags is the common textual information about a recording, such as is held in
+// an ID3v2 tag. Fields that are not present are empty or zero.
+type Tags struct {
+	// The title of the track.
+	Title string
+
+	// The performing artist.
+	Artist string
+
+	// The album the track is from.
+	Album string
+
+	// The artist of the album as a whole, if different to that of the track.
+	AlbumArtist string
+
+	// The position of the track on the album, and the number of tracks on it
+	// e.g. 3 and 12 from "3/12".
+	TrackNumber int
+	TrackTotal  int
+
+	// The position of the disc in a set, and the number of discs in the set.
+	DiscNumber int
+	DiscTotal  int
+
+	// The year of recording or release e.g. "2015".
+	Year string
+
+	// The genre e.g. "Classical".
+	Genre string
+
+	// A comment about the recording.
+	Comment string
+
+	// The data of every frame that is not held in one of the fields above,
+	// by frame ID in the order found, so that they are not lost by writing
+	// the tags again. The data is as held in the tag, after undoing any
+	// unsynchronisation.
+	Other map[string][][]byte
+}
+
+// clone returns a deep copy of the tags, or nil if t is nil.
+func (t *Tags) clone() *Tags {
+	if t == nil {
+		return nil
+	}
+	tags := *t
+	if t.Other != nil {
+		tags.Other = make(map[string][][]byte, len(t.Other))
+		for id, frames := range t.Other {
+			for _, frame := range frames {
+				tags.Other[id] = append(tags.Other[id], bytes.Clone(frame))
+			}
+		}
+	}
+	return &tags
 }
 
 // String returns the lowercase name of a Channel.
@@ -72,6 +222,299 @@ func (c Channel) String() string {
 		return "back left"
 	case BackRight:
 		return "back right"
+	case SideLeft:
+		return "side left"
+	case SideRight:
+		return "side right"
+	case TopCenter:
+		return "top center"
+	case BackCenter:
+		return "back center"
 	}
 	return "unknown"
 }
+
+// Abbreviations of the channels accepted by ParseChannel.
+var channelAbbreviations = map[string]Channel{
+	"fl":  FrontLeft,
+	"fr":  FrontRight,
+	"c":   Center,
+	"lfe": LowFrequency,
+	"bl":  BackLeft,
+	"br":  BackRight,
+	"sl":  SideLeft,
+	"sr":  SideRight,
+	"tc":  TopCenter,
+	"bc":  BackCenter,
+}
+
+// ParseChannel returns the Channel named by s, which is either the name given
+// by String e.g. "front left" or an abbreviation e.g. "FL", ignoring case and
+// surrounding spaces. Anything else is an error.
+func ParseChannel(s string) (Channel, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if c, ok := channelAbbreviations[name]; ok {
+		return c, nil
+	}
+	for c := FrontLeft; c <= BackCenter; c++ {
+		if name == c.String() {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("audio: unknown channel: %q", s)
+}
+
+// MarshalText implements encoding.TextMarshaler, using the name given by
+// String, so that a channel order is marshaled to JSON as e.g.
+// ["front left","front right"]. A value that is not a known channel is an
+// error.
+func (c Channel) MarshalText() ([]byte, error) {
+	if c < FrontLeft || c > BackCenter {
+		return nil, fmt.Errorf("audio: cannot marshal unknown channel %d", int(c))
+	}
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, accepting anything that
+// ParseChannel does.
+func (c *Channel) UnmarshalText(text []byte) error {
+	channel, err := ParseChannel(string(text))
+	if err != nil {
+		return err
+	}
+	*c = channel
+	return nil
+}
+
+// PaddingSize returns the number of bytes at the end of the samples for each
+// channel that are padding rather than samples, i.e. the unused part of the
+// final block for each channel.
+func (a *Audio) PaddingSize() uint64 {
+	if a.NumChannels == 0 || a.BitsPerSample == 0 {
+		return 0
+	}
+	size := a.EncodedSize() / uint64(a.NumChannels)
+	samples := a.sampleBytes()
+	if samples >= size {
+		return 0
+	}
+	return size - samples
+}
+
+// sampleBytes returns the number of bytes of samples for each channel,
+// excluding any padding.
+func (a *Audio) sampleBytes() uint64 {
+	if a.BitsPerSample == 1 {
+		return a.SampleCount/8 + (a.SampleCount%8+7)/8 // up to 8 samples per byte
+	}
+	return a.SampleCount
+}
+
+// sampleCount returns the number of samples per channel, which is SampleCount
+// if set, or otherwise computed from the size of the encoded samples including
+// any padding, or 0 if it cannot be computed.
+func (a *Audio) sampleCount() uint64 {
+	if a.SampleCount > 0 || a.NumChannels == 0 || a.BitsPerSample == 0 {
+		return a.SampleCount
+	}
+	return a.EncodedSize() / uint64(a.NumChannels) * 8 / uint64(a.BitsPerSample)
+}
+
+// EncodedSize returns the number of bytes of encoded samples, held in either
+// EncodedSection, EncodedBlocks or EncodedSamples.
+func (a *Audio) EncodedSize() uint64 {
+	if a.EncodedSection != nil {
+		return uint64(a.EncodedSection.Size())
+	}
+	if a.EncodedBlocks == nil {
+		return uint64(len(a.EncodedSamples))
+	}
+	var size uint64
+	for _, b := range a.EncodedBlocks {
+		size += uint64(len(b))
+	}
+	return size
+}
+
+// Size in bytes of the DSD, fmt and data chunk headers of a DSD stream file.
+const dsfHeaderSize = 28 + 52 + 12
+
+// BytesPerSecond returns the number of bytes of samples per second for all of
+// the channels, or 0 if the fields it needs are not set.
+func (a *Audio) BytesPerSecond() uint64 {
+	return uint64(a.SamplingFrequency) * uint64(a.NumChannels) * uint64(a.BitsPerSample) / 8
+}
+
+// DataSize returns the number of bytes of samples that the data chunk of a DSD
+// stream file holds for the audio, being a whole number of blocks for each
+// channel i.e. including the padding. The number of samples is SampleCount if
+// set, or otherwise computed from the size of the encoded samples. It returns
+// 0 if the fields it needs are not set.
+func (a *Audio) DataSize() uint64 {
+	if a.NumChannels == 0 || a.BlockSize == 0 || a.BitsPerSample == 0 {
+		return 0
+	}
+	n, blockSize := uint64(a.NumChannels), uint64(a.BlockSize)
+	size := (a.EncodedSize() + n - 1) / n
+	if a.SampleCount > 0 {
+		size = a.sampleBytes()
+	}
+	return (size + blockSize - 1) / blockSize * blockSize * n
+}
+
+// EstimatedFileSize returns the size in bytes of a DSD stream file holding the
+// audio: the chunk headers, the DataSize and the metadata, which may be
+// larger if padded when encoded. It returns 0 if DataSize does.
+func (a *Audio) EstimatedFileSize() uint64 {
+	size := a.DataSize()
+	if size == 0 {
+		return 0
+	}
+	return dsfHeaderSize + size + uint64(len(a.Metadata))
+}
+
+// Duration returns the duration of the audio, computed from the sample count
+// and sampling frequency. If the sample count is not set then it is computed
+// from the size of the encoded samples, which then includes any padding. It
+// returns 0 rather than dividing by zero if the fields it needs are not set.
+func (a *Audio) Duration() time.Duration {
+	samples := a.sampleCount()
+	f := uint64(a.SamplingFrequency)
+	if f == 0 {
+		return 0
+	}
+
+	// Split into whole seconds and a remainder to avoid overflow
+	return time.Duration(samples/f)*time.Second + time.Duration(samples%f)*time.Second/time.Duration(f)
+}
+
+// Clone returns a deep copy of the audio, sharing no memory with it, so that
+// either may be changed without affecting the other. Copying the struct
+// instead shares the channel order, samples and metadata. A clone of audio
+// whose samples are mapped from a file remains valid once the file is
+// released. Samples read on demand are not read, but the EncodedSection is
+// shared, as it is never written to, so both must be closed together.
+//
+// PackTo1Bit, UnpackTo8Bit, Interleave, RemapChannels and InvertPolarity
+// change the audio in place, so clone it first to keep the original, with
+// samples read on demand being read into EncodedSamples first. Trim,
+// SplitChannels and ExtractChannel return new audio, as do Concat,
+// MergeChannels, NewSilence and ReadRaw, sharing no memory with their
+// arguments.
+func (a *Audio) Clone() *Audio {
+	b := *a
+	b.ChannelOrder = slices.Clone(a.ChannelOrder)
+	b.EncodedSamples = bytes.Clone(a.EncodedSamples)
+	if a.EncodedBlocks != nil {
+		b.EncodedBlocks = make([][]byte, len(a.EncodedBlocks))
+		for i, block := range a.EncodedBlocks {
+			b.EncodedBlocks[i] = bytes.Clone(block)
+		}
+	}
+	b.Metadata = bytes.Clone(a.Metadata)
+	b.Tags = a.Tags.clone()
+	return &b
+}
+
+// SamplesReader returns an io.Reader over the encoded samples as one logical
+// stream, held in either EncodedSection, EncodedBlocks or EncodedSamples.
+func (a *Audio) SamplesReader() io.Reader {
+	if a.EncodedSection != nil {
+		return io.NewSectionReader(a.EncodedSection, 0, a.EncodedSection.Size())
+	}
+	if a.EncodedBlocks == nil {
+		return bytes.NewReader(a.EncodedSamples)
+	}
+	readers := make([]io.Reader, len(a.EncodedBlocks))
+	for i, b := range a.EncodedBlocks {
+		readers[i] = bytes.NewReader(b)
+	}
+	return io.MultiReader(readers...)
+}
+
+// Samples returns an io.SectionReader over the encoded samples as one logical
+// stream, held in either EncodedSection, EncodedBlocks or EncodedSamples, so
+// that any part of them may be read with ReadAt without regard to which is
+// used.
+func (a *Audio) Samples() *io.SectionReader {
+	switch {
+	case a.EncodedSection != nil:
+		return io.NewSectionReader(a.EncodedSection, 0, a.EncodedSection.Size())
+	case a.EncodedBlocks != nil:
+		r := &blocksReaderAt{blocks: a.EncodedBlocks, offsets: make([]int64, len(a.EncodedBlocks)+1)}
+		for i, b := range a.EncodedBlocks {
+			r.offsets[i+1] = r.offsets[i] + int64(len(b))
+		}
+		return io.NewSectionReader(r, 0, r.offsets[len(a.EncodedBlocks)])
+	}
+	return io.NewSectionReader(bytes.NewReader(a.EncodedSamples), 0, int64(len(a.EncodedSamples)))
+}
+
+// blocksReaderAt is an io.ReaderAt over a sequence of buffers, with the offset
+// of the start of each and of the end of the last.
+type blocksReaderAt struct {
+	blocks  [][]byte
+	offsets []int64
+}
+
+// ReadAt reads from the buffer holding offset off onwards.
+func (r *blocksReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("audio: negative offset %v", off)
+	}
+	i, _ := slices.BinarySearch(r.offsets, off+1)
+	n := 0
+	for i--; n < len(p) && i < len(r.blocks); i++ {
+		start := max(off+int64(n)-r.offsets[i], 0)
+		n += copy(p[n:], r.blocks[i][start:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close closes the source of the EncodedSection, if it is an io.Closer such as
+// the file opened by dsf.DecodeFile with dsf.WithLazySamples, and sets
+// EncodedSection to nil, after which the samples cannot be read. The source is
+// still closed if the samples have since been read into memory to be changed
+// in place, e.g. by RemapChannels. It does nothing if the samples were always
+// held in memory.
+func (a *Audio) Close() error {
+	a.dropSection()
+	if a.closer == nil {
+		return nil
+	}
+	c := a.closer
+	a.closer = nil
+	return c.Close()
+}
+
+// dropSection sets EncodedSection to nil, keeping its source to be closed by
+// Close if it is an io.Closer.
+func (a *Audio) dropSection() {
+	if a.EncodedSection == nil {
+		return
+	}
+	if r, _, _ := a.EncodedSection.Outer(); r != nil {
+		if c, ok := r.(io.Closer); ok {
+			a.closer = c
+		}
+	}
+	a.EncodedSection = nil
+}
+
+// loadSection reads samples read on demand into EncodedSamples, so that they
+// can be changed in place.
+func (a *Audio) loadSection() error {
+	if a.EncodedSection == nil {
+		return nil
+	}
+	samples, err := io.ReadAll(a.SamplesReader())
+	if err != nil {
+		return err
+	}
+	a.dropSection()
+	a.EncodedSamples, a.EncodedBlocks = samples, nil
+	return nil
+}
@@ -0,0 +1,445 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Table structure for a single padding size test
+type paddingSizeTest struct {
+	// Description for the test
+	description string
+	// The audio to check
+	audio Audio
+	// Expected number of bytes of padding per channel
+	expected uint64
+}
+
+// Table of all padding size tests
+var paddingSizeTests = []paddingSizeTest{
+	{"1-bit samples that fill the final block should have no padding", Audio{NumChannels: 2, BitsPerSample: 1, BlockSize: 4096, SampleCount: 4096 * 8, EncodedSamples: make([]byte, 2*4096)}, 0},
+	{"1-bit samples that part fill the final block should have padding", Audio{NumChannels: 2, BitsPerSample: 1, BlockSize: 4096, SampleCount: 4096*8 + 9, EncodedSamples: make([]byte, 2*2*4096)}, 4096 - 2},
+	{"8-bit samples that part fill the final block should have padding", Audio{NumChannels: 1, BitsPerSample: 8, BlockSize: 4096, SampleCount: 100, EncodedSamples: make([]byte, 4096)}, 4096 - 100},
+	{"A sample count exceeding the sample data should have no padding", Audio{NumChannels: 1, BitsPerSample: 1, BlockSize: 4096, SampleCount: 4096*8 + 1, EncodedSamples: make([]byte, 4096)}, 0},
+	{"Audio without any channels should have no padding", Audio{BitsPerSample: 1, EncodedSamples: make([]byte, 4096)}, 0},
+}
+
+// Run all padding size tests
+func TestPaddingSize(t *testing.T) {
+	for i, test := range paddingSizeTests {
+		actual := test.audio.PaddingSize()
+		if actual != test.expected {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.expected, actual)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// Table structure for a single duration test
+type durationTest struct {
+	// Description for the test
+	description string
+	// The audio to check
+	audio Audio
+	// Expected duration
+	expected time.Duration
+}
+
+// Table of all duration tests
+var durationTests = []durationTest{
+	{"Stereo DSD64 of 1-bit samples should last for the sample count", Audio{NumChannels: 2, SamplingFrequency: 2822400, BitsPerSample: 1, SampleCount: 2822400}, time.Second},
+	{"Mono DSD128 of 1-bit samples without a sample count should last for the encoded samples",
+		Audio{NumChannels: 1, SamplingFrequency: 5644800, BitsPerSample: 1, EncodedSamples: make([]byte, 5644800/8)}, time.Second},
+	{"5.1 DSD64 of 8-bit samples should last for the sample count", Audio{NumChannels: 6, SamplingFrequency: 2822400, BitsPerSample: 8, SampleCount: 1411200}, 500 * time.Millisecond},
+	{"5.1 DSD128 of 8-bit samples without a sample count should last for the encoded samples",
+		Audio{NumChannels: 6, SamplingFrequency: 5644800, BitsPerSample: 8, EncodedBlocks: [][]byte{make([]byte, 6*564480), make([]byte, 6*564480)}}, 200 * time.Millisecond},
+	{"A sample count that is not a whole number of seconds should last for the fraction", Audio{NumChannels: 2, SamplingFrequency: 2822400, BitsPerSample: 1, SampleCount: 2822400*3 + 28224}, 3010 * time.Millisecond},
+	{"A sample count that would overflow if not split into seconds should not overflow",
+		Audio{NumChannels: 2, SamplingFrequency: 2822400, BitsPerSample: 1, SampleCount: 2822400 * 36000}, 10 * time.Hour},
+	{"Audio without a sampling frequency should have no duration", Audio{NumChannels: 2, BitsPerSample: 1, SampleCount: 2822400}, 0},
+	{"Audio without any channels or sample count should have no duration", Audio{SamplingFrequency: 2822400, BitsPerSample: 1, EncodedSamples: make([]byte, 4096)}, 0},
+	{"Audio without bits per sample or sample count should have no duration", Audio{NumChannels: 1, SamplingFrequency: 2822400, EncodedSamples: make([]byte, 4096)}, 0},
+}
+
+// Run all duration tests
+func TestDuration(t *testing.T) {
+	for i, test := range durationTests {
+		actual := test.audio.Duration()
+		if actual != test.expected {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.expected, actual)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// splitBlocks returns b split into buffers of n bytes, the last of which may be
+// shorter.
+func splitBlocks(b []byte, n int) [][]byte {
+	blocks := [][]byte{}
+	for len(b) > n {
+		blocks = append(blocks, b[:n])
+		b = b[n:]
+	}
+	return append(blocks, b)
+}
+
+// Table of the buffers holding the same samples in different ways
+var samplesReaderTests = []struct {
+	description string
+	audio       Audio
+}{
+	{"Samples in EncodedSamples should be read", Audio{EncodedSamples: []byte("0123456789")}},
+	{"Samples in EncodedBlocks should be read in order", Audio{EncodedBlocks: splitBlocks([]byte("0123456789"), 4)}},
+	{"Samples in EncodedBlocks should be read instead of EncodedSamples", Audio{EncodedSamples: []byte("ignored"), EncodedBlocks: [][]byte{[]byte("01234"), {}, []byte("56789")}}},
+	{"Samples in EncodedSection should be read instead of EncodedBlocks", Audio{EncodedBlocks: [][]byte{[]byte("ignored")},
+		EncodedSection: io.NewSectionReader(strings.NewReader("xx0123456789xx"), 2, 10)}},
+}
+
+// Run all samples reader tests, which should read the same logical stream
+func TestSamplesReader(t *testing.T) {
+	for i, test := range samplesReaderTests {
+		actual, err := io.ReadAll(test.audio.SamplesReader())
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case string(actual) != "0123456789" || test.audio.EncodedSize() != 10:
+			t.Errorf("FAIL Test %v: %v:\nWant: %q of size 10\nActual: %q of size %v", i+1, test.description, "0123456789", actual, test.audio.EncodedSize())
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+
+	// Any part of the same logical stream should be read at an offset
+	offset := len(samplesReaderTests)
+	for i, test := range samplesReaderTests {
+		description := test.description + " at an offset"
+		r := test.audio.Samples()
+		p := make([]byte, 5)
+		n, err := r.ReadAt(p, 3)
+		m, eof := r.ReadAt(p[:4], 8)
+		switch {
+		case err != nil || n != 5 || r.Size() != 10:
+			t.Errorf("FAIL Test %v: %v:\nWant: 5 bytes of 10\nActual: %v bytes of %v, %v", offset+i+1, description, n, r.Size(), err)
+		case eof != io.EOF || m != 2 || string(p) != "89567":
+			t.Errorf("FAIL Test %v: %v:\nWant: %q and %v\nActual: %q and %v", offset+i+1, description, "89567", io.EOF, p, eof)
+		default:
+			t.Logf("PASS Test %v: %v", offset+i+1, description)
+		}
+	}
+
+	description := "The padding of samples in EncodedBlocks should be found"
+	a := paddingSizeTests[1].audio
+	a.EncodedBlocks = splitBlocks(a.EncodedSamples, 3000)
+	a.EncodedSamples = nil
+	if actual := a.PaddingSize(); actual != paddingSizeTests[1].expected {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", 2*len(samplesReaderTests)+1, description, paddingSizeTests[1].expected, actual)
+	} else {
+		t.Logf("PASS Test %v: %v", 2*len(samplesReaderTests)+1, description)
+	}
+}
+
+// Every channel should be named, and parsed from its name or abbreviation
+func TestParseChannel(t *testing.T) {
+	abbreviations := []string{"FL", "FR", "C", "LFE", "BL", "BR", "SL", "SR", "TC", "BC"}
+	for c := FrontLeft; c <= BackCenter; c++ {
+		description := fmt.Sprintf("The %v channel should be parsed from its name and abbreviation", c)
+		switch {
+		case c.String() == "unknown":
+			t.Errorf("FAIL Test %v: %v:\nWant: a name\nActual: unknown", int(c)+1, description)
+		case mustParseChannel(c.String()) != c || mustParseChannel(" "+strings.ToUpper(c.String())) != c:
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", int(c)+1, description, c, mustParseChannel(c.String()))
+		case mustParseChannel(abbreviations[c]) != c || mustParseChannel(strings.ToLower(abbreviations[c])) != c:
+			t.Errorf("FAIL Test %v: %v:\nWant: %v from %v\nActual: %v", int(c)+1, description, c, abbreviations[c], mustParseChannel(abbreviations[c]))
+		default:
+			t.Logf("PASS Test %v: %v", int(c)+1, description)
+		}
+	}
+
+	for i, s := range []string{"", "unknown", "front", "left", "F L", "7.1"} {
+		description := fmt.Sprintf("Parsing %q should result in an error", s)
+		if c, err := ParseChannel(s); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v", int(BackCenter)+i+2, description, c)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", int(BackCenter)+i+2, description, err.Error())
+		}
+	}
+}
+
+// mustParseChannel returns the channel named by s, or -1 if there is none
+func mustParseChannel(s string) Channel {
+	c, err := ParseChannel(s)
+	if err != nil {
+		return -1
+	}
+	return c
+}
+
+// Changing a clone in every way should leave the original untouched, however
+// it holds the samples
+func TestClone(t *testing.T) {
+	newAudio := func(blocks bool) *Audio {
+		a := &Audio{Encoding: DSD, NumChannels: 2, ChannelOrder: []Channel{FrontLeft, FrontRight}, SamplingFrequency: 2822400,
+			BitsPerSample: 1, BlockSize: 4, SampleCount: 64, EncodedSamples: []byte("0123456789abcdef"),
+			Metadata: []byte("ID3\x03\x00\x00\x00\x00\x00\x00"), Tags: &Tags{Title: "Title", Other: map[string][][]byte{"TXXX": {[]byte("x")}}}}
+		if blocks {
+			a.EncodedBlocks = splitBlocks(a.EncodedSamples, 5)
+		}
+		return a
+	}
+	for i, layout := range []string{"EncodedSamples", "EncodedBlocks"} {
+		description := fmt.Sprintf("Changing a clone of samples held in %v should not change the original", layout)
+		a := newAudio(i == 1)
+		b := a.Clone()
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v", i+1, description, a, b)
+			continue
+		}
+		b.ChannelOrder[0] = Center
+		b.EncodedSamples[0] = 'x'
+		if b.EncodedBlocks != nil {
+			b.EncodedBlocks[0][0], b.EncodedBlocks[1] = 'x', nil
+		}
+		b.Metadata[3] = 4
+		b.Tags.Title = "Changed"
+		b.Tags.Other["TXXX"][0][0] = 'y'
+		b.InvertPolarity()
+		if !reflect.DeepEqual(a, newAudio(i == 1)) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v", i+1, description, newAudio(i == 1), a)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+}
+
+// closer is an io.ReaderAt that records whether it has been closed
+type closer struct {
+	*strings.Reader
+	closed bool
+}
+
+// Close records that the closer has been closed.
+func (c *closer) Close() error {
+	c.closed = true
+	return nil
+}
+
+// Samples read on demand should be closed, and read into memory before being
+// changed in place
+func TestClose(t *testing.T) {
+	newAudio := func(c *closer) *Audio {
+		return &Audio{NumChannels: 2, ChannelOrder: []Channel{FrontLeft, FrontRight}, BitsPerSample: 8, BlockSize: 4, SampleCount: 4,
+			EncodedSection: io.NewSectionReader(c, 1, 8)}
+	}
+
+	description := "Changing samples read on demand should read them into memory"
+	c := &closer{Reader: strings.NewReader("x\x00\x01\x00\x01\x01\x00\x01\x00x")}
+	a := newAudio(c)
+	if err := a.InvertPolarity(); err != nil || a.EncodedSection != nil || string(a.EncodedSamples) != "\x01\x00\x01\x00\x00\x01\x00\x01" {
+		t.Errorf("FAIL Test 1: %v:\nWant: %q\nActual: %q with section %v, %v", description, "\x01\x00\x01\x00\x00\x01\x00\x01", a.EncodedSamples, a.EncodedSection, err)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "Closing samples read on demand should close their source"
+	a = newAudio(c)
+	if err := a.Close(); err != nil || !c.closed || a.EncodedSection != nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: closed\nActual: closed %v with section %v, %v", description, c.closed, a.EncodedSection, err)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	description = "Closing samples held in memory should do nothing"
+	a = &Audio{EncodedSamples: []byte("0123")}
+	if err := a.Close(); err != nil || string(a.EncodedSamples) != "0123" {
+		t.Errorf("FAIL Test 3: %v:\nWant: %q\nActual: %q, %v", description, "0123", a.EncodedSamples, err)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+
+	// Changing the samples in place should not stop their source being closed
+	edits := map[string]func(a *Audio) error{
+		"RemapChannels":  func(a *Audio) error { return a.RemapChannels([]Channel{FrontRight, FrontLeft}) },
+		"InvertPolarity": func(a *Audio) error { return a.InvertPolarity() },
+		"PackTo1Bit":     func(a *Audio) error { return a.PackTo1Bit() },
+	}
+	for _, name := range []string{"RemapChannels", "InvertPolarity", "PackTo1Bit"} {
+		description = "Closing samples read on demand and changed by " + name + " should close their source"
+		c := &closer{Reader: strings.NewReader("x\x00\x01\x00\x01\x01\x00\x01\x00x")}
+		a = newAudio(c)
+		if err := edits[name](a); err != nil || a.EncodedSection != nil {
+			t.Errorf("FAIL Test 4: %v:\nWant: samples in memory\nActual: section %v, %v", description, a.EncodedSection, err)
+		} else if err := a.Close(); err != nil || !c.closed {
+			t.Errorf("FAIL Test 4: %v:\nWant: closed\nActual: closed %v, %v", description, c.closed, err)
+		} else if err := a.Close(); err != nil {
+			t.Errorf("FAIL Test 4: %v:\nWant: closing again to do nothing\nActual: %v", description, err)
+		} else {
+			t.Logf("PASS Test 4: %v", description)
+		}
+	}
+}
+
+// Table structure for a single channel order JSON test
+type channelJSONTest struct {
+	// Description for the test
+	description string
+	// The channel order
+	order []Channel
+	// Expected JSON
+	json string
+}
+
+// Table of all channel order JSON tests
+var channelJSONTests = []channelJSONTest{
+	{"A stereo channel order should round trip as names", []Channel{FrontLeft, FrontRight}, `["front left","front right"]`},
+	{"A 5.1 channel order should round trip as names", []Channel{FrontLeft, FrontRight, Center, LowFrequency, BackLeft, BackRight},
+		`["front left","front right","center","low frequency","back left","back right"]`},
+	{"The zero value should round trip as front left", make([]Channel, 1), `["front left"]`},
+	{"The new channels should round trip as names", []Channel{SideLeft, SideRight, TopCenter, BackCenter}, `["side left","side right","top center","back center"]`},
+}
+
+// Run all channel order JSON tests, in both directions
+func TestChannelJSON(t *testing.T) {
+	for i, test := range channelJSONTests {
+		b, err := json.Marshal(test.order)
+		if err != nil || string(b) != test.json {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %s, %v", i+1, test.description, test.json, b, err)
+			continue
+		}
+		var order []Channel
+		if err := json.Unmarshal(b, &order); err != nil || !reflect.DeepEqual(order, test.order) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v, %v", i+1, test.description, test.order, order, err)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+
+	n := len(channelJSONTests)
+	description := "Abbreviations should be unmarshaled"
+	var order []Channel
+	if err := json.Unmarshal([]byte(`["FL","FR","LFE"]`), &order); err != nil || !reflect.DeepEqual(order, []Channel{FrontLeft, FrontRight, LowFrequency}) {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v, %v", n+1, description, []Channel{FrontLeft, FrontRight, LowFrequency}, order, err)
+	} else {
+		t.Logf("PASS Test %v: %v", n+1, description)
+	}
+
+	description = "Unmarshaling an unknown name should result in an error"
+	if err := json.Unmarshal([]byte(`["front left","middle"]`), &order); err == nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v", n+2, description, order)
+	} else {
+		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", n+2, description, err.Error())
+	}
+
+	description = "Marshaling an unknown channel should result in an error"
+	if b, err := json.Marshal([]Channel{Channel(99)}); err == nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %s", n+3, description, b)
+	} else {
+		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", n+3, description, err.Error())
+	}
+}
+
+// Table of all encoding tests
+var encodingTests = []struct {
+	// Description for the test
+	description string
+	// The encoding
+	encoding Encoding
+	// Expected name and JSON
+	name, json string
+}{
+	{"DSD should be named", DSD, "DSD", `"DSD"`},
+	{"DST should be named", DST, "DST", `"DST"`},
+}
+
+// Every encoding should be named, and round trip through JSON by name
+func TestEncoding(t *testing.T) {
+	for i, test := range encodingTests {
+		var encoding Encoding
+		b, err := json.Marshal(test.encoding)
+		if err == nil {
+			err = json.Unmarshal(b, &encoding)
+		}
+		switch {
+		case test.encoding.String() != test.name || fmt.Sprint(test.encoding) != test.name:
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.name, test.encoding.String())
+		case err != nil || string(b) != test.json || encoding != test.encoding:
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %s as %v, %v", i+1, test.description, test.json, b, encoding, err)
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+
+	n := len(encodingTests)
+	description := "An unknown encoding should be named unknown, and not marshaled"
+	if b, err := json.Marshal(Encoding(7)); err == nil || Encoding(7).String() != "unknown" {
+		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %s named %v", n+1, description, b, Encoding(7))
+	} else {
+		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", n+1, description, err.Error())
+	}
+
+	description = "Names should be unmarshaled without regard to case"
+	var a Audio
+	if err := json.Unmarshal([]byte(`{"Encoding":"dst"}`), &a); err != nil || a.Encoding != DST {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v, %v", n+2, description, DST, a.Encoding, err)
+	} else {
+		t.Logf("PASS Test %v: %v", n+2, description)
+	}
+
+	description = "Unmarshaling an unknown name should result in an error"
+	if err := json.Unmarshal([]byte(`"DXD"`), &a.Encoding); err == nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v", n+3, description, a.Encoding)
+	} else {
+		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", n+3, description, err.Error())
+	}
+}
+
+// Table structure for a single size test
+type sizeTest struct {
+	// Description for the test
+	description string
+	// The audio
+	audio Audio
+	// Expected bytes per second, data size and estimated file size
+	bytesPerSecond, dataSize, fileSize uint64
+}
+
+// Table of all size tests
+var sizeTests = []sizeTest{
+	{"Stereo DSD64 ending part way through a block should be padded to whole blocks",
+		Audio{NumChannels: 2, SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096, SampleCount: 5000*8 - 3, Metadata: make([]byte, 100)},
+		705600, 2 * 2 * 4096, 92 + 2*2*4096 + 100},
+	{"Mono of whole blocks should not be padded",
+		Audio{NumChannels: 1, SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096, SampleCount: 4096 * 8},
+		352800, 4096, 92 + 4096},
+	{"Without a sample count the size of the encoded samples should be used",
+		Audio{NumChannels: 2, SamplingFrequency: 5644800, BitsPerSample: 1, BlockSize: 4, EncodedSamples: make([]byte, 10)},
+		1411200, 16, 92 + 16},
+	{"8 bits per sample should be a byte per sample",
+		Audio{NumChannels: 6, SamplingFrequency: 2822400, BitsPerSample: 8, BlockSize: 4096, SampleCount: 4097},
+		6 * 2822400, 6 * 2 * 4096, 92 + 6*2*4096},
+	{"Audio without a block size should have no data size", Audio{NumChannels: 2, SamplingFrequency: 2822400, BitsPerSample: 1, SampleCount: 8}, 705600, 0, 0},
+	{"An empty Audio should have no sizes", Audio{}, 0, 0, 0},
+}
+
+// Run all size tests
+func TestSizes(t *testing.T) {
+	for i, test := range sizeTests {
+		a := test.audio
+		if a.BytesPerSecond() != test.bytesPerSecond || a.DataSize() != test.dataSize || a.EstimatedFileSize() != test.fileSize {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v, %v, %v\nActual: %v, %v, %v", i+1, test.description,
+				test.bytesPerSecond, test.dataSize, test.fileSize, a.BytesPerSecond(), a.DataSize(), a.EstimatedFileSize())
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+)
+
+// The binary form of an Audio written by MarshalBinary, independent of any
+// audio file format, with every integer little endian:
+//
+//	magic "AUDI" then version, uint16
+//	Encoding, NumChannels, SamplingFrequency, BitsPerSample, BlockSize, uint32
+//	SampleCount, uint64
+//	ChannelOrder: count, uint32, then each channel, uint8
+//	samples: size, uint64, then the encoded samples
+//	Metadata: size, uint64, then the metadata
+//	Tags: 0 if nil, otherwise 1 followed by each text field in turn as a
+//	size, uint32, then the text, then each number, uint32, then the number
+//	of Other frame IDs, uint32, then in order of ID the ID as a size,
+//	uint32, then the ID, then the number of frames, uint32, then each frame
+//	as a size, uint32, then the data
+//
+// Version 1 held only the Title, Artist, Album, Track, Year and Genre of the
+// Tags, with the track as text e.g. "3/12", and is still decoded.
+const (
+	binaryMagic   = "AUDI"
+	binaryVersion = 2
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler, encoding the audio in a
+// versioned binary form that does not depend on the fields of the struct, so
+// that it can be cached and decoded by UnmarshalBinary by later versions of
+// this package. The encoded samples are held as one, whether in EncodedSamples
+// or EncodedBlocks.
+func (a *Audio) MarshalBinary() ([]byte, error) {
+	fields := []uint64{uint64(a.Encoding), uint64(a.NumChannels), uint64(a.SamplingFrequency), uint64(a.BitsPerSample), uint64(a.BlockSize), uint64(len(a.ChannelOrder))}
+	for _, field := range fields {
+		if field > math.MaxUint32 {
+			return nil, fmt.Errorf("audio: cannot marshal %v channels of %v Hz, %v bits per sample and %v byte blocks", a.NumChannels, a.SamplingFrequency, a.BitsPerSample, a.BlockSize)
+		}
+	}
+	size := a.EncodedSize()
+	b := make([]byte, 0, 64+len(a.ChannelOrder)+int(size)+len(a.Metadata))
+	b = append(b, binaryMagic...)
+	b = binary.LittleEndian.AppendUint16(b, binaryVersion)
+	for _, field := range fields[:5] {
+		b = binary.LittleEndian.AppendUint32(b, uint32(field))
+	}
+	b = binary.LittleEndian.AppendUint64(b, a.SampleCount)
+	b = binary.LittleEndian.AppendUint32(b, uint32(fields[5]))
+	for _, c := range a.ChannelOrder {
+		if c < FrontLeft || c > BackCenter {
+			return nil, fmt.Errorf("audio: cannot marshal unknown channel %d", int(c))
+		}
+		b = append(b, byte(c))
+	}
+
+	b = binary.LittleEndian.AppendUint64(b, size)
+	n := len(b)
+	b = b[:n+int(size)]
+	if _, err := io.ReadFull(a.SamplesReader(), b[n:]); err != nil {
+		return nil, err
+	}
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(a.Metadata)))
+	b = append(b, a.Metadata...)
+
+	if a.Tags == nil {
+		return append(b, 0), nil
+	}
+	b = append(b, 1)
+	appendText := func(text []byte) {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(text)))
+		b = append(b, text...)
+	}
+	for _, field := range a.Tags.textFields() {
+		if uint64(len(*field)) > math.MaxUint32 {
+			return nil, fmt.Errorf("audio: cannot marshal a tag of %v bytes", len(*field))
+		}
+		appendText([]byte(*field))
+	}
+	for _, field := range a.Tags.numberFields() {
+		if *field < 0 || uint64(*field) > math.MaxUint32 {
+			return nil, fmt.Errorf("audio: cannot marshal a track or disc position of %v", *field)
+		}
+		b = binary.LittleEndian.AppendUint32(b, uint32(*field))
+	}
+	ids := slices.Sorted(maps.Keys(a.Tags.Other))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(ids)))
+	for _, id := range ids {
+		appendText([]byte(id))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(a.Tags.Other[id])))
+		for _, frame := range a.Tags.Other[id] {
+			if uint64(len(frame)) > math.MaxUint32 {
+				return nil, fmt.Errorf("audio: cannot marshal a %v frame of %v bytes", id, len(frame))
+			}
+			appendText(frame)
+		}
+	}
+	return b, nil
+}
+
+// textFields and numberFields return the fields of the tags other than Other,
+// in the order of the binary form.
+func (t *Tags) textFields() []*string {
+	return []*string{&t.Title, &t.Artist, &t.Album, &t.AlbumArtist, &t.Year, &t.Genre, &t.Comment}
+}
+
+func (t *Tags) numberFields() []*int {
+	return []*int{&t.TrackNumber, &t.TrackTotal, &t.DiscNumber, &t.DiscTotal}
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, decoding the binary
+// form written by MarshalBinary into the audio, replacing all of its fields.
+// The samples are held in EncodedSamples. The data is checked as it is
+// decoded, so that corrupt data results in an error, and nothing is allocated
+// beyond the size of the data.
+func (a *Audio) UnmarshalBinary(data []byte) error {
+	r := binaryReader{data: data}
+	if magic := r.next(len(binaryMagic)); string(magic) != binaryMagic {
+		return fmt.Errorf("audio: binary form does not start with %q: %q", binaryMagic, magic)
+	}
+	version := r.uint16()
+	if version < 1 || version > binaryVersion {
+		return fmt.Errorf("audio: unsupported binary form version: %v", version)
+	}
+	var b Audio
+	b.Encoding = Encoding(r.uint32())
+	b.NumChannels = uint(r.uint32())
+	b.SamplingFrequency = uint(r.uint32())
+	b.BitsPerSample = uint(r.uint32())
+	b.BlockSize = uint(r.uint32())
+	b.SampleCount = r.uint64()
+	if order := r.next(int(r.uint32())); len(order) > 0 {
+		b.ChannelOrder = make([]Channel, len(order))
+		for i, c := range order {
+			if b.ChannelOrder[i] = Channel(c); b.ChannelOrder[i] > BackCenter {
+				return fmt.Errorf("audio: unknown channel %v in binary form", c)
+			}
+		}
+	}
+	b.EncodedSamples = clone(r.next(r.size()))
+	b.Metadata = clone(r.next(r.size()))
+	if tags := r.next(1); len(tags) == 1 && tags[0] != 0 {
+		b.Tags = r.tags(version)
+	}
+	switch {
+	case r.err != nil:
+		return r.err
+	case len(r.data) > 0:
+		return fmt.Errorf("audio: %v bytes after the end of the binary form", len(r.data))
+	}
+	*a = b
+	return nil
+}
+
+// tags returns the Tags of the binary form of the given version.
+func (r *binaryReader) tags(version uint16) *Tags {
+	t := &Tags{}
+	text := func() string {
+		return string(r.next(int(r.uint32())))
+	}
+	if version == 1 {
+		var track string
+		for _, field := range []*string{&t.Title, &t.Artist, &t.Album, &track, &t.Year, &t.Genre} {
+			*field = text()
+		}
+		t.TrackNumber, t.TrackTotal, _ = parsePosition(track)
+		return t
+	}
+
+	for _, field := range t.textFields() {
+		*field = text()
+	}
+	for _, field := range t.numberFields() {
+		*field = int(r.uint32())
+	}
+	for n := r.uint32(); n > 0 && r.err == nil; n-- {
+		id := text()
+		for frames := r.uint32(); frames > 0 && r.err == nil; frames-- {
+			t.addOther(id, r.next(int(r.uint32())))
+		}
+	}
+	return t
+}
+
+// clone returns a copy of b, or nil if it is empty.
+func clone(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// binaryReader reads the fields of the binary form in turn, recording the
+// first error, after which every field reads as zero.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+// next returns the next n bytes, or nil with an error if there are fewer.
+func (r *binaryReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = fmt.Errorf("audio: binary form is truncated, expected %v more bytes but there are %v", n, len(r.data))
+		return nil
+	}
+	b := r.data[:n:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// uint16, uint32 and uint64 return the next integer of that size.
+func (r *binaryReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// size returns the next uint64 as a size in bytes, which is an error if it
+// exceeds the remaining data rather than overflowing an int.
+func (r *binaryReader) size() int {
+	n := r.uint64()
+	if r.err == nil && n > uint64(len(r.data)) {
+		r.err = fmt.Errorf("audio: binary form is truncated, expected %v more bytes but there are %v", n, len(r.data))
+	}
+	return int(min(n, uint64(len(r.data))))
+}
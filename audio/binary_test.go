@@ -0,0 +1,125 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// binaryTests returns the audio of all binary form tests
+func binaryTests() []struct {
+	description string
+	audio       *Audio
+} {
+	stereo := editAudio()
+	blocks := editAudio()
+	blocks.EncodedBlocks = splitBlocks(blocks.EncodedSamples, 3)
+	silence, _ := NewSilence(time.Millisecond, 2822400, []Channel{FrontLeft, FrontRight, Center, LowFrequency, BackLeft, BackRight})
+	silence.Tags = &Tags{Artist: "Artist", Genre: "Classical"}
+	tagged := editAudio()
+	tagged.Tags, _ = ParseID3(parseID3Tests[0].tag)
+	tagged.Tags.Other = parseID3Tests[3].tags.Other
+	return []struct {
+		description string
+		audio       *Audio
+	}{
+		{"Stereo with metadata and tags should round trip", stereo},
+		{"Samples held in EncodedBlocks should round trip as EncodedSamples", blocks},
+		{"8 bits per sample should round trip", unpacked(editAudio())},
+		{"5.1 without metadata should round trip", silence},
+		{"Every field of the tags should round trip", tagged},
+		{"Audio without a channel order, samples, metadata or tags should round trip", &Audio{NumChannels: 2, SamplingFrequency: 2822400, BitsPerSample: 1}},
+		{"An empty Audio should round trip", &Audio{}},
+	}
+}
+
+// Run all binary form tests, checking that each decodes to the same audio
+func TestBinary(t *testing.T) {
+	for i, test := range binaryTests() {
+		want := test.audio.Clone()
+		if want.EncodedBlocks != nil {
+			want.EncodedSamples, want.EncodedBlocks = mustReadAll(want), nil
+		}
+		var actual Audio
+		b, err := test.audio.MarshalBinary()
+		if err == nil {
+			err = actual.UnmarshalBinary(b)
+		}
+		if err != nil || !reflect.DeepEqual(&actual, want) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v, %v", i+1, test.description, want, actual, err)
+		} else {
+			t.Logf("PASS Test %v: %v: %v bytes", i+1, test.description, len(b))
+		}
+	}
+}
+
+// The binary form of version 1 should still be decoded, with its track as
+// text
+func TestBinaryVersion1(t *testing.T) {
+	description := "The binary form of version 1 should be decoded"
+	a := &Audio{NumChannels: 1, SamplingFrequency: 2822400, BitsPerSample: 1}
+	b, _ := a.MarshalBinary()
+	b = append(b[:len(b)-1], 1)
+	b[4] = 1
+	for _, field := range []string{"Title", "Artist", "Album", "3/12", "2015", "Genre"} {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(field)))
+		b = append(b, field...)
+	}
+	a.Tags = &Tags{Title: "Title", Artist: "Artist", Album: "Album", TrackNumber: 3, TrackTotal: 12, Year: "2015", Genre: "Genre"}
+	var actual Audio
+	if err := actual.UnmarshalBinary(b); err != nil || !reflect.DeepEqual(&actual, a) {
+		t.Errorf("FAIL Test 1: %v:\nWant: %+v\nActual: %+v, %v", description, a, actual, err)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+}
+
+// mustReadAll returns the encoded samples as one slice.
+func mustReadAll(a *Audio) []byte {
+	b, _ := io.ReadAll(a.SamplesReader())
+	return b
+}
+
+// Corrupt binary forms should result in an error, without allocating beyond
+// their size
+func TestBinaryError(t *testing.T) {
+	valid, _ := editAudio().MarshalBinary()
+	corrupt := func(offset int, value uint64) []byte {
+		b := append([]byte(nil), valid...)
+		binary.LittleEndian.PutUint64(b[offset:], value)
+		return b
+	}
+	// Offsets of the sizes in the binary form of the stereo audio
+	samplesOffset := 4 + 2 + 5*4 + 8 + 4 + 2
+	metadataOffset := samplesOffset + 8 + len(editAudio().EncodedSamples)
+	tests := []struct {
+		description string
+		data        []byte
+	}{
+		{"Nothing should result in an error", nil},
+		{"The wrong magic should result in an error", append([]byte("AUDX"), valid[4:]...)},
+		{"An unsupported version should result in an error", append([]byte("AUDI\x03\x00"), valid[6:]...)},
+		{"A truncated binary form should result in an error", valid[:len(valid)-1]},
+		{"Trailing bytes should result in an error", append(valid[:len(valid):len(valid)], 0)},
+		{"A huge sample size should result in an error", corrupt(samplesOffset, 1<<62)},
+		{"A sample size overflowing an int should result in an error", corrupt(samplesOffset, 1<<64-1)},
+		{"A huge metadata size should result in an error", corrupt(metadataOffset, 1<<40)},
+		{"An unknown channel should result in an error", append(append(append([]byte(nil), valid[:samplesOffset-2]...), 99), valid[samplesOffset-1:]...)},
+	}
+	for i, test := range tests {
+		a := Audio{NumChannels: 7}
+		if err := a.UnmarshalBinary(test.data); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %+v", i+1, test.description, a)
+		} else if a.NumChannels != 7 {
+			t.Errorf("FAIL Test %v: %v:\nWant: audio unchanged\nActual: %+v", i+1, test.description, a)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
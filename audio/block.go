@@ -0,0 +1,142 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"fmt"
+	"io"
+	"iter"
+)
+
+// Block is one block of the encoded samples of one channel.
+type Block struct {
+	// Index of the channel in ChannelOrder, and of the block within the
+	// channel.
+	Channel int
+	Index   int
+
+	// The block, including any padding that is present. Only the final block
+	// of the last channel may be shorter than BlockSize, where the encoded
+	// samples end without its padding.
+	Samples []byte
+
+	// Number of bytes at the start of Samples that are samples rather than
+	// padding, which is less than BlockSize only for the final block of each
+	// channel, according to SampleCount.
+	Size int
+
+	// Whether this is the final block of the channel.
+	Final bool
+}
+
+// NumBlocks returns the number of blocks of BlockSize bytes for each channel in
+// the encoded samples, or 0 if NumChannels or BlockSize is not set.
+func (a *Audio) NumBlocks() int {
+	if a.NumChannels == 0 || a.BlockSize == 0 {
+		return 0
+	}
+	groupSize := uint64(a.NumChannels) * uint64(a.BlockSize)
+	return int((a.EncodedSize() + groupSize - 1) / groupSize)
+}
+
+// Block returns block index of channel c, where c is the index of the channel
+// in ChannelOrder. The Samples of the block alias EncodedSamples where that
+// holds the encoded samples, so changing one changes the other, and are
+// otherwise read into a new buffer. It is an error if either index is out of
+// range.
+func (a *Audio) Block(c, index int) (Block, error) {
+	blocks, size, err := a.blockLayout()
+	if err != nil {
+		return Block{}, err
+	}
+	if c < 0 || uint(c) >= a.NumChannels || index < 0 || uint64(index) >= blocks {
+		return Block{}, fmt.Errorf("audio: block %v of channel %v is out of range for %v blocks of %v channels", index, c, blocks, a.NumChannels)
+	}
+	return a.block(a.Samples(), nil, c, index, size)
+}
+
+// Blocks returns an iterator over the blocks of every channel in the order they
+// are held in the encoded samples, i.e. block 0 of each channel in turn, then
+// block 1 and so on. The Samples of each block alias EncodedSamples where that
+// holds the encoded samples, and are otherwise read into a buffer that is
+// reused for the next block, so must be copied to be retained. Iteration stops
+// after yielding an error.
+func (a *Audio) Blocks() iter.Seq2[Block, error] {
+	return func(yield func(Block, error) bool) {
+		blocks, size, err := a.blockLayout()
+		if err != nil {
+			yield(Block{}, err)
+			return
+		}
+		r := a.Samples()
+		var buf []byte
+		for index := 0; uint64(index) < blocks; index++ {
+			for c := 0; uint(c) < a.NumChannels; c++ {
+				b, err := a.block(r, buf, c, index, size)
+				if !yield(b, err) || err != nil {
+					return
+				}
+				if a.EncodedBlocks != nil || a.EncodedSection != nil {
+					buf = b.Samples
+				}
+			}
+		}
+	}
+}
+
+// blockLayout returns the number of blocks for each channel and the number of
+// bytes of samples for each channel excluding the padding, checking that the
+// encoded samples hold whole blocks for every channel, or end with the final
+// sample of the last channel if SampleCount is set.
+func (a *Audio) blockLayout() (blocks, size uint64, err error) {
+	if a.NumChannels == 0 || a.BlockSize == 0 {
+		return 0, 0, fmt.Errorf("audio: cannot deinterleave %v channels of %v byte blocks", a.NumChannels, a.BlockSize)
+	}
+	groupSize := uint64(a.NumChannels) * uint64(a.BlockSize)
+	length := a.EncodedSize()
+	if length%groupSize != 0 && (a.SampleCount == 0 || a.validateSize() != nil) {
+		return 0, 0, fmt.Errorf("audio: %v bytes of samples is not a whole number of %v byte blocks for %v channels", length, a.BlockSize, a.NumChannels)
+	}
+
+	// Number of bytes of samples for each channel, excluding the padding
+	blocks = (length + groupSize - 1) / groupSize
+	size = blocks * uint64(a.BlockSize)
+	if a.SampleCount > 0 {
+		samples := a.sampleBytes()
+		if samples > size {
+			return 0, 0, fmt.Errorf("audio: sample count %v exceeds the %v bytes of samples for each channel", a.SampleCount, size)
+		}
+		size = samples
+	}
+	return blocks, size, nil
+}
+
+// block returns block index of channel c from r over the encoded samples, where
+// size is the number of bytes of samples for each channel, reading into buf if
+// the samples cannot be aliased.
+func (a *Audio) block(r *io.SectionReader, buf []byte, c, index int, size uint64) (Block, error) {
+	blockSize := uint64(a.BlockSize)
+	groupSize := uint64(a.NumChannels) * blockSize
+	offset := uint64(index)*groupSize + uint64(c)*blockSize
+	end := min(offset+blockSize, uint64(r.Size()))
+	b := Block{Channel: c, Index: index, Size: int(min(blockSize, size-min(size, uint64(index)*blockSize)))}
+	b.Final = offset+groupSize-uint64(c)*blockSize >= uint64(r.Size())
+	if a.EncodedBlocks == nil && a.EncodedSection == nil {
+		b.Samples = a.EncodedSamples[offset:end:end]
+		return b, nil
+	}
+
+	if uint64(cap(buf)) < end-offset {
+		buf = make([]byte, blockSize)
+	}
+	b.Samples = buf[:end-offset]
+	if n, err := r.ReadAt(b.Samples, int64(offset)); n < len(b.Samples) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Block{}, err
+	}
+	return b, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// Table structure for a single block test
+type blockTest struct {
+	// Description for the test
+	description string
+	// Channel and index of the block
+	c, index int
+	// Expected block
+	expected Block
+}
+
+// Table of all block tests, against editAudio
+var blockTests = []blockTest{
+	{"The first block should be whole samples", 0, 0, Block{Channel: 0, Index: 0, Samples: []byte{0, 1, 2, 3}, Size: 4}},
+	{"A middle block of the second channel should be whole samples", 1, 1, Block{Channel: 1, Index: 1, Samples: []byte{0x84, 0x85, 0x86, 0x87}, Size: 4}},
+	{"The final block should be part padding", 0, 2, Block{Channel: 0, Index: 2, Samples: []byte{8, 9, 0, 0}, Size: 2, Final: true}},
+	{"The final block of the second channel should be part padding", 1, 2, Block{Channel: 1, Index: 2, Samples: []byte{0x88, 0x89, 0, 0}, Size: 2, Final: true}},
+}
+
+// equalBlocks returns whether two blocks are the same.
+func equalBlocks(a, b Block) bool {
+	return a.Channel == b.Channel && a.Index == b.Index && bytes.Equal(a.Samples, b.Samples) && a.Size == b.Size && a.Final == b.Final
+}
+
+// Run all block tests, however the samples are held
+func TestBlock(t *testing.T) {
+	layouts := map[string]func(a *Audio){
+		"EncodedSamples": func(a *Audio) {},
+		"EncodedBlocks": func(a *Audio) {
+			a.EncodedBlocks = splitBlocks(a.EncodedSamples, 5)
+			a.EncodedSamples = nil
+		},
+		"EncodedSection": func(a *Audio) {
+			a.EncodedSection = io.NewSectionReader(bytes.NewReader(a.EncodedSamples), 0, int64(len(a.EncodedSamples)))
+			a.EncodedSamples = nil
+		},
+	}
+	i := 0
+	for _, layout := range []string{"EncodedSamples", "EncodedBlocks", "EncodedSection"} {
+		a := editAudio()
+		layouts[layout](a)
+		for _, test := range blockTests {
+			i++
+			description := fmt.Sprintf("%v in %v", test.description, layout)
+			actual, err := a.Block(test.c, test.index)
+			if err != nil || !equalBlocks(actual, test.expected) {
+				t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v, %v", i, description, test.expected, actual, err)
+			} else {
+				t.Logf("PASS Test %v: %v", i, description)
+			}
+		}
+
+		i++
+		description := "Iterating over the blocks in " + layout + " should yield every block in order"
+		var actual []Block
+		for b, err := range a.Blocks() {
+			if err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i, description, err.Error())
+				break
+			}
+			b.Samples = bytes.Clone(b.Samples)
+			actual = append(actual, b)
+		}
+		want := []Block{blockTests[0].expected, {Channel: 1, Samples: []byte{0x80, 0x81, 0x82, 0x83}, Size: 4},
+			{Index: 1, Samples: []byte{4, 5, 6, 7}, Size: 4}, blockTests[1].expected, blockTests[2].expected, blockTests[3].expected}
+		if a.NumBlocks() != 3 || len(actual) != len(want) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v blocks, 3 per channel\nActual: %+v, %v per channel", i, description, len(want), actual, a.NumBlocks())
+			continue
+		}
+		for j := range want {
+			if !equalBlocks(actual[j], want[j]) {
+				t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v", i, description, want[j], actual[j])
+				break
+			}
+		}
+		if !t.Failed() {
+			t.Logf("PASS Test %v: %v", i, description)
+		}
+	}
+
+	description := "Blocks of EncodedSamples should alias it"
+	a := editAudio()
+	b, _ := a.Block(1, 0)
+	b.Samples[0] = 0xff
+	if a.EncodedSamples[4] != 0xff || cap(b.Samples) != 4 {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, description, 0xff, a.EncodedSamples[4])
+	} else {
+		t.Logf("PASS Test %v: %v", i+1, description)
+	}
+
+	description = "The final block should be short where the samples end without its padding"
+	a = editAudio()
+	a.EncodedSamples = a.EncodedSamples[:len(a.EncodedSamples)-2]
+	want := Block{Channel: 1, Index: 2, Samples: []byte{0x88, 0x89}, Size: 2, Final: true}
+	if b, err := a.Block(1, 2); err != nil || !equalBlocks(b, want) {
+		t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v, %v", i+2, description, want, b, err)
+	} else {
+		t.Logf("PASS Test %v: %v", i+2, description)
+	}
+
+	description = "Iterating should stop when the loop breaks"
+	n := 0
+	for range a.Blocks() {
+		if n++; n == 2 {
+			break
+		}
+	}
+	if n != 2 {
+		t.Errorf("FAIL Test %v: %v:\nWant: 2 blocks\nActual: %v", i+3, description, n)
+	} else {
+		t.Logf("PASS Test %v: %v", i+3, description)
+	}
+}
+
+// Table structure for a single block error test
+type blockErrorTest struct {
+	// Description for the test
+	description string
+	// The audio, and channel and index of the block
+	audio    *Audio
+	c, index int
+}
+
+// Table of all block error tests
+var blockErrorTests = []blockErrorTest{
+	{"A channel beyond the last should result in an error", editAudio(), 2, 0},
+	{"A negative channel should result in an error", editAudio(), -1, 0},
+	{"A block beyond the last should result in an error", editAudio(), 0, 3},
+	{"A negative block should result in an error", editAudio(), 0, -1},
+	{"Audio without a block size should result in an error", &Audio{NumChannels: 2, EncodedSamples: make([]byte, 8)}, 0, 0},
+	{"Samples that are not whole blocks should result in an error", &Audio{NumChannels: 2, BlockSize: 4, EncodedSamples: make([]byte, 7)}, 0, 0},
+}
+
+// Run all block error tests, both for a single block and when iterating
+func TestBlockError(t *testing.T) {
+	for i, test := range blockErrorTests {
+		if b, err := test.audio.Block(test.c, test.index); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %+v", i+1, test.description, b)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+
+	description := "Iterating over samples that are not whole blocks should yield only an error"
+	var errs []error
+	for _, err := range blockErrorTests[len(blockErrorTests)-1].audio.Blocks() {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || errs[0] == nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: one error\nActual: %v", len(blockErrorTests)+1, description, errs)
+	} else {
+		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", len(blockErrorTests)+1, description, errs[0].Error())
+	}
+}
@@ -11,8 +11,11 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/snmoore/go/audio/dsf"
+	"maps"
 	"os"
+	"slices"
 )
 
 func main() {
@@ -33,9 +36,51 @@ func main() {
 		}
 	}()
 
-	// Decode the DSD stream file with logging to stdout
-	_, err = dsf.Decode(file, os.Stdout)
+	// Decode the DSD stream file with logging to stdout, tolerating cosmetic
+	// violations of the specification
+	var warnings []dsf.Warning
+	a, err := dsf.Decode(file, os.Stdout, dsf.WithLenient(), dsf.WithWarnings(&warnings), dsf.WithParsedTags())
 	if err != nil {
 		panic(err)
 	}
+
+	// Summarise the audio
+	fmt.Print("\nAudio\n=====\n")
+	fmt.Print(a.Summary())
+
+	// Summarise the tags, if any
+	if a.Tags != nil {
+		fmt.Print("\nTags\n====\n")
+		fmt.Printf("Title:                     %v\n", a.Tags.Title)
+		fmt.Printf("Artist:                    %v\n", a.Tags.Artist)
+		fmt.Printf("Album:                     %v\n", a.Tags.Album)
+		fmt.Printf("Album artist:              %v\n", a.Tags.AlbumArtist)
+		fmt.Printf("Track:                     %v\n", position(a.Tags.TrackNumber, a.Tags.TrackTotal))
+		fmt.Printf("Disc:                      %v\n", position(a.Tags.DiscNumber, a.Tags.DiscTotal))
+		fmt.Printf("Year:                      %v\n", a.Tags.Year)
+		fmt.Printf("Genre:                     %v\n", a.Tags.Genre)
+		fmt.Printf("Comment:                   %v\n", a.Tags.Comment)
+		for _, id := range slices.Sorted(maps.Keys(a.Tags.Other)) {
+			fmt.Printf("%-27v%v frame(s)\n", id+":", len(a.Tags.Other[id]))
+		}
+	}
+
+	// Summarise any violations of the specification
+	if len(warnings) > 0 {
+		fmt.Printf("\n%v warning(s): the file does not fully meet the specification\n", len(warnings))
+		for _, w := range warnings {
+			fmt.Printf("  %v\n", w)
+		}
+	}
+}
+
+// position formats a track or disc position e.g. "3/12", or "" if it is unset.
+func position(number, total int) string {
+	switch {
+	case total > 0:
+		return fmt.Sprintf("%v/%v", number, total)
+	case number > 0:
+		return fmt.Sprint(number)
+	}
+	return ""
 }
@@ -0,0 +1,89 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsd2pcm
+
+import (
+	"math"
+	"math/rand/v2"
+)
+
+// Dither is how PCM samples are dithered when rounded to integers.
+type Dither int
+
+// The ways of dithering.
+const (
+	// AutoDither is TPDFDither for 16 bit samples and NoDither for more
+	// bits, whose precision is beyond the noise floor of DSD. It is the
+	// default.
+	AutoDither Dither = iota
+
+	// NoDither rounds each sample to the nearest integer, which for a quiet
+	// signal of few bits is distortion correlated with the signal.
+	NoDither
+
+	// TPDFDither adds triangular probability density function noise of up to
+	// 1 least significant bit either way before rounding, which turns the
+	// distortion into white noise.
+	TPDFDither
+
+	// NoiseShapedDither is TPDFDither whose noise, together with that of the
+	// rounding, is shaped by second order error feedback, moving it from low
+	// frequencies where it is most audible to high ones.
+	NoiseShapedDither
+)
+
+// String returns the name of the dither e.g. "TPDF".
+func (d Dither) String() string {
+	switch d {
+	case AutoDither:
+		return "auto"
+	case NoDither:
+		return "none"
+	case TPDFDither:
+		return "TPDF"
+	case NoiseShapedDither:
+		return "noise shaped"
+	}
+	return "unknown"
+}
+
+// requantizer rounds the samples of one channel to integers, with dither.
+type requantizer struct {
+	// The dither, which is not AutoDither, and its source of noise.
+	dither Dither
+	rand   *rand.Rand
+
+	// Full scale of the integers.
+	fullScale float64
+
+	// Error of the last two samples rounded, for noise shaping.
+	e1, e2 float64
+}
+
+// newRequantizer returns a requantizer of channel c to integers of the given
+// full scale. Each channel has its own source of noise, determined by the seed
+// and the channel, so that channels are not correlated and are the same
+// whatever order they are requantized in.
+func newRequantizer(d Dither, fullScale float64, seed uint64, c int) *requantizer {
+	return &requantizer{dither: d, rand: rand.New(rand.NewPCG(seed, uint64(c))), fullScale: fullScale}
+}
+
+// quantize returns a sample as a fraction of full scale rounded to an integer,
+// clipping it to full scale.
+func (q *requantizer) quantize(sample float64) int32 {
+	x := sample * q.fullScale
+	if q.dither == NoDither {
+		return int32(math.Round(max(-q.fullScale, min(q.fullScale, x))))
+	}
+
+	// Subtract the shaped error of the earlier samples, so that the error
+	// in the output is filtered by (1 - z^-1)^2
+	if q.dither == NoiseShapedDither {
+		x -= 2*q.e1 - q.e2
+	}
+	y := math.Round(x + q.rand.Float64() - q.rand.Float64())
+	q.e1, q.e2 = y-x, q.e1
+	return int32(max(-q.fullScale, min(q.fullScale, y)))
+}
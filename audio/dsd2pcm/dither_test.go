@@ -0,0 +1,166 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsd2pcm
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+// thd returns the amplitude of a 1 kHz tone in channel c of PCM, and its total
+// harmonic distortion up to the tenth harmonic.
+func thd(p *PCM, c int) (float64, float64) {
+	samples := channel(p, c)
+	fundamental := amplitude(samples, p.SampleRate, 1000)
+	var harmonics float64
+	for h := 2; h <= 10; h++ {
+		harmonics += math.Pow(amplitude(samples, p.SampleRate, float64(h*1000)), 2)
+	}
+	return fundamental, math.Sqrt(harmonics) / fundamental
+}
+
+// A 1 kHz tone of 1.5 least significant bits of 16 bit PCM should have less
+// distortion with dither than without. The tone is DSD256, whose noise
+// converted to 88.2 kHz is below the least significant bit, as DSD64 would
+// dither itself.
+func TestDitherDistortion(t *testing.T) {
+	a := toneAudio(11289600, 200*time.Millisecond, 1000, 1.5/32767)
+	convert := func(d Dither) (float64, float64) {
+		p, err := Convert(a, WithSampleRate(88200), WithBitsPerSample(16), WithDither(d), WithSeed(1))
+		if err != nil {
+			t.Fatalf("FAIL Test 1: %v", err.Error())
+		}
+		fundamental, thd := thd(p, 0)
+		return fundamental * 32767, thd
+	}
+	_, undithered := convert(NoDither)
+	t.Logf("Without dither THD is %.1f dB", 20*math.Log10(undithered))
+
+	for i, d := range []Dither{TPDFDither, NoiseShapedDither, AutoDither} {
+		description := "The tone should have at least 10 dB less distortion with " + d.String() + " dither than without"
+		fundamental, thd := convert(d)
+		if math.Abs(fundamental-1.5) > 0.05 || thd > undithered/math.Sqrt(10) {
+			t.Errorf("FAIL Test %v: %v:\nWant: amplitude 1.5, THD < %v\nActual: amplitude %v, THD %v", i+1, description, undithered/math.Sqrt(10), fundamental, thd)
+		} else {
+			t.Logf("PASS Test %v: %v: THD %.1f dB", i+1, description, 20*math.Log10(thd))
+		}
+	}
+}
+
+// Table structure for a single dither seed test
+type ditherSeedTest struct {
+	// Description for the test
+	description string
+	// Options for each conversion
+	a, b []Option
+	// Are the conversions expected to be the same?
+	same bool
+}
+
+// Table of all dither seed tests
+var ditherSeedTests = []ditherSeedTest{
+	{"The same seed should be converted the same", []Option{WithSeed(1)}, []Option{WithSeed(1)}, true},
+	{"Different seeds should be converted differently", []Option{WithSeed(1)}, []Option{WithSeed(2)}, false},
+	{"No seed should be random", nil, nil, false},
+	{"16 bits should be dithered with TPDF by default", []Option{WithSeed(1)}, []Option{WithSeed(1), WithDither(TPDFDither)}, true},
+	{"Noise shaping should change the dither", []Option{WithSeed(1)}, []Option{WithSeed(1), WithDither(NoiseShapedDither)}, false},
+	{"24 bits should not be dithered by default", []Option{WithBitsPerSample(24)}, []Option{WithBitsPerSample(24), WithDither(NoDither)}, true},
+	{"24 bits should be dithered on request", []Option{WithBitsPerSample(24)}, []Option{WithBitsPerSample(24), WithDither(TPDFDither)}, false},
+}
+
+// Run all dither seed tests, on stereo 16 bit PCM
+func TestDitherSeed(t *testing.T) {
+	a := toneAudio(2822400, 10*time.Millisecond, 1000, 0.5, 0.5)
+	for i, test := range ditherSeedTests {
+		pa, errA := Convert(a, append([]Option{WithBitsPerSample(16)}, test.a...)...)
+		pb, errB := Convert(a, append([]Option{WithBitsPerSample(16)}, test.b...)...)
+		if errA != nil || errB != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v, %v", i+1, test.description, errA, errB)
+		} else if same := slices.Equal(pa.Samples, pb.Samples); same != test.same {
+			t.Errorf("FAIL Test %v: %v:\nWant: same %v\nActual: %v", i+1, test.description, test.same, same)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+
+	description := "The channels of a tone should be dithered differently"
+	p, _ := Convert(a, WithBitsPerSample(16), WithSeed(1))
+	if slices.Equal(channel(p, 0), channel(p, 1)) {
+		t.Errorf("FAIL Test %v: %v", len(ditherSeedTests)+1, description)
+	} else {
+		t.Logf("PASS Test %v: %v", len(ditherSeedTests)+1, description)
+	}
+}
+
+// Table structure for a single requantizer test
+type requantizerTest struct {
+	// Description for the test
+	description string
+	// The dither
+	dither Dither
+	// Constant sample in least significant bits, and the expected mean of
+	// it rounded
+	sample, mean float64
+}
+
+// Table of all requantizer tests
+var requantizerTests = []requantizerTest{
+	{"Without dither a fraction of a bit should be lost", NoDither, 0.3, 0},
+	{"With TPDF dither a fraction of a bit should be kept on average", TPDFDither, 0.3, 0.3},
+	{"With noise shaped dither a fraction of a bit should be kept on average", NoiseShapedDither, 0.3, 0.3},
+	{"With TPDF dither a negative fraction of a bit should be kept on average", TPDFDither, -1.7, -1.7},
+	{"Without dither full scale should be clipped", NoDither, 40000, 32767},
+	{"With TPDF dither full scale should be clipped", TPDFDither, 40000, 32767},
+	{"With noise shaped dither full scale should be clipped", NoiseShapedDither, -40000, -32767},
+}
+
+// Run all requantizer tests
+func TestRequantizer(t *testing.T) {
+	for i, test := range requantizerTests {
+		q := newRequantizer(test.dither, 32767, 1, 0)
+		var sum float64
+		const n = 100000
+		for range n {
+			sum += float64(q.quantize(test.sample / 32767))
+		}
+		if mean := sum / n; math.Abs(mean-test.mean) > 0.01 {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.mean, mean)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// Table structure for a single dither name test
+type ditherStringTest struct {
+	// Description for the test
+	description string
+	// The dither
+	dither Dither
+	// Expected name
+	expected string
+}
+
+// Table of all dither name tests
+var ditherStringTests = []ditherStringTest{
+	{"AutoDither should be named", AutoDither, "auto"},
+	{"NoDither should be named", NoDither, "none"},
+	{"TPDFDither should be named", TPDFDither, "TPDF"},
+	{"NoiseShapedDither should be named", NoiseShapedDither, "noise shaped"},
+	{"An unknown dither should be named as such", NoiseShapedDither + 1, "unknown"},
+}
+
+// Run all dither name tests
+func TestDitherString(t *testing.T) {
+	for i, test := range ditherStringTests {
+		if actual := test.dither.String(); actual != test.expected {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.expected, actual)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
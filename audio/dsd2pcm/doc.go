@@ -0,0 +1,21 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Package dsd2pcm converts DSD audio to PCM, low-pass filtering each channel
+// with the same FIR filter and decimating it to the output sample rate.
+//
+// A DSD sample of 1 is taken as +1 and a sample of 0 as -1, so that PCM full
+// scale is a DSD signal of all ones or all zeros. The SACD reference level of
+// 50% modulation is therefore half of full scale, or -6 dBFS.
+//
+// A FIR filter delays its input by its group delay, half of its length for a
+// linear phase filter and much less for a minimum phase filter, whose delay
+// also varies with frequency. The delay at 0 Hz is compensated for, to the
+// nearest DSD sample, so that each PCM sample is at the time of the first DSD
+// sample decimated to it, and the PCM is exactly as long as the DSD rather
+// than as long plus the delay. The filter overlaps the silence before and
+// after the samples for its length though, so a longer filter rings for
+// longer at the start and end, and a real time player would have to wait
+// for the delay.
+package dsd2pcm
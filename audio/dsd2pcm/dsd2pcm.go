@@ -0,0 +1,249 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsd2pcm
+
+import (
+	"fmt"
+	"github.com/snmoore/go/audio"
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+)
+
+// How far the coefficients given by WithFIR may sum from 1, about 0.01 dB.
+const firTolerance = 1e-3
+
+// Format describes PCM audio.
+type Format struct {
+	// Number of channels, and the channel for each in order.
+	NumChannels  uint
+	ChannelOrder []audio.Channel
+
+	// Sample rate in Hz.
+	SampleRate uint
+
+	// Bits per sample, and whether each sample is IEEE floating point rather
+	// than a signed integer.
+	BitsPerSample uint
+	Float         bool
+}
+
+// String returns a description of the format e.g. "2 channels of 352800 Hz,
+// 24 bit integer".
+func (f Format) String() string {
+	kind := "integer"
+	if f.Float {
+		kind = "float"
+	}
+	return fmt.Sprintf("%v channels of %v Hz, %v bit %v", f.NumChannels, f.SampleRate, f.BitsPerSample, kind)
+}
+
+// PCM is PCM audio converted from DSD audio.
+type PCM struct {
+	Format
+
+	// Samples as frames of one sample for each channel in ChannelOrder. For
+	// an integer format each sample is in Samples, a signed integer of
+	// BitsPerSample bits. For a floating point format each sample is in
+	// Floats, as a fraction of full scale rounded to BitsPerSample bits.
+	Samples []int32
+	Floats  []float64
+}
+
+// NumFrames returns the number of frames of samples.
+func (p *PCM) NumFrames() int {
+	if p.NumChannels == 0 {
+		return 0
+	}
+	return (len(p.Samples) + len(p.Floats)) / int(p.NumChannels)
+}
+
+// OutputFormat returns the format of the PCM that Convert would convert the
+// audio to with the same options, or an error if Convert would fail because
+// the audio or an option is out of range. The samples are not read.
+func OutputFormat(a *audio.Audio, opts ...Option) (Format, error) {
+	o, err := resolve(a, opts)
+	if err != nil {
+		return Format{}, err
+	}
+	return o.format(a), nil
+}
+
+// Convert converts DSD audio of 1 or 8 bits per sample to PCM, filtering each
+// channel with the same low-pass filter and decimating it to the sample rate.
+// There is a frame of PCM for each whole group of DSD samples decimated to one,
+// compensated for the delay of the filter. Integer samples are rounded with
+// dither as set by WithDither. The format of the PCM is that returned by
+// OutputFormat, which it is an error to be unable to convert to, as it is if
+// the audio is not DSD or fails Validate.
+func Convert(a *audio.Audio, opts ...Option) (*PCM, error) {
+	o, err := resolve(a, opts)
+	if err != nil {
+		return nil, err
+	}
+	ratio := int(o.ratio)
+
+	// Filter the samples of 1 bit per sample
+	src := a
+	if a.BitsPerSample == 8 {
+		src = a.Clone()
+		if err := src.PackTo1Bit(); err != nil {
+			return nil, err
+		}
+	}
+	sampleCount := src.SampleCount
+	if sampleCount == 0 {
+		sampleCount = uint64(src.NumBlocks()) * uint64(src.BlockSize) * 8
+	}
+	coefficients := o.coefficients
+	if coefficients == nil {
+		coefficients = design(o.preset, o.taps, ratio)
+	}
+	conv := &converter{
+		audio:   src,
+		filter:  newFilter(coefficients, ratio/8),
+		frames:  int(sampleCount / uint64(ratio)),
+		options: o,
+		pcm:     &PCM{Format: o.format(a)},
+	}
+	if conv.pcm.Float {
+		conv.pcm.Floats = make([]float64, conv.frames*int(a.NumChannels))
+	} else {
+		conv.pcm.Samples = make([]int32, conv.frames*int(a.NumChannels))
+	}
+	if err := conv.run(); err != nil {
+		return nil, err
+	}
+	return conv.pcm, nil
+}
+
+// resolve returns the options, with the defaults for the audio filled in, or
+// an error if the audio cannot be converted with them.
+func resolve(a *audio.Audio, opts []Option) (options, error) {
+	o := options{workers: runtime.GOMAXPROCS(0)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	fs := a.SamplingFrequency
+	if a.Encoding != audio.DSD {
+		return o, fmt.Errorf("dsd2pcm: cannot convert %v audio, only DSD", a.Encoding)
+	}
+	if a.BitsPerSample != 1 && a.BitsPerSample != 8 {
+		return o, fmt.Errorf("dsd2pcm: unsupported bits per sample: %v", a.BitsPerSample)
+	}
+
+	// The fields must be consistent before anything is allocated from them,
+	// but the metadata is not converted so is left unchecked
+	v := *a
+	v.Metadata = nil
+	if err := v.Validate(); err != nil {
+		return o, err
+	}
+
+	// The sample rate and the ratio must agree if both are given
+	switch {
+	case o.ratio != 0 && o.sampleRate != 0 && o.sampleRate*o.ratio != fs:
+		return o, fmt.Errorf("dsd2pcm: cannot decimate %v Hz to %v Hz by a ratio of %v", fs, o.sampleRate, o.ratio)
+	case o.ratio != 0:
+		if fs%o.ratio != 0 {
+			return o, fmt.Errorf("dsd2pcm: a decimation ratio of %v does not divide %v Hz", o.ratio, fs)
+		}
+		o.sampleRate = fs / o.ratio
+	case o.sampleRate == 0:
+		o.sampleRate = defaultSampleRate(fs)
+	}
+	if o.sampleRate == 0 || fs%o.sampleRate != 0 || fs/o.sampleRate%8 != 0 {
+		return o, fmt.Errorf("dsd2pcm: cannot decimate %v Hz to %v Hz, a multiple of 8 times the rate is required", fs, o.sampleRate)
+	}
+	o.ratio = fs / o.sampleRate
+
+	switch {
+	case o.bitsPerSample == 0 && o.float:
+		o.bitsPerSample = DefaultFloatBitsPerSample
+	case o.bitsPerSample == 0:
+		o.bitsPerSample = DefaultBitsPerSample
+	}
+	switch {
+	case o.float && o.bitsPerSample != 32 && o.bitsPerSample != 64:
+		return o, fmt.Errorf("dsd2pcm: unsupported floating point bits per sample: %v, only 32 or 64", o.bitsPerSample)
+	case !o.float && o.bitsPerSample != 16 && o.bitsPerSample != 24 && o.bitsPerSample != 32:
+		return o, fmt.Errorf("dsd2pcm: unsupported bits per sample: %v, only 16, 24 or 32", o.bitsPerSample)
+	}
+
+	// Only integers are dithered, by default only those of 16 bits
+	switch {
+	case o.dither < AutoDither || o.dither > NoiseShapedDither:
+		return o, fmt.Errorf("dsd2pcm: unknown dither %d", int(o.dither))
+	case o.float && o.dither != AutoDither && o.dither != NoDither:
+		return o, fmt.Errorf("dsd2pcm: cannot apply %v dither to floating point samples", o.dither)
+	case o.dither == AutoDither && !o.float && o.bitsPerSample == 16:
+		o.dither = TPDFDither
+	case o.dither == AutoDither:
+		o.dither = NoDither
+	}
+	if !o.seeded {
+		o.seed = rand.Uint64()
+	}
+
+	// The low-pass filter is given or designed from a preset
+	if o.coefficients != nil {
+		return o, checkFIR(o.coefficients)
+	}
+	if o.taps == 0 {
+		o.taps = DefaultTapsPerRatio * int(o.ratio)
+	}
+	switch {
+	case o.taps < MinTaps || o.taps > MaxTaps:
+		return o, fmt.Errorf("dsd2pcm: a filter of %v taps is out of range, from %v to %v are required", o.taps, MinTaps, MaxTaps)
+	case o.preset < SharpLinearPhase || o.preset > MinimumPhase:
+		return o, fmt.Errorf("dsd2pcm: unknown filter preset %d", int(o.preset))
+	}
+	return o, nil
+}
+
+// checkFIR returns an error unless the coefficients of a low-pass filter are
+// from MinTaps to MaxTaps in number, are finite and sum to 1.
+func checkFIR(coefficients []float64) error {
+	if n := len(coefficients); n < MinTaps || n > MaxTaps {
+		return fmt.Errorf("dsd2pcm: a filter of %v taps is out of range, from %v to %v are required", n, MinTaps, MaxTaps)
+	}
+	var sum float64
+	for _, c := range coefficients {
+		if math.IsNaN(c) || math.IsInf(c, 0) {
+			return fmt.Errorf("dsd2pcm: filter coefficient %v is not finite", c)
+		}
+		sum += c
+	}
+	if math.Abs(sum-1) > firTolerance {
+		return fmt.Errorf("dsd2pcm: filter coefficients sum to %v rather than 1", sum)
+	}
+	return nil
+}
+
+// format returns the format of the PCM converted from the audio.
+func (o options) format(a *audio.Audio) Format {
+	return Format{
+		NumChannels:   a.NumChannels,
+		ChannelOrder:  slices.Clone(a.ChannelOrder),
+		SampleRate:    o.sampleRate,
+		BitsPerSample: o.bitsPerSample,
+		Float:         o.float,
+	}
+}
+
+// defaultSampleRate returns the PCM sample rate for a DSD sampling frequency
+// unless WithSampleRate or WithRatio is given, or 0 if there is none.
+func defaultSampleRate(samplingFrequency uint) uint {
+	switch {
+	case samplingFrequency == 0:
+		return 0
+	case samplingFrequency%44100 == 0:
+		return 352800
+	case samplingFrequency%48000 == 0:
+		return 384000
+	}
+	return 0
+}
@@ -0,0 +1,353 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsd2pcm
+
+import (
+	"bytes"
+	"github.com/snmoore/go/audio"
+	"github.com/snmoore/go/audio/dsf"
+	"io"
+	"math"
+	"math/cmplx"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// modulate returns n samples of a sine of the given frequency in Hz and
+// amplitude as a fraction of full scale, at the sampling frequency, as 1 bit
+// DSD samples packed least significant first. It is a second order sigma
+// delta modulator.
+func modulate(samplingFrequency uint, frequency, amplitude float64, n int) []byte {
+	b := make([]byte, (n+7)/8)
+	var i1, i2, y float64
+	for i := range n {
+		x := amplitude * math.Sin(2*math.Pi*frequency*float64(i)/float64(samplingFrequency))
+		i1 += x - y
+		i2 += i1 - y
+		y = -1
+		if i2 >= 0 {
+			y = 1
+			b[i/8] |= 1 << (i % 8)
+		}
+	}
+	return b
+}
+
+// toneAudio returns DSD audio of the given duration with each channel as given
+// by modulate, or silence for an amplitude of 0.
+func toneAudio(samplingFrequency uint, d time.Duration, frequency float64, amplitudes ...float64) *audio.Audio {
+	order := []audio.Channel{audio.FrontLeft, audio.FrontRight, audio.Center, audio.LowFrequency, audio.BackLeft, audio.BackRight}
+	a, err := audio.New(audio.DSD, samplingFrequency, order[:len(amplitudes)], audio.WithDuration(d))
+	if err != nil {
+		panic(err)
+	}
+	channels, err := a.Deinterleave()
+	if err != nil {
+		panic(err)
+	}
+	for c, amplitude := range amplitudes {
+		if amplitude != 0 {
+			channels[c] = modulate(samplingFrequency, frequency, amplitude, len(channels[c])*8)
+		}
+	}
+	if err := a.Interleave(channels); err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// amplitude returns the amplitude of the given frequency in Hz in samples of
+// PCM at the sample rate, by a single bin of a discrete Fourier transform.
+func amplitude(samples []float64, sampleRate uint, frequency float64) float64 {
+	var sum complex128
+	for i, sample := range samples {
+		sum += complex(sample, 0) * cmplx.Rect(1, -2*math.Pi*frequency*float64(i)/float64(sampleRate))
+	}
+	return 2 * cmplx.Abs(sum) / float64(len(samples))
+}
+
+// phase returns the phase of a 1 kHz tone in channel c of PCM relative to that
+// of a sine starting at the first sample, which is 0 if the filter is
+// compensated for its delay.
+func phase(p *PCM, c int) float64 {
+	var sum complex128
+	first := p.NumFrames() / 8 // where channel starts
+	for i, sample := range channel(p, c) {
+		sum += complex(sample, 0) * cmplx.Rect(1, -2*math.Pi*1000*float64(first+i)/float64(p.SampleRate))
+	}
+	return math.Remainder(cmplx.Phase(sum)+math.Pi/2, 2*math.Pi)
+}
+
+// channel returns the samples of channel c of PCM as fractions of full scale,
+// without the frames at each end where the filter overlaps the silence beyond
+// the samples, and trimmed to whole cycles of 1 kHz.
+func channel(p *PCM, c int) []float64 {
+	var samples []float64
+	fullScale := float64(int64(1)<<(p.BitsPerSample-1) - 1)
+	for i := c; i < len(p.Samples); i += int(p.NumChannels) {
+		samples = append(samples, float64(p.Samples[i])/fullScale)
+	}
+	for i := c; i < len(p.Floats); i += int(p.NumChannels) {
+		samples = append(samples, p.Floats[i])
+	}
+	samples = samples[len(samples)/8 : len(samples)*7/8]
+	cycle := int(p.SampleRate) / 200 // 5 cycles of 1 kHz are whole samples
+	return samples[:len(samples)/cycle*cycle]
+}
+
+// Table structure for a single tone conversion test
+type toneTest struct {
+	// Description for the test
+	description string
+	// DSD sampling frequency
+	samplingFrequency uint
+	// Amplitude of the tone as a fraction of full scale, and the gain
+	// expected to be applied to it
+	amplitude, gain float64
+	// Options for the conversion
+	options []Option
+	// Expected format, other than the channels
+	format Format
+}
+
+// Table of all tone conversion tests
+var toneTests = []toneTest{
+	{"DSD64 should be converted to 352.8 kHz by default", 2822400, 0.5, 1, nil, Format{SampleRate: 352800, BitsPerSample: 24}},
+	{"DSD128 should be converted to 176.4 kHz", 5644800, 0.5, 1, []Option{WithSampleRate(176400)}, Format{SampleRate: 176400, BitsPerSample: 24}},
+	{"DSD256 should be converted to 88.2 kHz at 32 bits", 11289600, 0.5, 1, []Option{WithSampleRate(88200), WithBitsPerSample(32)}, Format{SampleRate: 88200, BitsPerSample: 32}},
+	{"DSD64 should be converted with a filter of the fewest taps", 2822400, 0.5, 1, []Option{WithSampleRate(88200), WithTaps(MinTaps)}, Format{SampleRate: 88200, BitsPerSample: 24}},
+	{"DSD64 should be decimated by a ratio of 16", 2822400, 0.5, 1, []Option{WithRatio(16)}, Format{SampleRate: 176400, BitsPerSample: 24}},
+	{"DSD128 should be decimated by a ratio of 64 to 16 bits", 5644800, 0.5, 1, []Option{WithRatio(64), WithBitsPerSample(16)}, Format{SampleRate: 88200, BitsPerSample: 16}},
+	{"An agreeing sample rate and ratio should be accepted", 2822400, 0.5, 1, []Option{WithRatio(32), WithSampleRate(88200)}, Format{SampleRate: 88200, BitsPerSample: 24}},
+	{"DSD64 should be converted to 32 bit floating point by default", 2822400, 0.5, 1, []Option{WithFloat()}, Format{SampleRate: 352800, BitsPerSample: 32, Float: true}},
+	{"DSD64 should be converted to 64 bit floating point", 2822400, 0.5, 1, []Option{WithFloat(), WithBitsPerSample(64)}, Format{SampleRate: 352800, BitsPerSample: 64, Float: true}},
+	{"The headroom gain should double the amplitude", 2822400, 0.25, HeadroomGain, []Option{WithHeadroomGain()}, Format{SampleRate: 352800, BitsPerSample: 24}},
+	{"DSD64 should be converted with the slow rolloff preset", 2822400, 0.5, 1, []Option{WithPreset(SlowRolloff)}, Format{SampleRate: 352800, BitsPerSample: 24}},
+	{"DSD64 should be converted with the minimum phase preset", 2822400, 0.5, 1, []Option{WithPreset(MinimumPhase)}, Format{SampleRate: 352800, BitsPerSample: 24}},
+	{"DSD128 should be converted to 88.2 kHz with the minimum phase preset", 5644800, 0.5, 1, []Option{WithRatio(64), WithPreset(MinimumPhase)}, Format{SampleRate: 88200, BitsPerSample: 24}},
+	{"DSD64 should be converted with custom coefficients", 2822400, 0.5, 1, []Option{WithFIR(lowPass(101, 0.02))}, Format{SampleRate: 352800, BitsPerSample: 24}},
+}
+
+// Run all tone conversion tests: a DSF of a 1 kHz tone should be converted to
+// a sine of that amplitude, or twice it with the headroom gain, with total
+// harmonic distortion below -60 dB and a phase error below 0.005 radians, or
+// about 0.8 microseconds
+func TestConvertTone(t *testing.T) {
+	for i, test := range toneTests {
+		var file bytes.Buffer
+		if err := dsf.Encode(toneAudio(test.samplingFrequency, 50*time.Millisecond, 1000, test.amplitude), &file, io.Discard); err != nil {
+			t.Fatalf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		}
+		a, err := dsf.Decode(&file, io.Discard)
+		if err != nil {
+			t.Fatalf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		}
+		p, err := Convert(a, test.options...)
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+		want := test.format
+		want.NumChannels, want.ChannelOrder = 1, a.ChannelOrder
+		format, err := OutputFormat(a, test.options...)
+		if err != nil || !reflect.DeepEqual(p.Format, want) || !reflect.DeepEqual(format, want) || p.Samples != nil && p.Floats != nil ||
+			p.NumFrames() != int(a.SampleCount/uint64(test.samplingFrequency/want.SampleRate)) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v, %v, %v frames", i+1, test.description, want, p.Format, format, p.NumFrames())
+			continue
+		}
+
+		samples := channel(p, 0)
+		expected := test.amplitude * test.gain
+		fundamental := amplitude(samples, p.SampleRate, 1000)
+		var harmonics float64
+		for h := 2; h <= 5; h++ {
+			harmonics += math.Pow(amplitude(samples, p.SampleRate, float64(h*1000)), 2)
+		}
+		thd := math.Sqrt(harmonics) / fundamental
+		if phase := phase(p, 0); math.Abs(fundamental-expected) > 0.005 || thd > 0.001 || math.Abs(phase) > 0.005 {
+			t.Errorf("FAIL Test %v: %v:\nWant: amplitude %v, THD < 0.001, phase 0\nActual: amplitude %v, THD %v, phase %v", i+1, test.description, expected, fundamental, thd, phase)
+		} else {
+			t.Logf("PASS Test %v: %v: amplitude %.4f, THD %.2f dB, phase %.5f", i+1, test.description, fundamental, 20*math.Log10(thd), phase)
+		}
+	}
+}
+
+// Multi-channel audio should have each channel filtered the same way
+func TestConvertChannels(t *testing.T) {
+	mono, err := Convert(toneAudio(2822400, 20*time.Millisecond, 1000, 0.5))
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v", err.Error())
+	}
+	a := toneAudio(2822400, 20*time.Millisecond, 1000, 0.5, 0, -0.5)
+	p, err := Convert(a)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v", err.Error())
+	}
+
+	tests := []struct {
+		description string
+		ok          bool
+	}{
+		{"The format should describe each channel in order",
+			p.NumChannels == 3 && slices.Equal(p.ChannelOrder, a.ChannelOrder) && p.NumFrames() == mono.NumFrames()},
+		{"The first channel should be as if it were alone",
+			slices.Equal(channel(p, 0), channel(mono, 0))},
+		{"Silence should be converted to almost nothing",
+			amplitude(channel(p, 1), p.SampleRate, 1000) < 1e-4 && slices.Max(channel(p, 1)) < 1e-3},
+		{"An inverted channel should be the negative of the first",
+			func() bool {
+				for i, sample := range channel(p, 2) {
+					if math.Abs(sample+channel(p, 0)[i]) > 2e-3 {
+						return false
+					}
+				}
+				return true
+			}()},
+	}
+	for i, test := range tests {
+		if !test.ok {
+			t.Errorf("FAIL Test %v: %v", i+1, test.description)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// 8 bits per sample should be converted as if packed to 1 bit per sample
+func TestConvert8Bit(t *testing.T) {
+	a := toneAudio(2822400, 10*time.Millisecond, 1000, 0.5)
+	want, err := Convert(a)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v", err.Error())
+	}
+	if err := a.UnpackTo8Bit(); err != nil {
+		t.Fatalf("FAIL Test 1: %v", err.Error())
+	}
+	actual, err := Convert(a)
+	if err != nil || !slices.Equal(actual.Samples, want.Samples) || a.BitsPerSample != 8 {
+		t.Errorf("FAIL Test 1: 8 bits per sample should be converted as 1 bit per sample, leaving the audio unchanged:\nWant: %v samples\nActual: %v", len(want.Samples), err)
+	} else {
+		t.Logf("PASS Test 1: 8 bits per sample should be converted as 1 bit per sample, leaving the audio unchanged")
+	}
+}
+
+// Table structure for a single conversion error test
+type convertErrorTest struct {
+	// Description for the test
+	description string
+	// The audio
+	audio *audio.Audio
+	// Options for the conversion
+	options []Option
+}
+
+// Table of all conversion error tests
+var convertErrorTests = []convertErrorTest{
+	{"DST audio should result in an error", &audio.Audio{Encoding: audio.DST, NumChannels: 1, SamplingFrequency: 2822400, BitsPerSample: 1}, nil},
+	{"16 bits per DSD sample should result in an error", &audio.Audio{NumChannels: 1, SamplingFrequency: 2822400, BitsPerSample: 16}, nil},
+	{"A sample rate that does not divide the sampling frequency should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithSampleRate(48000)}},
+	{"A decimation ratio below 8 should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithSampleRate(705600)}},
+	{"A decimation ratio that is not a multiple of 8 should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithSampleRate(235200)}},
+	{"A sampling frequency without a default sample rate should result in an error", &audio.Audio{NumChannels: 1, SamplingFrequency: 1000000, BitsPerSample: 1}, nil},
+	{"8 bits per PCM sample should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithBitsPerSample(8)}},
+	{"16 bits per floating point PCM sample should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithFloat(), WithBitsPerSample(16)}},
+	{"64 bits per integer PCM sample should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithBitsPerSample(64)}},
+	{"A ratio that does not divide the sampling frequency should result in an error", &audio.Audio{NumChannels: 1, SamplingFrequency: 2822440, BitsPerSample: 1}, []Option{WithRatio(64)}},
+	{"A ratio that is not a multiple of 8 should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithRatio(12)}},
+	{"A sample rate and ratio that disagree should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithRatio(8), WithSampleRate(88200)}},
+	{"Too few taps should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithTaps(MinTaps - 1)}},
+	{"Dither of floating point samples should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithFloat(), WithDither(TPDFDither)}},
+	{"An unknown dither should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithDither(NoiseShapedDither + 1)}},
+	{"Too many taps should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithTaps(MaxTaps + 1)}},
+	{"An unknown preset should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithPreset(MinimumPhase + 1)}},
+	{"Too few coefficients should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithFIR(lowPass(MinTaps-1, 0.05))}},
+	{"Empty coefficients should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithFIR([]float64{})}},
+	{"Coefficients that do not sum to 1 should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5), []Option{WithFIR(make([]float64, MinTaps))}},
+	{"Coefficients that are not finite should result in an error", toneAudio(2822400, time.Millisecond, 1000, 0.5),
+		[]Option{WithFIR(append(lowPass(MinTaps, 0.05), math.NaN()))}},
+	{"Samples that are not whole blocks should result in an error", &audio.Audio{NumChannels: 2, SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4, EncodedSamples: make([]byte, 7)}, nil},
+}
+
+// Run all conversion error tests, which should fail up front for the output
+// format too unless the samples are at fault
+func TestConvertError(t *testing.T) {
+	for i, test := range convertErrorTests {
+		format, formatErr := OutputFormat(test.audio, test.options...)
+		if p, err := Convert(test.audio, test.options...); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %+v", i+1, test.description, p.Format)
+		} else if formatErr == nil && test.audio.EncodedSamples == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error for the output format\nActual: %v", i+1, test.description, format)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
+
+// Table of all tests of inconsistent audio, which should fail up front for the
+// output format too, before anything is allocated
+var convertInvalidTests = []convertErrorTest{
+	{"A sample count far beyond the samples should result in an error", &audio.Audio{NumChannels: 1, SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096, SampleCount: 1 << 40, EncodedSamples: make([]byte, 8192)}, nil},
+	{"No block size should result in an error", &audio.Audio{NumChannels: 1, SamplingFrequency: 2822400, BitsPerSample: 1, EncodedSamples: make([]byte, 8192)}, nil},
+	{"A channel order that does not match the number of channels should result in an error", &audio.Audio{NumChannels: 2, ChannelOrder: []audio.Channel{audio.Center}, SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096, EncodedSamples: make([]byte, 8192)}, nil},
+}
+
+// Run all tests of inconsistent audio
+func TestConvertInvalid(t *testing.T) {
+	for i, test := range convertInvalidTests {
+		if format, err := OutputFormat(test.audio, test.options...); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error for the output format\nActual: %v", i+1, test.description, format)
+		} else if p, err := Convert(test.audio, test.options...); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %+v", i+1, test.description, p.Format)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
+
+// Table structure for a single format description test
+type formatStringTest struct {
+	// Description for the test
+	description string
+	// The format
+	format Format
+	// Expected description
+	expected string
+}
+
+// Table of all format description tests
+var formatStringTests = []formatStringTest{
+	{"An integer format should be described", Format{NumChannels: 2, SampleRate: 352800, BitsPerSample: 24}, "2 channels of 352800 Hz, 24 bit integer"},
+	{"A floating point format should be described", Format{NumChannels: 6, SampleRate: 88200, BitsPerSample: 32, Float: true}, "6 channels of 88200 Hz, 32 bit float"},
+}
+
+// Run all format description tests
+func TestFormatString(t *testing.T) {
+	for i, test := range formatStringTests {
+		if actual := test.format.String(); actual != test.expected {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.expected, actual)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// 32 bit floating point samples should be rounded to that precision
+func TestConvertFloat32(t *testing.T) {
+	p, err := Convert(toneAudio(2822400, 5*time.Millisecond, 1000, 0.5), WithFloat())
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v", err.Error())
+	}
+	exact := len(p.Floats) > 0 && p.Samples == nil
+	for _, sample := range p.Floats {
+		exact = exact && float64(float32(sample)) == sample
+	}
+	if !exact {
+		t.Errorf("FAIL Test 1: 32 bit floating point samples should be rounded to that precision")
+	} else {
+		t.Logf("PASS Test 1: 32 bit floating point samples should be rounded to that precision")
+	}
+}
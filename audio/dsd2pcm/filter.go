@@ -0,0 +1,253 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsd2pcm
+
+import (
+	"math"
+	"math/cmplx"
+	"slices"
+)
+
+// Preset is a built-in low-pass filter.
+type Preset int
+
+// The built-in low-pass filters.
+const (
+	// SharpLinearPhase stops all of the frequencies that would alias, with
+	// ringing both before and after a transient. It is the default.
+	SharpLinearPhase Preset = iota
+
+	// SlowRolloff has a quarter of the taps, so rolls off more gently and
+	// rings for less time, but lets some of the frequencies just above the
+	// Nyquist frequency alias.
+	SlowRolloff
+
+	// MinimumPhase has the magnitude response of SharpLinearPhase, but rings
+	// only after a transient, at the cost of a phase response that is not
+	// linear.
+	MinimumPhase
+)
+
+// String returns the name of the preset e.g. "sharp linear phase".
+func (p Preset) String() string {
+	switch p {
+	case SharpLinearPhase:
+		return "sharp linear phase"
+	case SlowRolloff:
+		return "slow rolloff"
+	case MinimumPhase:
+		return "minimum phase"
+	}
+	return "unknown"
+}
+
+// Shape parameter of the Kaiser window of the low-pass filter, for a stop band
+// attenuation of about 90 dB.
+const kaiserBeta = 9
+
+// Cutoff frequency of the low-pass filter as a fraction of the PCM sample
+// rate, far enough short of the Nyquist frequency of one half that the
+// default filter stops all of the frequencies that would alias.
+const cutoffRatio = 0.4
+
+// design returns the coefficients of the preset low-pass filter of n taps for
+// the decimation ratio.
+func design(p Preset, n, ratio int) []float64 {
+	cutoff := cutoffRatio / float64(ratio)
+	switch p {
+	case SlowRolloff:
+		return lowPass(max(MinTaps, n/4), cutoff)
+	case MinimumPhase:
+		return minimumPhase(lowPass(n, cutoff))
+	}
+	return lowPass(n, cutoff)
+}
+
+// filter is a FIR low-pass filter over 1 bit DSD samples that decimates by a
+// whole number of bytes. Rather than multiplying each sample by its
+// coefficient, each byte of samples is looked up in a table of the sum of the
+// coefficients for that byte, one table for each 8 taps.
+type filter struct {
+	// Sum of the coefficients for each byte of samples, for each 8 taps, in
+	// the order of the samples.
+	tables [][256]float64
+
+	// Bytes of samples for each PCM sample.
+	step int
+
+	// Bytes of samples before that of each PCM sample that the filter starts
+	// at, so as to compensate for the group delay.
+	offset int
+}
+
+// newFilter returns a filter of the given coefficients that decimates by step
+// bytes of samples. Each PCM sample is the convolution of the coefficients
+// with the samples, advanced by the group delay of the filter at 0 Hz to the
+// nearest sample, so that it is at the time of the first DSD sample decimated
+// to it. For a linear phase filter this is half of its length.
+func newFilter(coefficients []float64, step int) *filter {
+	// Pad the coefficients with zeros, before so that the delay is a whole
+	// number of bytes short of the end and after to a whole number of bytes
+	delay := min(max(0, int(math.Round(groupDelay(coefficients)))), len(coefficients)-1)
+	before := 7 - delay%8
+	h := make([]float64, (before+len(coefficients)+7)/8*8)
+	copy(h[before:], coefficients)
+	slices.Reverse(h)
+
+	f := &filter{tables: make([][256]float64, len(h)/8), step: step, offset: (len(h) - 1 - delay - before) / 8}
+	for t := range f.tables {
+		for b := range 256 {
+			var sum float64
+			for i, c := range h[8*t : 8*t+8] {
+				// The first sample is in the least significant bit
+				if b>>i&1 != 0 {
+					sum += c
+				} else {
+					sum -= c
+				}
+			}
+			f.tables[t][b] = sum
+		}
+	}
+	return f
+}
+
+// apply filters the samples of a channel into PCM samples filling out, each a
+// fraction of full scale, with silence taken as before and after the samples.
+func (f *filter) apply(samples []byte, out []float64) {
+	for m := range out {
+		start := m*f.step - f.offset
+		var sum float64
+		for t := max(0, -start); t < len(f.tables) && start+t < len(samples); t++ {
+			sum += f.tables[t][samples[start+t]]
+		}
+		out[m] = sum
+	}
+}
+
+// groupDelay returns the group delay in samples of a filter at 0 Hz.
+func groupDelay(h []float64) float64 {
+	var moment, sum float64
+	for k, c := range h {
+		moment += float64(k) * c
+		sum += c
+	}
+	return moment / sum
+}
+
+// lowPass returns the coefficients of a linear phase low-pass filter of n taps
+// with the given cutoff frequency as a fraction of the sampling frequency. It
+// is a Kaiser windowed sinc, normalised to a gain of 1 at 0 Hz.
+func lowPass(n int, cutoff float64) []float64 {
+	h := make([]float64, n)
+	centre := float64(n-1) / 2
+	var sum float64
+	for k := range h {
+		x := float64(k) - centre
+		h[k] = 2 * cutoff
+		if x != 0 {
+			h[k] = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		r := x / (centre + 1)
+		h[k] *= besselI0(kaiserBeta*math.Sqrt(1-r*r)) / besselI0(kaiserBeta)
+		sum += h[k]
+	}
+	for k := range h {
+		h[k] /= sum
+	}
+	return h
+}
+
+// minimumPhase returns the coefficients of the minimum phase filter of the
+// same length and magnitude response as the linear phase filter h, by folding
+// the real cepstrum of the magnitude response, normalised to a gain of 1 at
+// 0 Hz.
+func minimumPhase(h []float64) []float64 {
+	// Oversample the spectrum so that the cepstrum barely aliases
+	size := 1
+	for size < 16*len(h) {
+		size *= 2
+	}
+	spectrum := make([]complex128, size)
+	for k, c := range h {
+		spectrum[k] = complex(c, 0)
+	}
+	fft(spectrum, false)
+
+	// The log of the magnitude, floored in the stop band, transformed to
+	// the real cepstrum and folded onto positive quefrencies
+	for i, x := range spectrum {
+		spectrum[i] = complex(math.Log(max(cmplx.Abs(x), 1e-10)), 0)
+	}
+	fft(spectrum, true)
+	for i := 1; i < size/2; i++ {
+		spectrum[i] = 2 * complex(real(spectrum[i]), 0)
+		spectrum[size-i] = 0
+	}
+	spectrum[0] = complex(real(spectrum[0]), 0)
+	spectrum[size/2] = complex(real(spectrum[size/2]), 0)
+
+	fft(spectrum, false)
+	for i, x := range spectrum {
+		spectrum[i] = cmplx.Exp(x)
+	}
+	fft(spectrum, true)
+	m := make([]float64, len(h))
+	var sum float64
+	for k := range m {
+		m[k] = real(spectrum[k])
+		sum += m[k]
+	}
+	for k := range m {
+		m[k] /= sum
+	}
+	return m
+}
+
+// fft replaces x, whose length must be a power of 2, with its discrete Fourier
+// transform, or its inverse.
+func fft(x []complex128, inverse bool) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		if j ^= bit; i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	sign := -1.0
+	if inverse {
+		sign = 1
+	}
+	for size := 2; size <= n; size *= 2 {
+		w := cmplx.Rect(1, sign*2*math.Pi/float64(size))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := range size / 2 {
+				a, b := x[start+k], x[start+k+size/2]*wk
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				wk *= w
+			}
+		}
+	}
+	if inverse {
+		for i := range x {
+			x[i] /= complex(float64(n), 0)
+		}
+	}
+}
+
+// besselI0 returns the modified Bessel function of the first kind of order 0,
+// from its power series.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > sum*1e-12; k++ {
+		term *= x * x / (4 * float64(k*k))
+		sum += term
+	}
+	return sum
+}
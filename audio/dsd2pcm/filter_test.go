@@ -0,0 +1,176 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsd2pcm
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+// response returns the gain of a filter at the given frequency as a fraction
+// of the sampling frequency.
+func response(h []float64, frequency float64) float64 {
+	var sum complex128
+	for k, c := range h {
+		sum += complex(c, 0) * cmplx.Rect(1, -2*math.Pi*frequency*float64(k))
+	}
+	return cmplx.Abs(sum)
+}
+
+// Table structure for a single low-pass filter test
+type lowPassTest struct {
+	// Description for the test
+	description string
+	// Number of taps and cutoff frequency as a fraction of the sampling
+	// frequency
+	n      int
+	cutoff float64
+	// Frequencies where the gain should be 1 and where it should be below
+	// -60 dB, as fractions of the sampling frequency
+	pass, stop float64
+}
+
+// Table of all low-pass filter tests
+var lowPassTests = []lowPassTest{
+	{"The default filter for DSD64 to 352.8 kHz should pass 20 kHz and stop 176.4 kHz", 256, cutoffRatio / 8, 20000.0 / 2822400, 176400.0 / 2822400},
+	{"The default filter for DSD256 to 88.2 kHz should pass 20 kHz and stop 44.1 kHz", 4096, cutoffRatio / 128, 20000.0 / 11289600, 44100.0 / 11289600},
+	{"The shortest filter for DSD64 to 88.2 kHz should pass 1 kHz", MinTaps, cutoffRatio / 32, 1000.0 / 2822400, 0.5},
+}
+
+// Run all low-pass filter tests
+func TestLowPass(t *testing.T) {
+	for i, test := range lowPassTests {
+		h := lowPass(test.n, test.cutoff)
+		symmetric := true
+		for k := range h {
+			symmetric = symmetric && math.Abs(h[k]-h[len(h)-1-k]) < 1e-15
+		}
+		pass, stop := response(h, test.pass), response(h, test.stop)
+		if len(h) != test.n || !symmetric || math.Abs(response(h, 0)-1) > 1e-9 || math.Abs(pass-1) > 0.001 || stop > 0.001 {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v symmetric taps, gain 1 at %v and < 0.001 at %v\nActual: %v taps, symmetric %v, gain %v and %v",
+				i+1, test.description, test.n, test.pass, test.stop, len(h), symmetric, pass, stop)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// convolve returns n PCM samples filtered from the samples of a channel one by
+// one, as newFilter should: the convolution of the coefficients with the
+// samples advanced by the group delay, decimated by ratio.
+func convolve(coefficients []float64, samples []byte, ratio, n int) []float64 {
+	delay := int(math.Round(groupDelay(coefficients)))
+	out := make([]float64, n)
+	for m := range out {
+		for k, c := range coefficients {
+			i := m*ratio + delay - k
+			switch {
+			case i < 0 || i >= len(samples)*8:
+			case samples[i/8]>>(i%8)&1 != 0:
+				out[m] += c
+			default:
+				out[m] -= c
+			}
+		}
+	}
+	return out
+}
+
+// Table structure for a single filter test
+type filterTest struct {
+	// Description for the test
+	description string
+	// Coefficients of the filter
+	coefficients []float64
+	// Decimation ratio
+	ratio int
+}
+
+// Table of all filter tests
+var filterTests = []filterTest{
+	{"A linear phase filter of whole bytes should be convolved", lowPass(64, 0.05), 8},
+	{"A linear phase filter of part bytes should be convolved", lowPass(61, 0.05), 16},
+	{"A slow rolloff filter should be convolved", design(SlowRolloff, 256, 32), 32},
+	{"A minimum phase filter should be convolved", design(MinimumPhase, 128, 8), 8},
+	{"A filter longer than the samples should be convolved", lowPass(1000, 0.01), 64},
+	{"An asymmetric filter should be convolved", func() []float64 {
+		h := make([]float64, 50)
+		for k := range h {
+			h[k] = float64(k%7+1) / 200
+		}
+		return h
+	}(), 8},
+	{"A single tap should be the samples themselves", []float64{1}, 8},
+}
+
+// Run all filter tests: the filter should match the convolution of each
+// sample in turn, including the silence beyond the samples
+func TestFilter(t *testing.T) {
+	samples := make([]byte, 96)
+	for i := range samples {
+		samples[i] = byte(i*i*37 + i*11 + 5)
+	}
+	for i, test := range filterTests {
+		n := len(samples) * 8 / test.ratio
+		expected := convolve(test.coefficients, samples, test.ratio, n)
+		actual := make([]float64, n)
+		newFilter(test.coefficients, test.ratio/8).apply(samples, actual)
+		ok := true
+		for m := range expected {
+			ok = ok && math.Abs(actual[m]-expected[m]) < 1e-12
+		}
+		if !ok {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, expected, actual)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// The minimum phase filter should have the magnitude response of the linear
+// phase filter that it is designed from, with much less group delay
+func TestMinimumPhase(t *testing.T) {
+	h := lowPass(256, cutoffRatio/8)
+	m := minimumPhase(h)
+	ok := len(m) == len(h) && groupDelay(m) < groupDelay(h)/4
+	for _, frequency := range []float64{0, 0.001, 0.01, 0.04, 0.0625, 0.1, 0.3} {
+		ok = ok && math.Abs(response(m, frequency)-response(h, frequency)) < 1e-4
+	}
+	if !ok {
+		t.Errorf("FAIL Test 1: The minimum phase filter should have the same magnitude response and less delay:\nWant: delay < %v\nActual: %v taps, delay %v", groupDelay(h)/4, len(m), groupDelay(m))
+	} else {
+		t.Logf("PASS Test 1: The minimum phase filter should have the same magnitude response and less delay: %.2f samples rather than %.2f", groupDelay(m), groupDelay(h))
+	}
+}
+
+// Table structure for a single preset name test
+type presetStringTest struct {
+	// Description for the test
+	description string
+	// The preset
+	preset Preset
+	// Expected name
+	expected string
+}
+
+// Table of all preset name tests
+var presetStringTests = []presetStringTest{
+	{"SharpLinearPhase should be named", SharpLinearPhase, "sharp linear phase"},
+	{"SlowRolloff should be named", SlowRolloff, "slow rolloff"},
+	{"MinimumPhase should be named", MinimumPhase, "minimum phase"},
+	{"An unknown preset should be named as such", MinimumPhase + 1, "unknown"},
+}
+
+// Run all preset name tests
+func TestPresetString(t *testing.T) {
+	for i, test := range presetStringTests {
+		if actual := test.preset.String(); actual != test.expected {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.expected, actual)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
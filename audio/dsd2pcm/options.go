@@ -0,0 +1,168 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsd2pcm
+
+import (
+	"slices"
+)
+
+// Option configures how DSD audio is converted to PCM.
+type Option func(*options)
+
+// MinTaps and MaxTaps are the fewest and most taps of the low-pass filter that
+// WithTaps and WithFIR accept.
+const (
+	MinTaps = 48
+	MaxTaps = 1 << 16
+)
+
+// DefaultBitsPerSample and DefaultFloatBitsPerSample are the number of bits
+// per integer and floating point PCM sample unless WithBitsPerSample is given.
+const (
+	DefaultBitsPerSample      = 24
+	DefaultFloatBitsPerSample = 32
+)
+
+// HeadroomGain is the gain applied by WithHeadroomGain, +6 dB, which makes the
+// SACD reference level of 50% modulation full scale.
+const HeadroomGain = 2
+
+// DefaultTapsPerRatio is the number of taps of the low-pass filter, for each
+// DSD sample decimated to one PCM sample, unless WithTaps is given. For DSD64
+// to 352.8 kHz this is 256 taps.
+const DefaultTapsPerRatio = 32
+
+// options is the configuration built from a list of Option.
+type options struct {
+	// PCM sample rate and decimation ratio, or 0 for the default for the DSD
+	// sampling frequency.
+	sampleRate uint
+	ratio      uint
+
+	// Bits per PCM sample, or 0 for the default, and whether the samples are
+	// floating point rather than integers.
+	bitsPerSample uint
+	float         bool
+
+	// Whether to apply HeadroomGain.
+	headroomGain bool
+
+	// How integer samples are dithered, and the seed of the noise if seeded.
+	dither Dither
+	seed   uint64
+	seeded bool
+
+	// Number of workers converting channels in parallel.
+	workers int
+
+	// Number of taps of the low-pass filter, or 0 for the default for the
+	// decimation ratio, and the preset to design it from unless its
+	// coefficients are given.
+	taps         int
+	preset       Preset
+	coefficients []float64
+}
+
+// WithSampleRate sets the PCM sample rate in Hz. The DSD sampling frequency
+// must be a multiple of 8 times the rate, e.g. DSD64 may be converted to
+// 352.8 kHz, 176.4 kHz or 88.2 kHz. By default the rate is 352.8 kHz, or
+// 384 kHz for a sampling frequency that is a multiple of 48 kHz.
+func WithSampleRate(rate uint) Option {
+	return func(o *options) {
+		o.sampleRate = rate
+	}
+}
+
+// WithRatio sets the PCM sample rate as the DSD sampling frequency divided by
+// the decimation ratio, which must be a multiple of 8 such as 8, 16, 32 or 64
+// and must divide the sampling frequency. If WithSampleRate is also given then
+// the two must agree.
+func WithRatio(n uint) Option {
+	return func(o *options) {
+		o.ratio = n
+	}
+}
+
+// WithBitsPerSample sets the number of bits per PCM sample instead of
+// DefaultBitsPerSample, or DefaultFloatBitsPerSample with WithFloat. An
+// integer sample may be 16, 24 or 32 bits and a floating point sample 32 or
+// 64 bits.
+func WithBitsPerSample(n uint) Option {
+	return func(o *options) {
+		o.bitsPerSample = n
+	}
+}
+
+// WithFloat makes the PCM samples floating point rather than integers.
+func WithFloat() Option {
+	return func(o *options) {
+		o.float = true
+	}
+}
+
+// WithHeadroomGain applies HeadroomGain to the PCM samples, following the
+// convention that DSD has 6 dB of headroom above the SACD reference level.
+// Integer samples beyond full scale are clipped, as may happen for DSD above
+// the reference level, but floating point samples are not.
+func WithHeadroomGain() Option {
+	return func(o *options) {
+		o.headroomGain = true
+	}
+}
+
+// WithDither sets how integer samples are dithered when rounded, instead of
+// AutoDither. Floating point samples are not dithered.
+func WithDither(d Dither) Option {
+	return func(o *options) {
+		o.dither = d
+	}
+}
+
+// WithSeed seeds the noise of any dither, so that the same audio is always
+// converted to the same PCM. Otherwise the seed is random.
+func WithSeed(seed uint64) Option {
+	return func(o *options) {
+		o.seed, o.seeded = seed, true
+	}
+}
+
+// WithWorkers sets the number of workers that convert the channels in
+// parallel, each one channel at a time, instead of GOMAXPROCS. There are never
+// more workers than channels. A value of 1 converts the channels serially, in
+// the calling goroutine. The PCM is the same however many workers there are.
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// WithTaps sets the number of taps of the low-pass filter, from MinTaps to
+// MaxTaps, instead of DefaultTapsPerRatio times the decimation ratio. More
+// taps give a sharper filter, and more latency, at the cost of speed.
+func WithTaps(n int) Option {
+	return func(o *options) {
+		o.taps = n
+	}
+}
+
+// WithPreset sets the low-pass filter to the preset of the number of taps
+// instead of SharpLinearPhase.
+func WithPreset(p Preset) Option {
+	return func(o *options) {
+		o.preset = p
+	}
+}
+
+// WithFIR sets the coefficients of the low-pass filter, instead of those of a
+// preset, of which there must be from MinTaps to MaxTaps. They must be
+// normalised to a gain of 1 at 0 Hz, i.e. sum to 1, as each is the gain of a
+// DSD sample of +1 or -1. They are convolved with the samples at the sampling
+// frequency, before decimation, so must cut off below the Nyquist frequency
+// of the PCM sample rate.
+func WithFIR(coefficients []float64) Option {
+	return func(o *options) {
+		o.coefficients = slices.Clone(coefficients)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsd2pcm
+
+import (
+	"github.com/snmoore/go/audio"
+	"sync"
+	"sync/atomic"
+)
+
+// converter converts each channel of DSD audio of 1 bit per sample to PCM.
+type converter struct {
+	// Input, and the filter and number of frames to convert it to.
+	audio  *audio.Audio
+	filter *filter
+	frames int
+
+	// Configuration.
+	options
+
+	// Output, with its samples allocated.
+	pcm *PCM
+}
+
+// run converts every channel, serially or by several workers in parallel. If
+// converting a channel fails then the workers stop converting the channels
+// after it in ChannelOrder as soon as they can, but finish those before it, so
+// that the error returned is that of the first channel that fails however many
+// workers there are.
+func (conv *converter) run() error {
+	numChannels := int(conv.audio.NumChannels)
+	workers := max(1, min(conv.workers, numChannels))
+	var failed atomic.Int64
+	failed.Store(int64(numChannels))
+	if workers == 1 {
+		for c := range numChannels {
+			if err := conv.channel(c, &failed); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Each worker takes the next channel until there are none, or until one
+	// before it has failed
+	errs := make([]error, numChannels)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range next {
+				if errs[c] = conv.channel(c, &failed); errs[c] != nil {
+					for first := failed.Load(); int64(c) < first && !failed.CompareAndSwap(first, int64(c)); {
+						first = failed.Load()
+					}
+				}
+			}
+		}()
+	}
+	for c := 0; int64(c) < failed.Load(); c++ {
+		next <- c
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// channel converts channel c, the index of the channel in ChannelOrder,
+// stopping early without an error if failed becomes the index of a channel
+// before it that has failed.
+func (conv *converter) channel(c int, failed *atomic.Int64) error {
+	// Read the samples of the channel a block at a time, excluding the
+	// padding
+	samples := make([]byte, 0, conv.audio.NumBlocks()*int(conv.audio.BlockSize))
+	for index := range conv.audio.NumBlocks() {
+		if int64(c) > failed.Load() {
+			return nil
+		}
+		b, err := conv.audio.Block(c, index)
+		if err != nil {
+			return err
+		}
+		samples = append(samples, b.Samples[:b.Size]...)
+	}
+	if int64(c) > failed.Load() {
+		return nil
+	}
+	out := make([]float64, conv.frames)
+	conv.filter.apply(samples, out)
+
+	// Scale each sample, rounding it to the format, with any dither, and
+	// clipping an integer beyond full scale
+	gain := 1.0
+	if conv.headroomGain {
+		gain = HeadroomGain
+	}
+	p, stride := conv.pcm, int(conv.pcm.NumChannels)
+	switch {
+	case p.Float && p.BitsPerSample == 32:
+		for m, sample := range out {
+			p.Floats[c+m*stride] = float64(float32(sample * gain))
+		}
+	case p.Float:
+		for m, sample := range out {
+			p.Floats[c+m*stride] = sample * gain
+		}
+	default:
+		q := newRequantizer(conv.dither, float64(int64(1)<<(p.BitsPerSample-1)-1), conv.seed, c)
+		for m, sample := range out {
+			p.Samples[c+m*stride] = q.quantize(sample * gain)
+		}
+	}
+	return nil
+}
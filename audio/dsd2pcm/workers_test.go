@@ -0,0 +1,142 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsd2pcm
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/snmoore/go/audio"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+// sixChannelAudio returns 5.1 channel DSD audio of the given duration, with
+// samples that differ in every channel.
+func sixChannelAudio(samplingFrequency uint, d time.Duration) *audio.Audio {
+	order := []audio.Channel{audio.FrontLeft, audio.FrontRight, audio.Center, audio.LowFrequency, audio.BackLeft, audio.BackRight}
+	a, err := audio.New(audio.DSD, samplingFrequency, order, audio.WithDuration(d))
+	if err != nil {
+		panic(err)
+	}
+	for i := range a.EncodedSamples {
+		a.EncodedSamples[i] = byte(i*i*37 + i*11 + i/4096)
+	}
+	return a
+}
+
+// failingReaderAt reads from data, except that reading any of the bytes from
+// each offset in fail results in an error.
+type failingReaderAt struct {
+	data []byte
+	fail []int64
+}
+
+func (r failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	for _, fail := range r.fail {
+		if off <= fail && fail < off+int64(len(p)) {
+			return 0, fmt.Errorf("read of byte %v failed", fail)
+		}
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+// Table structure for a single workers test
+type workersTest struct {
+	// Description for the test
+	description string
+	// Options for the conversion
+	options []Option
+}
+
+// Table of all workers tests
+var workersTests = []workersTest{
+	{"24 bit integers should be the same however many workers", nil},
+	{"Dithered 16 bit integers should be the same however many workers", []Option{WithBitsPerSample(16), WithDither(NoiseShapedDither), WithSeed(7)}},
+	{"32 bit floating point should be the same however many workers", []Option{WithFloat()}},
+	{"64 bit floating point should be the same however many workers", []Option{WithFloat(), WithBitsPerSample(64)}},
+}
+
+// Run all workers tests against converting serially
+func TestWorkers(t *testing.T) {
+	a := sixChannelAudio(2822400, 5*time.Millisecond)
+	for i, test := range workersTests {
+		serial, err := Convert(a, append([]Option{WithWorkers(1)}, test.options...)...)
+		if err != nil {
+			t.Fatalf("FAIL Test %v: %v: %v", i+1, test.description, err.Error())
+		}
+		failed := false
+		for _, workers := range []int{0, 2, 3, 6, 16} {
+			p, err := Convert(a, append([]Option{WithWorkers(workers)}, test.options...)...)
+			if err != nil || !slices.Equal(p.Samples, serial.Samples) || !slices.Equal(p.Floats, serial.Floats) {
+				t.Errorf("FAIL Test %v: %v:\nWant: the same PCM with %v workers as with 1\nActual: %v", i+1, test.description, workers, err)
+				failed = true
+			}
+		}
+		if !failed {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// Table structure for a single workers error test
+type workersErrorTest struct {
+	// Description for the test
+	description string
+	// Offsets in the encoded samples that fail to be read
+	fail []int64
+	// Expected error
+	expected string
+}
+
+// Table of all workers error tests, against sixChannelAudio of 2 blocks per
+// channel
+var workersErrorTests = []workersErrorTest{
+	{"A channel that fails should result in its error", []int64{3 * 4096}, "read of byte 12288 failed"},
+	{"Channels that fail should result in the error of the first", []int64{(6 + 5) * 4096, (6+1)*4096 + 100, 4 * 4096}, "read of byte 28772 failed"},
+	{"The last channel that fails should result in its error", []int64{12*4096 - 1}, "read of byte 49151 failed"},
+}
+
+// Run all workers error tests, each with any number of workers
+func TestWorkersError(t *testing.T) {
+	a := sixChannelAudio(2822400, 2*4096*8*time.Second/2822400)
+	for i, test := range workersErrorTests {
+		b := a.Clone()
+		b.EncodedSection = io.NewSectionReader(failingReaderAt{a.EncodedSamples, test.fail}, 0, int64(len(a.EncodedSamples)))
+		b.EncodedSamples = nil
+		failed := false
+		for _, workers := range []int{1, 2, 3, 6} {
+			if p, err := Convert(b, WithWorkers(workers)); err == nil || err.Error() != test.expected {
+				t.Errorf("FAIL Test %v: %v:\nWant: %v with %v workers\nActual: %v, %v", i+1, test.description, test.expected, workers, err, p)
+				failed = true
+			}
+		}
+		if !failed {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, test.expected)
+		}
+	}
+}
+
+// Convert 5.1 channel DSD256 to 352.8 kHz serially
+func BenchmarkConvertSerial(b *testing.B) {
+	benchmarkConvert(b, 1)
+}
+
+// Convert 5.1 channel DSD256 to 352.8 kHz with a worker for each channel
+func BenchmarkConvertParallel(b *testing.B) {
+	benchmarkConvert(b, 6)
+}
+
+func benchmarkConvert(b *testing.B, workers int) {
+	a := sixChannelAudio(11289600, 100*time.Millisecond)
+	b.SetBytes(int64(len(a.EncodedSamples)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Convert(a, WithWorkers(workers)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
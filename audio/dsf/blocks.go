@@ -0,0 +1,69 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"io"
+)
+
+// BlockFunc is called for each block of sample data, with the index of the
+// channel in ChannelOrder, the index of the block within that channel, and the
+// block itself. The block is only valid until BlockFunc returns. Returning an
+// error stops the decoding, and the error is returned to the caller.
+type BlockFunc func(channel int, blockIndex uint64, block []byte) error
+
+// ReadBlocks reads the remaining sample data one block at a time, calling fn for
+// each block for each channel in turn. A single buffer of BlockSize bytes is
+// reused for every block, so memory usage is independent of the file size. The
+// final block for each channel includes its padding, which can be excluded
+// using Info.SampleBytes.
+func (r *Reader) ReadBlocks(fn BlockFunc) error {
+	channels := int(r.NumChannels)
+	block := make([]byte, r.BlockSize)
+	for index := uint64(0); ; index++ {
+		for channel := 0; channel < channels; channel++ {
+			if _, err := io.ReadFull(r, block); err != nil {
+				if err == io.EOF && channel == 0 {
+					return nil
+				}
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			if err := fn(channel, index, block); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// DecodeBlocks reads a DSD stream file from r, calling fn for each block of
+// sample data as per Reader.ReadBlocks. The metadata is not read.
+func DecodeBlocks(r io.Reader, fn BlockFunc, opts ...Option) error {
+	reader, err := NewReader(r, opts...)
+	if err != nil {
+		return err
+	}
+	return reader.ReadBlocks(fn)
+}
+
+// SampleBytes returns the number of bytes of samples in the block with the given
+// index for each channel, excluding any padding. This is BlockSize for all but
+// the final block, and 0 for any index beyond the final block.
+func (i *Info) SampleBytes(blockIndex uint64) int {
+	samples := i.SampleCount
+	if i.BitsPerSample == 1 {
+		samples = samples/8 + (samples%8+7)/8 // up to 8 samples per byte
+	}
+	blockSize := uint64(i.BlockSize)
+	if blockSize == 0 || blockIndex > samples/blockSize {
+		return 0
+	}
+	if remaining := samples - blockIndex*blockSize; remaining < blockSize {
+		return int(remaining)
+	}
+	return int(blockSize)
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Each block should be visited in turn for each channel, including the padding
+// of the final block
+func TestDecodeBlocks(t *testing.T) {
+	description := "Each block should be visited in turn for each channel"
+
+	// Prepare 3 groups of stereo blocks, with each block filled with its index,
+	// and 2.5 blocks of samples per channel
+	var samples []byte
+	for i := 0; i < 6; i++ {
+		samples = append(samples, bytes.Repeat([]byte{byte(i)}, 4096)...)
+	}
+	c := newTestFile(2, 2, 4096*8*5/2, uint64(len(samples)), samples, nil)
+
+	// Record the blocks visited
+	type visit struct {
+		channel    int
+		blockIndex uint64
+		value      byte
+	}
+	var visits []visit
+	err := DecodeBlocks(bytes.NewReader(c), func(channel int, blockIndex uint64, block []byte) error {
+		if len(block) != 4096 || !bytes.Equal(block, bytes.Repeat(block[:1], 4096)) {
+			t.Errorf("FAIL Test 1: %v:\nIncorrect block %v for channel %v", description, blockIndex, channel)
+		}
+		visits = append(visits, visit{channel, blockIndex, block[0]})
+		return nil
+	})
+	want := []visit{{0, 0, 0}, {1, 0, 1}, {0, 1, 2}, {1, 1, 3}, {0, 2, 4}, {1, 2, 5}}
+	if err != nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if !reflect.DeepEqual(visits, want) {
+		t.Errorf("FAIL Test 1: %v:\nWant: %v\nActual: %v", description, want, visits)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	// An error from the callback should stop the decoding
+	description = "An error from the callback should stop the decoding"
+	stop := errors.New("stop")
+	count := 0
+	err = DecodeBlocks(bytes.NewReader(c), func(channel int, blockIndex uint64, block []byte) error {
+		count++
+		if blockIndex == 1 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || count != 3 {
+		t.Errorf("FAIL Test 2: %v:\nWant: %v after 3 blocks\nActual: %v after %v blocks", description, stop, err, count)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	// Truncated sample data should result in an error
+	description = "Truncated sample data should result in an error"
+	err = DecodeBlocks(bytes.NewReader(c[:len(c)-4096-100]), func(int, uint64, []byte) error { return nil })
+	if err == nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 3: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// Table of the number of bytes of samples in each block, for 2.5 blocks of
+// samples per channel
+var sampleBytesTests = []struct {
+	blockIndex uint64
+	size       int
+}{
+	{0, 4096},
+	{1, 4096},
+	{2, 2048},
+	{3, 0},
+	{1 << 62, 0},
+}
+
+// The padding of the final block should be identified
+func TestInfoSampleBytes(t *testing.T) {
+	info := Info{BitsPerSample: 1, BlockSize: 4096, SampleCount: 4096 * 8 * 5 / 2}
+	for i, test := range sampleBytesTests {
+		description := "The number of bytes of samples in a block should exclude the padding"
+		if actual := info.SampleBytes(test.blockIndex); actual != test.size {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, description, test.size, actual)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+}
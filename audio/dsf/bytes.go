@@ -0,0 +1,108 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"github.com/snmoore/go/audio"
+	"io"
+)
+
+// DecodeBytes reads a DSD stream file held in b and returns it as an Audio,
+// without copying the sample data or metadata. The EncodedSamples and Metadata
+// of the Audio are sub-slices of b, so b must not be modified whilst the Audio
+// is in use, and modifying the Audio modifies b. The exception is if some of
+// the padding declared by the file is missing and this is tolerated, or if the
+// metadata is an ID3v2 tag found after the data chunk without a pointer to it,
+// in which case that part is copied instead.
+func DecodeBytes(b []byte, opts ...Option) (*audio.Audio, error) {
+	a := new(audio.Audio)
+	d := newDecoder(nil, opts)
+	if err := d.decodeBytes(b, a); err != nil {
+		if d.recovered {
+			return a, err
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// decodeBytes reads a DSD stream file held in b into a. Where possible the
+// EncodedSamples and Metadata of a are set to sub-slices of b rather than being
+// copied, which is only impossible if the file is missing some of the padding
+// that it declares and this is tolerated.
+func (d *decoder) decodeBytes(b []byte, a *audio.Audio) error {
+	r := bytes.NewReader(b)
+	d.reset(r, a)
+	defer d.startChunk("")
+
+	// Read the DSD, fmt and data chunk headers
+	if err := d.readHeaders(); err != nil {
+		return err
+	}
+
+	// Alias the sample data if it is all present, otherwise copy it
+	length := d.end - d.position
+	if present, _ := d.nextRun(); present >= length && uint64(r.Len()) >= length {
+		a.EncodedSamples = subslice(b, r, length)
+		d.hashSamples(a.EncodedSamples, d.position)
+		d.position += length
+		if d.progress != nil {
+			d.progress(length, length)
+		}
+	} else {
+		samples, err := d.allocate("data", nil, length)
+		if err != nil {
+			return err
+		}
+		a.EncodedSamples = samples
+		if err := d.readAllSamples(a.EncodedSamples); err != nil {
+			return d.recoverSamples(err)
+		}
+	}
+	d.logSamples()
+
+	// Skip the remainder of the sample data
+	if d.position < d.sampleDataSize {
+		if err := d.skipSamples(d.sampleDataSize - d.position); err != nil {
+			return err
+		}
+	}
+
+	// Alias the metadata, or as much of it as is present
+	if d.metadataSize == 0 || d.withoutMetadata || uint64(r.Len()) < d.metadataGap {
+		if err := d.readMetadata(); err != nil {
+			return err
+		}
+	} else {
+		d.startChunk("metadata")
+		if err := d.skipMetadataGap(); err != nil {
+			return err
+		}
+		var err error
+		switch n := uint64(r.Len()); {
+		case n == 0:
+			err = io.EOF
+		case n < d.metadataSize:
+			err = io.ErrUnexpectedEOF
+		}
+		a.Metadata = subslice(b, r, min(d.metadataSize, uint64(r.Len())))
+		if err := d.finishMetadataChunk(err); err != nil {
+			return err
+		}
+	}
+
+	// The total file size should match the length of b
+	return d.checkFileLength(uint64(len(b)))
+}
+
+// subslice returns the next n bytes of b, which is being read by r, and
+// advances r past them. The capacity of the result is limited so that appending
+// to it cannot overwrite the rest of b.
+func subslice(b []byte, r *bytes.Reader, n uint64) []byte {
+	offset := uint64(len(b) - r.Len())
+	r.Seek(int64(n), io.SeekCurrent)
+	return b[offset : offset+n : offset+n]
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// Decoding from a slice should give the same result as Decode, with the sample
+// data and metadata aliasing the slice
+func TestDecodeBytes(t *testing.T) {
+	description := "Decoding from a slice should alias the slice"
+
+	// Read the whole DSD stream file into memory
+	b, err := ioutil.ReadFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	want, err := Decode(bytes.NewReader(b), nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+
+	a, err := DecodeBytes(b)
+	switch {
+	case err != nil:
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	case !reflect.DeepEqual(a, want):
+		t.Errorf("FAIL Test 1: %v:\nWant: %+v\nActual: %+v", description, want, a)
+	case &a.EncodedSamples[0] != &b[92] || &a.Metadata[0] != &b[4188]:
+		t.Errorf("FAIL Test 1: %v:\nWant: aliased\nActual: copied", description)
+	case cap(a.EncodedSamples) != len(a.EncodedSamples):
+		t.Errorf("FAIL Test 1: %v:\nWant: capacity %v\nActual: capacity %v", description, len(a.EncodedSamples), cap(a.EncodedSamples))
+	default:
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	// Metadata missing from the end of the slice should be tolerated in lenient
+	// mode, aliasing what there is without allocating what is missing
+	description = "Metadata missing from the end of the slice should be tolerated in lenient mode"
+	var warnings []Warning
+	// The total file size and the truncated ID3v2 tag header are both warned about
+	a, err = DecodeBytes(b[:4190], WithLenient(), WithWarnings(&warnings))
+	if err != nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if !bytes.Equal(a.Metadata, b[4188:4190]) || len(warnings) != 2 {
+		t.Errorf("FAIL Test 2: %v:\nWant: % x, 2 warnings\nActual: % x, %v", description, b[4188:4190], a.Metadata, warnings)
+	} else if &a.Metadata[0] != &b[4188] || cap(a.Metadata) != 2 {
+		t.Errorf("FAIL Test 2: %v:\nWant: aliased with capacity 2\nActual: capacity %v", description, cap(a.Metadata))
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	// Truncated sample data should result in an error
+	description = "Truncated sample data should result in an error"
+	if _, err := DecodeBytes(b[:1000]); err == nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 3: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// Decode a slice by aliasing it
+func BenchmarkDecodeBytes(b *testing.B) {
+	c := newBenchmarkFile()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(c)))
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeBytes(c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
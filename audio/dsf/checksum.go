@@ -0,0 +1,154 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"hash/crc32"
+)
+
+// Checksum selects the algorithm used to checksum the sample data.
+type Checksum int
+
+// Supported checksum algorithms.
+const (
+	MD5   Checksum = iota // 16 byte MD5 digest
+	CRC32                 // 4 byte big-endian IEEE CRC-32
+)
+
+// String returns the name of the checksum algorithm.
+func (c Checksum) String() string {
+	switch c {
+	case MD5:
+		return "MD5"
+	case CRC32:
+		return "CRC32"
+	default:
+		return fmt.Sprintf("Checksum(%d)", int(c))
+	}
+}
+
+// new returns a hash.Hash for the checksum algorithm, defaulting to MD5.
+func (c Checksum) new() hash.Hash {
+	if c == CRC32 {
+		return crc32.NewIEEE()
+	}
+	return md5.New()
+}
+
+// sampleHasher checksums interleaved sample data in the order in which it is
+// stored in the data chunk, excluding the padding of the final block for each
+// channel. Files that differ only in their padding therefore have the same
+// checksum.
+type sampleHasher struct {
+	hash hash.Hash
+
+	// Size in bytes of the sample data including the padding, and position of
+	// the final group of blocks within it.
+	size  uint64
+	final uint64
+
+	// Size in bytes of each block, and the number of bytes of samples in the
+	// final block for each channel.
+	blockSize uint64
+	tail      uint64
+}
+
+// newSampleHasher returns a sampleHasher for size bytes of sample data holding
+// sampleBytes bytes of samples per channel.
+func newSampleHasher(c Checksum, size, numChannels, blockSize, sampleBytes uint64) *sampleHasher {
+	h := &sampleHasher{hash: c.new(), size: size, blockSize: blockSize, tail: blockSize}
+	groupSize := numChannels * blockSize
+	if groupSize > 0 && size >= groupSize {
+		h.final = size - groupSize
+		if preceding := h.final / numChannels; sampleBytes >= preceding && sampleBytes-preceding < blockSize {
+			h.tail = sampleBytes - preceding
+		}
+	}
+	return h
+}
+
+// write adds p, which starts at position within the sample data, to the
+// checksum, skipping any padding of the final blocks.
+func (h *sampleHasher) write(p []byte, position uint64) {
+	for len(p) > 0 && position < h.size {
+		n := uint64(len(p))
+		if position < h.final {
+			if n > h.final-position {
+				n = h.final - position
+			}
+			h.hash.Write(p[:n])
+		} else {
+			offset := (position - h.final) % h.blockSize
+			if n > h.blockSize-offset {
+				n = h.blockSize - offset
+			}
+			if offset < h.tail {
+				m := h.tail - offset
+				if m > n {
+					m = n
+				}
+				h.hash.Write(p[:m])
+			}
+		}
+		p = p[n:]
+		position += n
+	}
+}
+
+// sum returns the checksum of the sample data written so far.
+func (h *sampleHasher) sum() []byte {
+	return h.hash.Sum(nil)
+}
+
+// hashSamples adds p, which starts at position within the sample data, to the
+// checksum selected by WithChecksum, storing the checksum once the end of the
+// sample data to be read is reached.
+func (d *decoder) hashSamples(p []byte, position uint64) {
+	if d.checksum == nil {
+		return
+	}
+	if d.hasher == nil {
+		sampleBytes := d.fmt.Details().SampleCount
+		if d.audio.BitsPerSample == 1 {
+			sampleBytes = sampleBytes/8 + (sampleBytes%8+7)/8
+		}
+		d.hasher = newSampleHasher(d.checksumType, d.sampleDataSize, uint64(d.audio.NumChannels), uint64(d.audio.BlockSize), sampleBytes)
+	}
+	d.hasher.write(p, position)
+	if position+uint64(len(p)) == d.end {
+		*d.checksum = d.hasher.sum()
+	}
+}
+
+// hashSamples adds p, which starts at position within the sample data, to the
+// checksum selected by WithChecksum as it is written, excluding the padding of
+// the final block for each channel. The fmt chunk must already have been
+// written.
+func (e *encoder) hashSamples(p []byte, position uint64) {
+	if e.checksum == nil {
+		return
+	}
+	if e.hasher == nil {
+		sampleBytes := e.fmt.Details().SampleCount
+		if e.audio.BitsPerSample == 1 {
+			sampleBytes = sampleBytes/8 + (sampleBytes%8+7)/8
+		}
+		e.hasher = newSampleHasher(e.checksumType, e.sampleDataSize, uint64(e.audio.NumChannels), uint64(e.blockSize()), sampleBytes)
+	}
+	e.hasher.write(p, position)
+}
+
+// storeChecksum stores the checksum selected by WithChecksum once all of the
+// sample data has been written.
+func (e *encoder) storeChecksum() {
+	if e.checksum == nil {
+		return
+	}
+	e.hashSamples(nil, 0)
+	*e.checksum = e.hasher.sum()
+}
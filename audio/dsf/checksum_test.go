@@ -0,0 +1,161 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// Write a stereo DSD stream file with 10 bytes of samples for each channel,
+// followed by padding of the given value
+func newChecksumFile(padding byte) []byte {
+	samples := bytes.Repeat([]byte{padding}, 2*4096)
+	for i := 0; i < 10; i++ {
+		samples[i] = byte(0x10 + i)
+		samples[4096+i] = byte(0x20 + i)
+	}
+	return newTestFile(2, 2, 10*8, uint64(len(samples)), samples, nil)
+}
+
+// The samples of newChecksumFile, excluding the padding
+var checksumSamples = []byte{
+	0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19,
+	0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27, 0x28, 0x29,
+}
+
+// Ways of decoding a DSD stream file that should all compute the checksum
+var checksumDecoders = []struct {
+	description string
+	decode      func(b []byte, opts ...Option) ([]byte, error)
+}{
+	{"Decode", func(b []byte, opts ...Option) ([]byte, error) {
+		var sum []byte
+		_, err := Decode(bytes.NewReader(b), nil, append(opts, WithChecksum(MD5, &sum))...)
+		return sum, err
+	}},
+	{"DecodeWithDetails", func(b []byte, opts ...Option) ([]byte, error) {
+		var sum []byte
+		result, err := DecodeWithDetails(bytes.NewReader(b), nil, append(opts, WithChecksum(MD5, &sum))...)
+		if err != nil || !bytes.Equal(result.Checksum, sum) {
+			return nil, err
+		}
+		return result.Checksum, nil
+	}},
+	{"DecodeBytes", func(b []byte, opts ...Option) ([]byte, error) {
+		var sum []byte
+		_, err := DecodeBytes(b, append(opts, WithChecksum(MD5, &sum))...)
+		return sum, err
+	}},
+	{"Reader", func(b []byte, opts ...Option) ([]byte, error) {
+		var sum []byte
+		r, err := NewReader(bytes.NewReader(b), append(opts, WithChecksum(MD5, &sum))...)
+		if err != nil {
+			return nil, err
+		}
+		_, err = ioutil.ReadAll(r)
+		return sum, err
+	}},
+	{"Validate", func(b []byte, opts ...Option) ([]byte, error) {
+		var sum []byte
+		_, err := Validate(bytes.NewReader(b), append(opts, WithChecksum(MD5, &sum))...)
+		return sum, err
+	}},
+}
+
+// Every way of decoding should compute the same checksum, excluding the padding
+func TestChecksum(t *testing.T) {
+	want := md5.Sum(checksumSamples)
+	for i, decoder := range checksumDecoders {
+		for _, padding := range []byte{0x00, 0x69} {
+			description := decoder.description + " should checksum the samples excluding the padding"
+			sum, err := decoder.decode(newChecksumFile(padding))
+			if err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+			} else if !bytes.Equal(sum, want[:]) {
+				t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x", i+1, description, want, sum)
+			} else {
+				t.Logf("PASS Test %v: %v", i+1, description)
+			}
+		}
+	}
+}
+
+// The CRC32 checksum should be the big-endian IEEE CRC-32 of the samples
+func TestChecksumCRC32(t *testing.T) {
+	description := "The CRC32 checksum should be the IEEE CRC-32 of the samples"
+	want := make([]byte, 4)
+	binary.BigEndian.PutUint32(want, crc32.ChecksumIEEE(checksumSamples))
+	var sum []byte
+	if _, err := Decode(bytes.NewReader(newChecksumFile(0x69)), nil, WithChecksum(CRC32, &sum)); err != nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if !bytes.Equal(sum, want) {
+		t.Errorf("FAIL Test 1: %v:\nWant: % x\nActual: % x", description, want, sum)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+}
+
+// Reading in parallel should compute the same checksum as reading serially
+func TestChecksumParallel(t *testing.T) {
+	description := "Reading in parallel should compute the same checksum as reading serially"
+	c := newParallelFile()
+	var serial, parallel []byte
+	if _, err := Decode(bytes.NewReader(c), nil, WithWorkers(1), WithChecksum(MD5, &serial)); err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	if _, err := Decode(bytes.NewReader(c), nil, WithWorkers(4), WithChecksum(MD5, &parallel)); err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	want := md5.Sum(c[92 : 92+2*640*4096])
+	if !bytes.Equal(serial, want[:]) || !bytes.Equal(parallel, want[:]) {
+		t.Errorf("FAIL Test 1: %v:\nWant: % x\nActual: % x and % x", description, want, serial, parallel)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+}
+
+// Encoding should compute the same checksum as decoding
+func TestChecksumEncode(t *testing.T) {
+	description := "Encoding should compute the same checksum as decoding"
+	var decoded, encoded []byte
+	a, err := Decode(bytes.NewReader(newChecksumFile(0x69)), nil, WithChecksum(MD5, &decoded))
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	if err := Encode(a, ioutil.Discard, ioutil.Discard, WithChecksum(MD5, &encoded)); err != nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if len(encoded) == 0 || !bytes.Equal(encoded, decoded) {
+		t.Errorf("FAIL Test 1: %v:\nWant: % x\nActual: % x", description, decoded, encoded)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "Encoding samples read on demand should compute the same checksum as decoding"
+	b := a.Clone()
+	b.EncodedSection = io.NewSectionReader(bytes.NewReader(a.EncodedSamples), 0, int64(len(a.EncodedSamples)))
+	encoded = nil
+	if err := Encode(b, ioutil.Discard, ioutil.Discard, WithChecksum(MD5, &encoded)); err != nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if !bytes.Equal(encoded, decoded) {
+		t.Errorf("FAIL Test 2: %v:\nWant: % x\nActual: % x", description, decoded, encoded)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	description = "A read error whilst encoding samples read on demand should result in an error and no checksum"
+	b.EncodedSection = io.NewSectionReader(failingReaderAt{bytes.NewReader(a.EncodedSamples), 4096}, 0, int64(len(a.EncodedSamples)))
+	encoded = nil
+	if err := Encode(b, ioutil.Discard, ioutil.Discard, WithChecksum(MD5, &encoded)); err == nil || encoded != nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: error and no checksum\nActual: %v and % x", description, err, encoded)
+	} else {
+		t.Logf("PASS Test 3: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
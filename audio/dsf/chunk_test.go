@@ -0,0 +1,59 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Decoding the chunks manually should give the same result as binary.Read, and
+// encoding them should give back the original bytes
+func TestChunkDecode(t *testing.T) {
+	description := "Decoding the chunks manually should match binary.Read"
+
+	// DSD chunk
+	var want, actual DsdChunk
+	if err := binary.Read(bytes.NewReader(validDsdChunk), binary.LittleEndian, &want); err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	actual.decode(validDsdChunk)
+	b := make([]byte, dsdChunkSize)
+	actual.encode(b)
+	if actual != want || !bytes.Equal(b, validDsdChunk) {
+		t.Errorf("FAIL Test 1: %v:\nWant: % x\nActual: % x", description, validDsdChunk, b)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	// fmt chunk
+	var wantFmt, actualFmt FmtChunk
+	if err := binary.Read(bytes.NewReader(validFmtChunk), binary.LittleEndian, &wantFmt); err != nil {
+		t.Fatalf("FAIL Test 2: %v:\n%v", description, err.Error())
+	}
+	actualFmt.decode(validFmtChunk)
+	b = make([]byte, fmtChunkSize)
+	actualFmt.encode(b)
+	if actualFmt != wantFmt || !bytes.Equal(b, validFmtChunk) {
+		t.Errorf("FAIL Test 2: %v:\nWant: % x\nActual: % x", description, validFmtChunk, b)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	// data chunk
+	var wantData, actualData DataChunk
+	if err := binary.Read(bytes.NewReader(validDataChunk), binary.LittleEndian, &wantData); err != nil {
+		t.Fatalf("FAIL Test 3: %v:\n%v", description, err.Error())
+	}
+	actualData.decode(validDataChunk)
+	b = make([]byte, dataChunkSize)
+	actualData.encode(b)
+	if actualData != wantData || !bytes.Equal(b, validDataChunk) {
+		t.Errorf("FAIL Test 3: %v:\nWant: % x\nActual: % x", description, validDataChunk, b)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+}
@@ -6,13 +6,20 @@ package dsf
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // DataChunk is the file structure of the data chunk within a DSD stream file,
 // excluding the variable length sample data. See "DSF File Format
 // Specification", v1.01, Sony Corporation. All data is little-endian. This is
-// exported to allow reading with binary.Read.
+// exported to allow reading with binary.Read, although the decoder reads and
+// decodes it manually.
 type DataChunk struct {
 	// data chunk header.
 	// 'd' , 'a' , 't', 'a '.
@@ -25,58 +32,925 @@ type DataChunk struct {
 	// Samples []byte
 }
 
+// DataDetails is the data chunk header with its fields decoded to native
+// values.
+type DataDetails struct {
+	Header string
+	Size   uint64
+}
+
+// Details returns the fields of the data chunk header as native values.
+func (c *DataChunk) Details() DataDetails {
+	return DataDetails{
+		Header: string(c.Header[:]),
+		Size:   binary.LittleEndian.Uint64(c.Size[:]),
+	}
+}
+
 // Header identifying a data chunk within a DSD stream file.
 const dataChunkHeader = "data"
 
 // Size in bytes of a data chunk within a DSD stream file, excluding samples.
 const dataChunkSize = 12
 
-// readDataChunk reads the data chunk and stores the result in d. The audio
-// samples are typically huge (tens or hundreds of MB) and hence are written
-// directly into the audio.Audio in d.
+// Offset in bytes of the data chunk, which usually follows the fmt chunk, but
+// may follow unknown chunks that are skipped unless decoding strictly.
+const dataChunkOffset = fmtChunkOffset + fmtChunkSize
+
+// Offsets in bytes of the fields within a data chunk.
+const (
+	dataHeaderOffset = 0
+	dataSizeOffset   = 4
+)
+
+// decode sets the fields of the chunk from b, which holds the entire chunk
+// excluding the sample data.
+func (c *DataChunk) decode(b []byte) {
+	copy(c.Header[:], b[dataHeaderOffset:])
+	copy(c.Size[:], b[dataSizeOffset:])
+}
+
+// encode writes the fields of the chunk into b, which must hold the entire
+// chunk excluding the sample data.
+func (c *DataChunk) encode(b []byte) {
+	copy(b[dataHeaderOffset:], c.Header[:])
+	copy(b[dataSizeOffset:], c.Size[:])
+}
+
+// Limits on the number and total size in bytes of unknown chunks that will be
+// skipped before the data chunk unless decoding strictly.
+const (
+	maxUnknownChunks = 8
+	maxUnknownSize   = 1 << 20
+)
+
+// readDataChunk reads the data chunk header and stores the result in d. The
+// audio samples are typically huge (tens or hundreds of MB) and hence are not
+// read here, but are left for readSamples to read incrementally.
 func (d *decoder) readDataChunk() error {
-	// Read the chunk excluding the sample data
-	err := binary.Read(d.reader, binary.LittleEndian, &d.data)
+	for {
+		// Read the chunk excluding the sample data
+		b := d.buffer[:dataChunkSize]
+		if n, err := io.ReadFull(d.reader, b); err != nil {
+			return d.shortRead("data", "data chunk", d.dataOffset(), dataChunkSize, uint64(n), err)
+		}
+		d.data.decode(b)
+
+		// Chunk header
+		header := string(d.data.Header[:])
+		switch header {
+		case dataChunkHeader:
+			// This is the expected chunk header
+		case dsdChunkHeader:
+			return fmt.Errorf("data: expected data chunk but found DSD chunk")
+		case fmtChunkHeader:
+			return fmt.Errorf("data: expected data chunk but found fmt chunk")
+		default:
+			// Unknown chunks may be skipped unless decoding strictly
+			err := fmt.Errorf("data: bad chunk header: %q at offset %v\ndata chunk: % x", header, d.dataOffset()+dataHeaderOffset, d.data)
+			if d.strictness < Normal || !isChunkHeader(header) {
+				return err
+			}
+			if err := d.skipUnknownChunk(err); err != nil {
+				return err
+			}
+			continue
+		}
+		break
+	}
+	c := d.data.Details()
+	header := c.Header
+
+	// Size of this chunk
+	size := c.Size
+	d.tailSize = uint64(d.audio.BlockSize)
+	if size != dataChunkSize+d.sampleDataSize {
+		err := d.badDataSize(size)
+		if !d.isUnpaddedSize(size) {
+			return err
+		}
+		err = d.violation(Normal, err, Warning{
+			Field:    "data.Size",
+			Expected: fmt.Sprint(dataChunkSize + d.sampleDataSize),
+			Actual:   fmt.Sprint(size),
+			Message:  "chunk size excludes the padding of the final block",
+		})
+		if err != nil {
+			return err
+		}
+
+		// Only part of the final block for each channel is present
+		final := size - dataChunkSize + d.groupSize() - d.sampleDataSize
+		d.tailSize = final / uint64(d.audio.NumChannels)
+	}
+
+	// The sample data follows immediately
+	d.position = 0
+	d.end = d.sampleDataSize
+
+	// Log the fields of the chunk (only active if debug logging is enabled)
+	if logEnabled(d.logger) {
+		logField(d.logger, "data", "Chunk header", header)
+		logField(d.logger, "data", "Size of this chunk", size)
+	}
+
+	return nil
+}
+
+// selectRange restricts the sample data to be read to the time range selected by
+// WithStart and WithLimit, rounded outwards to whole groups of blocks.
+func (d *decoder) selectRange() error {
+	if d.start == 0 && d.limit == 0 {
+		return nil
+	}
+	if d.start < 0 || d.limit < 0 {
+		return fmt.Errorf("data: bad time range: start %v, limit %v", d.start, d.limit)
+	}
+	groupSize := d.groupSize()
+	if groupSize == 0 || d.audio.BitsPerSample == 0 {
+		return nil
+	}
+
+	// Find the groups of blocks covering the time range
+	blockSamples := uint64(d.audio.BlockSize) * 8 / uint64(d.audio.BitsPerSample)
+	groups := d.sampleDataSize / groupSize
+	first := d.samplesAt(d.start) / blockSamples
+	if first >= groups {
+		return fmt.Errorf("data: start %v is beyond the end of the audio", d.start)
+	}
+	last := groups
+	if d.limit > 0 {
+		end := d.samplesAt(d.start + d.limit)
+		last = (end + blockSamples - 1) / blockSamples
+		if last > groups {
+			last = groups
+		}
+	}
+
+	// Skip to the first group, and stop after the last group
+	if err := d.skipSamples(first * groupSize); err != nil {
+		return err
+	}
+	d.end = last * groupSize
+	if d.sampleCount > last*blockSamples {
+		d.sampleCount = last * blockSamples
+	}
+	d.sampleCount -= first * blockSamples
+	d.audio.SampleCount = d.sampleCount
+
+	return nil
+}
+
+// samplesAt returns the number of samples per channel that occur before time t.
+func (d *decoder) samplesAt(t time.Duration) uint64 {
+	f := uint64(d.audio.SamplingFrequency)
+	return uint64(t/time.Second)*f + uint64(t%time.Second)*f/uint64(time.Second)
+}
+
+// groupSize returns the size in bytes of a group of blocks i.e. one block for
+// each channel.
+func (d *decoder) groupSize() uint64 {
+	return uint64(d.audio.NumChannels) * uint64(d.audio.BlockSize)
+}
+
+// unpaddedSize returns the number of bytes of sample data implied by the fmt
+// chunk if the final block for each channel were not padded to the block size.
+func (d *decoder) unpaddedSize() uint64 {
+	length := d.sampleCount
+	if d.audio.BitsPerSample == 1 {
+		length = length/8 + (length%8+7)/8 // fit up to 8 samples into 1 byte
+	}
+	return length * uint64(d.audio.NumChannels)
+}
+
+// badDataSize returns an error for a data chunk size that does not match the
+// size implied by the fmt chunk. The sizes expected with and without the padding
+// of the final block for each channel are both given, along with which of them
+// the size matches if any, to show whether the sample count in the fmt chunk or
+// the size of the data chunk is wrong.
+func (d *decoder) badDataSize(size uint64) error {
+	padded := dataChunkSize + d.sampleDataSize
+	unpadded := dataChunkSize + d.unpaddedSize()
+	var match string
+	switch {
+	case size == unpadded:
+		match = "matches the size without padding, so the data chunk excludes the padding of the final block"
+	case d.isUnpaddedSize(size):
+		match = "is between the two, so the data chunk excludes part of the padding of the final block"
+	default:
+		match = "matches neither, so either the sample count in the fmt chunk or the size of the data chunk is wrong"
+	}
+	return fmt.Errorf("data: bad chunk size: %v at offset %v: expected %v with the final block padded to %v bytes, or %v without padding, for %v samples per channel, %v channels and %v bits per sample; the size %v",
+		size, d.dataOffset()+dataSizeOffset, padded, d.audio.BlockSize, unpadded,
+		d.sampleCount, d.audio.NumChannels, d.audio.BitsPerSample, match)
+}
+
+// isUnpaddedSize returns whether size is a data chunk size that excludes some
+// or all of the padding of the final block for each channel, but still covers
+// all of the samples.
+func (d *decoder) isUnpaddedSize(size uint64) bool {
+	channels := uint64(d.audio.NumChannels)
+	if channels == 0 || d.audio.BlockSize == 0 || size < dataChunkSize ||
+		size-dataChunkSize >= d.sampleDataSize {
+		return false
+	}
+
+	// Number of bytes of samples in the final block for each channel
+	samples := d.sampleCount
+	if d.audio.BitsPerSample == 1 {
+		samples = samples/8 + (samples%8+7)/8
+	}
+	samples %= uint64(d.audio.BlockSize)
+	if samples == 0 {
+		return false
+	}
+
+	// The final block for each channel must be the same size, and at least
+	// cover the samples
+	if size-dataChunkSize+d.groupSize() < d.sampleDataSize {
+		return false
+	}
+	final := size - dataChunkSize + d.groupSize() - d.sampleDataSize
+	return final%channels == 0 && final/channels >= samples
+}
+
+// skipUnknownChunk skips over an unknown chunk whose header has been read into
+// d.data, as long as the limits on unknown chunks have not been reached. err is
+// the error to return if the unknown chunk cannot be skipped.
+func (d *decoder) skipUnknownChunk(badHeader error) error {
+	c := d.data.Details()
+	header, size := c.Header, c.Size
+	if d.unknownChunks >= maxUnknownChunks || size < dataChunkSize ||
+		d.unknownSize+size > maxUnknownSize {
+		return badHeader
+	}
+
+	// Skip the remainder of the chunk
+	offset := d.dataOffset()
+	n, err := io.CopyN(ioutil.Discard, d.reader, int64(size-dataChunkSize))
+	d.unknownChunks++
+	d.unknownSize += dataChunkSize + uint64(n)
 	if err != nil {
+		return d.shortRead("data", fmt.Sprintf("unknown chunk %q", header), offset, size, dataChunkSize+uint64(n), err)
+	}
+
+	return d.violation(Normal, badHeader, Warning{
+		Field:    "data.Header",
+		Expected: fmt.Sprintf("%q", dataChunkHeader),
+		Actual:   fmt.Sprintf("%q", header),
+		Message:  fmt.Sprintf("skipped unknown chunk of %v bytes", size),
+	})
+}
+
+// isChunkHeader returns whether header is plausibly that of a chunk, i.e. four
+// printable ASCII characters.
+func isChunkHeader(header string) bool {
+	for i := 0; i < len(header); i++ {
+		if header[i] < ' ' || header[i] > '~' {
+			return false
+		}
+	}
+	return len(header) == 4
+}
+
+// readSamples reads up to len(p) bytes of sample data into p. It returns io.EOF
+// once all of the sample data in the data chunk has been read, leaving any
+// subsequent metadata chunk unread.
+func (d *decoder) readSamples(p []byte) (int, error) {
+	if d.position == d.end {
+		return 0, io.EOF
+	}
+
+	// Do not read beyond the end of the data chunk
+	if uint64(len(p)) > d.end-d.position {
+		p = p[:d.end-d.position]
+	}
+
+	// Padding that is not present in the file is filled with zero, otherwise do
+	// not read beyond the next padding that is not present
+	present, missing := d.nextRun()
+	if missing > 0 {
+		if uint64(len(p)) > missing {
+			p = p[:missing]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		d.position += uint64(len(p))
+		return len(p), nil
+	}
+	if uint64(len(p)) > present {
+		p = p[:present]
+	}
+
+	n, err := d.reader.Read(p)
+	d.position += uint64(n)
+	if err == io.EOF && d.position < d.end {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Size in bytes of the pieces in which the sample data is read, between calls
+// to the progress function.
+const progressInterval = 1 << 20
+
+// Minimum size in bytes of the sample data for it to be read in parallel.
+const minParallelSize = 4 << 20
+
+// readAllSamples reads the selected range of the sample data into p, which must
+// be exactly the right size, reporting progress and adding to any checksum
+// after each piece. The sample data is read in parallel if possible.
+func (d *decoder) readAllSamples(p []byte) error {
+	position := d.position
+	if ok, err := d.readSamplesParallel(p); ok {
+		if err == nil {
+			d.hashSamples(p, position)
+		}
 		return err
 	}
 
-	// Chunk header
-	header := string(d.data.Header[:])
-	switch header {
-	case dataChunkHeader:
-		// This is the expected chunk header
-	case dsdChunkHeader:
-		return fmt.Errorf("data: expected data chunk but found DSD chunk")
-	case fmtChunkHeader:
-		return fmt.Errorf("data: expected data chunk but found fmt chunk")
+	for read := 0; ; {
+		n := len(p) - read
+		if n > progressInterval {
+			n = progressInterval
+		}
+		if _, err := io.ReadFull(readerFunc(d.readSamples), p[read:read+n]); err != nil {
+			return d.truncatedSamples(position, err)
+		}
+		d.hashSamples(p[read:read+n], position+uint64(read))
+		read += n
+		if d.progress != nil {
+			d.progress(uint64(read), uint64(len(p)))
+		}
+		if read == len(p) {
+			return nil
+		}
+	}
+}
+
+// readBlockBuffers reads the selected range of the sample data into the
+// EncodedBlocks of the audio.Audio in d, as a sequence of buffers of the size
+// requested by WithBlockBuffers rounded down to whole groups of blocks. The
+// existing buffers are reused if large enough. If the data chunk is truncated
+// the buffers hold whatever was read.
+func (d *decoder) readBlockBuffers() error {
+	start, total := d.position, d.end-d.position
+	if d.memoryLimit > 0 && total > d.memoryLimit {
+		return fmt.Errorf("data: data chunk of %v bytes exceeds limit %v", total, d.memoryLimit)
+	}
+	size := d.blockBuffers
+	if groupSize := d.groupSize(); groupSize > 0 {
+		if size < groupSize {
+			size = groupSize
+		}
+		size -= size % groupSize
+	}
+
+	old := d.audio.EncodedBlocks
+	blocks := old[:0]
+	d.audio.EncodedSamples = nil
+	defer func() { d.audio.EncodedBlocks = blocks }()
+	for d.position < d.end {
+		// Reuse the existing buffer in the same place, if any
+		var reuse []byte
+		if len(blocks) < len(old) {
+			reuse = old[len(blocks)]
+		}
+		n := d.end - d.position
+		if n > size {
+			n = size
+		}
+		buf, err := d.allocate("data", reuse, n)
+		if err != nil {
+			return err
+		}
+
+		// Read the buffer in pieces, between calls to the progress function
+		for read := 0; read < len(buf); {
+			n := len(buf) - read
+			if n > progressInterval {
+				n = progressInterval
+			}
+			position := d.position
+			if _, err := io.ReadFull(readerFunc(d.readSamples), buf[read:read+n]); err != nil {
+				blocks = append(blocks, buf[:read+int(d.position-position)])
+				return d.truncatedSamples(start, err)
+			}
+			d.hashSamples(buf[read:read+n], position)
+			read += n
+			if d.progress != nil {
+				d.progress(d.position-start, total)
+			}
+		}
+		blocks = append(blocks, buf)
+	}
+	return nil
+}
+
+// readSamplesParallel reads the selected range of the sample data into p using
+// several workers calling ReadAt concurrently, if the input is an io.ReaderAt
+// and an io.Seeker. It returns false if the sample data must be read serially
+// instead. The progress function is only called from the calling goroutine.
+func (d *decoder) readSamplesParallel(p []byte) (bool, error) {
+	// Check whether reading in parallel is possible and worthwhile
+	ra, ok := d.reader.(io.ReaderAt)
+	if !ok || d.workers < 2 || len(p) < minParallelSize {
+		return false, nil
+	}
+	s, ok := d.reader.(io.Seeker)
+	if !ok {
+		return false, nil
+	}
+	if present, _ := d.nextRun(); present < uint64(len(p)) {
+		return false, nil
+	}
+	start, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, nil
+	}
+
+	// Read serially if the file is truncated, to find exactly where
+	length, err := s.Seek(0, io.SeekEnd)
+	if _, serr := s.Seek(start, io.SeekStart); serr != nil {
+		return true, serr
+	}
+	if err != nil || length-start < int64(len(p)) {
+		return false, nil
+	}
+
+	// Split the sample data into one range per worker, each read in pieces
+	size := (len(p) + d.workers - 1) / d.workers
+	progress := make(chan int)
+	errs := make(chan error, d.workers)
+	var failed int32
+	var wg sync.WaitGroup
+	for offset := 0; offset < len(p); offset += size {
+		end := offset + size
+		if end > len(p) {
+			end = len(p)
+		}
+		wg.Add(1)
+		go func(part []byte, offset int64) {
+			defer wg.Done()
+			for len(part) > 0 {
+				// Stop if any other worker has failed
+				if atomic.LoadInt32(&failed) != 0 {
+					return
+				}
+				n := len(part)
+				if n > progressInterval {
+					n = progressInterval
+				}
+				m, err := ra.ReadAt(part[:n], offset)
+				if m == n {
+					err = nil
+				} else if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				if err != nil {
+					atomic.StoreInt32(&failed, 1)
+					errs <- err
+					return
+				}
+				progress <- n
+				part = part[n:]
+				offset += int64(n)
+			}
+		}(p[offset:end], start+int64(offset))
+	}
+	go func() {
+		wg.Wait()
+		close(progress)
+	}()
+
+	// Report progress until all of the workers have finished
+	read := 0
+	for n := range progress {
+		read += n
+		if d.progress != nil {
+			d.progress(uint64(read), uint64(len(p)))
+		}
+	}
+	select {
+	case err := <-errs:
+		return true, err
 	default:
-		return fmt.Errorf("data: bad chunk header: %q\ndata chunk: % x", header, d.data)
 	}
 
-	// Size of this chunk
-	size := binary.LittleEndian.Uint64(d.data.Size[:])
-	if size != dataChunkSize+uint64(len(d.audio.EncodedSamples)) {
-		return fmt.Errorf("data: bad chunk size: %v\nfmt chunk: % x\ndata chunk: % x", size, d.fmt, d.data)
+	// Continue from the end of the sample data
+	if _, err := s.Seek(start+int64(len(p)), io.SeekStart); err != nil {
+		return true, err
+	}
+	d.position += uint64(len(p))
+	if d.stats != nil {
+		d.stats.ReaderAt = true
 	}
 
-	// Read the sample data directly into the audio.Audio in d
-	err = binary.Read(d.reader, binary.LittleEndian, &d.audio.EncodedSamples)
+	return true, nil
+}
+
+// referenceSamples sets the EncodedSection of the audio.Audio in d to the
+// selected range of the sample data in the input rather than reading it, if
+// requested by WithLazySamples and the input is an io.ReaderAt and an
+// io.Seeker. It returns false if the sample data must be read instead, which
+// is the case if any of it is missing from the input or a checksum of it is
+// requested.
+func (d *decoder) referenceSamples() (bool, error) {
+	if !d.lazySamples || d.checksum != nil {
+		return false, nil
+	}
+
+	// The section must not collect stats once decoding is complete
+	r := d.reader
+	if d.statsReader != nil {
+		r = d.statsReader.r
+	}
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return false, nil
+	}
+	s, ok := d.reader.(io.Seeker)
+	if !ok {
+		return false, nil
+	}
+	n := d.end - d.position
+	if present, _ := d.nextRun(); present < n {
+		return false, nil
+	}
+	start, err := s.Seek(0, io.SeekCurrent)
 	if err != nil {
+		return false, nil
+	}
+
+	// Read the sample data if the file is truncated, to report exactly where
+	length, err := s.Seek(0, io.SeekEnd)
+	if _, serr := s.Seek(start, io.SeekStart); serr != nil {
+		return true, serr
+	}
+	if err != nil || uint64(length-start) < n {
+		return false, nil
+	}
+
+	d.audio.EncodedSamples = nil
+	d.audio.EncodedBlocks = nil
+	d.audio.EncodedSection = io.NewSectionReader(ra, start, int64(n))
+	return true, d.skipSamples(n)
+}
+
+// skipSamples skips over the next n bytes of sample data, seeking if the input
+// is an io.Seeker rather than reading and discarding.
+func (d *decoder) skipSamples(n uint64) error {
+	end := d.end
+	d.end = d.position + n
+	defer func() {
+		d.end = end
+	}()
+
+	// Seeking is only possible where all of the sample data is present
+	if s, ok := d.reader.(io.Seeker); ok {
+		if present, _ := d.nextRun(); present >= n {
+			if _, err := s.Seek(int64(n), io.SeekCurrent); err != nil {
+				return err
+			}
+			d.position += n
+			if d.stats != nil {
+				d.stats.Seeker = true
+			}
+			return nil
+		}
+	}
+
+	start := d.position
+	if _, err := io.CopyN(ioutil.Discard, readerFunc(d.readSamples), int64(n)); err != nil {
+		return d.truncatedSamples(start, err)
+	}
+	return nil
+}
+
+// truncatedSamples returns an error for a short read of the sample data that
+// began at position start, saying how much of the audio is complete. Errors
+// other than io.EOF and io.ErrUnexpectedEOF are returned unchanged.
+func (d *decoder) truncatedSamples(start uint64, err error) error {
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	offset := d.sampleOffset(start)
+	at := fmt.Sprint(d.sampleOffset(d.position))
+	if d.totalFileSize > 0 {
+		at += fmt.Sprintf(" of %v", d.totalFileSize)
+	}
+	groupSize := d.groupSize()
+	if groupSize == 0 || d.audio.BitsPerSample == 0 || d.audio.SamplingFrequency == 0 {
+		return fmt.Errorf("data: file is truncated at offset %v: expected %v bytes of sample data from offset %v but found %v: %w",
+			at, d.end-start, offset, d.position-start, err)
+	}
+
+	// Only whole groups of blocks are complete
+	blockSamples := uint64(d.audio.BlockSize) * 8 / uint64(d.audio.BitsPerSample)
+	total := d.fmt.Details().SampleCount
+	complete := d.position / groupSize * blockSamples
+	if complete > total {
+		complete = total
+	}
+	return fmt.Errorf("data: file is truncated at offset %v: expected %v bytes of sample data from offset %v but found %v, so %v of %v blocks per channel (%v of %v) are complete: %w",
+		at, d.end-start, offset, d.position-start, d.position/groupSize, d.sampleDataSize/groupSize,
+		d.durationOf(complete), d.durationOf(total), err)
+}
+
+// recoverSamples keeps the whole groups of blocks of sample data that were read
+// into the audio.Audio in d before err, if requested by WithRecovery and err
+// is because the data chunk is truncated. Otherwise err is returned unchanged.
+func (d *decoder) recoverSamples(err error) error {
+	groupSize := d.groupSize()
+	if !d.recovery || !errors.Is(err, io.ErrUnexpectedEOF) || groupSize == 0 || d.audio.BitsPerSample == 0 {
+		return err
+	}
+
+	// The sample data read so far starts at a group, as does any range selected
+	read := uint64(len(d.audio.EncodedSamples)) - (d.end - d.position)
+	if d.audio.EncodedBlocks != nil {
+		read = d.audio.EncodedSize()
+	}
+	length := read + d.end - d.position
+	groups := read / groupSize
+	blockSamples := uint64(d.audio.BlockSize) * 8 / uint64(d.audio.BitsPerSample)
+	samples := groups * blockSamples
+	if samples > d.sampleCount {
+		samples = d.sampleCount
+	}
+	if d.audio.EncodedBlocks != nil {
+		d.audio.EncodedBlocks = truncateBlocks(d.audio.EncodedBlocks, groups*groupSize)
+	} else {
+		d.audio.EncodedSamples = d.audio.EncodedSamples[:groups*groupSize]
+	}
+	d.audio.SampleCount = samples
+	d.recovered = true
+	return fmt.Errorf("%w; recovered %v of %v blocks per channel, %v samples per channel (%v)",
+		err, groups, length/groupSize, samples, d.durationOf(samples))
+}
+
+// truncateBlocks returns blocks cut down to hold only the first n bytes.
+func truncateBlocks(blocks [][]byte, n uint64) [][]byte {
+	for i, b := range blocks {
+		if n <= uint64(len(b)) {
+			if n == 0 {
+				return blocks[:i]
+			}
+			blocks[i] = b[:n]
+			return blocks[:i+1]
+		}
+		n -= uint64(len(b))
+	}
+	return blocks
+}
+
+// dataOffset returns the offset from the start of the file of the data chunk,
+// which follows the fmt chunk including any extension and any unknown chunks.
+func (d *decoder) dataOffset() uint64 {
+	return dataChunkOffset + uint64(len(d.fmtExtension)) + d.unknownSize
+}
+
+// sampleOffset returns the offset from the start of the file of the given
+// position within the sample data.
+func (d *decoder) sampleOffset(position uint64) uint64 {
+	return d.dataOffset() + dataChunkSize + position
+}
+
+// durationOf returns the duration of the given number of samples per channel,
+// rounded to the nearest millisecond.
+func (d *decoder) durationOf(samples uint64) time.Duration {
+	f := uint64(d.audio.SamplingFrequency)
+	t := time.Duration(samples/f)*time.Second + time.Duration(samples%f)*time.Second/time.Duration(f)
+	return t.Round(time.Millisecond)
+}
+
+// readerFunc adapts a function such as decoder.readSamples to an io.Reader.
+type readerFunc func(p []byte) (int, error)
+
+// Read calls f(p).
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// nextRun returns the number of bytes of sample data that are present in the
+// file from the current position up to the next padding that is not present,
+// or if the current position is within such padding, the number of bytes of it
+// that remain.
+func (d *decoder) nextRun() (present, missing uint64) {
+	blockSize := uint64(d.audio.BlockSize)
+	if d.tailSize == blockSize {
+		return d.sampleDataSize - d.position, 0
+	}
+
+	// Only the final group of blocks is affected
+	final := d.sampleDataSize - d.groupSize()
+	if d.position < final {
+		return final - d.position + d.tailSize, 0
+	}
+	offset := (d.position - final) % blockSize
+	if offset < d.tailSize {
+		return d.tailSize - offset, 0
+	}
+	return 0, blockSize - offset
+}
+
+// logSamples logs the first few bytes of sample data read from the data chunk.
+func (d *decoder) logSamples() {
+	samples := d.audio.EncodedSamples
+	if len(d.audio.EncodedBlocks) > 0 {
+		samples = d.audio.EncodedBlocks[0]
+	}
+
+	// Log the sample data (only active if debug logging is enabled)
+	if len(samples) > 0 && logEnabled(d.logger) {
+		n := len(samples)
+		if n > 20 {
+			n = 20
+		}
+		logField(d.logger, "data", "Sample data", samples[:n])
+	}
+}
+
+// writeDataChunk writes the data chunk, including the sample data. The sample
+// data is written in pieces rather than in one go, so that the output is not
+// asked to buffer it all at once.
+func (e *encoder) writeDataChunk() error {
+	if err := e.writeDataHeader(); err != nil {
 		return err
 	}
 
-	// Log the fields of the chunk (only active if a log output has been set)
-	d.logger.Print("\nData Chunk\n==========\n")
-	d.logger.Printf("Chunk header:              %q\n", header)
-	d.logger.Printf("Size of this chunk:        %v\n", size)
-	if len(d.audio.EncodedSamples) > 0 {
-		n := len(d.audio.EncodedSamples)
+	// Write the sample data, from whichever buffers hold it, or as it is read,
+	// checksumming it as it is written
+	var position uint64
+	if e.audio.EncodedSection != nil {
+		err := e.readSection(func(p []byte) error {
+			if position == 0 {
+				e.logSamples(p)
+			}
+			e.hashSamples(p, position)
+			position += uint64(len(p))
+			return e.writeSamples(p)
+		})
+		if err != nil {
+			return err
+		}
+		return e.writePadding()
+	}
+	samples := e.audio.EncodedSamples
+	if len(e.audio.EncodedBlocks) > 0 {
+		samples = e.audio.EncodedBlocks[0]
+	}
+	e.logSamples(samples)
+	if e.audio.EncodedBlocks == nil {
+		e.hashSamples(e.audio.EncodedSamples, 0)
+		if err := e.writeSamples(e.audio.EncodedSamples); err != nil {
+			return err
+		}
+	}
+	for _, p := range e.audio.EncodedBlocks {
+		e.hashSamples(p, position)
+		position += uint64(len(p))
+		if err := e.writeSamples(p); err != nil {
+			return err
+		}
+	}
+
+	return e.writePadding()
+}
+
+// readSection reads the sample data held in the EncodedSection of the
+// audio.Audio in e a piece at a time through the scratch buffer, and calls fn
+// with each piece in turn.
+func (e *encoder) readSection(fn func(p []byte) error) error {
+	size := int(min(e.audio.EncodedSize(), progressInterval))
+	if size == 0 {
+		return nil
+	}
+	if cap(e.scratch) < size {
+		e.scratch = make([]byte, size)
+	}
+	buf := e.scratch[:size]
+	r := e.audio.SamplesReader()
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := fn(buf[:n]); err != nil {
+				return err
+			}
+		}
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return nil
+		case err != nil:
+			return err
+		}
+	}
+}
+
+// checkSampleData checks that the sample data in the audio.Audio in e includes
+// all or none of the padding when encoding strictly. Otherwise it may include
+// any of the padding, as audio.Audio.Validate has already checked that it
+// reaches the final sample of the last channel and does not extend beyond the
+// final block for each channel.
+func (e *encoder) checkSampleData() error {
+	a := e.audio
+	if a.SampleCount == 0 || a.NumChannels == 0 || (a.BitsPerSample != 1 && a.BitsPerSample != 8) {
+		return nil
+	}
+
+	// Number of bytes of samples for each channel, and the sizes of the sample
+	// data with and without the padding of the final block for each channel
+	sampleBytes := a.SampleCount
+	if a.BitsPerSample == 1 {
+		sampleBytes = sampleBytes/8 + (sampleBytes%8+7)/8 // up to 8 samples per byte
+	}
+	blockSize := uint64(e.blockSize())
+	blocks := (sampleBytes + blockSize - 1) / blockSize
+	padded := blocks * uint64(a.NumChannels) * blockSize
+	unpadded := padded - (blocks*blockSize - sampleBytes)
+
+	if size := e.sampleDataSize; e.strictness < Normal && size != unpadded && size != padded {
+		return fmt.Errorf("data: %v bytes of sample data is part padded, expected %v without the padding or %v with it", size, unpadded, padded)
+	}
+	return nil
+}
+
+// prepareDataHeader sets the fields of the data chunk excluding the sample
+// data, ready to be written.
+func (e *encoder) prepareDataHeader() {
+	// Chunk header
+	header := dataChunkHeader
+	copy(e.data.Header[:], header)
+
+	// Size of this chunk, including the padding of the final block for each
+	// channel
+	size := e.layout.DataChunkSize
+	binary.LittleEndian.PutUint64(e.data.Size[:], size)
+
+	// Log the fields of the chunk (only active if debug logging is enabled)
+	if logEnabled(e.logger) {
+		logField(e.logger, "data", "Chunk header", header)
+		logField(e.logger, "data", "Size of this chunk", size)
+	}
+}
+
+// writeDataHeader writes the data chunk excluding the sample data, which must
+// already be prepared.
+func (e *encoder) writeDataHeader() error {
+	// Write the chunk excluding the sample data in one go
+	var b [dataChunkSize]byte
+	e.data.encode(b[:])
+	return e.write(b[:])
+}
+
+// logSamples logs the first few bytes of sample data written to the data chunk,
+// as the decoder does when reading it.
+func (e *encoder) logSamples(samples []byte) {
+	// Log the sample data (only active if debug logging is enabled)
+	if len(samples) > 0 && logEnabled(e.logger) {
+		n := len(samples)
 		if n > 20 {
 			n = 20
 		}
-		d.logger.Printf("Sample data:               % x...\n", d.audio.EncodedSamples[:n])
+		logField(e.logger, "data", "Sample data", samples[:n])
+	}
+}
+
+// writePadding writes the padding that follows the sample data. Audio samples
+// should complete the final block for every channel, so they are padded with
+// the byte given by WithPadByte, written separately to leave the audio.Audio
+// untouched.
+func (e *encoder) writePadding() error {
+	n := e.paddedSize() - e.sampleDataSize
+	if n > 0 {
+		e.logger.Debug("padding the audio samples", "bytes", n)
 	}
+	return e.writeRepeated(e.padByte, n)
+}
 
+// writeSamples writes p in pieces of at most progressInterval bytes, between
+// calls to the progress function and checks of the context, if any.
+func (e *encoder) writeSamples(p []byte) error {
+	for len(p) > 0 {
+		n := len(p)
+		if n > progressInterval {
+			n = progressInterval
+		}
+		if err := e.canceled(); err != nil {
+			return err
+		}
+		if err := e.write(p[:n]); err != nil {
+			return err
+		}
+		e.reportProgress()
+		p = p[n:]
+	}
 	return nil
 }
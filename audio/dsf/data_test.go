@@ -6,10 +6,14 @@ package dsf
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/snmoore/go/audio"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -50,9 +54,9 @@ func TestDataRead(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Run each test
@@ -97,18 +101,18 @@ func TestDataReadError(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Read an empty chunk to force a read error
 	d.reader = bytes.NewReader([]byte{})
 	err := d.readDataChunk()
 
-	// Reading the chunk should have thrown an error
-	if err == nil {
-		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", len(dataChunkTests)+1, description)
+	// Reading the chunk should have thrown an error wrapping io.ErrUnexpectedEOF
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", len(dataChunkTests)+1, description, io.ErrUnexpectedEOF, err)
 	} else {
 		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", len(dataChunkTests)+1, description, err.Error())
 	}
@@ -124,9 +128,9 @@ func TestDataReadInsufficientSamples(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Start with a valid chunk
@@ -135,11 +139,15 @@ func TestDataReadInsufficientSamples(t *testing.T) {
 
 	// Expect 4096 bytes of sample data, but do not actually provide them
 	copy(c[4:], []byte{0x0C, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	d.sampleDataSize = 4096
 	d.audio.EncodedSamples = make([]byte, 4096)
 
 	// Reading the chunk should throw an error
 	d.reader = bytes.NewReader(c)
 	err := d.readDataChunk()
+	if err == nil {
+		_, err = io.ReadFull(readerFunc(d.readSamples), d.audio.EncodedSamples)
+	}
 	if err == nil {
 		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", len(dataChunkTests)+2, description)
 	} else {
@@ -163,9 +171,9 @@ func TestDataReadSamples(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Start with a valid chunk
@@ -178,11 +186,15 @@ func TestDataReadSamples(t *testing.T) {
 
 	// Prepare the decoder to expect 4096 bytes of sample data
 	// This is normally done when reading a fmt chunk, omitted in this test
+	d.sampleDataSize = 4096
 	d.audio.EncodedSamples = make([]byte, 4096)
 
 	// Reading the chunk should not throw an error
 	d.reader = bytes.NewReader(c)
 	err := d.readDataChunk()
+	if err == nil {
+		_, err = io.ReadFull(readerFunc(d.readSamples), d.audio.EncodedSamples)
+	}
 	if err != nil {
 		t.Fatalf("FAIL Test %v: %v:\nWant: nil\nActual: %v", len(dataChunkTests)+3, description, err.Error())
 	} else {
@@ -197,3 +209,482 @@ func TestDataReadSamples(t *testing.T) {
 		}
 	}
 }
+
+// An unknown chunk before the data chunk should result in an error, or be
+// skipped when decoding in lenient mode
+func TestDataSkipUnknownChunk(t *testing.T) {
+	description := "An unknown chunk before the data chunk should result in an error, or be skipped when decoding in lenient mode"
+
+	// Read the whole DSD stream file into memory
+	b, err := ioutil.ReadFile("test/valid_without_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+
+	// Insert a 20 byte "junk" chunk between the fmt and data chunks
+	junk := []byte{
+		'j', 'u', 'n', 'k',
+		0x14, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	}
+	c := append(append(append([]byte{}, b[:80]...), junk...), b[80:]...)
+	c[12] += byte(len(junk))
+
+	// Decoding strictly should result in an error
+	_, err = Decode(bytes.NewReader(c), nil, WithStrictness(Strict))
+	if err == nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 1: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	// Decoding in lenient mode should skip the unknown chunk with a warning
+	var warnings []Warning
+	a, err := Decode(bytes.NewReader(c), nil, WithLenient(), WithWarnings(&warnings))
+	if err != nil {
+		t.Fatalf("FAIL Test 2: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	if len(warnings) != 1 || warnings[0].Field != "data.Header" || !bytes.Equal(a.EncodedSamples, b[92:]) {
+		t.Errorf("FAIL Test 2: %v:\nWant: 1 warning and the sample data\nActual: %v", description, warnings)
+	} else {
+		t.Logf("PASS Test 2: %v:\nWant: 1 warning\nActual: %v", description, warnings)
+	}
+
+	// Too many unknown chunks should result in an error even in lenient mode
+	c = append([]byte{}, b[:80]...)
+	for i := 0; i <= maxUnknownChunks; i++ {
+		c = append(c, junk...)
+	}
+	c = append(c, b[80:]...)
+	binary.LittleEndian.PutUint64(c[12:], uint64(len(c)))
+	_, err = Decode(bytes.NewReader(c), nil, WithLenient())
+	if err == nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 3: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// newTestFile returns a DSD stream file containing the given sample data and
+// metadata, with the given channel type and number, sample count and data chunk
+// size. The other fields are as per the valid test chunks.
+func newTestFile(channelType, channelNum uint32, sampleCount uint64, dataSize uint64, samples, metadata []byte) []byte {
+	// DSD chunk
+	c := make([]byte, len(validDsdChunk))
+	copy(c, validDsdChunk)
+	total := uint64(len(validDsdChunk)+len(validFmtChunk)+len(validDataChunk)+len(samples)) + uint64(len(metadata))
+	binary.LittleEndian.PutUint64(c[12:], total)
+	if len(metadata) > 0 {
+		binary.LittleEndian.PutUint64(c[20:], total-uint64(len(metadata)))
+	}
+
+	// fmt chunk
+	f := make([]byte, len(validFmtChunk))
+	copy(f, validFmtChunk)
+	binary.LittleEndian.PutUint32(f[20:], channelType)
+	binary.LittleEndian.PutUint32(f[24:], channelNum)
+	binary.LittleEndian.PutUint64(f[36:], sampleCount)
+	c = append(c, f...)
+
+	// data chunk
+	c = append(c, validDataChunk...)
+	binary.LittleEndian.PutUint64(c[len(c)-8:], dataChunkSize+dataSize)
+	c = append(c, samples...)
+
+	// Metadata chunk
+	return append(c, metadata...)
+}
+
+// Table structure for a single data chunk size test
+type dataSizeTest struct {
+	// Description for the test
+	description string
+	// Sample data to be placed in the data chunk
+	samples []byte
+	// Is lenient mode enabled?
+	lenient bool
+	// Is an error expected to be thrown?
+	expectError bool
+}
+
+// Table driven data chunk size tests, for stereo with 10 bytes of samples
+// followed by padding for each channel
+var dataSizeTests = []dataSizeTest{
+	{"Reading a data chunk that includes the padding should not result in an error", stereoSamples(4096), false, false},
+	{"Reading a data chunk that includes the padding in lenient mode should not result in an error", stereoSamples(4096), true, false},
+	{"Reading a data chunk that excludes the padding should result in an error", stereoSamples(10), false, true},
+	{"Reading a data chunk that excludes the padding in lenient mode should not result in an error", stereoSamples(10), true, false},
+	{"Reading a data chunk that excludes some of the padding in lenient mode should not result in an error", stereoSamples(100), true, false},
+	{"Reading a data chunk that excludes some of the samples in lenient mode should result in an error", stereoSamples(9), true, true},
+	{"Reading a data chunk that has an uneven final block in lenient mode should result in an error", stereoSamples(10)[:19], true, true},
+}
+
+// stereoSamples returns the sample data for stereo with 10 bytes of samples for
+// each channel, with the final block for each channel of the given size.
+func stereoSamples(finalBlockSize int) []byte {
+	var samples []byte
+	for _, b := range []byte{0x11, 0x22} {
+		block := make([]byte, finalBlockSize)
+		for i := 0; i < 10 && i < finalBlockSize; i++ {
+			block[i] = b
+		}
+		samples = append(samples, block...)
+	}
+	return samples
+}
+
+// Run the table driven tests
+func TestDataReadSize(t *testing.T) {
+	// All tests should read the same padded sample data
+	want := stereoSamples(4096)
+
+	// Run each test
+	for i, test := range dataSizeTests {
+		// Read and decode the DSD stream file
+		c := newTestFile(2, 2, 80, uint64(len(test.samples)), test.samples, nil)
+		opts := []Option{WithStrictness(Strict)}
+		if test.lenient {
+			opts = append(opts, WithLenient())
+		}
+		a, err := Decode(bytes.NewReader(c), nil, opts...)
+
+		// Check the result from reading the chunk
+		if test.expectError {
+			// Reading the chunk should have thrown an error
+			if err == nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", i+1, test.description)
+			} else {
+				t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+			}
+		} else {
+			// Reading the chunk should not have thrown an error, and should have
+			// read the padded sample data
+			if err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			} else if !bytes.Equal(a.EncodedSamples, want) {
+				t.Errorf("FAIL Test %v: %v:\nIncorrect sample data", i+1, test.description)
+			} else {
+				t.Logf("PASS Test %v: %v:\nWant: nil\nActual: nil", i+1, test.description)
+			}
+		}
+	}
+}
+
+// Table structure for a single data chunk size diagnostics test
+type dataSizeDiagnosticsTest struct {
+	// Description for the test
+	description string
+	// Size of the sample data declared by the data chunk
+	dataSize uint64
+	// Expected part of the error when decoding strictly, or empty if none
+	match string
+	// Is the size tolerated when not decoding strictly?
+	tolerated bool
+}
+
+// Table of data chunk size diagnostics tests, for stereo with 10 bytes of
+// samples for each channel, so 8192 bytes with padding and 20 bytes without
+var dataSizeDiagnosticsTests = []dataSizeDiagnosticsTest{
+	{"A data chunk size that matches the padded size should be accepted",
+		8192, "", true},
+	{"A data chunk size that matches the unpadded size should be diagnosed as excluding the padding",
+		20, "matches the size without padding", true},
+	{"A data chunk size between the unpadded and padded sizes should be diagnosed as excluding part of the padding",
+		200, "is between the two", true},
+	{"A data chunk size that matches neither should be diagnosed as such",
+		8194, "matches neither", false},
+	{"A data chunk size smaller than the samples should be diagnosed as matching neither",
+		10, "matches neither", false},
+}
+
+// Run all data chunk size diagnostics tests
+func TestDataSizeDiagnostics(t *testing.T) {
+	for i, test := range dataSizeDiagnosticsTests {
+		samples := make([]byte, test.dataSize)
+		c := newTestFile(2, 2, 80, test.dataSize, samples, nil)
+
+		// Decoding strictly the error should give all three sizes and which
+		// one matches, once the total file size allows for the padding
+		strict := append([]byte{}, c...)
+		binary.LittleEndian.PutUint64(strict[12:], dsdChunkSize+fmtChunkSize+dataChunkSize+8192)
+		_, err := Decode(bytes.NewReader(strict), nil, WithStrictness(Strict))
+		switch {
+		case test.match == "" && err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case test.match == "":
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		case err == nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", i+1, test.description)
+		case !strings.Contains(err.Error(), fmt.Sprintf("bad chunk size: %v at offset 84: expected 8204 with the final block padded to 4096 bytes, or 32 without padding", dataChunkSize+test.dataSize)) ||
+			!strings.Contains(err.Error(), test.match):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.match, err.Error())
+		default:
+			t.Logf("PASS Test %v: %v:\n%v", i+1, test.description, err.Error())
+		}
+
+		// Otherwise the size should be tolerated if it covers the samples
+		var warnings []Warning
+		_, err = Decode(bytes.NewReader(c), nil, WithWarnings(&warnings))
+		if test.tolerated != (err == nil) {
+			t.Errorf("FAIL Test %v: %v when not decoding strictly:\nWant: tolerated %v\nActual: %v", i+1, test.description, test.tolerated, err)
+		} else if test.match != "" && test.tolerated && (len(warnings) == 0 || warnings[len(warnings)-1].Field != "data.Size") {
+			t.Errorf("FAIL Test %v: %v when not decoding strictly:\nWant: data.Size warning\nActual: %v", i+1, test.description, warnings)
+		} else {
+			t.Logf("PASS Test %v: %v when not decoding strictly", i+1, test.description)
+		}
+	}
+}
+
+// The whole groups of blocks read from a truncated data chunk should be
+// recovered if requested
+func TestRecovery(t *testing.T) {
+	// Stereo with 640 blocks per channel, truncated within the 4th group of
+	// blocks
+	c := newParallelFile()
+	samples := c[92:]
+	truncated := c[:92+3*8192+100]
+	want := "recovered 3 of 640 blocks per channel, 98304 samples per channel (35ms)"
+
+	decoders := []struct {
+		name   string
+		decode func(b []byte, opts ...Option) (*audio.Audio, error)
+	}{
+		{"Decode", func(b []byte, opts ...Option) (*audio.Audio, error) {
+			return Decode(bytes.NewReader(b), nil, opts...)
+		}},
+		{"DecodeBytes", func(b []byte, opts ...Option) (*audio.Audio, error) {
+			return DecodeBytes(b, opts...)
+		}},
+		{"DecodeWithDetails", func(b []byte, opts ...Option) (*audio.Audio, error) {
+			result, err := DecodeWithDetails(bytes.NewReader(b), nil, opts...)
+			if result == nil {
+				return nil, err
+			}
+			return result.Audio, err
+		}},
+		{"Decoder", func(b []byte, opts ...Option) (*audio.Audio, error) {
+			return NewDecoder(opts...).Decode(bytes.NewReader(b))
+		}},
+		{"DecodeFile", func(b []byte, opts ...Option) (*audio.Audio, error) {
+			name := t.TempDir() + "/truncated.dsf"
+			if err := ioutil.WriteFile(name, b, 0644); err != nil {
+				return nil, err
+			}
+			return DecodeFile(name, opts...)
+		}},
+	}
+	for i, decoder := range decoders {
+		description := fmt.Sprintf("The complete groups of blocks should be recovered (%v)", decoder.name)
+		a, err := decoder.decode(truncated, WithRecovery(), WithWorkers(4))
+		switch {
+		case !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), want):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, description, want, err)
+		case a == nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: audio\nActual: nil", i+1, description)
+		case !bytes.Equal(a.EncodedSamples, samples[:3*8192]) || a.SampleCount != 3*4096*8:
+			t.Errorf("FAIL Test %v: %v:\nWant: %v bytes and %v samples\nActual: %v bytes and %v samples", i+1, description, 3*8192, 3*4096*8, len(a.EncodedSamples), a.SampleCount)
+		default:
+			t.Logf("PASS Test %v: %v:\n%v", i+1, description, err.Error())
+		}
+		if a != nil {
+			Release(a)
+		}
+
+		description = fmt.Sprintf("Nothing should be recovered by default (%v)", decoder.name)
+		if a, err := decoder.decode(truncated); a != nil || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil and an error\nActual: %v and %v", i+1, description, a, err)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+
+	description := "Nothing should be recovered when truncated before the sample data"
+	if a, err := Decode(bytes.NewReader(c[:85]), nil, WithRecovery()); a != nil || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("FAIL Test %v: %v:\nWant: nil and an error\nActual: %v and %v", len(decoders)+1, description, a, err)
+	} else {
+		t.Logf("PASS Test %v: %v", len(decoders)+1, description)
+	}
+
+	description = "No complete groups of blocks should recover empty audio"
+	a, err := Decode(bytes.NewReader(c[:92+8000]), nil, WithRecovery())
+	if a == nil || len(a.EncodedSamples) != 0 || a.SampleCount != 0 || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("FAIL Test %v: %v:\nWant: empty audio and an error\nActual: %v and %v", len(decoders)+2, description, a, err)
+	} else {
+		t.Logf("PASS Test %v: %v", len(decoders)+2, description)
+	}
+}
+
+// Table structure for a single block buffers test
+type blockBuffersTest struct {
+	// Description for the test
+	description string
+	// Size hint given to WithBlockBuffers
+	sizeHint int
+	// Expected length of each buffer
+	lengths []int
+}
+
+// Table of all block buffers tests, using a file with 5 MiB of sample data in
+// groups of 8 KiB
+var blockBuffersTests = []blockBuffersTest{
+	{"The sample data should be read into buffers of the size given", 1 << 20, []int{1 << 20, 1 << 20, 1 << 20, 1 << 20, 1 << 20}},
+	{"The size of each buffer should be rounded down to whole groups of blocks", 3*8192 + 100, nil},
+	{"The size of each buffer should be at least one group of blocks", 100, nil},
+	{"The default size of each buffer should be used for a size hint of 0", 0, []int{DefaultBlockBufferSize, 1 << 20}},
+}
+
+// Run all block buffers tests, checking that the sample data, checksum and
+// progress are the same as when reading into one buffer, and that Encode
+// accepts either
+func TestBlockBuffers(t *testing.T) {
+	c := newParallelFile()
+	samples := c[92 : 92+2*640*4096]
+	var want []byte
+	a, err := Decode(bytes.NewReader(c), nil, WithChecksum(MD5, &want))
+	if err != nil {
+		t.Fatalf("FAIL Test 1: Decoding into one buffer:\n%v", err.Error())
+	}
+	var encoded bytes.Buffer
+	if err := Encode(a, &encoded, nil); err != nil {
+		t.Fatalf("FAIL Test 1: Encoding from one buffer:\n%v", err.Error())
+	}
+
+	for i, test := range blockBuffersTests {
+		// Buffers of whole groups of blocks, except for the final buffer
+		lengths := test.lengths
+		if lengths == nil {
+			size := 8192
+			if test.sizeHint > size {
+				size = test.sizeHint - test.sizeHint%8192
+			}
+			for n := len(samples); n > 0; n -= size {
+				lengths = append(lengths, min(n, size))
+			}
+		}
+
+		var sum []byte
+		var progress [2]uint64
+		a, err := Decode(bytes.NewReader(c), nil, WithBlockBuffers(test.sizeHint), WithChecksum(MD5, &sum),
+			WithProgress(func(read, total uint64) { progress = [2]uint64{read, total} }))
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+		actual := make([]int, len(a.EncodedBlocks))
+		for j, b := range a.EncodedBlocks {
+			actual[j] = len(b)
+		}
+		switch {
+		case a.EncodedSamples != nil || fmt.Sprint(actual) != fmt.Sprint(lengths):
+			t.Errorf("FAIL Test %v: %v:\nWant: buffers of %v bytes\nActual: %v bytes and buffers of %v bytes", i+1, test.description, lengths, len(a.EncodedSamples), actual)
+		case !bytes.Equal(bytes.Join(a.EncodedBlocks, nil), samples) || len(a.Metadata) != 11:
+			t.Errorf("FAIL Test %v: %v:\nWant: the same sample data and metadata\nActual: different", i+1, test.description)
+		case !bytes.Equal(sum, want) || progress != [2]uint64{uint64(len(samples)), uint64(len(samples))}:
+			t.Errorf("FAIL Test %v: %v:\nWant: checksum % x and progress %v\nActual: checksum % x and progress %v", i+1, test.description, want, len(samples), sum, progress)
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+
+		description := fmt.Sprintf("Encoding from buffers of %v bytes should match encoding from one buffer", lengths[0])
+		var b bytes.Buffer
+		var encodedSum []byte
+		if err := Encode(a, &b, nil, WithChecksum(MD5, &encodedSum)); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		} else if !bytes.Equal(b.Bytes(), encoded.Bytes()) || !bytes.Equal(encodedSum, want) {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x, checksum % x\nActual: % x, checksum % x", i+1, description, encoded.Bytes(), want, b.Bytes(), encodedSum)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+
+	description := "Decoding into the same Audio again should reuse its buffers"
+	a = new(audio.Audio)
+	if err := DecodeInto(bytes.NewReader(c), a, WithBlockBuffers(1<<20)); err != nil {
+		t.Fatalf("FAIL Test %v: %v:\n%v", len(blockBuffersTests)+1, description, err.Error())
+	}
+	first := &a.EncodedBlocks[0][0]
+	if err := DecodeInto(bytes.NewReader(c), a, WithBlockBuffers(1<<20)); err != nil || &a.EncodedBlocks[0][0] != first {
+		t.Errorf("FAIL Test %v: %v:\nWant: the same buffers\nActual: different buffers, %v", len(blockBuffersTests)+1, description, err)
+	} else {
+		t.Logf("PASS Test %v: %v", len(blockBuffersTests)+1, description)
+	}
+
+	description = "Decoding into the same Audio without the option should clear its buffers"
+	if err := DecodeInto(bytes.NewReader(c), a); err != nil || a.EncodedBlocks != nil || !bytes.Equal(a.EncodedSamples, samples) {
+		t.Errorf("FAIL Test %v: %v:\nWant: only EncodedSamples\nActual: %v buffers, %v", len(blockBuffersTests)+2, description, len(a.EncodedBlocks), err)
+	} else {
+		t.Logf("PASS Test %v: %v", len(blockBuffersTests)+2, description)
+	}
+
+	description = "The memory limit should apply to the buffers in total"
+	if _, err := Decode(bytes.NewReader(c), nil, WithBlockBuffers(1<<20), WithMemoryLimit(2<<20)); err == nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", len(blockBuffersTests)+3, description)
+	} else {
+		t.Logf("PASS Test %v: %v:\n%v", len(blockBuffersTests)+3, description, err.Error())
+	}
+
+	description = "The complete groups of blocks should be recovered from the buffers"
+	a, err = Decode(bytes.NewReader(c[:92+3*8192+100]), nil, WithBlockBuffers(2*8192), WithRecovery())
+	switch {
+	case !errors.Is(err, io.ErrUnexpectedEOF) || !strings.Contains(err.Error(), "recovered 3 of 640 blocks per channel"):
+		t.Errorf("FAIL Test %v: %v:\nWant: an error stating 3 blocks were recovered\nActual: %v", len(blockBuffersTests)+4, description, err)
+	case a == nil:
+		t.Errorf("FAIL Test %v: %v:\nWant: audio\nActual: nil", len(blockBuffersTests)+4, description)
+	case len(a.EncodedBlocks) != 2 || !bytes.Equal(bytes.Join(a.EncodedBlocks, nil), samples[:3*8192]) || a.SampleCount != 3*4096*8:
+		t.Errorf("FAIL Test %v: %v:\nWant: 2 buffers of %v bytes and %v samples\nActual: %v buffers of %v bytes and %v samples", len(blockBuffersTests)+4, description, 3*8192, 3*4096*8, len(a.EncodedBlocks), a.EncodedSize(), a.SampleCount)
+	default:
+		t.Logf("PASS Test %v: %v:\n%v", len(blockBuffersTests)+4, description, err.Error())
+	}
+}
+
+// Table structure for a single sample data size test
+type sampleDataSizeTest struct {
+	// Description for the test
+	description string
+	// Bits per sample, sample count and size of the sample data, for stereo
+	// in blocks of 4096 bytes
+	bitsPerSample uint
+	sampleCount   uint64
+	size          int
+	// Strictness to encode with
+	strictness Strictness
+	// Is an error expected to be thrown?
+	expectError bool
+}
+
+// Table of all sample data size tests, where 4196 bytes of samples for each
+// channel need 12388 bytes of sample data without the padding and 16384 with it
+var sampleDataSizeTests = []sampleDataSizeTest{
+	{"Sample data without the padding should be encoded", 1, 4196 * 8, 12388, Normal, false},
+	{"Sample data with the padding should be encoded", 1, 4196 * 8, 16384, Normal, false},
+	{"Sample data with part of the padding should be encoded", 1, 4196 * 8, 14000, Normal, false},
+	{"Sample data with part of the padding should result in an error when strict", 1, 4196 * 8, 14000, Strict, true},
+	{"Sample data with the padding should be encoded when strict", 1, 4196 * 8, 16384, Strict, false},
+	{"Sample data whose final byte is part used should be encoded", 1, 4196*8 - 7, 12388, Normal, false},
+	{"Sample data short of the final sample should result in an error", 1, 4196 * 8, 12387, Normal, true},
+	{"Sample data beyond the padding should result in an error", 1, 4196 * 8, 16385, Normal, true},
+	{"Sample data of an extra block for each channel should result in an error", 1, 4196 * 8, 24576, Normal, true},
+	{"Sample data of less than one block for each channel should result in an error", 1, 4196 * 8, 4096, Normal, true},
+	{"8-bit sample data without the padding should be encoded", 8, 4196, 12388, Normal, false},
+	{"8-bit sample data short of the final sample should result in an error", 8, 4196, 12387, Normal, true},
+	{"Sample data of any size should be encoded without a sample count", 1, 0, 12387, Normal, false},
+}
+
+// Run all sample data size tests, checking that nothing is written on error
+func TestEncodeSampleDataSize(t *testing.T) {
+	for i, test := range sampleDataSizeTests {
+		a := audio.Audio{Encoding: audio.DSD, NumChannels: 2, ChannelOrder: []audio.Channel{audio.FrontLeft, audio.FrontRight},
+			SamplingFrequency: 2822400, BitsPerSample: test.bitsPerSample, BlockSize: 4096, SampleCount: test.sampleCount,
+			EncodedSamples: make([]byte, test.size)}
+		var b bytes.Buffer
+		err := Encode(&a, &b, nil, WithStrictness(test.strictness))
+		switch {
+		case test.expectError && (err == nil || b.Len() != 0):
+			t.Errorf("FAIL Test %v: %v:\nWant: error and 0 bytes\nActual: %v and %v bytes", i+1, test.description, err, b.Len())
+		case !test.expectError && err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		default:
+			t.Logf("PASS Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.expectError, err)
+		}
+	}
+}
@@ -6,12 +6,16 @@ package dsf
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 )
 
 // DsdChunk is the file structure of the DSD chunk within a DSD stream file.
 // See "DSF File Format Specification", v1.01, Sony Corporation. All data is
-// little-endian. This is exported to allow reading with binary.Read.
+// little-endian. This is exported to allow reading with binary.Read, although
+// the decoder reads and decodes it manually.
 type DsdChunk struct {
 	// DSD chunk header.
 	// 'D' , 'S' , 'D', ' ' (includes 1 space).
@@ -30,68 +34,177 @@ type DsdChunk struct {
 	MetadataPointer [8]byte
 }
 
+// DsdDetails is the DSD chunk with its fields decoded to native values.
+type DsdDetails struct {
+	Header          string
+	Size            uint64
+	TotalFileSize   uint64
+	MetadataPointer uint64
+}
+
+// Details returns the fields of the DSD chunk as native values.
+func (c *DsdChunk) Details() DsdDetails {
+	return DsdDetails{
+		Header:          string(c.Header[:]),
+		Size:            binary.LittleEndian.Uint64(c.Size[:]),
+		TotalFileSize:   binary.LittleEndian.Uint64(c.TotalFileSize[:]),
+		MetadataPointer: binary.LittleEndian.Uint64(c.MetadataPointer[:]),
+	}
+}
+
 // Header identifying a DSD chunk within a DSD stream file.
 const dsdChunkHeader = "DSD "
 
+// ErrNotDSF is wrapped by the error returned when decoding input that does not
+// start with a DSD chunk header, and so is not a DSD stream file at all. Input
+// that is empty instead results in an error wrapping io.EOF, whilst input that
+// is truncated after the start of the DSD chunk header results in an error
+// wrapping io.ErrUnexpectedEOF.
+var ErrNotDSF = errors.New("not a DSD stream file")
+
 // Size in bytes of a DSD chunk within a DSD stream file.
 const dsdChunkSize = 28
 
+// Offsets in bytes of the fields within a DSD chunk, which is always at the
+// start of a DSD stream file.
+const (
+	dsdHeaderOffset          = 0
+	dsdSizeOffset            = 4
+	dsdTotalFileSizeOffset   = 12
+	dsdMetadataPointerOffset = 20
+)
+
+// decode sets the fields of the chunk from b, which holds the entire chunk.
+func (c *DsdChunk) decode(b []byte) {
+	copy(c.Header[:], b[dsdHeaderOffset:])
+	copy(c.Size[:], b[dsdSizeOffset:])
+	copy(c.TotalFileSize[:], b[dsdTotalFileSizeOffset:])
+	copy(c.MetadataPointer[:], b[dsdMetadataPointerOffset:])
+}
+
+// encode writes the fields of the chunk into b, which must hold the entire
+// chunk.
+func (c *DsdChunk) encode(b []byte) {
+	copy(b[dsdHeaderOffset:], c.Header[:])
+	copy(b[dsdSizeOffset:], c.Size[:])
+	copy(b[dsdTotalFileSizeOffset:], c.TotalFileSize[:])
+	copy(b[dsdMetadataPointerOffset:], c.MetadataPointer[:])
+}
+
 // readDSDChunk reads the DSD chunk and stores the result in d.
 func (d *decoder) readDSDChunk() error {
 	// Read the entire chunk in one go
-	err := binary.Read(d.reader, binary.LittleEndian, &d.dsd)
-	if err != nil {
-		return err
+	b := d.buffer[:dsdChunkSize]
+	if n, err := io.ReadFull(d.reader, b); err != nil {
+		// Whatever there is should at least start like a DSD chunk header
+		m := n
+		if m > len(dsdChunkHeader) {
+			m = len(dsdChunkHeader)
+		}
+		if string(b[:m]) != dsdChunkHeader[:m] {
+			return fmt.Errorf("dsd: bad chunk header: %q at offset %v: %w", b[:m], dsdHeaderOffset, ErrNotDSF)
+		}
+		return d.shortRead("dsd", "DSD chunk", 0, dsdChunkSize, uint64(n), err)
 	}
+	d.dsd.decode(b)
+	c := d.dsd.Details()
 
 	// Chunk header
-	header := string(d.dsd.Header[:])
+	header := c.Header
 	switch header {
 	case dsdChunkHeader:
 		// This is the expected chunk header
 	case fmtChunkHeader:
-		return fmt.Errorf("dsd: expected DSD chunk but found fmt chunk")
+		return fmt.Errorf("dsd: expected DSD chunk but found fmt chunk: %w", ErrNotDSF)
 	case dataChunkHeader:
-		return fmt.Errorf("dsd: expected DSD chunk but found data chunk")
+		return fmt.Errorf("dsd: expected DSD chunk but found data chunk: %w", ErrNotDSF)
 	default:
-		return fmt.Errorf("dsd: bad chunk header: %q\ndsd chunk: % x", header, d.dsd)
+		return fmt.Errorf("dsd: bad chunk header: %q at offset %v: %w\ndsd chunk: % x", header, dsdHeaderOffset, ErrNotDSF, d.dsd)
 	}
 
 	// Size of this chunk
-	size := binary.LittleEndian.Uint64(d.dsd.Size[:])
+	size := c.Size
 	if size != dsdChunkSize {
-		return fmt.Errorf("dsd: bad chunk size: %v bytes\ndsd chunk: % x", size, d.dsd)
+		err := d.violation(Permissive,
+			fmt.Errorf("dsd: bad chunk size: %v bytes at offset %v\ndsd chunk: % x", size, dsdSizeOffset, d.dsd),
+			Warning{
+				Field:    "dsd.Size",
+				Expected: fmt.Sprint(dsdChunkSize),
+				Actual:   fmt.Sprint(size),
+				Message:  "bad chunk size",
+			})
+		if err != nil {
+			return err
+		}
 	}
 
 	// Total file size
-	totalFileSize := binary.LittleEndian.Uint64(d.dsd.TotalFileSize[:])
-	if totalFileSize < (dsdChunkSize + fmtChunkSize + dataChunkSize) {
-		return fmt.Errorf("dsd: bad total file size: %v bytes\ndsd chunk: % x", totalFileSize, d.dsd)
+	totalFileSize := c.TotalFileSize
+	if totalFileSize < (dsdChunkSize+fmtChunkSize+dataChunkSize) || totalFileSize > math.MaxInt64 {
+		return fmt.Errorf("dsd: bad total file size: %v bytes at offset %v\ndsd chunk: % x", totalFileSize, dsdTotalFileSizeOffset, d.dsd)
 	}
 
 	// Pointer to Metadata chunk
-	metadataPointer := binary.LittleEndian.Uint64(d.dsd.MetadataPointer[:])
+	metadataPointer := c.MetadataPointer
 	if metadataPointer != 0 {
 		if metadataPointer >= totalFileSize || metadataPointer <= (dsdChunkSize+fmtChunkSize+dataChunkSize) {
-			return fmt.Errorf("dsd: bad pointer to metadata chunk: %v bytes\ndsd chunk: % x", metadataPointer, d.dsd)
+			err := d.violation(Permissive,
+				fmt.Errorf("dsd: bad pointer to metadata chunk: %v bytes at offset %v\ndsd chunk: % x", metadataPointer, dsdMetadataPointerOffset, d.dsd),
+				Warning{
+					Field:    "dsd.MetadataPointer",
+					Expected: fmt.Sprintf("0 or between %v and %v", dsdChunkSize+fmtChunkSize+dataChunkSize, totalFileSize),
+					Actual:   fmt.Sprint(metadataPointer),
+					Message:  "bad pointer to metadata chunk, so the metadata is ignored",
+				})
+			if err != nil {
+				return err
+			}
+			metadataPointer = 0
 		} else {
-			// Prepare the audio.Audio in d to hold the metadata
-			d.audio.Metadata = make([]byte, totalFileSize-metadataPointer)
+			// Remember how much metadata to expect once the data chunk is read
+			d.metadataSize = totalFileSize - metadataPointer
 		}
 	}
 
-	// Log the fields of the chunk (only active if a log output has been set)
-	d.logger.Print("\nDSD Chunk\n=========\n")
-	d.logger.Printf("Chunk header:              %q\n", header)
-	d.logger.Printf("Size of this chunk:        %v bytes\n", size)
-	d.logger.Printf("Total file size:           %v bytes\n", totalFileSize)
-	d.logger.Printf("Pointer to Metadata chunk: %v\n", metadataPointer)
+	// Store the information that is useful
+	d.totalFileSize = totalFileSize
+	d.metadataPointer = metadataPointer
+
+	// Log the fields of the chunk (only active if debug logging is enabled)
+	if logEnabled(d.logger) {
+		logField(d.logger, "dsd", "Chunk header", header)
+		logField(d.logger, "dsd", "Size of this chunk", size)
+		logField(d.logger, "dsd", "Total file size", totalFileSize)
+		logField(d.logger, "dsd", "Pointer to Metadata chunk", metadataPointer)
+	}
 
 	return nil
 }
 
-// writeDSDChunk writes the DSD chunk.
-func (e *encoder) writeDSDChunk() error {
+// checkFileLength checks the total file size from the DSD chunk against length,
+// the actual length of the file, once the whole file has been decoded. Unless
+// decoding strictly a mismatch is tolerated, as the chunks themselves have
+// been read successfully, but it is recorded so that the header can be fixed.
+func (d *decoder) checkFileLength(length uint64) error {
+	if length == d.totalFileSize || d.warned("dsd.TotalFileSize") {
+		return nil
+	}
+	message := "total file size overstates the length of the file"
+	if length > d.totalFileSize {
+		message = "total file size understates the length of the file"
+	}
+	return d.violation(Normal,
+		fmt.Errorf("dsd: total file size %v at offset %v does not match the length of the file %v", d.totalFileSize, dsdTotalFileSizeOffset, length),
+		Warning{
+			Field:    "dsd.TotalFileSize",
+			Expected: fmt.Sprint(length),
+			Actual:   fmt.Sprint(d.totalFileSize),
+			Message:  message,
+		})
+}
+
+// prepareDSDChunk sets the fields of the DSD chunk, ready to be written.
+func (e *encoder) prepareDSDChunk() {
 	// Chunk header
 	header := dsdChunkHeader
 	copy(e.dsd.Header[:], header)
@@ -101,29 +214,26 @@ func (e *encoder) writeDSDChunk() error {
 	binary.LittleEndian.PutUint64(e.dsd.Size[:], size)
 
 	// Total file size
-	totalFileSize := uint64(dsdChunkSize + fmtChunkSize + dataChunkSize +
-		len(e.audio.EncodedSamples) + len(e.audio.Metadata))
+	totalFileSize := e.layout.TotalFileSize
 	binary.LittleEndian.PutUint64(e.dsd.TotalFileSize[:], totalFileSize)
 
 	// Pointer to Metadata chunk
-	metadataPointer := uint64(0)
-	if len(e.audio.Metadata) > 0 {
-		metadataPointer = totalFileSize - uint64(len(e.audio.Metadata))
-	}
+	metadataPointer := e.layout.MetadataPointer
 	binary.LittleEndian.PutUint64(e.dsd.MetadataPointer[:], metadataPointer)
 
-	// Log the fields of the chunk (only active if a log output has been set)
-	e.logger.Print("\nDSD Chunk\n=========\n")
-	e.logger.Printf("Chunk header:              %q\n", header)
-	e.logger.Printf("Size of this chunk:        %v\n", size)
-	e.logger.Printf("Total file size:           %v\n", totalFileSize)
-	e.logger.Printf("Pointer to Metadata chunk: %v\n", metadataPointer)
-
-	// Write the entire chunk in one go
-	err := binary.Write(e.writer, binary.LittleEndian, &e.dsd)
-	if err != nil {
-		return err
+	// Log the fields of the chunk (only active if debug logging is enabled)
+	if logEnabled(e.logger) {
+		logField(e.logger, "dsd", "Chunk header", header)
+		logField(e.logger, "dsd", "Size of this chunk", size)
+		logField(e.logger, "dsd", "Total file size", totalFileSize)
+		logField(e.logger, "dsd", "Pointer to Metadata chunk", metadataPointer)
 	}
+}
 
-	return nil
+// writeDSDChunk writes the DSD chunk, which must already be prepared.
+func (e *encoder) writeDSDChunk() error {
+	// Write the entire chunk in one go
+	var b [dsdChunkSize]byte
+	e.dsd.encode(b[:])
+	return e.write(b[:])
 }
@@ -6,9 +6,12 @@ package dsf
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/snmoore/go/audio"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"testing"
 )
@@ -43,6 +46,7 @@ var dsdChunkTests = []test{
 	// Total file size: should be at least 92 bytes for DSD, fmt and data chunks
 	{"Reading a DSD chunk that has an invalid total file size (too small) should result in an error", 12, []byte{91}, true},
 	{"Reading a DSD chunk that has a valid total file size should not result in an error", 12, []byte{92}, false},
+	{"Reading a DSD chunk that has an invalid total file size (too large to seek) should result in an error", 12, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80}, true},
 
 	// Pointer to Metadata chunk: if present the metada should be located after the DSD, fmt and data chunks
 	{"Reading a DSD chunk that has an invalid pointer to metadata (too small) should result in an error", 20, []byte{91}, true},
@@ -62,9 +66,9 @@ func TestDsdRead(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Run each test
@@ -109,19 +113,123 @@ func TestDsdReadError(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Read an empty chunk to force a read error
 	d.reader = bytes.NewReader([]byte{})
 	err := d.readDSDChunk()
 
-	// Reading the chunk should have thrown an error
-	if err == nil {
-		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", len(dsdChunkTests)+1, description)
+	// Reading the chunk should have thrown an error wrapping io.EOF
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", len(dsdChunkTests)+1, description, io.EOF, err)
 	} else {
 		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", len(dsdChunkTests)+1, description, err.Error())
 	}
 }
+
+// Table of the errors wrapped when the start of the input is not a complete DSD
+// chunk, so that empty, partial and foreign input can be told apart
+var dsdStartTests = []struct {
+	description string
+	input       []byte
+	want        error
+}{
+	{"Empty input should result in an error wrapping io.EOF", []byte{}, io.EOF},
+	{"Input truncated within the chunk header should result in an error wrapping io.ErrUnexpectedEOF", []byte("DS"), io.ErrUnexpectedEOF},
+	{"Input truncated after the chunk header should result in an error wrapping io.ErrUnexpectedEOF", validDsdChunk[:10], io.ErrUnexpectedEOF},
+	{"Short input that is not a DSD chunk header should result in an error wrapping ErrNotDSF", []byte("RIF"), ErrNotDSF},
+	{"Input that is not a DSD stream file should result in an error wrapping ErrNotDSF", []byte("RIFF\x24\x00\x00\x00WAVEfmt \x10\x00\x00\x00\x01\x00\x02\x00\x44\xac\x00\x00"), ErrNotDSF},
+	{"Input that starts with a fmt chunk should result in an error wrapping ErrNotDSF", validFmtChunk, ErrNotDSF},
+}
+
+// Run all tests of the start of the input, decoding the whole file
+func TestDsdStart(t *testing.T) {
+	for i, test := range dsdStartTests {
+		_, err := Decode(bytes.NewReader(test.input), nil)
+		unexpected := errors.Is(err, io.ErrUnexpectedEOF)
+		if !errors.Is(err, test.want) || (test.want == io.EOF && unexpected) || (test.want == ErrNotDSF && unexpected) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.want, err)
+		} else {
+			t.Logf("PASS Test %v: %v:\n%v", i+1, test.description, err.Error())
+		}
+	}
+}
+
+// Table structure for a single file length test
+type fileLengthTest struct {
+	// Description for the test
+	description string
+	// Modification to make to a valid DSD stream file
+	modify func(b []byte) []byte
+	// Message of the warning expected, or empty if none
+	message string
+}
+
+// Table of all file length tests, using files with and without metadata
+var fileLengthTests = []fileLengthTest{
+	{"A total file size that matches the length of the file should be accepted",
+		func(b []byte) []byte { return b },
+		""},
+	{"A total file size that overstates the length of the file should be detected",
+		func(b []byte) []byte {
+			binary.LittleEndian.PutUint64(b[12:], binary.LittleEndian.Uint64(b[12:])+8)
+			return b
+		},
+		"total file size overstates the length of the file"},
+	{"A total file size that understates the length of the file should be detected",
+		func(b []byte) []byte { return append(b, make([]byte, 8)...) },
+		"total file size understates the length of the file"},
+}
+
+// Run all file length tests, with each of the decoders that know the length
+func TestDsdFileLength(t *testing.T) {
+	metadata := []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	decoders := []struct {
+		name   string
+		decode func(b []byte, opts ...Option) error
+	}{
+		{"Decode", func(b []byte, opts ...Option) error {
+			_, err := Decode(bytes.NewReader(b), nil, opts...)
+			return err
+		}},
+		{"DecodeBytes", func(b []byte, opts ...Option) error {
+			_, err := DecodeBytes(b, opts...)
+			return err
+		}},
+	}
+	for i, test := range fileLengthTests {
+		for _, m := range [][]byte{nil, metadata} {
+			for _, decoder := range decoders {
+				b := test.modify(newTestFile(1, 1, 1, 4096, make([]byte, 4096), m))
+				description := fmt.Sprintf("%v (%v, %v bytes of metadata)", test.description, decoder.name, len(m))
+
+				// Tolerated with a single warning by default
+				var warnings []Warning
+				err := decoder.decode(b, WithWarnings(&warnings))
+				switch {
+				case err != nil:
+					t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+				case test.message == "" && len(warnings) > 0:
+					t.Errorf("FAIL Test %v: %v:\nWant: no warnings\nActual: %v", i+1, description, warnings)
+				case test.message != "" && (len(warnings) != 1 || warnings[0].Field != "dsd.TotalFileSize"):
+					t.Errorf("FAIL Test %v: %v:\nWant: 1 dsd.TotalFileSize warning\nActual: %v", i+1, description, warnings)
+				case test.message != "" && len(m) == 0 && (warnings[0].Message != test.message || warnings[0].Expected != fmt.Sprint(len(b))):
+					t.Errorf("FAIL Test %v: %v:\nWant: %v, expected %v\nActual: %v", i+1, description, test.message, len(b), warnings[0])
+				default:
+					t.Logf("PASS Test %v: %v", i+1, description)
+				}
+
+				// Rejected when decoding strictly
+				err = decoder.decode(b, WithStrictness(Strict))
+				if (test.message != "") != (err != nil) {
+					t.Errorf("FAIL Test %v: %v when decoding strictly:\nWant: error %v\nActual: %v", i+1, description, test.message != "", err)
+				} else {
+					t.Logf("PASS Test %v: %v when decoding strictly", i+1, description)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"github.com/snmoore/go/audio"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Memory mappings aliased by the Audio returned from DecodeFile, until they are
+// released. These are never unmapped automatically, as slices of a mapping may
+// be retained beyond the Audio without the garbage collector knowing.
+var (
+	mappingsMutex sync.Mutex
+	mappings      = make(map[*audio.Audio][]byte)
+)
+
+// DecodeFile reads the DSD stream file at path and returns it as an Audio.
+//
+// Where supported the file is memory-mapped, and the EncodedSamples and
+// Metadata of the Audio alias the mapping rather than being copied, which
+// greatly reduces memory usage and decoding time for large files. The mapping
+// is private, so modifying the samples does not modify the file. Release must
+// be called once the Audio is no longer needed to unmap the file, which is
+// otherwise never unmapped, and the Audio never garbage collected. The
+// EncodedSamples and Metadata must not be used after Release, including any
+// slices of them that have been retained elsewhere.
+//
+// If the file cannot be memory-mapped then it is read as per Decode instead,
+// in which case calling Release is unnecessary but harmless.
+//
+// With WithRecovery the Audio recovered from a file truncated within the data
+// chunk is returned together with the error, as by Decode, and must still be
+// released or closed.
+//
+// With WithLazySamples the file is neither memory-mapped nor read into memory,
+// but left open with the EncodedSection of the Audio referencing its sample
+// data. Close must then be called on the Audio once it is no longer needed to
+// close the file, rather than Release.
+func DecodeFile(path string, opts ...Option) (*audio.Audio, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	d := newDecoder(nil, opts)
+	a := new(audio.Audio)
+	if d.lazySamples {
+		err := d.decode(f, a)
+		if err != nil && !d.recovered {
+			f.Close()
+			return nil, err
+		}
+		if a.EncodedSection == nil {
+			f.Close()
+		}
+		return a, err
+	}
+	defer f.Close()
+
+	// Fall back to reading the file if it cannot be memory-mapped
+	m, err := mmapFile(f)
+	if err != nil {
+		if err := d.decode(f, a); err != nil {
+			if d.recovered {
+				return a, err
+			}
+			return nil, err
+		}
+		return a, nil
+	}
+	err = d.decodeBytes(m, a)
+	if err != nil && !d.recovered {
+		munmapFile(m)
+		return nil, err
+	}
+
+	// Remember the mapping so that it can be unmapped later, including when
+	// what was recovered from a truncated file may alias it
+	mappingsMutex.Lock()
+	mappings[a] = m
+	mappingsMutex.Unlock()
+
+	return a, err
+}
+
+// Release unmaps the file aliased by an Audio returned from DecodeFile, and
+// sets its EncodedSamples and Metadata to nil. It does nothing if the Audio
+// does not alias a file, including if it has already been released.
+func Release(a *audio.Audio) error {
+	mappingsMutex.Lock()
+	m, ok := mappings[a]
+	delete(mappings, a)
+	mappingsMutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	a.EncodedSamples = nil
+	a.Metadata = nil
+	return munmapFile(m)
+}
+
+// EncodeFile writes the Audio a as a DSD stream file at path, as per Encode.
+//
+// The file is written atomically: it is first written to a temporary file in
+// the same directory, which is synced to disk and then renamed to path only if
+// encoding succeeds, so path is never left holding a truncated file. The
+// temporary file is removed if encoding fails. An existing file at path is
+// replaced, keeping its permissions.
+func EncodeFile(path string, a *audio.Audio, opts ...Option) (err error) {
+	f, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	// Keep the permissions of any existing file
+	if info, err := os.Stat(path); err == nil {
+		if err := f.Chmod(info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	if err := Encode(a, f, nil, opts...); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// createTemp creates a new hidden file in the same directory as path, with the
+// same permissions as os.Create would give it.
+func createTemp(path string) (*os.File, error) {
+	dir, base := filepath.Split(path)
+	for {
+		name := filepath.Join(dir, "."+base+"."+strconv.FormatUint(uint64(rand.Uint32()), 10)+".tmp")
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
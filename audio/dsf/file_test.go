@@ -0,0 +1,263 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"github.com/snmoore/go/audio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// Table of files to decode both by mapping and by copying
+var decodeFileTests = []string{
+	"test/valid_without_metadata.dsf",
+	"test/valid_with_metadata.dsf",
+}
+
+// The mapped and copied paths should produce identical results
+func TestDecodeFile(t *testing.T) {
+	for i, filename := range decodeFileTests {
+		description := "Decoding " + filename + " by mapping and by copying should produce identical results"
+
+		// Decode the DSD stream file by copying
+		file, err := os.Open(filename)
+		if err != nil {
+			t.Fatalf("FAIL Test %v: %v:\n%v", i+1, description, err.Error())
+		}
+		want, err := Decode(file, nil)
+		file.Close()
+		if err != nil {
+			t.Fatalf("FAIL Test %v: %v:\n%v", i+1, description, err.Error())
+		}
+
+		// Decode the DSD stream file by mapping
+		a, err := DecodeFile(filename)
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		} else if !reflect.DeepEqual(a, want) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v", i+1, description, want, a)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+
+		// Releasing should clear the samples, and releasing again should be harmless
+		if a != nil {
+			if err := Release(a); err != nil || a.EncodedSamples != nil || a.Metadata != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: released\nActual: %v", i+1, description, err)
+			}
+			if err := Release(a); err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+			}
+		}
+	}
+}
+
+// A mapped file should not be unmapped until released, even once the Audio is
+// no longer referenced, as slices of it may have been retained
+func TestDecodeFileRetained(t *testing.T) {
+	description := "A retained slice of a mapped file should remain valid until released"
+
+	want, err := ioutil.ReadFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	a, err := DecodeFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+
+	// Retain only the samples, and collect garbage
+	samples := a.EncodedSamples
+	a = nil
+	runtime.GC()
+	runtime.GC()
+	if !bytes.Equal(samples, want[92:92+len(samples)]) {
+		t.Errorf("FAIL Test 1: %v:\nWant: samples unchanged\nActual: samples changed", description)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	// The Audio can still be released
+	mappingsMutex.Lock()
+	for m := range mappings {
+		if len(m.EncodedSamples) > 0 && &m.EncodedSamples[0] == &samples[0] {
+			a = m
+		}
+	}
+	mappingsMutex.Unlock()
+	if a == nil {
+		t.Skip("memory-mapping is not supported on this platform")
+	}
+	if err := Release(a); err != nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+}
+
+// Modifying the samples of a mapped file should not modify the file, and
+// errors should be returned as when copying
+func TestDecodeFilePrivate(t *testing.T) {
+	description := "Modifying the samples of a mapped file should not modify the file"
+
+	// Write a DSD stream file with distinct sample data
+	name := filepath.Join(t.TempDir(), "private.dsf")
+	c := newParallelFile()
+	if err := ioutil.WriteFile(name, c, 0644); err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	a, err := DecodeFile(name)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	defer Release(a)
+	for i := range a.EncodedSamples {
+		a.EncodedSamples[i] = 0x69
+	}
+	actual, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	if !bytes.Equal(actual, c) {
+		t.Errorf("FAIL Test 1: %v:\nWant: file unchanged\nActual: file changed", description)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	// A corrupt file should result in an error
+	description = "Decoding a corrupt file by mapping should result in an error"
+	if _, err := DecodeFile("test/invalid_missing_metadata.dsf"); err == nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 2: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	// A missing file should result in an error
+	description = "Decoding a missing file should result in an error"
+	if _, err := DecodeFile(filepath.Join(t.TempDir(), "missing.dsf")); err == nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 3: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// Samples read on demand should match those read into memory, and encode and
+// checksum identically
+func TestDecodeFileLazy(t *testing.T) {
+	for i, filename := range decodeFileTests {
+		description := "Decoding " + filename + " lazily should match decoding it into memory"
+		want, err := DecodeFile(filename)
+		if err != nil {
+			t.Fatalf("FAIL Test %v: %v:\n%v", i+1, description, err.Error())
+		}
+		defer Release(want)
+		a, err := DecodeFile(filename, WithLazySamples())
+		if err != nil {
+			t.Fatalf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		}
+		defer a.Close()
+		if a.EncodedSection == nil || a.EncodedSamples != nil || !a.Equal(want) {
+			t.Errorf("FAIL Test %v: %v:\nWant: samples read on demand\nActual: section %v, %v", i+1, description, a.EncodedSection, a.EqualReport(want))
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+
+		description = "Encoding " + filename + " decoded lazily should produce the same file and checksum"
+		var b, c bytes.Buffer
+		var sum, wantSum []byte
+		if err := Encode(want, &b, nil, WithRawMetadata(), WithChecksum(CRC32, &wantSum)); err != nil {
+			t.Fatalf("FAIL Test %v: %v:\n%v", i+1, description, err.Error())
+		}
+		if err := Encode(a, &c, nil, WithRawMetadata(), WithChecksum(CRC32, &sum)); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		} else if !bytes.Equal(b.Bytes(), c.Bytes()) || !bytes.Equal(sum, wantSum) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v bytes with checksum %x\nActual: %v bytes with checksum %x", i+1, description, b.Len(), wantSum, c.Len(), sum)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+
+		description = "Closing " + filename + " decoded lazily should close the file"
+		f, _, _ := a.EncodedSection.Outer()
+		if err := a.Close(); err != nil || a.EncodedSection != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err)
+		} else if err := f.(*os.File).Close(); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: already closed\nActual: nil", i+1, description)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+
+	description := "Decoding lazily with a checksum should read the samples into memory"
+	var sum []byte
+	a, err := DecodeFile(decodeFileTests[0], WithLazySamples(), WithChecksum(MD5, &sum))
+	if err != nil || a.EncodedSection != nil || len(a.EncodedSamples) == 0 || sum == nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: samples in memory\nActual: %v", len(decodeFileTests)+1, description, err)
+	} else {
+		t.Logf("PASS Test %v: %v", len(decodeFileTests)+1, description)
+	}
+}
+
+// Decode a file by mapping it
+func BenchmarkDecodeFileMapped(b *testing.B) {
+	name := newParallelTempFile(b).Name()
+	b.SetBytes(int64(len(newParallelFile())))
+	for i := 0; i < b.N; i++ {
+		a, err := DecodeFile(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		Release(a)
+	}
+}
+
+// Encoding to a file should give the same file as Encode, keep the permissions
+// of an existing file, and leave it untouched on failure
+func TestEncodeFile(t *testing.T) {
+	a, err := DecodeFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: Decoding the test file:\n%v", err.Error())
+	}
+	defer Release(a)
+	var want bytes.Buffer
+	if err := Encode(a, &want, nil, WithRawMetadata()); err != nil {
+		t.Fatalf("FAIL Test 1: Encoding the test file:\n%v", err.Error())
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "encoded.dsf")
+
+	description := "Encoding to a new file should give the same file as Encode"
+	err = EncodeFile(path, a, WithRawMetadata())
+	c, _ := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(c, want.Bytes()) {
+		t.Errorf("FAIL Test 1: %v:\nWant: %v bytes\nActual: %v bytes, %v", description, want.Len(), len(c), err)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "Encoding to an existing file should replace it, keeping its permissions"
+	os.WriteFile(path, []byte("old"), 0600)
+	os.Chmod(path, 0640)
+	err = EncodeFile(path, a, WithRawMetadata())
+	c, _ = ioutil.ReadFile(path)
+	info, _ := os.Stat(path)
+	if err != nil || !bytes.Equal(c, want.Bytes()) || info == nil || info.Mode().Perm() != 0640 {
+		t.Errorf("FAIL Test 2: %v:\nWant: %v bytes, -rw-r-----\nActual: %v bytes, %v, %v", description, want.Len(), len(c), info, err)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	description = "Failing to encode should leave the existing file untouched and remove the temporary file"
+	err = EncodeFile(path, &audio.Audio{Encoding: audio.DSD, NumChannels: 1, BitsPerSample: 1, SamplingFrequency: 44100})
+	c, _ = ioutil.ReadFile(path)
+	entries, _ := os.ReadDir(dir)
+	if err == nil || !bytes.Equal(c, want.Bytes()) || len(entries) != 1 {
+		t.Errorf("FAIL Test 3: %v:\nWant: error, %v bytes, 1 file\nActual: %v, %v bytes, %v files", description, want.Len(), err, len(c), len(entries))
+	} else {
+		t.Logf("PASS Test 3: %v:\n%v", description, err.Error())
+	}
+}
@@ -8,12 +8,16 @@ import (
 	"encoding/binary"
 	"fmt"
 	"github.com/snmoore/go/audio"
-	"reflect"
+	"io"
+	"math"
+	"slices"
+	"strings"
 )
 
 // FmtChunk is the file structure of the fmt chunk within a DSD stream file.
 // See "DSF File Format Specification", v1.01, Sony Corporation. All data is
-// little-endian. This is exported to allow reading with binary.Read.
+// little-endian. This is exported to allow reading with binary.Read, although
+// the decoder reads and decodes it manually.
 type FmtChunk struct {
 	// fmt chunk header.
 	// 'f' , 'm' , 't' , ' ' (includes 1 space).
@@ -62,7 +66,8 @@ type FmtChunk struct {
 	SampleCount [8]byte
 
 	// Block size per channel.
-	// 4096, unused samples should be filled with zero.
+	// 4096, unused samples should be filled with zero, although this package
+	// pads with DSD silence by default, see WithPadByte.
 	BlockSize [4]byte
 
 	// Reserved.
@@ -70,12 +75,98 @@ type FmtChunk struct {
 	Reserved [4]byte
 }
 
+// FmtDetails is the fmt chunk with its fields decoded to native values.
+type FmtDetails struct {
+	Header            string
+	Size              uint64
+	Version           uint32
+	Identifier        uint32
+	ChannelType       uint32
+	ChannelNum        uint32
+	SamplingFrequency uint32
+	BitsPerSample     uint32
+	SampleCount       uint64
+	BlockSize         uint32
+	Reserved          uint32
+}
+
+// Details returns the fields of the fmt chunk as native values.
+func (c *FmtChunk) Details() FmtDetails {
+	return FmtDetails{
+		Header:            string(c.Header[:]),
+		Size:              binary.LittleEndian.Uint64(c.Size[:]),
+		Version:           binary.LittleEndian.Uint32(c.Version[:]),
+		Identifier:        binary.LittleEndian.Uint32(c.Identifier[:]),
+		ChannelType:       binary.LittleEndian.Uint32(c.ChannelType[:]),
+		ChannelNum:        binary.LittleEndian.Uint32(c.ChannelNum[:]),
+		SamplingFrequency: binary.LittleEndian.Uint32(c.SamplingFrequency[:]),
+		BitsPerSample:     binary.LittleEndian.Uint32(c.BitsPerSample[:]),
+		SampleCount:       binary.LittleEndian.Uint64(c.SampleCount[:]),
+		BlockSize:         binary.LittleEndian.Uint32(c.BlockSize[:]),
+		Reserved:          binary.LittleEndian.Uint32(c.Reserved[:]),
+	}
+}
+
 // Header identifying a fmt chunk within a DSD stream file.
 const fmtChunkHeader = "fmt "
 
 // Size in bytes of a fmt chunk within a DSD stream file.
 const fmtChunkSize = 52
 
+// Maximum number of bytes after the Reserved field of a fmt chunk that is
+// larger than fmtChunkSize. These are reserved by the specification for future
+// versions.
+const fmtMaxExtensionSize = 1 << 16
+
+// Offset in bytes of the fmt chunk, which always follows the DSD chunk.
+const fmtChunkOffset = dsdChunkSize
+
+// Offsets in bytes of the fields within a fmt chunk.
+const (
+	fmtHeaderOffset            = 0
+	fmtSizeOffset              = 4
+	fmtVersionOffset           = 12
+	fmtIdentifierOffset        = 16
+	fmtChannelTypeOffset       = 20
+	fmtChannelNumOffset        = 24
+	fmtSamplingFrequencyOffset = 28
+	fmtBitsPerSampleOffset     = 32
+	fmtSampleCountOffset       = 36
+	fmtBlockSizeOffset         = 44
+	fmtReservedOffset          = 48
+)
+
+// decode sets the fields of the chunk from b, which holds the entire chunk.
+func (c *FmtChunk) decode(b []byte) {
+	copy(c.Header[:], b[fmtHeaderOffset:])
+	copy(c.Size[:], b[fmtSizeOffset:])
+	copy(c.Version[:], b[fmtVersionOffset:])
+	copy(c.Identifier[:], b[fmtIdentifierOffset:])
+	copy(c.ChannelType[:], b[fmtChannelTypeOffset:])
+	copy(c.ChannelNum[:], b[fmtChannelNumOffset:])
+	copy(c.SamplingFrequency[:], b[fmtSamplingFrequencyOffset:])
+	copy(c.BitsPerSample[:], b[fmtBitsPerSampleOffset:])
+	copy(c.SampleCount[:], b[fmtSampleCountOffset:])
+	copy(c.BlockSize[:], b[fmtBlockSizeOffset:])
+	copy(c.Reserved[:], b[fmtReservedOffset:])
+}
+
+// encode writes the fields of the chunk into b, which must hold the entire
+// chunk.
+func (c *FmtChunk) encode(b []byte) {
+	copy(b[fmtHeaderOffset:], c.Header[:])
+	copy(b[fmtSizeOffset:], c.Size[:])
+	copy(b[fmtVersionOffset:], c.Version[:])
+	copy(b[fmtIdentifierOffset:], c.Identifier[:])
+	copy(b[fmtChannelTypeOffset:], c.ChannelType[:])
+	copy(b[fmtChannelNumOffset:], c.ChannelNum[:])
+	copy(b[fmtSamplingFrequencyOffset:], c.SamplingFrequency[:])
+	copy(b[fmtBitsPerSampleOffset:], c.BitsPerSample[:])
+	copy(b[fmtSampleCountOffset:], c.SampleCount[:])
+	copy(b[fmtBlockSizeOffset:], c.BlockSize[:])
+	copy(b[fmtReservedOffset:], c.Reserved[:])
+}
+
 // Value of the Version field.
 const fmtVersion = 1
 
@@ -96,7 +187,9 @@ var fmtChannelType = map[uint32]string{
 // Channel order corresponding to the ChannelType field.
 // The mapping for mono is undefined in the specification, but using center
 // seems reasonable and allows an easy way to check for mismatch between the
-// ChannelType and ChannelNum fields.
+// ChannelType and ChannelNum fields. This is only the convention of this
+// package: mono is decoded as center, but is encoded from any one channel or
+// none.
 var fmtChannelOrder = map[uint32][]audio.Channel{
 	1: {audio.Center},
 	2: {audio.FrontLeft, audio.FrontRight},
@@ -107,6 +200,48 @@ var fmtChannelOrder = map[uint32][]audio.Channel{
 	7: {audio.FrontLeft, audio.FrontRight, audio.Center, audio.LowFrequency, audio.BackLeft, audio.BackRight},
 }
 
+// Set of channels corresponding to the ChannelType field, ignoring their order.
+var fmtChannelMask = map[uint32]audio.ChannelMask{
+	1: 0x04,
+	2: 0x03,
+	3: 0x07,
+	4: 0x33,
+	5: 0x0f,
+	6: 0x37,
+	7: 0x3f,
+}
+
+// Channel type encoded for each number of channels when there is no channel
+// order, which is the first in the specification with that number of channels.
+var fmtDefaultChannelType = map[uint]uint32{
+	1: 1,
+	2: 2,
+	3: 3,
+	4: 4,
+	5: 6,
+	6: 7,
+}
+
+// fmtChannelTypeOf returns the value of the ChannelType field corresponding to
+// the channel order, or 0 if there is none.
+func fmtChannelTypeOf(order []audio.Channel) uint32 {
+	for channelType := uint32(1); channelType <= uint32(len(fmtChannelOrder)); channelType++ {
+		if slices.Equal(order, fmtChannelOrder[channelType]) {
+			return channelType
+		}
+	}
+	return 0
+}
+
+// channelOrderString returns the channel order as a comma separated list.
+func channelOrderString(order []audio.Channel) string {
+	s := make([]string, len(order))
+	for i, channel := range order {
+		s[i] = channel.String()
+	}
+	return strings.Join(s, ", ")
+}
+
 // Values of the ChannelNum field and their meaning.
 var fmtChannelNum = map[uint32]string{
 	1: "mono",
@@ -126,8 +261,39 @@ var fmtSamplingFrequency = map[uint32]string{
 	5644800:  "DSD128",
 	11289600: "DSD256",
 	22579200: "DSD512",
+	45158400: "DSD1024",
+	3072000:  "DSD64/48k",
+	6144000:  "DSD128/48k",
+	12288000: "DSD256/48k",
+	24576000: "DSD512/48k",
+	49152000: "DSD1024/48k",
+}
+
+// Values of the SamplingFrequency field defined by the specification, which are
+// the only values accepted when encoding strictly.
+var fmtSpecSamplingFrequencies = []uint32{2822400, 5644800}
+
+// samplingFrequenciesString returns the sampling frequencies and their meaning
+// as a comma separated list in ascending order, or all of the standard
+// sampling frequencies if nil.
+func samplingFrequenciesString(frequencies []uint32) string {
+	if frequencies == nil {
+		for frequency := range fmtSamplingFrequency {
+			frequencies = append(frequencies, frequency)
+		}
+	}
+	frequencies = slices.Sorted(slices.Values(frequencies))
+	s := make([]string, len(frequencies))
+	for i, frequency := range frequencies {
+		s[i] = fmt.Sprintf("%v (%v)", frequency, fmtSamplingFrequency[frequency])
+	}
+	return strings.Join(s, ", ")
 }
 
+// Minimum value of the SamplingFrequency field that is accepted by
+// WithAnyFrequency.
+const fmtMinSamplingFrequency = 1000000
+
 // Values of the BitsPerSample field.
 var fmtBitsPerSample = map[uint32]struct{}{
 	1: {},
@@ -137,19 +303,35 @@ var fmtBitsPerSample = map[uint32]struct{}{
 // Value of the BlockSize field.
 const fmtBlockSize = 4096
 
+// Range of values of the BlockSize field that are tolerated,
+// for files that use a power of two other than 4096.
+const (
+	fmtMinBlockSize = 64
+	fmtMaxBlockSize = 65536
+)
+
+// isValidBlockSize returns whether blockSize is a power of two within the range
+// tolerated.
+func isValidBlockSize(blockSize uint32) bool {
+	return blockSize >= fmtMinBlockSize && blockSize <= fmtMaxBlockSize &&
+		blockSize&(blockSize-1) == 0
+}
+
 // Value of the Reserved field.
 const fmtReserved = 0
 
 // readFmtChunk reads the fmt chunk and stores the result in d.
 func (d *decoder) readFmtChunk() error {
 	// Read the entire chunk in one go
-	err := binary.Read(d.reader, binary.LittleEndian, &d.fmt)
-	if err != nil {
-		return err
+	b := d.buffer[:fmtChunkSize]
+	if n, err := io.ReadFull(d.reader, b); err != nil {
+		return d.shortRead("fmt", "fmt chunk", fmtChunkOffset, fmtChunkSize, uint64(n), err)
 	}
+	d.fmt.decode(b)
+	c := d.fmt.Details()
 
 	// Chunk header
-	header := string(d.fmt.Header[:])
+	header := c.Header
 	switch header {
 	case fmtChunkHeader:
 		// This is the expected chunk header
@@ -158,124 +340,219 @@ func (d *decoder) readFmtChunk() error {
 	case dataChunkHeader:
 		return fmt.Errorf("fmt: expected fmt chunk but found data chunk")
 	default:
-		return fmt.Errorf("fmt: bad chunk header: %q\nfmt chunk: % x", header, d.fmt)
+		return fmt.Errorf("fmt: bad chunk header: %q at offset %v\nfmt chunk: % x", header, fmtChunkOffset+fmtHeaderOffset, d.fmt)
 	}
 
 	// Size of this chunk
-	size := binary.LittleEndian.Uint64(d.fmt.Size[:])
-	if size != fmtChunkSize {
-		return fmt.Errorf("fmt: bad chunk size: %v\nfmt chunk: % x", size, d.fmt)
+	size := c.Size
+	if size < fmtChunkSize || size-fmtChunkSize > fmtMaxExtensionSize {
+		return fmt.Errorf("fmt: bad chunk size: %v at offset %v\nfmt chunk: % x", size, fmtChunkOffset+fmtSizeOffset, d.fmt)
+	}
+	if size > fmtChunkSize {
+		if err := d.readFmtExtension(size - fmtChunkSize); err != nil {
+			return err
+		}
 	}
 
 	// Format version
-	formatVersion := binary.LittleEndian.Uint32(d.fmt.Version[:])
+	formatVersion := c.Version
 	if formatVersion != fmtVersion {
-		return fmt.Errorf("fmt: bad format version: %v\nfmt chunk: % x", formatVersion, d.fmt)
+		err := d.violation(Permissive,
+			fmt.Errorf("fmt: bad format version: %v at offset %v\nfmt chunk: % x", formatVersion, fmtChunkOffset+fmtVersionOffset, d.fmt),
+			Warning{
+				Field:    "fmt.Version",
+				Expected: fmt.Sprint(fmtVersion),
+				Actual:   fmt.Sprint(formatVersion),
+				Message:  "unknown format version",
+			})
+		if err != nil {
+			return err
+		}
 	}
 
 	// Format id
-	formatId := binary.LittleEndian.Uint32(d.fmt.Identifier[:])
+	formatId := c.Identifier
 	if formatId != fmtIdentifier {
-		return fmt.Errorf("fmt: bad format id: %v\nfmt chunk: % x", formatId, d.fmt)
+		err := d.violation(Permissive,
+			fmt.Errorf("fmt: bad format id: %v at offset %v\nfmt chunk: % x", formatId, fmtChunkOffset+fmtIdentifierOffset, d.fmt),
+			Warning{
+				Field:    "fmt.Identifier",
+				Expected: fmt.Sprint(fmtIdentifier),
+				Actual:   fmt.Sprint(formatId),
+				Message:  "unknown format id",
+			})
+		if err != nil {
+			return err
+		}
 	}
 
 	// Channel Type
-	channelType := binary.LittleEndian.Uint32(d.fmt.ChannelType[:])
+	channelType := c.ChannelType
 	channelTypeString, ok := fmtChannelType[channelType]
 	if !ok {
-		return fmt.Errorf("fmt: bad channel type: %v\nfmt chunk: % x", channelType, d.fmt)
+		return fmt.Errorf("fmt: bad channel type: %v at offset %v\nfmt chunk: % x", channelType, fmtChunkOffset+fmtChannelTypeOffset, d.fmt)
 	}
 
 	// Channel order corresponding to the ChannelType field
 	order, _ := fmtChannelOrder[channelType]
 
 	// Channel num
-	channelNum := binary.LittleEndian.Uint32(d.fmt.ChannelNum[:])
+	channelNum := c.ChannelNum
 	_, ok = fmtChannelNum[channelNum]
 	if !ok {
-		return fmt.Errorf("fmt: bad channel num: %v\nfmt chunk: % x", channelNum, d.fmt)
+		return fmt.Errorf("fmt: bad channel num: %v at offset %v\nfmt chunk: % x", channelNum, fmtChunkOffset+fmtChannelNumOffset, d.fmt)
 	}
 	if channelNum != uint32(len(order)) {
 		return fmt.Errorf("fmt: mismatch between channel type %v and channel num %v:\nfmt chunk: % x", channelType, channelNum, d.fmt)
 	}
 
+	// Channel order given by WithChannelOrder, for nonstandard layouts
+	if d.channelOrder != nil {
+		if channelNum != uint32(len(d.channelOrder)) {
+			return fmt.Errorf("fmt: mismatch between channel num %v and channel order %v", channelNum, d.channelOrder)
+		}
+		order = d.channelOrder
+	}
+
 	// Sampling frequency
-	samplingFrequency := binary.LittleEndian.Uint32(d.fmt.SamplingFrequency[:])
+	samplingFrequency := c.SamplingFrequency
 	samplingFrequencyString, ok := fmtSamplingFrequency[samplingFrequency]
 	if !ok {
-		return fmt.Errorf("fmt: bad sampling frequency: %v\nfmt chunk: % x", samplingFrequency, d.fmt)
+		if (!d.anyFrequency && d.strictness < Permissive) || samplingFrequency < fmtMinSamplingFrequency {
+			return fmt.Errorf("fmt: bad sampling frequency: %v at offset %v\nfmt chunk: % x", samplingFrequency, fmtChunkOffset+fmtSamplingFrequencyOffset, d.fmt)
+		}
+		samplingFrequencyString = "nonstandard"
+		d.warn(Warning{
+			Field:    "fmt.SamplingFrequency",
+			Expected: "a standard DSD sampling frequency",
+			Actual:   fmt.Sprint(samplingFrequency),
+			Message:  "nonstandard sampling frequency",
+		})
 	}
 
 	// Bits per sample
-	bitsPerSample := binary.LittleEndian.Uint32(d.fmt.BitsPerSample[:])
+	bitsPerSample := c.BitsPerSample
 	_, ok = fmtBitsPerSample[bitsPerSample]
 	if !ok {
-		return fmt.Errorf("fmt: bad bits per sample: %v\nfmt chunk: % x", bitsPerSample, d.fmt)
+		return fmt.Errorf("fmt: bad bits per sample: %v at offset %v\nfmt chunk: % x", bitsPerSample, fmtChunkOffset+fmtBitsPerSampleOffset, d.fmt)
 	}
 
 	// Sample count
-	sampleCount := binary.LittleEndian.Uint64(d.fmt.SampleCount[:])
+	sampleCount := c.SampleCount
 
 	// Block size per channel
-	blockSize := binary.LittleEndian.Uint32(d.fmt.BlockSize[:])
+	blockSize := c.BlockSize
 	if blockSize != fmtBlockSize {
-		return fmt.Errorf("fmt: bad block size: %v\nfmt chunk: % x", blockSize, d.fmt)
+		err := fmt.Errorf("fmt: bad block size: %v at offset %v\nfmt chunk: % x", blockSize, fmtChunkOffset+fmtBlockSizeOffset, d.fmt)
+		if !isValidBlockSize(blockSize) {
+			return err
+		}
+		err = d.violation(Normal, err, Warning{
+			Field:    "fmt.BlockSize",
+			Expected: fmt.Sprint(fmtBlockSize),
+			Actual:   fmt.Sprint(blockSize),
+			Message:  "nonstandard block size",
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	// Reserved
-	reserved := binary.LittleEndian.Uint32(d.fmt.Reserved[:])
+	reserved := c.Reserved
 	if reserved != fmtReserved {
-		return fmt.Errorf("fmt: bad reserved bytes: %#x\nfmt chunk: % x", reserved, d.fmt)
-	}
-
-	// Log the fields of the chunk (only active if a log output has been set)
-	d.logger.Print("\nFmt Chunk\n=========\n")
-	d.logger.Printf("Chunk header:              %q\n", header)
-	d.logger.Printf("Size of this chunk:        %v bytes\n", size)
-	d.logger.Printf("Format version:            %v\n", formatVersion)
-	d.logger.Printf("Format id:                 %v\n", formatId)
-	d.logger.Printf("Channel type:              %v (%s)\n", channelType, channelTypeString)
-	d.logger.Printf("Channel num:               %v\n", channelNum)
-	if len(order) > 1 {
-		var s string
-		for i, channel := range order {
-			if i < len(order)-1 {
-				s += channel.String() + ", "
-			} else {
-				s += channel.String()
-			}
+		err := d.violation(Normal,
+			fmt.Errorf("fmt: bad reserved bytes: %#x at offset %v\nfmt chunk: % x", reserved, fmtChunkOffset+fmtReservedOffset, d.fmt),
+			Warning{
+				Field:    "fmt.Reserved",
+				Expected: fmt.Sprintf("%#x", fmtReserved),
+				Actual:   fmt.Sprintf("%#x", reserved),
+				Message:  "reserved bytes are not zero",
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Log the fields of the chunk (only active if debug logging is enabled)
+	if logEnabled(d.logger) {
+		logField(d.logger, "fmt", "Chunk header", header)
+		logField(d.logger, "fmt", "Size of this chunk", size)
+		logField(d.logger, "fmt", "Format version", formatVersion)
+		logField(d.logger, "fmt", "Format id", formatId)
+		logField(d.logger, "fmt", "Channel type", channelType, channelTypeString)
+		logField(d.logger, "fmt", "Channel num", channelNum)
+		if len(order) > 1 {
+			logField(d.logger, "fmt", "Channel order", channelOrderString(order))
+		}
+		logField(d.logger, "fmt", "Sampling frequency", samplingFrequency, samplingFrequencyString)
+		logField(d.logger, "fmt", "Bits per sample", bitsPerSample)
+		logField(d.logger, "fmt", "Sample count", sampleCount)
+		logField(d.logger, "fmt", "Block size per channel", blockSize)
+		if len(d.fmtExtension) > 0 {
+			logField(d.logger, "fmt", "Extension", d.fmtExtension)
 		}
-		d.logger.Printf("Channel order:             %v\n", s)
 	}
-	d.logger.Printf("Sampling frequency:        %vHz (%s)\n", samplingFrequency, samplingFrequencyString)
-	d.logger.Printf("Bits per sample:           %v\n", bitsPerSample)
-	d.logger.Printf("Sample count:              %v\n", sampleCount)
-	d.logger.Printf("Block size per channel:    %v bytes\n", blockSize)
 
 	// Store the information that is useful
 	d.audio.Encoding = audio.DSD
 	d.audio.NumChannels = uint(channelNum)
-	d.audio.ChannelOrder = order
+	d.audio.ChannelOrder = append(d.audio.ChannelOrder[:0], order...)
 	d.audio.SamplingFrequency = uint(samplingFrequency)
 	d.audio.BitsPerSample = uint(bitsPerSample)
 	d.audio.BlockSize = uint(blockSize)
+	d.audio.SampleCount = sampleCount
 
-	// Prepare the audio.Audio in d to hold the encoded samples
+	// Calculate the number of bytes of sample data expected in the data chunk
+	d.sampleCount = sampleCount
 	length := sampleCount
 	if bitsPerSample == 1 {
-		length = (length + 7) / 8 // fit up to 8 samples into 1 byte
+		length = length/8 + (length%8+7)/8 // fit up to 8 samples into 1 byte
+	}
+	if length > math.MaxUint64/uint64(channelNum)-uint64(blockSize) {
+		return fmt.Errorf("fmt: bad sample count: %v at offset %v\nfmt chunk: % x", sampleCount, fmtChunkOffset+fmtSampleCountOffset, d.fmt)
 	}
 	if (length % uint64(blockSize)) > 0 { // pad to the block size
 		length += uint64(blockSize) - (length % uint64(blockSize))
 	}
 	length *= uint64(channelNum) // same amount for each channel
-	d.audio.EncodedSamples = make([]byte, length)
+	d.sampleDataSize = length
+
+	// Apply any policy of the caller, before the sample data is allocated
+	if d.fmtValidator != nil {
+		if err := d.fmtValidator(d.info()); err != nil {
+			return fmt.Errorf("fmt: rejected by validator: %w", err)
+		}
+	}
 
 	return nil
 }
 
-// writeFmtChunk writes the fmt chunk.
-func (e *encoder) writeFmtChunk() error {
+// readFmtExtension reads the n bytes that follow the Reserved field of a fmt
+// chunk larger than fmtChunkSize, so that the data chunk is found after them.
+// Unless decoding strictly these are tolerated and kept in d.fmtExtension.
+func (d *decoder) readFmtExtension(n uint64) error {
+	err := d.violation(Normal,
+		fmt.Errorf("fmt: bad chunk size: %v at offset %v\nfmt chunk: % x", fmtChunkSize+n, fmtChunkOffset+fmtSizeOffset, d.fmt),
+		Warning{
+			Field:    "fmt.Size",
+			Expected: fmt.Sprint(fmtChunkSize),
+			Actual:   fmt.Sprint(fmtChunkSize + n),
+			Message:  "fmt chunk has extension bytes after the reserved field",
+		})
+	if err != nil {
+		return err
+	}
+	d.fmtExtension = make([]byte, n)
+	if m, err := io.ReadFull(d.reader, d.fmtExtension); err != nil {
+		return d.shortRead("fmt", "fmt chunk extension", fmtChunkOffset+fmtChunkSize, n, uint64(m), err)
+	}
+	return nil
+}
+
+// prepareFmtChunk sets the fields of the fmt chunk, ready to be written, or
+// returns an error if the audio.Audio cannot be encoded.
+func (e *encoder) prepareFmtChunk() error {
 	// Chunk header
 	header := fmtChunkHeader
 	copy(e.fmt.Header[:], header)
@@ -292,39 +569,82 @@ func (e *encoder) writeFmtChunk() error {
 	formatId := uint32(fmtIdentifier)
 	binary.LittleEndian.PutUint32(e.fmt.Identifier[:], formatId)
 
-	// Channel type
-	var channelType uint32
-	for key, order := range fmtChannelOrder {
-		if reflect.DeepEqual(e.audio.ChannelOrder, order) {
-			channelType = key
+	// Channel type, which may be given by WithChannelType for nonstandard
+	// layouts as long as the number of channels matches
+	channelType := e.channelType
+	if channelType != 0 {
+		if _, ok := fmtChannelType[channelType]; !ok {
+			return fmt.Errorf("fmt: unsupported channel type: %v", channelType)
+		}
+		if len(fmtChannelOrder[channelType]) != len(e.audio.ChannelOrder) {
+			return fmt.Errorf("fmt: mismatch between channel type %v and channel order: %v", channelType, e.audio.ChannelOrder)
 		}
 	}
+
+	// Mono may be in any one channel, as center is only the convention of this
+	// package, and without a channel order the number of channels gives the
+	// default channel type
+	if channelType == 0 && e.audio.NumChannels == 1 && len(e.audio.ChannelOrder) == 1 {
+		channelType = 1
+	}
+	if channelType == 0 && len(e.audio.ChannelOrder) == 0 {
+		channelType = fmtDefaultChannelType[e.audio.NumChannels]
+	}
+	if channelType == 0 {
+		channelType = fmtChannelTypeOf(e.audio.ChannelOrder)
+	}
+	if channelType == 0 && len(e.audio.ChannelOrder) == 0 {
+		return fmt.Errorf("fmt: no default channel order for %v channels, set the channel order or see WithChannelType", e.audio.NumChannels)
+	}
 	if channelType == 0 {
-		var s string
-		for i, channel := range e.audio.ChannelOrder {
-			if i < len(e.audio.ChannelOrder)-1 {
-				s += channel.String() + ", "
-			} else {
-				s += channel.String()
+		// Name the channel type with the same channels, if any, as the
+		// channels only need reordering
+		mask, err := audio.OrderToMask(e.audio.ChannelOrder)
+		for channelType := uint32(1); err == nil && channelType <= uint32(len(fmtChannelMask)); channelType++ {
+			if fmtChannelMask[channelType] == mask {
+				return fmt.Errorf("fmt: unsupported channel ordering: %v, which has the channels of %v (%v) in a different order, reorder the channels or see WithChannelType",
+					channelOrderString(e.audio.ChannelOrder), fmtChannelType[channelType], channelOrderString(fmtChannelOrder[channelType]))
 			}
 		}
-		return fmt.Errorf("fmt: unsupported channel ordering: %v", s)
+		var supported []string
+		for channelType := uint32(1); channelType <= uint32(len(fmtChannelOrder)); channelType++ {
+			supported = append(supported, fmt.Sprintf("%v (%v)", fmtChannelType[channelType], channelOrderString(fmtChannelOrder[channelType])))
+		}
+		return fmt.Errorf("fmt: unsupported channel ordering: %v, supported orderings are %v, or see WithChannelType",
+			channelOrderString(e.audio.ChannelOrder), strings.Join(supported, "; "))
 	}
 	channelTypeString, _ := fmtChannelType[channelType]
 	binary.LittleEndian.PutUint32(e.fmt.ChannelType[:], channelType)
 
 	// Channel num
 	channelNum := uint32(e.audio.NumChannels)
-	if channelNum > 1 && (channelNum != uint32(len(e.audio.ChannelOrder))) {
+	if channelNum != uint32(len(fmtChannelOrder[channelType])) {
 		return fmt.Errorf("fmt: mismatch between num channels and channel order: %v, %v", channelNum, e.audio.ChannelOrder)
 	}
 	binary.LittleEndian.PutUint32(e.fmt.ChannelNum[:], channelNum)
 
-	// SamplingFrequency
+	// SamplingFrequency, which must be defined by the specification when
+	// encoding strictly, and may be nonstandard with a warning when encoding
+	// permissively or with any frequency
 	samplingFrequency := uint32(e.audio.SamplingFrequency)
 	samplingFrequencyString, ok := fmtSamplingFrequency[samplingFrequency]
-	if !ok {
-		return fmt.Errorf("fmt: unsupported sampling frequency: %v", samplingFrequency)
+	switch {
+	case e.strictness < Normal && !slices.Contains(fmtSpecSamplingFrequencies, samplingFrequency):
+		return fmt.Errorf("fmt: unsupported sampling frequency: %v, accepted when encoding strictly are %v",
+			samplingFrequency, samplingFrequenciesString(fmtSpecSamplingFrequencies))
+	case !ok && !e.anyFrequency && e.strictness < Permissive:
+		return fmt.Errorf("fmt: unsupported sampling frequency: %v, accepted are %v, or any of at least %v when encoding permissively or with any frequency",
+			samplingFrequency, samplingFrequenciesString(nil), fmtMinSamplingFrequency)
+	case !ok && samplingFrequency < fmtMinSamplingFrequency:
+		return fmt.Errorf("fmt: unsupported sampling frequency: %v, accepted are any of at least %v", samplingFrequency, fmtMinSamplingFrequency)
+	case !ok:
+		samplingFrequencyString = "nonstandard"
+		e.warn(Warning{
+			Field:    "fmt.SamplingFrequency",
+			Expected: "a standard DSD sampling frequency",
+			Actual:   fmt.Sprint(samplingFrequency),
+			Message:  "nonstandard sampling frequency",
+		})
 	}
 	binary.LittleEndian.PutUint32(e.fmt.SamplingFrequency[:], samplingFrequency)
 
@@ -336,35 +656,53 @@ func (e *encoder) writeFmtChunk() error {
 	}
 	binary.LittleEndian.PutUint32(e.fmt.BitsPerSample[:], bitsPerSample)
 
-	// SampleCount
-
-	// Log the fields of the chunk (only active if a log output has been set)
-	e.logger.Print("\nFmt Chunk\n=========\n")
-	e.logger.Printf("Chunk header:              %q\n", header)
-	e.logger.Printf("Size of this chunk:        %v\n", size)
-	e.logger.Printf("Format version:            %v\n", formatVersion)
-	e.logger.Printf("Format id:                 %v\n", formatId)
-	e.logger.Printf("Channel type:              %v (%s)\n", channelType, channelTypeString)
-	e.logger.Printf("Channel num:               %v\n", channelNum)
-	if len(e.audio.ChannelOrder) > 1 {
-		var s string
-		for i, channel := range e.audio.ChannelOrder {
-			if i < len(e.audio.ChannelOrder)-1 {
-				s += channel.String() + ", "
-			} else {
-				s += channel.String()
-			}
-		}
-		e.logger.Printf("Channel order:             %v\n", s)
+	// Block size per channel, which is the usual 4096 bytes if not set, and
+	// may only be nonstandard unless encoding strictly
+	blockSize := uint32(e.blockSize())
+	if blockSize != fmtBlockSize && (!isValidBlockSize(blockSize) || e.strictness < Normal) {
+		return fmt.Errorf("fmt: unsupported block size: %v", blockSize)
 	}
-	e.logger.Printf("Sampling frequency:        %vHz (%s)\n", samplingFrequency, samplingFrequencyString)
-	e.logger.Printf("Bits per sample:           %v\n", bitsPerSample)
 
-	// Write the entire chunk in one go
-	err := binary.Write(e.writer, binary.LittleEndian, &e.fmt)
-	if err != nil {
-		return err
+	// SampleCount, as planned from the sample data if it has not been set
+	sampleCount := e.layout.SampleCount
+	if maxSampleCount := e.maxSampleCount(); sampleCount > maxSampleCount {
+		return fmt.Errorf("fmt: sample count %v exceeds the %v samples per channel", sampleCount, maxSampleCount)
+	}
+	binary.LittleEndian.PutUint64(e.fmt.SampleCount[:], sampleCount)
+	binary.LittleEndian.PutUint32(e.fmt.BlockSize[:], blockSize)
+
+	// Reserved, which is zero whatever was written before
+	reserved := uint32(fmtReserved)
+	binary.LittleEndian.PutUint32(e.fmt.Reserved[:], reserved)
+
+	// Log the fields of the chunk (only active if debug logging is enabled)
+	if logEnabled(e.logger) {
+		logField(e.logger, "fmt", "Chunk header", header)
+		logField(e.logger, "fmt", "Size of this chunk", size)
+		logField(e.logger, "fmt", "Format version", formatVersion)
+		logField(e.logger, "fmt", "Format id", formatId)
+		logField(e.logger, "fmt", "Channel type", channelType, channelTypeString)
+		logField(e.logger, "fmt", "Channel num", channelNum)
+		order := e.audio.ChannelOrder
+		if len(order) == 0 {
+			order = fmtChannelOrder[channelType]
+		}
+		if len(order) > 1 {
+			logField(e.logger, "fmt", "Channel order", channelOrderString(order))
+		}
+		logField(e.logger, "fmt", "Sampling frequency", samplingFrequency, samplingFrequencyString)
+		logField(e.logger, "fmt", "Bits per sample", bitsPerSample)
+		logField(e.logger, "fmt", "Sample count", sampleCount)
+		logField(e.logger, "fmt", "Block size per channel", blockSize)
 	}
 
 	return nil
 }
+
+// writeFmtChunk writes the fmt chunk, which must already be prepared.
+func (e *encoder) writeFmtChunk() error {
+	// Write the entire chunk in one go
+	var b [fmtChunkSize]byte
+	e.fmt.encode(b[:])
+	return e.write(b[:])
+}
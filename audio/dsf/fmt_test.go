@@ -6,11 +6,17 @@ package dsf
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/snmoore/go/audio"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 // A valid fmt chunk
@@ -105,13 +111,20 @@ var fmtChunkTests = []test{
 	{"Reading a fmt chunk that has matched channel type and number of channels (5 channels) should not result in an error", 20, []byte{6, 0, 0, 0, 5, 0, 0, 0}, false},
 	{"Reading a fmt chunk that has matched channel type and number of channels (5.1 channels) should not result in an error", 20, []byte{7, 0, 0, 0, 6, 0, 0, 0}, false},
 
-	// Sampling frequency: should be 2822400Hz, 5644800Hz, 11289600Hz or 22579200Hz
+	// Sampling frequency: should be a multiple of 44100Hz or 48000Hz from DSD64 to DSD1024
 	// Only 2822400Hz and 5644800Hz are defined by the specification, but the other rates are in active use
 	{"Reading a fmt chunk that has an invalid sampling frequency (44100Hz) should result in an error", 28, []byte{0x44, 0xAC, 0x00, 0x00}, true},
 	{"Reading a fmt chunk that has a valid sampling frequency (2822400Hz) should not result in an error", 28, []byte{0x00, 0x11, 0x2B, 0x00}, false},
 	{"Reading a fmt chunk that has a valid sampling frequency (5644800Hz) should not result in an error", 28, []byte{0x00, 0x22, 0x56, 0x00}, false},
 	{"Reading a fmt chunk that has a valid sampling frequency (11289600Hz) should not result in an error", 28, []byte{0x00, 0x44, 0xAC, 0x00}, false},
 	{"Reading a fmt chunk that has a valid sampling frequency (22579200Hz) should not result in an error", 28, []byte{0x00, 0x88, 0x58, 0x01}, false},
+	{"Reading a fmt chunk that has a valid sampling frequency (45158400Hz) should not result in an error", 28, []byte{0x00, 0x10, 0xB1, 0x02}, false},
+	{"Reading a fmt chunk that has a valid sampling frequency (3072000Hz) should not result in an error", 28, []byte{0x00, 0xE0, 0x2E, 0x00}, false},
+	{"Reading a fmt chunk that has a valid sampling frequency (6144000Hz) should not result in an error", 28, []byte{0x00, 0xC0, 0x5D, 0x00}, false},
+	{"Reading a fmt chunk that has a valid sampling frequency (12288000Hz) should not result in an error", 28, []byte{0x00, 0x80, 0xBB, 0x00}, false},
+	{"Reading a fmt chunk that has a valid sampling frequency (24576000Hz) should not result in an error", 28, []byte{0x00, 0x00, 0x77, 0x01}, false},
+	{"Reading a fmt chunk that has a valid sampling frequency (49152000Hz) should not result in an error", 28, []byte{0x00, 0x00, 0xEE, 0x02}, false},
+	{"Reading a fmt chunk that has an invalid sampling frequency (2822401Hz) should result in an error", 28, []byte{0x01, 0x11, 0x2B, 0x00}, true},
 
 	// Bits per sample: should be 1 or 8
 	{"Reading a fmt chunk that has an invalid number of bits per sample (0) should result in an error", 32, []byte{0}, true},
@@ -139,9 +152,9 @@ func TestFmtRead(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Run each test
@@ -186,19 +199,703 @@ func TestFmtReadError(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Read an empty chunk to force a read error
 	d.reader = bytes.NewReader([]byte{})
 	err := d.readFmtChunk()
 
-	// Reading the chunk should have thrown an error
-	if err == nil {
-		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", len(fmtChunkTests)+1, description)
+	// Reading the chunk should have thrown an error wrapping io.ErrUnexpectedEOF
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", len(fmtChunkTests)+1, description, io.ErrUnexpectedEOF, err)
 	} else {
 		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", len(fmtChunkTests)+1, description, err.Error())
 	}
 }
+
+// Table driven fmt chunk tests when reading in lenient mode
+var fmtChunkLenientTests = []test{
+	// Block size per channel: should be a power of two from 64 to 65536 bytes
+	{"Reading a fmt chunk in lenient mode that has a valid block size (1024) should not result in an error", 44, []byte{0x00, 0x04, 0x00, 0x00}, false},
+	{"Reading a fmt chunk in lenient mode that has a valid block size (65536) should not result in an error", 44, []byte{0x00, 0x00, 0x01, 0x00}, false},
+	{"Reading a fmt chunk in lenient mode that has an invalid block size (1000) should result in an error", 44, []byte{0xE8, 0x03, 0x00, 0x00}, true},
+	{"Reading a fmt chunk in lenient mode that has an invalid block size (32) should result in an error", 44, []byte{0x20, 0x00, 0x00, 0x00}, true},
+	{"Reading a fmt chunk in lenient mode that has an invalid block size (131072) should result in an error", 44, []byte{0x00, 0x00, 0x02, 0x00}, true},
+
+	// Reserved bytes: non-zero bytes should be tolerated
+	{"Reading a fmt chunk in lenient mode that has invalid reserved bytes (non-zero) should not result in an error", 48, []byte{0x01, 0x02, 0x03, 0x04}, false},
+}
+
+// Run the table driven tests in lenient mode
+func TestFmtReadLenient(t *testing.T) {
+	// Run each test
+	for i, test := range fmtChunkLenientTests {
+		// Prepare a decoder in lenient mode
+		var d decoder
+		d.audio = new(audio.Audio)
+		d.strictness = Normal
+
+		// Only log the chunk contents if verbose is enabled
+		if testing.Verbose() {
+			d.logger = newLogger(os.Stdout)
+		} else {
+			d.logger = newLogger(ioutil.Discard)
+		}
+
+		// Start with a valid chunk
+		c := make([]byte, len(validFmtChunk))
+		copy(c, validFmtChunk)
+
+		// Patch the test data into the valid chunk
+		copy(c[test.offset:], test.data)
+
+		// Read the chunk
+		d.reader = bytes.NewReader(c)
+		err := d.readFmtChunk()
+
+		// Check the result from reading the chunk
+		if test.expectError {
+			// Reading the chunk should have thrown an error
+			if err == nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", i+1, test.description)
+			} else {
+				t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+			}
+		} else {
+			// Reading the chunk should not have thrown an error, but should have
+			// recorded a warning
+			if err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			} else if len(d.warnings) != 1 {
+				t.Errorf("FAIL Test %v: %v:\nWant: 1 warning\nActual: %v", i+1, test.description, d.warnings)
+			} else {
+				t.Logf("PASS Test %v: %v:\nWant: nil\nActual: nil", i+1, test.description)
+			}
+		}
+	}
+}
+
+// The expected size of the sample data should use the actual block size
+func TestFmtReadBlockSize(t *testing.T) {
+	description := "The expected size of the sample data should use the actual block size"
+
+	// Read the whole DSD stream file into memory
+	b, err := ioutil.ReadFile("test/valid_without_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+
+	// Use a block size of 1024 bytes, reducing the sample data accordingly
+	b = b[:92+1024]
+	binary.LittleEndian.PutUint64(b[12:], uint64(len(b)))
+	binary.LittleEndian.PutUint32(b[72:], 1024)
+	binary.LittleEndian.PutUint64(b[84:], 12+1024)
+
+	// Decoding in lenient mode should not result in an error
+	a, err := Decode(bytes.NewReader(b), nil, WithLenient())
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	if a.BlockSize != 1024 || len(a.EncodedSamples) != 1024 {
+		t.Errorf("FAIL Test 1: %v:\nWant: 1024 byte blocks\nActual: %v byte blocks, %v bytes of samples", description, a.BlockSize, len(a.EncodedSamples))
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+}
+
+// A file with a 48kHz family sampling frequency should be decoded, and a file
+// with a nonstandard sampling frequency should only be decoded with a warning
+// when any frequency is accepted
+func TestFmtReadSamplingFrequency(t *testing.T) {
+	description := "A file with a 48kHz family or nonstandard sampling frequency should be decoded"
+
+	// Read the whole DSD stream file into memory
+	b, err := ioutil.ReadFile("test/valid_without_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+
+	// DSD128/48k should be decoded
+	binary.LittleEndian.PutUint32(b[56:], 6144000)
+	a, err := Decode(bytes.NewReader(b), nil)
+	if err != nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if a.SamplingFrequency != 6144000 {
+		t.Errorf("FAIL Test 1: %v:\nWant: 6144000Hz\nActual: %vHz", description, a.SamplingFrequency)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	// A nonstandard frequency should result in an error
+	binary.LittleEndian.PutUint32(b[56:], 4000000)
+	_, err = Decode(bytes.NewReader(b), nil)
+	if err == nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 2: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	// A nonstandard frequency should be decoded with a warning when any frequency is accepted
+	var warnings []Warning
+	a, err = Decode(bytes.NewReader(b), nil, WithAnyFrequency(), WithWarnings(&warnings))
+	if err != nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if a.SamplingFrequency != 4000000 || len(warnings) != 1 {
+		t.Errorf("FAIL Test 3: %v:\nWant: 4000000Hz and 1 warning\nActual: %vHz and %v", description, a.SamplingFrequency, warnings)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+
+	// A frequency below the minimum should result in an error even when any frequency is accepted
+	binary.LittleEndian.PutUint32(b[56:], 44100)
+	_, err = Decode(bytes.NewReader(b), nil, WithAnyFrequency())
+	if err == nil {
+		t.Errorf("FAIL Test 4: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 4: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// The sample count should be preserved when decoding, and written when encoding
+func TestFmtSampleCount(t *testing.T) {
+	description := "The sample count should be preserved when decoding"
+
+	// 1000 samples per channel fill 125 bytes of each 4096 byte block
+	samples := make([]byte, 2*4096)
+	c := newTestFile(2, 2, 1000, uint64(len(samples)), samples, nil)
+	a, err := Decode(bytes.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	if a.SampleCount != 1000 || a.PaddingSize() != 4096-125 {
+		t.Errorf("FAIL Test 1: %v:\nWant: 1000 samples, %v bytes of padding\nActual: %v samples, %v bytes of padding", description, 4096-125, a.SampleCount, a.PaddingSize())
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	// The sample count should be written to the fmt chunk
+	description = "The sample count should be written when encoding"
+	var b bytes.Buffer
+	e := encoder{logger: newLogger(ioutil.Discard), audio: a, writer: &b, sampleDataSize: a.EncodedSize()}
+	if err := writeFmtChunk(&e); err != nil {
+		t.Fatalf("FAIL Test 2: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	if actual := binary.LittleEndian.Uint64(b.Bytes()[36:]); actual != 1000 {
+		t.Errorf("FAIL Test 2: %v:\nWant: 1000\nActual: %v", description, actual)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	// A sample count exceeding the sample data should result in an error
+	description = "A sample count exceeding the sample data should result in an error when encoding"
+	a.SampleCount = 2*4096*8 + 1
+	if err := writeFmtChunk(&e); err == nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 3: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// Table of sample counts around a block boundary, and the expected size of the
+// sample data for each channel including the padding of the final block
+var alignedSampleCountTests = []struct {
+	sampleCount uint64
+	size        int
+}{
+	{4096*8 - 1, 4096},
+	{4096 * 8, 4096},
+	{4096*8 + 1, 2 * 4096},
+	{2 * 4096 * 8, 2 * 4096},
+}
+
+// A sample count that exactly fills the final block should not be padded by a
+// further block
+func TestFmtReadAlignedSampleCount(t *testing.T) {
+	for i, test := range alignedSampleCountTests {
+		description := fmt.Sprintf("A sample count of %v should need %v bytes of sample data per channel", test.sampleCount, test.size)
+		samples := make([]byte, 2*test.size)
+		c := newTestFile(2, 2, test.sampleCount, uint64(len(samples)), samples, nil)
+		a, err := Decode(bytes.NewReader(c), nil)
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		} else if len(a.EncodedSamples) != len(samples) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v bytes\nActual: %v bytes", i+1, description, len(samples), len(a.EncodedSamples))
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+}
+
+// The channel order may be overridden when decoding, and the channel type when
+// encoding, for nonstandard layouts
+func TestFmtChannelOrder(t *testing.T) {
+	// 4 channels declared as channel type 5, but holding L, R, Ls, Rs
+	order := []audio.Channel{audio.FrontLeft, audio.FrontRight, audio.BackLeft, audio.BackRight}
+	samples := make([]byte, 4*4096)
+	c := newTestFile(5, 4, 1, uint64(len(samples)), samples, nil)
+
+	description := "The channel order should be overridden when decoding"
+	a, err := Decode(bytes.NewReader(c), nil, WithChannelOrder(order))
+	if err != nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if !reflect.DeepEqual(a.ChannelOrder, order) {
+		t.Errorf("FAIL Test 1: %v:\nWant: %v\nActual: %v", description, order, a.ChannelOrder)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "A channel order override of the wrong length should result in an error when decoding"
+	if _, err := Decode(bytes.NewReader(c), nil, WithChannelOrder(order[:3])); err == nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 2: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	// Without the override the channel order matches channel type 4, not 5
+	description = "The channel type should be overridden when encoding"
+	var b bytes.Buffer
+	e := encoder{logger: newLogger(ioutil.Discard), audio: a, writer: &b, sampleDataSize: a.EncodedSize()}
+	e.channelType = 5
+	if err := writeFmtChunk(&e); err != nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if actual := binary.LittleEndian.Uint32(b.Bytes()[20:]); actual != 5 {
+		t.Errorf("FAIL Test 3: %v:\nWant: 5\nActual: %v", description, actual)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+
+	description = "A channel type override with a different number of channels should result in an error when encoding"
+	e.channelType = 6
+	if err := e.prepareFmtChunk(); err == nil {
+		t.Errorf("FAIL Test 4: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 4: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	description = "A nonstandard channel order should result in an error when encoding without an override"
+	a.ChannelOrder = []audio.Channel{audio.FrontRight, audio.FrontLeft, audio.BackLeft, audio.BackRight}
+	e.channelType = 0
+	if err := e.prepareFmtChunk(); err == nil {
+		t.Errorf("FAIL Test 5: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 5: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// Insert extension bytes after the Reserved field of the fmt chunk of a test
+// file, adjusting the chunk size, total file size and metadata pointer to suit
+func withFmtExtension(c, extension []byte) []byte {
+	n := uint64(len(extension))
+	at := fmtChunkOffset + fmtChunkSize
+	c = append(c[:at:at], append(append([]byte{}, extension...), c[at:]...)...)
+	binary.LittleEndian.PutUint64(c[12:], binary.LittleEndian.Uint64(c[12:])+n)
+	if pointer := binary.LittleEndian.Uint64(c[20:]); pointer != 0 {
+		binary.LittleEndian.PutUint64(c[20:], pointer+n)
+	}
+	binary.LittleEndian.PutUint64(c[fmtChunkOffset+fmtSizeOffset:], fmtChunkSize+n)
+	return c
+}
+
+// A fmt chunk larger than 52 bytes should be accepted unless decoding strictly,
+// with the extension bytes skipped so that the data chunk is still found
+func TestFmtExtension(t *testing.T) {
+	extension := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	samples := make([]byte, 4096)
+	for i := range samples {
+		samples[i] = byte(i)
+	}
+	metadata := []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	c := withFmtExtension(newTestFile(1, 1, 4096*8, 4096, samples, metadata), extension)
+
+	description := "A 60 byte fmt chunk should be accepted, with its extension captured"
+	var warnings []Warning
+	result, err := DecodeWithDetails(bytes.NewReader(c), nil, WithWarnings(&warnings))
+	switch {
+	case err != nil:
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	case !bytes.Equal(result.FmtExtension, extension):
+		t.Errorf("FAIL Test 1: %v:\nWant: % x\nActual: % x", description, extension, result.FmtExtension)
+	case !bytes.Equal(result.Audio.EncodedSamples, samples) || !bytes.Equal(result.Audio.Metadata, metadata):
+		t.Errorf("FAIL Test 1: %v:\nWant: samples and metadata\nActual: % x...\n% x", description, result.Audio.EncodedSamples[:8], result.Audio.Metadata)
+	case result.Fmt.Size != 60:
+		t.Errorf("FAIL Test 1: %v:\nWant: 60\nActual: %v", description, result.Fmt.Size)
+	case len(warnings) != 1 || warnings[0].Field != "fmt.Size":
+		t.Errorf("FAIL Test 1: %v:\nWant: fmt.Size warning\nActual: %v", description, warnings)
+	default:
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "A 60 byte fmt chunk should be accepted when decoding from bytes"
+	if a, err := DecodeBytes(c); err != nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if !bytes.Equal(a.EncodedSamples, samples) || !bytes.Equal(a.Metadata, metadata) {
+		t.Errorf("FAIL Test 2: %v:\nWant: samples and metadata\nActual: % x...\n% x", description, a.EncodedSamples[:8], a.Metadata)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	description = "A 60 byte fmt chunk should result in an error when decoding strictly"
+	if _, err := Decode(bytes.NewReader(c), nil, WithStrictness(Strict)); err == nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 3: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	description = "A fmt chunk extension that is truncated should result in an error"
+	if _, err := Decode(bytes.NewReader(c[:fmtChunkOffset+fmtChunkSize+4]), nil); err == nil {
+		t.Errorf("FAIL Test 4: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 4: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	description = "A fmt chunk extension that is too large should result in an error"
+	binary.LittleEndian.PutUint64(c[fmtChunkOffset+fmtSizeOffset:], fmtChunkSize+fmtMaxExtensionSize+1)
+	if _, err := Decode(bytes.NewReader(c), nil); err == nil {
+		t.Errorf("FAIL Test 5: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 5: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// A fmt validator should see the format before anything else is read, and be
+// able to reject it
+func TestFmtValidator(t *testing.T) {
+	samples := make([]byte, 2*4096)
+	c := newTestFile(2, 2, 1000, uint64(len(samples)), samples, nil)
+	errPolicy := errors.New("only DSD128 is accepted")
+	policy := func(info Info) error {
+		if info.SamplingFrequency != 5644800 {
+			return errPolicy
+		}
+		return nil
+	}
+
+	description := "A fmt validator should be called once with the format of the audio"
+	var calls []Info
+	if _, err := Decode(bytes.NewReader(c), nil, WithFmtValidator(func(info Info) error {
+		calls = append(calls, info)
+		return nil
+	})); err != nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if len(calls) != 1 || calls[0].SamplingFrequency != 2822400 || calls[0].NumChannels != 2 ||
+		calls[0].BitsPerSample != 1 || calls[0].BlockSize != 4096 || calls[0].SampleCount != 1000 {
+		t.Errorf("FAIL Test 1: %v:\nWant: 1 call\nActual: %+v", description, calls)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	// Nothing after the fmt chunk should be read once the format is rejected
+	description = "A fmt validator should abort decoding with its error wrapped"
+	input := io.MultiReader(bytes.NewReader(c[:dsdChunkSize+fmtChunkSize]), failingReader{})
+	if a, err := Decode(input, nil, WithFmtValidator(policy)); a != nil || !errors.Is(err, errPolicy) {
+		t.Errorf("FAIL Test 2: %v:\nWant: %v\nActual: %v", description, errPolicy, err)
+	} else {
+		t.Logf("PASS Test 2: %v:\n%v", description, err.Error())
+	}
+
+	description = "A fmt validator should also apply when decoding only the format"
+	if _, err := DecodeInfo(bytes.NewReader(c), WithFmtValidator(policy)); !errors.Is(err, errPolicy) {
+		t.Errorf("FAIL Test 3: %v:\nWant: %v\nActual: %v", description, errPolicy, err)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+
+	description = "A fmt validator that accepts the format should not affect decoding"
+	binary.LittleEndian.PutUint32(c[dsdChunkSize+fmtSamplingFrequencyOffset:], 5644800)
+	if _, err := Decode(bytes.NewReader(c), nil, WithFmtValidator(policy)); err != nil {
+		t.Errorf("FAIL Test 4: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else {
+		t.Logf("PASS Test 4: %v", description)
+	}
+}
+
+// writeFmtChunk plans the layout, then prepares and writes the fmt chunk for e
+func writeFmtChunk(e *encoder) error {
+	e.planLayout()
+	if err := e.prepareFmtChunk(); err != nil {
+		return err
+	}
+	return e.writeFmtChunk()
+}
+
+// Table structure for a single fmt chunk writing test
+type fmtWriteTest struct {
+	// Description for the test
+	description string
+	// Audio to write the fmt chunk for
+	audio audio.Audio
+	// Expected block size and sample count when the chunk is read back
+	blockSize   uint
+	sampleCount uint64
+}
+
+// Table of all fmt chunk writing tests, using DSD64
+var fmtWriteTests = []fmtWriteTest{
+	{"The block size and sample count should be written as given",
+		audio.Audio{NumChannels: 1, ChannelOrder: []audio.Channel{audio.Center}, SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096, SampleCount: 1000, EncodedSamples: make([]byte, 4096)},
+		4096, 1000},
+	{"A block size that is not set should be written as 4096",
+		audio.Audio{NumChannels: 1, ChannelOrder: []audio.Channel{audio.Center}, SamplingFrequency: 2822400, BitsPerSample: 1, SampleCount: 1000, EncodedSamples: make([]byte, 4096)},
+		4096, 1000},
+	{"A 1-bit sample count that is not set should be derived from the sample data",
+		audio.Audio{NumChannels: 2, ChannelOrder: []audio.Channel{audio.FrontLeft, audio.FrontRight}, SamplingFrequency: 2822400, BitsPerSample: 1, EncodedSamples: make([]byte, 2*2*4096)},
+		4096, 2 * 4096 * 8},
+	{"An 8-bit sample count that is not set should be derived from the sample data",
+		audio.Audio{NumChannels: 2, ChannelOrder: []audio.Channel{audio.FrontLeft, audio.FrontRight}, SamplingFrequency: 2822400, BitsPerSample: 8, EncodedSamples: make([]byte, 2*4096)},
+		4096, 4096},
+}
+
+// Run all fmt chunk writing tests, reading each chunk back strictly
+func TestFmtWrite(t *testing.T) {
+	for i, test := range fmtWriteTests {
+		// Anything left in the Reserved field from before should be cleared
+		var b bytes.Buffer
+		e := encoder{logger: newLogger(ioutil.Discard), audio: &test.audio, writer: &b, sampleDataSize: test.audio.EncodedSize()}
+		copy(e.fmt.Reserved[:], []byte{1, 2, 3, 4})
+		if err := writeFmtChunk(&e); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+
+		d := decoder{logger: newLogger(ioutil.Discard), audio: new(audio.Audio), reader: bytes.NewReader(b.Bytes())}
+		d.strictness = Strict
+		err := d.readFmtChunk()
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case d.audio.BlockSize != test.blockSize || d.audio.SampleCount != test.sampleCount || d.fmt.Details().Reserved != 0:
+			t.Errorf("FAIL Test %v: %v:\nWant: block size %v, sample count %v and reserved 0\nActual: %+v", i+1, test.description, test.blockSize, test.sampleCount, d.fmt.Details())
+		case d.audio.NumChannels != test.audio.NumChannels || d.audio.BitsPerSample != test.audio.BitsPerSample || d.audio.SamplingFrequency != test.audio.SamplingFrequency:
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v", i+1, test.description, test.audio, d.audio)
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// Table of channel orders of mono audio that should all be encoded as mono
+var monoChannelOrders = []struct {
+	description string
+	order       []audio.Channel
+}{
+	{"Mono audio in the center channel should be encoded as mono", []audio.Channel{audio.Center}},
+	{"Mono audio in the front left channel should be encoded as mono", []audio.Channel{audio.FrontLeft}},
+	{"Mono audio without a channel order should be encoded as mono", nil},
+}
+
+// Run all mono encoding tests, checking that the channel type is mono and that
+// the audio is decoded in the center channel
+func TestFmtWriteMono(t *testing.T) {
+	for i, test := range monoChannelOrders {
+		a := audio.Audio{Encoding: audio.DSD, NumChannels: 1, ChannelOrder: test.order, SamplingFrequency: 2822400, BitsPerSample: 1,
+			SampleCount: 4096 * 8, EncodedSamples: make([]byte, 4096)}
+		var b bytes.Buffer
+		if err := Encode(&a, &b, nil); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+		actual, err := Decode(bytes.NewReader(b.Bytes()), nil, WithStrictness(Strict))
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case binary.LittleEndian.Uint32(b.Bytes()[fmtChunkOffset+fmtChannelTypeOffset:]) != 1:
+			t.Errorf("FAIL Test %v: %v:\nWant: channel type 1\nActual: %v", i+1, test.description, binary.LittleEndian.Uint32(b.Bytes()[fmtChunkOffset+fmtChannelTypeOffset:]))
+		case !reflect.DeepEqual(actual.ChannelOrder, []audio.Channel{audio.Center}):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, []audio.Channel{audio.Center}, actual.ChannelOrder)
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+
+	description := "Mono audio with a channel order of more than one channel should result in an error"
+	a := audio.Audio{Encoding: audio.DSD, NumChannels: 1, ChannelOrder: []audio.Channel{audio.FrontLeft, audio.FrontRight}, SamplingFrequency: 2822400,
+		BitsPerSample: 1, SampleCount: 4096 * 8, EncodedSamples: make([]byte, 4096)}
+	if err := Encode(&a, new(bytes.Buffer), nil); err == nil {
+		t.Errorf("FAIL Test 4: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 4: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// Table of the default channel order and channel type for each number of
+// channels, for audio without a channel order
+var defaultChannelOrderTests = []struct {
+	numChannels uint
+	channelType uint32
+	order       []audio.Channel
+}{
+	{1, 1, []audio.Channel{audio.Center}},
+	{2, 2, []audio.Channel{audio.FrontLeft, audio.FrontRight}},
+	{3, 3, []audio.Channel{audio.FrontLeft, audio.FrontRight, audio.Center}},
+	{4, 4, []audio.Channel{audio.FrontLeft, audio.FrontRight, audio.BackLeft, audio.BackRight}},
+	{5, 6, []audio.Channel{audio.FrontLeft, audio.FrontRight, audio.Center, audio.BackLeft, audio.BackRight}},
+	{6, 7, []audio.Channel{audio.FrontLeft, audio.FrontRight, audio.Center, audio.LowFrequency, audio.BackLeft, audio.BackRight}},
+}
+
+// Run all default channel order tests, checking that audio with only the number
+// of channels is encoded with the default channel type and decoded in the
+// default order, without the audio being modified
+func TestFmtWriteDefaultChannelOrder(t *testing.T) {
+	for i, test := range defaultChannelOrderTests {
+		description := fmt.Sprintf("%v channels without a channel order should be encoded in the default order", test.numChannels)
+		a := audio.Audio{Encoding: audio.DSD, NumChannels: test.numChannels, SamplingFrequency: 2822400, BitsPerSample: 1,
+			SampleCount: 4096 * 8, EncodedSamples: make([]byte, 4096*test.numChannels)}
+		var b bytes.Buffer
+		if err := Encode(&a, &b, nil); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+			continue
+		}
+		actual, err := Decode(bytes.NewReader(b.Bytes()), nil, WithStrictness(Strict))
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		case binary.LittleEndian.Uint32(b.Bytes()[fmtChunkOffset+fmtChannelTypeOffset:]) != test.channelType:
+			t.Errorf("FAIL Test %v: %v:\nWant: channel type %v\nActual: %v", i+1, description, test.channelType, binary.LittleEndian.Uint32(b.Bytes()[fmtChunkOffset+fmtChannelTypeOffset:]))
+		case !reflect.DeepEqual(actual.ChannelOrder, test.order):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, description, test.order, actual.ChannelOrder)
+		case a.ChannelOrder != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: the audio unchanged\nActual: channel order %v", i+1, description, a.ChannelOrder)
+		default:
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+
+	n := len(defaultChannelOrderTests)
+	for i, test := range []struct {
+		description string
+		numChannels uint
+		order       []audio.Channel
+	}{
+		{"7 channels without a channel order should result in an error", 7, nil},
+		{"No channels without a channel order should result in an error", 0, nil},
+		{"A channel order inconsistent with the number of channels should result in an error", 2, defaultChannelOrderTests[2].order},
+	} {
+		a := audio.Audio{Encoding: audio.DSD, NumChannels: test.numChannels, ChannelOrder: test.order, SamplingFrequency: 2822400,
+			BitsPerSample: 1, SampleCount: 4096 * 8, EncodedSamples: make([]byte, 4096*test.numChannels)}
+		if err := Encode(&a, new(bytes.Buffer), nil); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", n+i+1, test.description)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", n+i+1, test.description, err.Error())
+		}
+	}
+}
+
+// Table of channel orders and the channel type each should be encoded as, or 0
+// if there is none
+var channelTypeTests = []struct {
+	order       []audio.Channel
+	channelType uint32
+}{
+	{[]audio.Channel{audio.Center}, 1},
+	{[]audio.Channel{audio.FrontLeft, audio.FrontRight}, 2},
+	{[]audio.Channel{audio.FrontLeft, audio.FrontRight, audio.Center}, 3},
+	{[]audio.Channel{audio.FrontLeft, audio.FrontRight, audio.BackLeft, audio.BackRight}, 4},
+	{[]audio.Channel{audio.FrontLeft, audio.FrontRight, audio.Center, audio.LowFrequency}, 5},
+	{[]audio.Channel{audio.FrontLeft, audio.FrontRight, audio.Center, audio.BackLeft, audio.BackRight}, 6},
+	{[]audio.Channel{audio.FrontLeft, audio.FrontRight, audio.Center, audio.LowFrequency, audio.BackLeft, audio.BackRight}, 7},
+	{[]audio.Channel{audio.FrontRight, audio.FrontLeft}, 0},
+	{[]audio.Channel{}, 0},
+	{nil, 0},
+}
+
+// Run all channel type tests, then check that an unsupported channel order
+// results in an error listing the supported ones unless the channel type is
+// given
+func TestFmtChannelType(t *testing.T) {
+	for i, test := range channelTypeTests {
+		description := fmt.Sprintf("Channel order %v should be channel type %v", test.order, test.channelType)
+		if actual := fmtChannelTypeOf(test.order); actual != test.channelType {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, description, test.channelType, actual)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+
+	n := len(channelTypeTests) + 1
+	description := "An unsupported channel order should result in an error listing the supported ones"
+	a, _ := audio.NewSilence(10*time.Millisecond, 2822400, []audio.Channel{audio.FrontRight, audio.FrontLeft})
+	err := Encode(a, ioutil.Discard, nil)
+	if err == nil || !strings.Contains(err.Error(), "front right, front left") || !strings.Contains(err.Error(), "stereo (front left, front right)") {
+		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v", n, description, err)
+	} else {
+		t.Logf("PASS Test %v: %v:\n%v", n, description, err.Error())
+	}
+
+	description = "An unsupported channel order without the channels of a channel type should result in an error listing the supported ones"
+	a.ChannelOrder = []audio.Channel{audio.SideLeft, audio.SideRight}
+	err = Encode(a, ioutil.Discard, nil)
+	if err == nil || !strings.Contains(err.Error(), "side left, side right") || !strings.Contains(err.Error(), "5.1 channels (") {
+		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v", n+1, description, err)
+	} else {
+		t.Logf("PASS Test %v: %v:\n%v", n+1, description, err.Error())
+	}
+	a.ChannelOrder = []audio.Channel{audio.FrontRight, audio.FrontLeft}
+	n++
+
+	description = "An unsupported channel order should be encoded as the channel type given"
+	var b bytes.Buffer
+	if err := Encode(a, &b, nil, WithChannelType(2)); err != nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", n+1, description, err.Error())
+	} else if actual := binary.LittleEndian.Uint32(b.Bytes()[fmtChunkOffset+fmtChannelTypeOffset:]); actual != 2 {
+		t.Errorf("FAIL Test %v: %v:\nWant: 2\nActual: %v", n+1, description, actual)
+	} else {
+		t.Logf("PASS Test %v: %v", n+1, description)
+	}
+}
+
+// The set of channels of each channel type should match its channel order
+func TestFmtChannelMask(t *testing.T) {
+	for channelType := uint32(1); channelType <= uint32(len(fmtChannelOrder)); channelType++ {
+		description := fmt.Sprintf("Channel type %v should have the channels of its channel order", channelType)
+		mask, err := audio.OrderToMask(fmtChannelOrder[channelType])
+		if err != nil || mask != fmtChannelMask[channelType] {
+			t.Errorf("FAIL Test %v: %v:\nWant: %#x\nActual: %#x, %v", channelType, description, fmtChannelMask[channelType], mask, err)
+		} else {
+			t.Logf("PASS Test %v: %v", channelType, description)
+		}
+	}
+}
+
+// A rejected sampling frequency should result in an error listing those that
+// are accepted, and a nonstandard one permitted should result in one warning
+func TestFmtWriteSamplingFrequency(t *testing.T) {
+	newAudio := func(samplingFrequency uint) *audio.Audio {
+		a, _ := audio.NewSilence(10*time.Millisecond, samplingFrequency, []audio.Channel{audio.Center})
+		return a
+	}
+
+	description := "A sampling frequency rejected when encoding strictly should list those defined by the specification"
+	err := Encode(newAudio(11289600), ioutil.Discard, nil, WithStrictness(Strict))
+	if err == nil || !strings.Contains(err.Error(), "2822400 (DSD64), 5644800 (DSD128)") || strings.Contains(err.Error(), "DSD256") {
+		t.Errorf("FAIL Test 1: %v:\nWant: error listing DSD64 and DSD128\nActual: %v", description, err)
+	} else {
+		t.Logf("PASS Test 1: %v:\n%v", description, err.Error())
+	}
+
+	description = "A sampling frequency rejected when encoding should list the standard ones"
+	err = Encode(newAudio(3000000), ioutil.Discard, nil)
+	if err == nil || !strings.Contains(err.Error(), "3072000 (DSD64/48k)") || !strings.Contains(err.Error(), "45158400 (DSD1024)") {
+		t.Errorf("FAIL Test 2: %v:\nWant: error listing the standard sampling frequencies\nActual: %v", description, err)
+	} else {
+		t.Logf("PASS Test 2: %v:\n%v", description, err.Error())
+	}
+
+	description = "A nonstandard sampling frequency permitted when encoding permissively should result in one warning"
+	var warnings []Warning
+	var b seekBuffer
+	wr, err := NewWriter(&b, Info{NumChannels: 1, ChannelOrder: []audio.Channel{audio.Center}, SamplingFrequency: 3000000, BitsPerSample: 1},
+		WithStrictness(Permissive), WithWarnings(&warnings))
+	if err == nil {
+		if err = wr.WriteSamples(make([]byte, 4096)); err == nil {
+			err = wr.Close()
+		}
+	}
+	if err != nil || len(warnings) != 1 || warnings[0].Field != "fmt.SamplingFrequency" {
+		t.Errorf("FAIL Test 3: %v:\nWant: 1 warning\nActual: %v, %v", description, warnings, err)
+	} else {
+		t.Logf("PASS Test 3: %v: %v", description, warnings[0])
+	}
+}
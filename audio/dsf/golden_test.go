@@ -0,0 +1,196 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/snmoore/go/audio"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// Whether to update the golden files rather than compare with them, as in
+// go test -run TestGolden -update
+var update = flag.Bool("update", false, "update the golden files")
+
+// Table structure for a single golden file test
+type goldenTest struct {
+	// Description for the test
+	description string
+	// Golden file, in the test directory
+	golden string
+	// Channel order, sampling frequency and sample count of the audio
+	order             []audio.Channel
+	samplingFrequency uint
+	sampleCount       uint64
+	// Metadata of the audio, if any
+	metadata []byte
+}
+
+// An ID3v2 tag holding a title
+var goldenTag = id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x00Title")))
+
+// Table of all golden file tests, using blocks of 4096 bytes
+var goldenTests = []goldenTest{
+	{"Mono DSD64 of whole blocks without metadata", "golden_mono_dsd64.dsf",
+		paddingChannelOrders[0], 2822400, 4096 * 8, nil},
+	{"Mono DSD64 ending part way through a byte with metadata", "golden_mono_dsd64_tag.dsf",
+		paddingChannelOrders[0], 2822400, 5000*8 - 3, goldenTag},
+	{"Stereo DSD64 of whole blocks with metadata", "golden_stereo_dsd64_tag.dsf",
+		paddingChannelOrders[1], 2822400, 2 * 4096 * 8, goldenTag},
+	{"Stereo DSD128 ending part way through a block without metadata", "golden_stereo_dsd128.dsf",
+		paddingChannelOrders[1], 5644800, 5000 * 8, nil},
+	{"5.1 DSD64 ending part way through a block with metadata", "golden_5.1_dsd64_tag.dsf",
+		paddingChannelOrders[2], 2822400, 4100 * 8, goldenTag},
+	{"5.1 DSD128 of whole blocks without metadata", "golden_5.1_dsd128.dsf",
+		paddingChannelOrders[2], 5644800, 4096 * 8, nil},
+}
+
+// goldenAudio returns the audio for a golden file test, whose sample data ends
+// with the final sample of the final channel i.e. excludes the padding.
+func goldenAudio(test goldenTest) *audio.Audio {
+	channels := len(test.order)
+	sampleBytes := int(test.sampleCount+7) / 8
+	blocks := (sampleBytes + 4095) / 4096
+	length := (blocks-1)*channels*4096 + (channels-1)*4096 + sampleBytes - (blocks-1)*4096
+	samples := make([]byte, length)
+	for i := range samples {
+		samples[i] = byte(i*7 + i/4096 + channels)
+	}
+	a := mustNew(test.samplingFrequency, test.order)
+	a.SampleCount, a.EncodedSamples, a.Metadata = test.sampleCount, samples, test.metadata
+	return a
+}
+
+// Run all golden file tests, encoding each audio and checking that it matches
+// the golden file, that it decodes strictly to the same audio field by field,
+// and that encoding the decoded audio gives the same file again
+func TestGolden(t *testing.T) {
+	for i, test := range goldenTests {
+		a := goldenAudio(test)
+		var b bytes.Buffer
+		if err := Encode(a, &b, nil); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+		encoded := b.Bytes()
+
+		// Compare with the golden file, or update it
+		golden := "test/" + test.golden
+		if *update {
+			if err := ioutil.WriteFile(golden, encoded, 0644); err != nil {
+				t.Fatalf("FAIL Test %v: %v:\n%v", i+1, test.description, err.Error())
+			}
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: golden file %v\nActual: %v", i+1, test.description, golden, err.Error())
+			continue
+		}
+		if !bytes.Equal(encoded, want) {
+			t.Errorf("FAIL Test %v: %v:\nWant: the %v bytes of %v\nActual: %v different bytes", i+1, test.description, len(want), golden, len(encoded))
+			continue
+		}
+
+		// Decode strictly, which includes the padding in the sample data
+		actual, err := Decode(bytes.NewReader(encoded), nil, WithStrictness(Strict))
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+		padded := uint64(len(a.ChannelOrder)) * 4096 * ((test.sampleCount + 8*4096 - 1) / (8 * 4096))
+		samples, padding := actual.EncodedSamples, []byte(nil)
+		if len(samples) >= len(a.EncodedSamples) {
+			samples, padding = samples[:len(a.EncodedSamples)], samples[len(a.EncodedSamples):]
+		}
+		switch {
+		case actual.Encoding != a.Encoding || actual.NumChannels != a.NumChannels || !reflect.DeepEqual(actual.ChannelOrder, a.ChannelOrder):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v channels %v\nActual: %v channels %v", i+1, test.description, a.NumChannels, a.ChannelOrder, actual.NumChannels, actual.ChannelOrder)
+		case actual.SamplingFrequency != a.SamplingFrequency || actual.BitsPerSample != a.BitsPerSample || actual.BlockSize != a.BlockSize || actual.SampleCount != a.SampleCount:
+			t.Errorf("FAIL Test %v: %v:\nWant: %v Hz, %v bits, %v byte blocks, %v samples\nActual: %v Hz, %v bits, %v byte blocks, %v samples", i+1, test.description,
+				a.SamplingFrequency, a.BitsPerSample, a.BlockSize, a.SampleCount, actual.SamplingFrequency, actual.BitsPerSample, actual.BlockSize, actual.SampleCount)
+		case uint64(len(actual.EncodedSamples)) != padded || !bytes.Equal(samples, a.EncodedSamples) || !bytes.Equal(padding, bytes.Repeat([]byte{SilencePadByte}, len(padding))):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v bytes of sample data followed by DSD silence to %v bytes\nActual: %v different bytes", i+1, test.description, len(a.EncodedSamples), padded, len(actual.EncodedSamples))
+		case !bytes.Equal(actual.Metadata, a.Metadata):
+			t.Errorf("FAIL Test %v: %v:\nWant: metadata % x\nActual: % x", i+1, test.description, a.Metadata, actual.Metadata)
+		default:
+			// Encode the decoded audio, which should be identical
+			var again bytes.Buffer
+			if err := Encode(actual, &again, nil); err != nil || !bytes.Equal(again.Bytes(), encoded) {
+				t.Errorf("FAIL Test %v: %v:\nWant: the same file when encoded again\nActual: %v different bytes, %v", i+1, test.description, again.Len(), err)
+			} else {
+				t.Logf("PASS Test %v: %v", i+1, test.description)
+			}
+		}
+	}
+}
+
+// Trimming each golden file should encode to a valid file of fewer samples,
+// and no larger as the final block is padded, that decodes to the trimmed
+// audio
+func TestGoldenTrim(t *testing.T) {
+	for i, test := range goldenTests {
+		description := fmt.Sprintf("Trimming %v should encode to a file of fewer samples", test.golden)
+		a := goldenAudio(test)
+		duration := a.Duration()
+		trimmed, err := a.Trim(duration/4, duration*3/4)
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+			continue
+		}
+		var b, full bytes.Buffer
+		if err := Encode(trimmed, &b, nil); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+			continue
+		}
+		Encode(a, &full, nil)
+		actual, err := Decode(bytes.NewReader(b.Bytes()), nil, WithStrictness(Strict))
+		if err != nil || b.Len() > full.Len() || actual.SampleCount >= a.SampleCount || !actual.Equal(trimmed) {
+			t.Errorf("FAIL Test %v: %v:\nWant: at most %v bytes and fewer than %v samples decoding to the trimmed audio\nActual: %v bytes, %v samples, %v", i+1, description,
+				full.Len(), a.SampleCount, b.Len(), actual.SampleCount, err)
+		} else {
+			t.Logf("PASS Test %v: %v: %v samples", i+1, description, actual.SampleCount)
+		}
+	}
+}
+
+// Each channel of each golden file should be extracted as mono audio that
+// encodes to a valid file
+func TestGoldenSplitChannels(t *testing.T) {
+	for i, test := range goldenTests {
+		description := fmt.Sprintf("Each channel of %v should encode as mono", test.golden)
+		a := goldenAudio(test)
+		split, err := a.SplitChannels()
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+			continue
+		}
+		failed := false
+		for c, mono := range split {
+			// Mono is decoded as center whichever channel was encoded
+			var b bytes.Buffer
+			err := Encode(mono, &b, nil)
+			if err == nil {
+				var actual *audio.Audio
+				if actual, err = Decode(bytes.NewReader(b.Bytes()), nil, WithStrictness(Strict)); err == nil {
+					actual.ChannelOrder = mono.ChannelOrder
+					if report := actual.EqualReport(mono); actual.SampleCount != a.SampleCount || report != "" {
+						err = fmt.Errorf("decoded %v samples: %v", actual.SampleCount, report)
+					}
+				}
+			}
+			if err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: channel %v encoded\nActual: %v", i+1, description, c, err)
+				failed = true
+			}
+		}
+		if !failed {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+}
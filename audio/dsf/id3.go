@@ -0,0 +1,30 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"github.com/snmoore/go/audio"
+	"github.com/snmoore/go/audio/internal/id3"
+)
+
+// parseTags parses the tags from the metadata chunk in the audio.Audio in d, if
+// requested by WithParsedTags. A malformed tag is recorded as a warning rather
+// than an error, keeping whatever was parsed before the problem was found.
+func (d *decoder) parseTags() {
+	if !d.parsedTags || !bytes.HasPrefix(d.audio.Metadata, []byte(id3.Identifier)) {
+		return
+	}
+	tags, err := audio.ParseID3(d.audio.Metadata)
+	d.audio.Tags = tags
+	if err != nil {
+		d.warn(Warning{
+			Field:    "metadata.Tags",
+			Expected: "well-formed ID3v2.3 or ID3v2.4 tag",
+			Actual:   err.Error(),
+			Message:  "malformed ID3v2 tag",
+		})
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/snmoore/go/audio"
+	"reflect"
+	"testing"
+)
+
+// Build an ID3v2 frame, with a syncsafe size for ID3v2.4
+func id3Frame(version byte, id string, flags byte, data []byte) []byte {
+	f := append([]byte(id), 0, 0, 0, 0, 0, flags)
+	n := uint32(len(data))
+	if version == 4 {
+		n = n&0x7f | n>>7&0x7f<<8 | n>>14&0x7f<<16 | n>>21&0x7f<<24
+	}
+	binary.BigEndian.PutUint32(f[4:], n)
+	return append(f, data...)
+}
+
+// Build an ID3v2 tag holding the given frames followed by some padding
+func id3Tag(version, flags byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	body = append(body, make([]byte, 16)...)
+	n := len(body)
+	return append([]byte{'I', 'D', '3', version, 0, flags,
+		byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}, body...)
+}
+
+// Table structure for a single ID3v2 tag parsing test
+type id3TagsTest struct {
+	// Description for the test
+	description string
+	// The ID3v2 tag
+	tag []byte
+	// Expected tags
+	tags *audio.Tags
+	// Is a warning expected?
+	expectWarning bool
+}
+
+// Table of all ID3v2 tag parsing tests
+var id3TagsTests = []id3TagsTest{
+	{"An ID3v2.3 tag in ISO-8859-1 should be parsed",
+		id3Tag(3, 0,
+			id3Frame(3, "TIT2", 0, []byte("\x00Caf\xe9")),
+			id3Frame(3, "TPE1", 0, []byte("\x00Artist")),
+			id3Frame(3, "TALB", 0, []byte("\x00Album\x00")),
+			id3Frame(3, "TRCK", 0, []byte("\x003/12")),
+			id3Frame(3, "TYER", 0, []byte("\x002015")),
+			id3Frame(3, "TCON", 0, []byte("\x00Classical")),
+			id3Frame(3, "COMM", 0, []byte("\x00eng\x00Comment"))),
+		&audio.Tags{Title: "Café", Artist: "Artist", Album: "Album", TrackNumber: 3, TrackTotal: 12, Year: "2015", Genre: "Classical", Comment: "Comment"}, false},
+	{"An ID3v2.3 tag in UTF-16 should be parsed",
+		id3Tag(3, 0,
+			id3Frame(3, "TIT2", 0, []byte{1, 0xff, 0xfe, 'T', 0, 'i', 0, 't', 0, 'l', 0, 'e', 0, 0, 0}),
+			id3Frame(3, "TPE1", 0, []byte{1, 0xfe, 0xff, 0, 'A', 0, 'r', 0, 't', 0, 'i', 0, 's', 0, 't'})),
+		&audio.Tags{Title: "Title", Artist: "Artist"}, false},
+	{"An ID3v2.4 tag in UTF-8 should be parsed",
+		id3Tag(4, 0,
+			id3Frame(4, "TIT2", 0, append([]byte{3}, []byte("Café")...)),
+			id3Frame(4, "TDRC", 0, []byte("\x032015-10-16")),
+			id3Frame(4, "TCON", 0, append([]byte{3}, bytes.Repeat([]byte("Jazz"), 40)...))),
+		&audio.Tags{Title: "Café", Year: "2015-10-16", Genre: string(bytes.Repeat([]byte("Jazz"), 40))}, false},
+	{"An ID3v2.4 frame with a data length indicator should be parsed",
+		id3Tag(4, 0,
+			id3Frame(4, "TALB", 0x01, []byte("\x00\x00\x00\x06\x03Album"))),
+		&audio.Tags{Album: "Album"}, false},
+	{"An ID3v2.3 tag with unsynchronisation should be parsed",
+		id3Tag(3, 0x80,
+			id3Frame(3, "TIT2", 0, []byte{0, 'A', 0xff, 0x00, 'B'})),
+		&audio.Tags{Title: "A\u00ffB"}, false},
+	{"An ID3v2 tag without frames should result in empty tags",
+		[]byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		&audio.Tags{}, false},
+	{"A frame that exceeds the tag should result in a warning, keeping the earlier frames",
+		func() []byte {
+			t := id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x00Title")), id3Frame(3, "TPE1", 0, []byte("\x00Artist")))
+			t[10+10+6+7] = 0x7f
+			return t
+		}(),
+		&audio.Tags{Title: "Title"}, true},
+	{"A bad text encoding should result in a warning",
+		id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x09Title"))),
+		&audio.Tags{}, true},
+	{"An ID3v2.2 tag should result in a warning",
+		id3Tag(2, 0),
+		nil, true},
+}
+
+// Run all ID3v2 tag parsing tests, decoding a file with each tag
+func TestParsedTags(t *testing.T) {
+	for i, test := range id3TagsTests {
+		c := newTestFile(1, 1, 1, 4096, make([]byte, 4096), test.tag)
+		var warnings []Warning
+		a, err := Decode(bytes.NewReader(c), nil, WithParsedTags(), WithWarnings(&warnings))
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case !reflect.DeepEqual(a.Tags, test.tags):
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v", i+1, test.description, test.tags, a.Tags)
+		case test.expectWarning != (len(warnings) > 0 && warnings[len(warnings)-1].Field == "metadata.Tags"):
+			t.Errorf("FAIL Test %v: %v:\nWant: warning %v\nActual: %v", i+1, test.description, test.expectWarning, warnings)
+		case !bytes.Equal(a.Metadata, test.tag):
+			t.Errorf("FAIL Test %v: %v:\nWant: raw tag\nActual: % x", i+1, test.description, a.Metadata)
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+
+	// Tags should only be parsed when requested
+	description := "Tags should only be parsed when requested"
+	c := newTestFile(1, 1, 1, 4096, make([]byte, 4096), id3TagsTests[0].tag)
+	if a, err := Decode(bytes.NewReader(c), nil); err != nil || a.Tags != nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %+v, %v", len(id3TagsTests)+1, description, a, err)
+	} else {
+		t.Logf("PASS Test %v: %v", len(id3TagsTests)+1, description)
+	}
+}
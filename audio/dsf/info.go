@@ -0,0 +1,84 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"github.com/snmoore/go/audio"
+	"io"
+	"time"
+)
+
+// Info describes the format of a DSD stream file, as read from its DSD and fmt
+// chunks.
+type Info struct {
+	// The number of channels e.g. 2 for stereo.
+	NumChannels uint
+
+	// The channel order e.g. front left, front right.
+	ChannelOrder []audio.Channel
+
+	// The sampling frequency in Hertz.
+	SamplingFrequency uint
+
+	// The number of bits per sample.
+	BitsPerSample uint
+
+	// Block size per channel in bytes.
+	BlockSize uint
+
+	// The number of samples per channel.
+	SampleCount uint64
+
+	// Total file size in bytes.
+	TotalFileSize uint64
+
+	// Pointer to the metadata chunk, or 0 if there is no metadata.
+	MetadataPointer uint64
+
+	// The duration of the audio, computed from the sample count and sampling
+	// frequency.
+	Duration time.Duration
+}
+
+// info returns the Info for the DSD and fmt chunks read by d.
+func (d *decoder) info() Info {
+	info := Info{
+		NumChannels:       d.audio.NumChannels,
+		ChannelOrder:      d.audio.ChannelOrder,
+		SamplingFrequency: d.audio.SamplingFrequency,
+		BitsPerSample:     d.audio.BitsPerSample,
+		BlockSize:         d.audio.BlockSize,
+		SampleCount:       d.sampleCount,
+		TotalFileSize:     d.totalFileSize,
+		MetadataPointer:   d.metadataPointer,
+	}
+
+	// The duration is computed as for the audio itself
+	a := audio.Audio{SamplingFrequency: info.SamplingFrequency, SampleCount: info.SampleCount}
+	info.Duration = a.Duration()
+
+	return info
+}
+
+// DecodeInfo reads the DSD and fmt chunks of a DSD stream file from r and
+// returns the format of the audio. Nothing beyond the fmt chunk is read, so no
+// memory is allocated for the sample data or metadata.
+func DecodeInfo(r io.Reader, opts ...Option) (*Info, error) {
+	d := newDecoder(nil, opts)
+	d.reset(r, new(audio.Audio))
+
+	// 1st chunk should be DSD
+	if err := d.readDSDChunk(); err != nil {
+		return nil, err
+	}
+
+	// 2nd chunk should be fmt
+	if err := d.readFmtChunk(); err != nil {
+		return nil, err
+	}
+
+	info := d.info()
+	return &info, nil
+}
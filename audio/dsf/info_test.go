@@ -0,0 +1,57 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The format is decoded from the DSD and fmt chunks without reading any further
+func TestDecodeInfo(t *testing.T) {
+	description := "The format is decoded from the DSD and fmt chunks without reading any further"
+
+	// Read the whole DSD stream file into memory
+	b, err := ioutil.ReadFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	r := bytes.NewReader(b)
+
+	// Decode the format
+	info, err := DecodeInfo(r)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+
+	// Verify the format
+	want := Info{
+		NumChannels:       1,
+		SamplingFrequency: 2822400,
+		BitsPerSample:     1,
+		BlockSize:         4096,
+		SampleCount:       1,
+		TotalFileSize:     4198,
+		MetadataPointer:   4188,
+		Duration:          time.Second / 2822400,
+	}
+	if len(info.ChannelOrder) != 1 {
+		t.Errorf("FAIL Test 1: %v:\nIncorrect channel order: %v", description, info.ChannelOrder)
+	}
+	info.ChannelOrder = nil
+	if !reflect.DeepEqual(*info, want) {
+		t.Errorf("FAIL Test 1: %v:\nWant: %+v\nActual: %+v", description, want, *info)
+	}
+
+	// Verify nothing beyond the fmt chunk was read
+	if read := len(b) - r.Len(); read != dsdChunkSize+fmtChunkSize {
+		t.Errorf("FAIL Test 1: %v:\nWant: %v bytes read\nActual: %v", description, dsdChunkSize+fmtChunkSize, read)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build 386 || arm || mips || mipsle
+
+package dsf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// A data chunk larger than can be addressed on a 32-bit platform should result
+// in an error rather than a panic or a truncated buffer
+func TestDecodeTooLarge(t *testing.T) {
+	description := "A data chunk of more than 4GiB should be too large for a 32-bit platform"
+
+	// Declare 5GiB of stereo sample data, without actually providing it
+	const size = 5 << 30
+	c := newTestFile(2, 2, size/2*8, size, nil, nil)
+	binary.LittleEndian.PutUint64(c[12:], uint64(len(c))+size)
+
+	_, err := Decode(bytes.NewReader(c), nil, WithMemoryLimit(0))
+	if err == nil || !strings.Contains(err.Error(), "too large for this platform") {
+		t.Errorf("FAIL Test 1: %v:\nWant: too large for this platform\nActual: %v", description, err)
+	} else {
+		t.Logf("PASS Test 1: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"fmt"
+	"github.com/snmoore/go/audio"
+	"io/ioutil"
+)
+
+// Layout describes the sizes and offsets of the chunks of a DSD stream file as
+// Encode would write it, all in bytes.
+type Layout struct {
+	// Size of the sample data given, and of the padding that completes the
+	// final block for each channel.
+	SampleDataSize uint64
+	PaddingSize    uint64
+
+	// Size of the data chunk, including its header and the padding.
+	DataChunkSize uint64
+
+	// Pointer to the metadata chunk, or 0 if there is no metadata, and the size
+	// of the metadata chunk, including any padding.
+	MetadataPointer uint64
+	MetadataSize    uint64
+
+	// Total file size.
+	TotalFileSize uint64
+
+	// The number of samples per channel, which is computed from the sample
+	// data if the audio.Audio does not set it.
+	SampleCount uint64
+}
+
+// planLayout sets the layout of the file from the sizes of the sample data and
+// metadata, for the chunks to be prepared from. The sizes are those given by
+// audio.Audio for the sample count, so that they always agree.
+func (e *encoder) planLayout() {
+	l := Layout{
+		SampleDataSize: e.sampleDataSize,
+		MetadataSize:   e.metadataSize(),
+		SampleCount:    e.audio.SampleCount,
+	}
+
+	// Assume there is no padding if the sample count has not been set
+	if l.SampleCount == 0 && e.audio.BitsPerSample > 0 {
+		l.SampleCount = e.maxSampleCount()
+	}
+
+	// The metadata follows the padded sample data
+	sizing := audio.Audio{NumChannels: e.audio.NumChannels, BitsPerSample: e.audio.BitsPerSample, BlockSize: e.blockSize(), SampleCount: l.SampleCount}
+	padded := sizing.DataSize()
+	l.PaddingSize = padded - min(padded, e.sampleDataSize)
+	l.DataChunkSize = dataChunkSize + padded
+	l.TotalFileSize = sizing.EstimatedFileSize() + l.MetadataSize
+	if padded == 0 {
+		l.TotalFileSize = dsdChunkSize + fmtChunkSize + dataChunkSize + l.MetadataSize
+	}
+	if l.MetadataSize > 0 {
+		l.MetadataPointer = l.TotalFileSize - l.MetadataSize
+	}
+	e.layout = l
+}
+
+// maxSampleCount returns the largest number of samples per channel that the
+// sample data can hold, excluding the padding.
+func (e *encoder) maxSampleCount() uint64 {
+	bytesPerChannel := e.sampleDataSize
+	if n := uint64(e.audio.NumChannels); n > 0 {
+		bytesPerChannel = (bytesPerChannel + n - 1) / n
+	}
+	return bytesPerChannel * 8 / uint64(e.audio.BitsPerSample)
+}
+
+// prepare checks the audio.Audio in e and prepares the chunk headers, so that
+// an audio.Audio that cannot be encoded is rejected before anything is
+// written.
+func (e *encoder) prepare() error {
+	if e.audio.Encoding != audio.DSD {
+		return fmt.Errorf("unsupported audio encoding: %v, a DSD stream file holds only DSD", e.audio.Encoding)
+	}
+
+	// The fields must be consistent, with the block size that is encoded, but
+	// the metadata is left to checkMetadata as it depends on the options
+	a := *e.audio
+	a.BlockSize = e.blockSize()
+	a.Metadata = nil
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	if err := e.checkSampleData(); err != nil {
+		return err
+	}
+	if err := e.checkMetadata(); err != nil {
+		return err
+	}
+	return e.prepareHeaders()
+}
+
+// PlanLayout returns the Layout of the DSD stream file that Encode would write
+// for the Audio a with the same options, without writing anything, so that
+// the exact size of the file is known up front e.g. to preallocate it. It
+// returns the error that Encode would return if a cannot be encoded.
+func PlanLayout(a *audio.Audio, opts ...Option) (Layout, error) {
+	e := newEncoder(nil, opts)
+	e.reset(ioutil.Discard, a)
+	if err := e.prepare(); err != nil {
+		return Layout{}, err
+	}
+	return e.layout, nil
+}
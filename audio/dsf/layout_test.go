@@ -0,0 +1,136 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/snmoore/go/audio"
+	"testing"
+)
+
+// Table structure for a single layout test
+type layoutTest struct {
+	// Description for the test
+	description string
+	// Audio to plan the layout of, and options
+	a    *audio.Audio
+	opts []Option
+	// Expected layout
+	layout Layout
+}
+
+// layoutAudio returns audio in blocks of 4096 bytes with the given channel
+// order, sample count, size of sample data and metadata
+func layoutAudio(order []audio.Channel, sampleCount uint64, size int, metadata []byte) *audio.Audio {
+	a := mustNew(2822400, order)
+	a.SampleCount, a.EncodedSamples, a.Metadata = sampleCount, make([]byte, size), metadata
+	return a
+}
+
+// Size of goldenTag, which is used as the metadata
+var goldenTagSize = uint64(len(goldenTag))
+
+// Table of all layout tests
+var layoutTests = []layoutTest{
+	{"Mono of whole blocks without metadata should need no padding",
+		layoutAudio(paddingChannelOrders[0], 4096*8, 4096, nil), nil,
+		Layout{SampleDataSize: 4096, DataChunkSize: 12 + 4096, TotalFileSize: 92 + 4096, SampleCount: 4096 * 8}},
+	{"Mono ending part way through a byte should be padded to the end of the block",
+		layoutAudio(paddingChannelOrders[0], 5000*8-3, 5000, goldenTag), nil,
+		Layout{SampleDataSize: 5000, PaddingSize: 3192, DataChunkSize: 12 + 8192, MetadataPointer: 92 + 8192,
+			MetadataSize: goldenTagSize, TotalFileSize: 92 + 8192 + goldenTagSize, SampleCount: 5000*8 - 3}},
+	{"Stereo ending part way through a block should pad the final block of each channel",
+		layoutAudio(paddingChannelOrders[1], 5000*8, 3*4096+904, nil), nil,
+		Layout{SampleDataSize: 13192, PaddingSize: 3192, DataChunkSize: 12 + 16384, TotalFileSize: 92 + 16384, SampleCount: 5000 * 8}},
+	{"Stereo sample data that already includes the padding should need no more",
+		layoutAudio(paddingChannelOrders[1], 5000*8, 4*4096, goldenTag), nil,
+		Layout{SampleDataSize: 16384, DataChunkSize: 12 + 16384, MetadataPointer: 92 + 16384,
+			MetadataSize: goldenTagSize, TotalFileSize: 92 + 16384 + goldenTagSize, SampleCount: 5000 * 8}},
+	{"A sample count that is not set should be computed from the sample data",
+		layoutAudio(paddingChannelOrders[1], 0, 2*4096, nil), nil,
+		Layout{SampleDataSize: 8192, DataChunkSize: 12 + 8192, TotalFileSize: 92 + 8192, SampleCount: 4096 * 8}},
+	{"5.1 ending part way through a block with padded metadata should include both paddings",
+		layoutAudio(paddingChannelOrders[2], 4100*8, 6*4096+5*4096+4, goldenTag), []Option{WithMetadataPadding(100)},
+		Layout{SampleDataSize: 45060, PaddingSize: 4092, DataChunkSize: 12 + 49152, MetadataPointer: 92 + 49152,
+			MetadataSize: goldenTagSize + 100, TotalFileSize: 92 + 49152 + goldenTagSize + 100, SampleCount: 4100 * 8}},
+	{"Metadata padding without metadata should be ignored",
+		layoutAudio(paddingChannelOrders[0], 4096*8, 4096, nil), []Option{WithMetadataPadding(100)},
+		Layout{SampleDataSize: 4096, DataChunkSize: 12 + 4096, TotalFileSize: 92 + 4096, SampleCount: 4096 * 8}},
+}
+
+// Run all layout tests, checking the layout and that Encode writes exactly the
+// file it describes
+func TestPlanLayout(t *testing.T) {
+	for i, test := range layoutTests {
+		layout, err := PlanLayout(test.a, test.opts...)
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+		if layout != test.layout {
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v", i+1, test.description, test.layout, layout)
+			continue
+		}
+
+		var b bytes.Buffer
+		n, err := EncodeCount(test.a, &b, nil, test.opts...)
+		encoded := b.Bytes()
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case uint64(n) != layout.TotalFileSize || uint64(len(encoded)) != layout.TotalFileSize:
+			t.Errorf("FAIL Test %v: %v:\nWant: %v bytes\nActual: %v bytes", i+1, test.description, layout.TotalFileSize, len(encoded))
+		case binary.LittleEndian.Uint64(encoded[20:28]) != layout.MetadataPointer ||
+			binary.LittleEndian.Uint64(encoded[28+fmtSampleCountOffset:28+fmtSampleCountOffset+8]) != layout.SampleCount ||
+			binary.LittleEndian.Uint64(encoded[84:92]) != layout.DataChunkSize:
+			t.Errorf("FAIL Test %v: %v:\nWant: the headers to match %+v\nActual: % x", i+1, test.description, layout, encoded[:92])
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// Planning the layout of audio that cannot be encoded results in the same
+// error as encoding it
+func TestPlanLayoutError(t *testing.T) {
+	tests := []struct {
+		description string
+		a           *audio.Audio
+	}{
+		{"Planning the layout of DST audio should result in an error", &audio.Audio{Encoding: audio.DST}},
+		{"Planning the layout of too little sample data should result in an error", layoutAudio(paddingChannelOrders[1], 5000*8, 4096, nil)},
+		{"Planning the layout of an unsupported sampling frequency should result in an error", &audio.Audio{Encoding: audio.DSD, NumChannels: 1,
+			SamplingFrequency: 44100, BitsPerSample: 1, BlockSize: 4096, EncodedSamples: make([]byte, 4096)}},
+		{"Planning the layout of audio with several inconsistencies should result in an error listing them all", &audio.Audio{Encoding: audio.DSD,
+			NumChannels: 2, ChannelOrder: []audio.Channel{audio.Center}, BitsPerSample: 2, EncodedSamples: make([]byte, 4096)}},
+	}
+	for i, test := range tests {
+		_, err := PlanLayout(test.a)
+		if err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", i+1, test.description)
+		} else if encodeErr := Encode(test.a, &bytes.Buffer{}, nil); encodeErr == nil || encodeErr.Error() != err.Error() {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, encodeErr, err.Error())
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
+
+// The layout of each golden file should agree with the sizes of its audio
+func TestPlanLayoutSizes(t *testing.T) {
+	for i, test := range goldenTests {
+		description := fmt.Sprintf("The layout of %v should agree with the sizes of its audio", test.golden)
+		a := goldenAudio(test)
+		l, err := PlanLayout(a)
+		if err != nil || l.DataChunkSize-dataChunkSize != a.DataSize() || l.TotalFileSize != a.EstimatedFileSize() {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v, %v\nActual: %v, %v, %v", i+1, description, a.DataSize(), a.EstimatedFileSize(),
+				l.DataChunkSize-dataChunkSize, l.TotalFileSize, err)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+}
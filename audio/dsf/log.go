@@ -0,0 +1,200 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Keys of the attributes of the records logged for the fields of each chunk.
+const (
+	logChunkKey       = "chunk"
+	logFieldKey       = "field"
+	logValueKey       = "value"
+	logDescriptionKey = "description"
+)
+
+// Message of the records logged for the fields of each chunk.
+const logFieldMessage = "chunk field"
+
+// newLogger returns a logger that writes to w in the aligned text layout of
+// fieldHandler, or that discards everything if w is nil.
+func newLogger(w io.Writer) *slog.Logger {
+	if w == nil || w == io.Discard {
+		return slog.New(slog.DiscardHandler)
+	}
+	return slog.New(&fieldHandler{w: w, state: new(fieldState)})
+}
+
+// logEnabled returns whether the fields of each chunk are logged by l, which
+// avoids building the records when they would be discarded.
+func logEnabled(l *slog.Logger) bool {
+	return l.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// logField logs the value of a field of the named chunk at Debug level, with an
+// optional description of the value e.g. the name of a sampling frequency.
+func logField(l *slog.Logger, chunk, field string, value any, description ...string) {
+	args := []any{logChunkKey, chunk, logFieldKey, field, logValueKey, value}
+	if len(description) > 0 {
+		args = append(args, logDescriptionKey, description[0])
+	}
+	l.Debug(logFieldMessage, args...)
+}
+
+// logWarning logs a violation of the specification that was tolerated at Warn
+// level.
+func logWarning(l *slog.Logger, w Warning) {
+	l.Warn(w.Message, logFieldKey, w.Field, "expected", w.Expected, "actual", w.Actual)
+}
+
+// fieldState is the state shared by a fieldHandler and those derived from it.
+type fieldState struct {
+	mu sync.Mutex
+
+	// Chunk whose fields were logged most recently.
+	chunk string
+}
+
+// fieldHandler is a slog.Handler that writes records as aligned text for people
+// to read, as written to the io.Writer given to Decode and Encode. The fields of
+// each chunk are written under a heading for the chunk, one per line, and other
+// records are written with their level, message and attributes.
+type fieldHandler struct {
+	w     io.Writer
+	state *fieldState
+
+	// Attributes added by WithAttrs, and the prefix for the keys of those
+	// added later from WithGroup.
+	attrs  []slog.Attr
+	prefix string
+}
+
+// Enabled returns true, as all levels are written.
+func (h *fieldHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+// Handle writes the record r.
+func (h *fieldHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := append([]slog.Attr{}, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		if h.prefix != "" {
+			a.Key = h.prefix + a.Key
+		}
+		attrs = append(attrs, a)
+		return true
+	})
+
+	// Find the attributes of a chunk field
+	var chunk, field, description string
+	var value slog.Value
+	var others []slog.Attr
+	for _, a := range attrs {
+		switch a.Key {
+		case logChunkKey:
+			chunk = a.Value.String()
+		case logFieldKey:
+			field = a.Value.String()
+		case logValueKey:
+			value = a.Value
+		case logDescriptionKey:
+			description = a.Value.String()
+		default:
+			others = append(others, a)
+		}
+	}
+
+	var b strings.Builder
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+	if r.Message == logFieldMessage {
+		// Write a heading when the chunk changes
+		if chunk != h.state.chunk {
+			heading := chunkHeading(chunk)
+			fmt.Fprintf(&b, "\n%v\n%v\n", heading, strings.Repeat("=", len(heading)))
+			h.state.chunk = chunk
+		}
+		fmt.Fprintf(&b, "%-27s%v", field+":", formatLogValue(value))
+		if description != "" {
+			fmt.Fprintf(&b, " (%v)", description)
+		}
+	} else {
+		// Write anything else with its level
+		label := strings.ToUpper(r.Level.String()[:1]) + strings.ToLower(r.Level.String()[1:])
+		if r.Level == slog.LevelWarn {
+			label = "Warning"
+		}
+		fmt.Fprintf(&b, "%-27s%v", label+":", r.Message)
+		if field != "" {
+			fmt.Fprintf(&b, " %v=%v", logFieldKey, formatLogValue(slog.StringValue(field)))
+		}
+		for _, a := range others {
+			fmt.Fprintf(&b, " %v=%v", a.Key, formatLogValue(a.Value))
+		}
+	}
+	b.WriteByte('\n')
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+// WithAttrs returns a handler that adds attrs to every record.
+func (h *fieldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		a.Key = h.prefix + a.Key
+		h2.attrs = append(h2.attrs, a)
+	}
+	return &h2
+}
+
+// WithGroup returns a handler that qualifies the keys of later attributes with
+// name.
+func (h *fieldHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+// chunkHeading returns the heading for the fields of the named chunk.
+func chunkHeading(chunk string) string {
+	switch chunk {
+	case "":
+		return "Chunk"
+	case "dsd":
+		return "DSD Chunk"
+	default:
+		return strings.ToUpper(chunk[:1]) + chunk[1:] + " Chunk"
+	}
+}
+
+// formatLogValue formats v for fieldHandler, showing bytes in hex and quoting
+// strings that would otherwise be ambiguous e.g. chunk headers.
+func formatLogValue(v slog.Value) string {
+	v = v.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		s := v.String()
+		if s == "" || strings.TrimSpace(s) != s || strings.IndexFunc(s, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+			return fmt.Sprintf("%q", s)
+		}
+		return s
+	case slog.KindAny:
+		if b, ok := v.Any().([]byte); ok {
+			return fmt.Sprintf("% x...", b)
+		}
+	}
+	return v.String()
+}
@@ -0,0 +1,231 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/snmoore/go/audio"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordHandler is a slog.Handler that keeps every record at or above a level.
+type recordHandler struct {
+	mu      sync.Mutex
+	level   slog.Level
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler      { return h }
+
+// attrs returns the attributes of r as strings.
+func attrs(r slog.Record) map[string]string {
+	m := make(map[string]string)
+	r.Attrs(func(a slog.Attr) bool {
+		m[a.Key] = a.Value.String()
+		return true
+	})
+	return m
+}
+
+// Decoding a slightly malformed file should log a Warn record for the violation
+func TestLogWarnings(t *testing.T) {
+	description := "Decoding a slightly malformed file should log a Warn record for the violation"
+	file, err := os.Open("test/invalid_nonzero_reserved.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	defer file.Close()
+
+	h := &recordHandler{level: slog.LevelDebug}
+	if _, err := Decode(file, nil, WithLenient(), WithLogger(slog.New(h))); err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	var warnings, fields int
+	for _, r := range h.records {
+		a := attrs(r)
+		switch r.Level {
+		case slog.LevelWarn:
+			warnings++
+			if a["field"] != "fmt.Reserved" || a["expected"] != "0x0" || a["actual"] != "0x4030201" {
+				t.Errorf("FAIL Test 1: %v:\nWant: fmt.Reserved warning\nActual: %v %v", description, r.Message, a)
+			}
+		case slog.LevelDebug:
+			fields++
+			if a["chunk"] == "" || a["field"] == "" || a["value"] == "" {
+				t.Errorf("FAIL Test 1: %v:\nWant: chunk, field and value attributes\nActual: %v", description, a)
+			}
+		}
+	}
+	if warnings != 1 || fields == 0 {
+		t.Errorf("FAIL Test 1: %v:\nWant: 1 warning and some fields\nActual: %v warnings and %v fields", description, warnings, fields)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	// Only the warnings should reach a JSON logger at Warn level
+	description = "Only the warnings should reach a JSON logger at Warn level"
+	var b bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&b, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	if _, err := file.Seek(0, 0); err != nil {
+		t.Fatalf("FAIL Test 2: %v:\n%v", description, err.Error())
+	}
+	if _, err := Decode(file, nil, WithLogger(logger)); err != nil {
+		t.Fatalf("FAIL Test 2: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	var record map[string]string
+	if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &record) != nil || record["level"] != "WARN" || record["field"] != "fmt.Reserved" {
+		t.Errorf("FAIL Test 2: %v:\nWant: 1 warning\nActual: %v", description, b.String())
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	// Padding the samples when encoding is routine, so nothing should reach a
+	// logger at Info level
+	description = "Encoding samples that need padding should log nothing at Info level"
+	h = &recordHandler{level: slog.LevelInfo}
+	a := mustNew(2822400, []audio.Channel{audio.Center})
+	a.SampleCount, a.EncodedSamples = 1000*8, make([]byte, 1000)
+	if err := Encode(a, ioutil.Discard, nil, WithLogger(slog.New(h))); err != nil {
+		t.Fatalf("FAIL Test 3: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	if len(h.records) != 0 {
+		t.Errorf("FAIL Test 3: %v:\nWant: no records\nActual: %v", description, h.records)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+}
+
+// Logging to an io.Writer should write aligned text for people to read
+func TestLogWriter(t *testing.T) {
+	description := "Logging to an io.Writer should write each chunk under a heading"
+	file, err := os.Open("test/invalid_nonzero_reserved.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	defer file.Close()
+
+	var b bytes.Buffer
+	if _, err := Decode(file, &b); err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	for _, want := range []string{
+		"\nDSD Chunk\n=========\nChunk header:              \"DSD \"\n",
+		"\nFmt Chunk\n=========\n",
+		"Sampling frequency:        2822400 (DSD64)\n",
+		"Warning:                   reserved bytes are not zero field=fmt.Reserved expected=0x0 actual=0x4030201\n",
+		"\nData Chunk\n==========\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("FAIL Test 1: %v:\nWant: %q\nActual: %v", description, want, b.String())
+			return
+		}
+	}
+	t.Logf("PASS Test 1: %v", description)
+}
+
+// Table structure for a single test of logging to nil
+type logNilTest struct {
+	// Description for the test
+	description string
+	// Call with a nil io.Writer to log to
+	call func() error
+}
+
+// Encoding and decoding with a nil io.Writer to log to should log nothing
+// rather than panic
+func TestLogNil(t *testing.T) {
+	a := mustNew(2822400, []audio.Channel{audio.FrontLeft, audio.FrontRight})
+	a.SampleCount, a.EncodedSamples, a.Metadata = 4096*8, make([]byte, 2*4096), id3Tag(3, 0)
+	var encoded bytes.Buffer
+	if err := Encode(a, &encoded, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	format := Info{NumChannels: 2, ChannelOrder: a.ChannelOrder, SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096}
+
+	tests := []logNilTest{
+		{"Encoding with a nil io.Writer to log to should not panic", func() error {
+			return Encode(a, ioutil.Discard, nil)
+		}},
+		{"Encoding planar channels with a nil io.Writer to log to should not panic", func() error {
+			return EncodePlanar([][]byte{make([]byte, 4096), make([]byte, 4096)}, format, ioutil.Discard, nil)
+		}},
+		{"Decoding with a nil io.Writer to log to should not panic", func() error {
+			_, err := Decode(bytes.NewReader(encoded.Bytes()), nil)
+			return err
+		}},
+	}
+	for i, test := range tests {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: panic: %v", i+1, test.description, r)
+				}
+			}()
+			if err := test.call(); err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			} else {
+				t.Logf("PASS Test %v: %v", i+1, test.description)
+			}
+		}()
+	}
+}
+
+// logFields returns the log without the lines logged other than for the fields
+// of each chunk, such as padding the sample data when encoding
+func logFields(log string) string {
+	var lines []string
+	for _, line := range strings.Split(log, "\n") {
+		if !strings.HasPrefix(line, "Debug:") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The fields logged when encoding should match those logged when decoding the
+// result, so that the two logs can be compared line by line
+func TestLogParity(t *testing.T) {
+	for i, test := range goldenTests {
+		for j, padding := range []int{0, 64} {
+			n := 2*i + j + 1
+			description := fmt.Sprintf("Logging when encoding with %v bytes of metadata padding should match logging when decoding: %v", padding, test.golden)
+			var encoded, encodeLog, decodeLog bytes.Buffer
+			if err := Encode(goldenAudio(test), &encoded, &encodeLog, WithMetadataPadding(padding)); err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", n, description, err.Error())
+				continue
+			}
+			if _, err := Decode(bytes.NewReader(encoded.Bytes()), &decodeLog); err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", n, description, err.Error())
+				continue
+			}
+			if logFields(encodeLog.String()) != logFields(decodeLog.String()) {
+				t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", n, description, decodeLog.String(), encodeLog.String())
+			} else {
+				t.Logf("PASS Test %v: %v", n, description)
+			}
+		}
+	}
+}
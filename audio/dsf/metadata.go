@@ -5,42 +5,408 @@
 package dsf
 
 import (
-	"encoding/binary"
 	"fmt"
+	"github.com/snmoore/go/audio"
+	"github.com/snmoore/go/audio/internal/id3"
+	"io"
 )
 
 // readMetadataChunk reads the metadata chunk and stores the result in d. This
-// may be large and hence is written directly into the audio.Audio in d.
+// may be large and hence is written directly into the audio.Audio in d,
+// reusing its buffer if large enough.
 func (d *decoder) readMetadataChunk() error {
-	// Read the metadata directly into the audio.Audio in d
-	err := binary.Read(d.reader, binary.LittleEndian, &d.audio.Metadata)
+	metadata, err := d.readUpTo("metadata", d.audio.Metadata, d.metadataSize)
+	if metadata != nil {
+		d.audio.Metadata = metadata
+	}
+	return d.finishMetadataChunk(err)
+}
+
+// finishMetadataChunk checks the metadata chunk in the audio.Audio in d once
+// it has been read, given the error from reading it, which is io.EOF or
+// io.ErrUnexpectedEOF if the metadata is shorter than the metadata chunk.
+func (d *decoder) finishMetadataChunk(err error) error {
+	n := len(d.audio.Metadata)
+	if err == io.ErrUnexpectedEOF {
+		// The total file size may have overstated the size of the metadata
+		err = d.violation(Normal, err, Warning{
+			Field:    "dsd.TotalFileSize",
+			Expected: fmt.Sprint(d.totalFileSize - (d.metadataSize - uint64(n))),
+			Actual:   fmt.Sprint(d.totalFileSize),
+			Message:  "total file size overstates the size of the metadata",
+		})
+	}
+	if err == io.EOF {
+		// None of the metadata is present, which is never at the start of the
+		// file so is still unexpected
+		err = io.ErrUnexpectedEOF
+	}
 	if err != nil {
+		return d.shortRead("metadata", "metadata chunk", d.metadataPointer, d.metadataSize, uint64(n), err)
+	}
+
+	return d.checkMetadataChunk()
+}
+
+// readTrailingTag reads an ID3v2 tag that immediately follows the data chunk of
+// a file whose DSD chunk has no pointer to the metadata chunk, as left by some
+// tag editors. Anything else that follows the data chunk is ignored, as is
+// the tag when decoding strictly.
+func (d *decoder) readTrailingTag() error {
+	if d.strictness < Normal || d.dsd.Details().MetadataPointer != 0 {
+		return nil
+	}
+
+	// Look for an ID3v2 tag header
+	header := d.buffer[:id3.HeaderSize]
+	n, err := io.ReadFull(d.reader, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	size, ok := id3.ParseHeader(header[:n])
+	if !ok {
+		return nil
+	}
+	offset := d.dataOffset() + d.data.Details().Size
+	d.warn(Warning{
+		Field:    "dsd.MetadataPointer",
+		Expected: fmt.Sprint(offset),
+		Actual:   "0",
+		Message:  "pointer to metadata chunk is missing, but an ID3v2 tag follows the data chunk",
+	})
+
+	// Read the rest of the tag, no more of which is allocated than is there
+	if err := d.checkAllocation("metadata", size); err != nil {
+		return err
+	}
+	rest, err := d.readUpTo("metadata", nil, size-id3.HeaderSize)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
 		return err
 	}
+	metadata := make([]byte, id3.HeaderSize+len(rest))
+	copy(metadata, header)
+	copy(metadata[id3.HeaderSize:], rest)
+	d.metadataPointer, d.metadataSize = offset, size
+	if err != nil {
+		// Keep what there is, as the tag would otherwise be lost
+		d.warn(Warning{
+			Field:    "metadata.Size",
+			Expected: fmt.Sprint(size),
+			Actual:   fmt.Sprint(len(metadata)),
+			Message:  "ID3v2 tag after the data chunk is truncated",
+		})
+	}
+	d.audio.Metadata = metadata
+	return d.checkMetadataChunk()
+}
 
+// checkMetadataChunk checks the metadata chunk in the audio.Audio in d.
+func (d *decoder) checkMetadataChunk() error {
 	// Check this is not just another DSD, fmt or data chunk
-	header := string(d.audio.Metadata[:4])
+	var header string
+	if len(d.audio.Metadata) >= 4 {
+		header = string(d.audio.Metadata[:4])
+	}
+	var err error
 	switch header {
 	case dsdChunkHeader:
-		return fmt.Errorf("metadata: expected metadata chunk but found DSD chunk")
+		err = fmt.Errorf("metadata: expected metadata chunk but found DSD chunk")
 	case fmtChunkHeader:
-		return fmt.Errorf("metadata: expected metadata chunk but found fmt chunk")
+		err = fmt.Errorf("metadata: expected metadata chunk but found fmt chunk")
 	case dataChunkHeader:
-		return fmt.Errorf("metadata: expected metadata chunk but found data chunk")
+		err = fmt.Errorf("metadata: expected metadata chunk but found data chunk")
 	default:
-		// Anything else is acceptable
+		// Anything else should be an ID3v2 tag
 	}
 
-	if len(d.audio.Metadata) > 0 {
-		// Log the fields of the chunk (only active if a log output has been set)
-		d.logger.Print("\nMetadata Chunk\n==============\n")
-		d.logger.Printf("Size of metadata:          %v bytes\n", len(d.audio.Metadata))
+	// The region must be large enough for at least an ID3v2 tag header
+	if err == nil && d.metadataSize < id3.HeaderSize {
+		err = fmt.Errorf("metadata: metadata chunk of %v bytes is smaller than an ID3v2 tag header of %v bytes", d.metadataSize, id3.HeaderSize)
+	}
+
+	// A bad metadata chunk is ignored when decoding permissively
+	if err != nil {
+		err = d.violation(Permissive, err, Warning{
+			Field:    "metadata.Header",
+			Expected: "ID3v2 tag",
+			Actual:   fmt.Sprintf("%q", header),
+			Message:  "bad metadata chunk, so the metadata is ignored",
+		})
+		if err != nil {
+			return err
+		}
+		d.audio.Metadata = nil
+		return nil
+	}
+	if err := d.checkID3Tag(); err != nil {
+		return err
+	}
+
+	if len(d.audio.Metadata) > 0 && logEnabled(d.logger) {
+		// Log the fields of the chunk (only active if debug logging is enabled)
+		logField(d.logger, "metadata", "Size of metadata", len(d.audio.Metadata))
 		n := len(d.audio.Metadata)
 		if n > 20 {
 			n = 20
 		}
-		d.logger.Printf("Metadata:                  % x...\n", d.audio.Metadata[:n])
+		logField(d.logger, "metadata", "Metadata", d.audio.Metadata[:n])
+	}
+
+	// Parse the tags, if requested
+	d.parseTags()
+
+	return nil
+}
+
+// padID3Header adds padding bytes to the size in the ID3v2 tag header, which
+// must be one that id3.ParseHeader accepts. A tag with a footer cannot be
+// padded, as nothing may follow the footer.
+func padID3Header(header []byte, padding uint64) error {
+	if header[5]&id3.FooterFlag != 0 {
+		return fmt.Errorf("metadata: cannot pad an ID3v2 tag with a footer")
+	}
+	size := id3.Syncsafe(header[6:10])
+	if padding > id3.MaxSize-size {
+		return fmt.Errorf("metadata: ID3v2 tag of %v bytes with %v bytes of padding exceeds the largest size of %v bytes",
+			size+id3.HeaderSize, padding, id3.MaxSize+id3.HeaderSize)
+	}
+	id3.PutSyncsafe(header[6:10], size+padding)
+	return nil
+}
+
+// checkID3Tag checks that the metadata chunk in the audio.Audio in d starts with
+// a plausible ID3v2 tag header, which is a violation of the specification if
+// not.
+func (d *decoder) checkID3Tag() error {
+	if _, ok := id3.ParseHeader(d.audio.Metadata); ok {
+		return nil
+	}
+	n := len(d.audio.Metadata)
+	if n > id3.HeaderSize {
+		n = id3.HeaderSize
+	}
+	return d.violation(Normal,
+		fmt.Errorf("metadata: bad ID3v2 tag header: % x", d.audio.Metadata[:n]),
+		Warning{
+			Field:    "metadata.Header",
+			Expected: "ID3v2 tag header",
+			Actual:   fmt.Sprintf("% x", d.audio.Metadata[:n]),
+			Message:  "metadata chunk is not an ID3v2 tag",
+		})
+}
+
+// ReadMetadata reads the metadata chunk e.g. an ID3v2 tag from the DSD stream
+// file r, seeking directly to it using the pointer in the DSD chunk rather than
+// reading the sample data. It returns nil if the file has no metadata.
+func ReadMetadata(r io.ReadSeeker, opts ...Option) ([]byte, error) {
+	d := newDecoder(nil, opts)
+	d.reset(r, new(audio.Audio))
+
+	// Pointers are relative to the start of the file
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1st chunk should be DSD
+	if err := d.readDSDChunk(); err != nil {
+		return nil, err
+	}
+
+	// Seek to the metadata chunk, if any
+	if d.metadataSize == 0 {
+		return nil, nil
+	}
+	if err := d.checkAllocation("metadata", d.metadataSize); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(start+int64(d.metadataPointer), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// Read the metadata chunk
+	if err := d.readMetadataChunk(); err != nil {
+		return nil, err
+	}
+
+	return d.audio.Metadata, nil
+}
+
+// checkMetadata checks that the metadata in the audio.Audio in e, if any, is an
+// ID3v2 tag whose size matches that of the metadata, and that can be padded as
+// requested by WithMetadataPadding, unless requested by WithRawMetadata.
+// Anything else is only tolerated when encoding permissively.
+func (e *encoder) checkMetadata() error {
+	metadata := e.audio.Metadata
+	if len(metadata) == 0 || e.rawMetadata {
+		return nil
+	}
+
+	var err error
+	var w Warning
+	if size, ok := id3.ParseHeader(metadata); !ok {
+		n := min(len(metadata), id3.HeaderSize)
+		err = fmt.Errorf("metadata: bad ID3v2 tag header: % x", metadata[:n])
+		w = Warning{
+			Field:    "metadata.Header",
+			Expected: "ID3v2 tag header",
+			Actual:   fmt.Sprintf("% x", metadata[:n]),
+			Message:  "metadata is not an ID3v2 tag",
+		}
+	} else if size != uint64(len(metadata)) {
+		err = fmt.Errorf("metadata: ID3v2 tag of %v bytes but the metadata is %v bytes", size, len(metadata))
+		w = Warning{
+			Field:    "metadata.Size",
+			Expected: fmt.Sprint(size),
+			Actual:   fmt.Sprint(len(metadata)),
+			Message:  "size of ID3v2 tag does not match that of the metadata",
+		}
+	} else if e.metadataPadding > 0 {
+		var header [id3.HeaderSize]byte
+		copy(header[:], metadata)
+		err = padID3Header(header[:], e.metadataPadding)
+		w = Warning{
+			Field:    "metadata.Header",
+			Expected: "ID3v2 tag that can be padded",
+			Actual:   fmt.Sprintf("% x", header),
+			Message:  "padding is appended to an ID3v2 tag that cannot be padded",
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	if e.strictness < Permissive {
+		return err
+	}
+	e.warn(w)
+	return nil
+}
+
+// metadataSize returns the size in bytes of the metadata chunk, including any
+// padding requested by WithMetadataPadding.
+func (e *encoder) metadataSize() uint64 {
+	if len(e.audio.Metadata) == 0 {
+		return 0
+	}
+	return uint64(len(e.audio.Metadata)) + e.metadataPadding
+}
+
+// writeMetadataChunk writes the metadata e.g. an ID3v2 tag verbatim, if any,
+// followed by any padding requested by WithMetadataPadding. The padding is
+// added to the size in the tag header, unless the metadata is raw or is not a
+// tag that can be padded.
+func (e *encoder) writeMetadataChunk() error {
+	metadata := e.audio.Metadata
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	// Copy the tag header to include the padding in its size
+	var header []byte
+	if size, ok := id3.ParseHeader(metadata); e.metadataPadding > 0 && !e.rawMetadata && ok && size == uint64(len(metadata)) {
+		header = append(header, metadata[:id3.HeaderSize]...)
+		if err := padID3Header(header, e.metadataPadding); err == nil {
+			metadata = metadata[id3.HeaderSize:]
+		} else {
+			header = nil
+		}
 	}
 
+	// Log the fields of the chunk as written, including any padding (only
+	// active if debug logging is enabled)
+	if logEnabled(e.logger) {
+		logField(e.logger, "metadata", "Size of metadata", e.metadataSize())
+		preview := append(header[:len(header):len(header)], metadata[:min(len(metadata), 20)]...)
+		logField(e.logger, "metadata", "Metadata", preview[:min(len(preview), 20)])
+	}
+
+	if len(header) > 0 {
+		if err := e.write(header); err != nil {
+			return err
+		}
+	}
+	if err := e.write(metadata); err != nil {
+		return err
+	}
+	if err := e.writeRepeated(0, e.metadataPadding); err != nil {
+		return err
+	}
+	e.reportProgress()
 	return nil
 }
+
+// UpdateMetadataInPlace overwrites the metadata chunk of the DSD stream file f
+// with newTag, an ID3v2 tag, without rewriting the rest of the file, which must
+// start at the current position of f. The tag is padded with zero to fill the
+// existing metadata chunk, so it fits if it is no larger than the tag there
+// plus any padding, see WithMetadataPadding. Otherwise f is left untouched and
+// an error is returned, in which case Remux with WithNewMetadata can rewrite
+// the whole file instead. The DSD, fmt and data chunk headers are checked as
+// when decoding, and the metadata chunk must already start with an ID3v2 tag,
+// so that nothing else in f can be overwritten.
+func UpdateMetadataInPlace(f io.ReadWriteSeeker, newTag []byte) error {
+	d := newDecoder(nil, nil)
+	d.reset(f, new(audio.Audio))
+
+	// Pointers are relative to the start of the file
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	// Read the DSD, fmt and data chunk headers, which should point to a
+	// metadata chunk that follows the data chunk
+	if err := d.readHeaders(); err != nil {
+		return err
+	}
+	if d.metadataSize == 0 {
+		return fmt.Errorf("metadata: file has no metadata chunk to update in place, see Remux")
+	}
+
+	// The new tag must be a complete ID3v2 tag that fits, and that can be padded
+	// if smaller
+	size, ok := id3.ParseHeader(newTag)
+	if !ok {
+		n := min(len(newTag), id3.HeaderSize)
+		return fmt.Errorf("metadata: bad ID3v2 tag header: % x", newTag[:n])
+	}
+	if size != uint64(len(newTag)) {
+		return fmt.Errorf("metadata: ID3v2 tag of %v bytes but the metadata is %v bytes", size, len(newTag))
+	}
+	if size > d.metadataSize {
+		return fmt.Errorf("metadata: ID3v2 tag of %v bytes does not fit in the metadata chunk of %v bytes, see Remux", size, d.metadataSize)
+	}
+	var header [id3.HeaderSize]byte
+	copy(header[:], newTag)
+	padding := d.metadataSize - size
+	if padding > 0 {
+		if err := padID3Header(header[:], padding); err != nil {
+			return err
+		}
+	}
+
+	// The metadata chunk should already start with an ID3v2 tag
+	if _, err := f.Seek(start+int64(d.metadataPointer), io.SeekStart); err != nil {
+		return err
+	}
+	existing := d.buffer[:id3.HeaderSize]
+	if n, err := io.ReadFull(f, existing); err != nil {
+		return d.shortRead("metadata", "metadata chunk", d.metadataPointer, d.metadataSize, uint64(n), err)
+	}
+	if _, ok := id3.ParseHeader(existing); !ok {
+		return fmt.Errorf("metadata: bad ID3v2 tag header at offset %v: % x", d.metadataPointer, existing)
+	}
+
+	// Overwrite the metadata chunk
+	if _, err := f.Seek(start+int64(d.metadataPointer), io.SeekStart); err != nil {
+		return err
+	}
+	e := newEncoder(nil, nil)
+	e.reset(f, nil)
+	for _, p := range [][]byte{header[:], newTag[id3.HeaderSize:]} {
+		if err := e.write(p); err != nil {
+			return err
+		}
+	}
+	return e.writeRepeated(0, padding)
+}
@@ -6,10 +6,15 @@ package dsf
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/snmoore/go/audio"
+	"github.com/snmoore/go/audio/internal/id3"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -42,9 +47,9 @@ func TestMetadataRead(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Run each test
@@ -57,7 +62,7 @@ func TestMetadataRead(t *testing.T) {
 		copy(c[test.offset:], test.data)
 
 		// Read the chunk
-		d.audio.Metadata = make([]byte, len(validMetadataChunk))
+		d.metadataSize = uint64(len(validMetadataChunk))
 		d.reader = bytes.NewReader(c)
 		err := d.readMetadataChunk()
 
@@ -90,22 +95,22 @@ func TestMetadataReadError(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Prepare the decoder to expect 1024 bytes of metadata
 	// This is normally done when reading a DSD chunk, omitted in this test
-	d.audio.Metadata = make([]byte, 1024)
+	d.metadataSize = 1024
 
 	// Read an empty chunk to force a read error
 	d.reader = bytes.NewReader([]byte{})
 	err := d.readMetadataChunk()
 
-	// Reading the chunk should have thrown an error
-	if err == nil {
-		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", len(metadataChunkTests)+1, description)
+	// Reading the chunk should have thrown an error wrapping io.ErrUnexpectedEOF
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", len(metadataChunkTests)+1, description, io.ErrUnexpectedEOF, err)
 	} else {
 		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", len(metadataChunkTests)+1, description, err.Error())
 	}
@@ -121,9 +126,9 @@ func TestMetadataReadInsufficientBytes(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Expect 1024 bytes of metadata, but do not actually provide them
@@ -144,11 +149,12 @@ func TestMetadataReadInsufficientBytes(t *testing.T) {
 func TestMetadataReadBytes(t *testing.T) {
 	description := "Samples are read correctly from a metadata chunk"
 
-	// Prepare 1024 bytes of metadata
+	// Prepare 1024 bytes of metadata, starting with an ID3v2 tag header
 	metadata := make([]byte, 1024)
 	for i, _ := range metadata {
 		metadata[i] = byte(i)
 	}
+	copy(metadata, []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x07, 0x76})
 
 	// Prepare a decoder to use
 	var d decoder
@@ -156,9 +162,9 @@ func TestMetadataReadBytes(t *testing.T) {
 
 	// Only log the chunk contents if verbose is enabled
 	if testing.Verbose() {
-		d.logger = log.New(os.Stdout, "", 0)
+		d.logger = newLogger(os.Stdout)
 	} else {
-		d.logger = log.New(ioutil.Discard, "", 0)
+		d.logger = newLogger(ioutil.Discard)
 	}
 
 	// Use the 1024 bytes of metadata prepared previously
@@ -168,6 +174,7 @@ func TestMetadataReadBytes(t *testing.T) {
 	// Prepare the decoder to expect 1024 bytes of metadata
 	// This is normally done when reading a DSD chunk, omitted in this test
 	d.audio.Metadata = make([]byte, 1024)
+	d.metadataSize = 1024
 
 	// Reading the chunk should not throw an error
 	d.reader = bytes.NewReader(c)
@@ -186,3 +193,534 @@ func TestMetadataReadBytes(t *testing.T) {
 		}
 	}
 }
+
+// Table structure for a single ReadMetadata test
+type readMetadataTest struct {
+	// Description for the test
+	description string
+	// Name of the DSD stream file to read
+	filename string
+	// Expected number of bytes of metadata
+	size int
+	// Is an error expected to be thrown?
+	expectError bool
+}
+
+// Table driven ReadMetadata tests
+var readMetadataTests = []readMetadataTest{
+	{"Reading the metadata from a DSD stream file with metadata should not result in an error", "test/valid_with_metadata.dsf", 10, false},
+	{"Reading the metadata from a DSD stream file without metadata should not result in an error", "test/valid_without_metadata.dsf", 0, false},
+	{"Reading the metadata from a DSD stream file that has missing metadata should result in an error", "test/invalid_missing_metadata.dsf", 0, true},
+	{"Reading the metadata from a DSD stream file that has missing chunks (missing DSD) should result in an error", "test/invalid_missing_dsd.dsf", 0, true},
+}
+
+// Run the table driven tests
+func TestReadMetadata(t *testing.T) {
+	// Run each test
+	for i, test := range readMetadataTests {
+		// Open the DSD stream file
+		file, err := os.Open(test.filename)
+		if err != nil {
+			t.Fatalf("FAIL Test %v: %v:\n%v", i+1, test.description, err.Error())
+		}
+
+		// Read the metadata
+		metadata, err := ReadMetadata(file)
+
+		// Check the result from reading the metadata
+		if test.expectError {
+			// Reading the metadata should have thrown an error
+			if err == nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", i+1, test.description)
+			} else {
+				t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+			}
+		} else {
+			// Reading the metadata should not have thrown an error
+			if err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			} else if len(metadata) != test.size {
+				t.Errorf("FAIL Test %v: %v:\nWant: %v bytes\nActual: %v bytes", i+1, test.description, test.size, len(metadata))
+			} else {
+				t.Logf("PASS Test %v: %v:\nWant: nil\nActual: nil", i+1, test.description)
+			}
+		}
+
+		// Close the DSD stream file
+		if err := file.Close(); err != nil {
+			t.Errorf("FAIL Test %v: %v:\n%v", i+1, test.description, err.Error())
+		}
+	}
+}
+
+// Table structure for a single ID3v2 tag test
+type id3Test struct {
+	// Description for the test
+	description string
+	// Metadata chunk
+	metadata []byte
+	// Decode in lenient mode?
+	lenient bool
+	// Is an error expected to be thrown?
+	expectError bool
+	// Expected number of warnings
+	warnings int
+}
+
+// Table driven ID3v2 tag tests
+var id3Tests = []id3Test{
+	{"A metadata chunk of 1 byte should result in an error", []byte{'I'}, false, true, 0},
+	{"A metadata chunk of 3 bytes should result in an error", []byte{'I', 'D', '3'}, false, true, 0},
+	{"A metadata chunk of 3 bytes should result in an error in lenient mode", []byte{'I', 'D', '3'}, true, true, 0},
+	{"A metadata chunk smaller than an ID3v2 tag header should result in an error", []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x00}, false, true, 0},
+	{"A valid ID3v2.3 tag header should not result in an error", []byte{'I', 'D', '3', 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, false, false, 0},
+	{"A valid ID3v2.4 tag header with a footer should not result in an error", []byte{'I', 'D', '3', 0x04, 0x00, 0x10, 0x00, 0x00, 0x01, 0x7f}, false, false, 0},
+	{"A metadata chunk that is not an ID3v2 tag should result in an error", []byte{'A', 'P', 'E', 'T', 'A', 'G', 'E', 'X', 0x00, 0x00}, false, true, 0},
+	{"An ID3v2 tag header with a bad version should result in an error", []byte{'I', 'D', '3', 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, false, true, 0},
+	{"An ID3v2 tag header with a bad syncsafe size should result in an error", []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00}, false, true, 0},
+	{"An ID3v2 tag header with a bad syncsafe size should result in a warning in lenient mode", []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00}, true, false, 1},
+}
+
+// Run the table driven tests
+func TestMetadataID3(t *testing.T) {
+	for i, test := range id3Tests {
+		c := newTestFile(1, 1, 1, 4096, make([]byte, 4096), test.metadata)
+		var warnings []Warning
+		opts := []Option{WithWarnings(&warnings), WithStrictness(Strict)}
+		if test.lenient {
+			opts = append(opts, WithLenient())
+		}
+		_, err := Decode(bytes.NewReader(c), nil, opts...)
+		switch {
+		case test.expectError && err == nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", i+1, test.description)
+		case !test.expectError && err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case len(warnings) != test.warnings:
+			t.Errorf("FAIL Test %v: %v:\nWant: %v warnings\nActual: %v", i+1, test.description, test.warnings, warnings)
+		default:
+			t.Logf("PASS Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.expectError, err)
+		}
+	}
+}
+
+// Decoding should never panic whatever the metadata pointer and total file size
+func FuzzMetadataPointer(f *testing.F) {
+	b, err := ioutil.ReadFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(uint64(4188), uint64(4198))
+	f.Add(uint64(4195), uint64(4198))
+	f.Add(uint64(93), uint64(4198))
+	f.Add(uint64(4197), uint64(4198))
+	f.Fuzz(func(t *testing.T, pointer, total uint64) {
+		c := make([]byte, len(b))
+		copy(c, b)
+		binary.LittleEndian.PutUint64(c[12:], total)
+		binary.LittleEndian.PutUint64(c[20:], pointer)
+		Decode(bytes.NewReader(c), nil, WithLenient())
+		DecodeBytes(c, WithLenient())
+		ReadMetadata(bytes.NewReader(c))
+	})
+}
+
+// Build a DSD stream file whose metadata follows a gap of the given size after
+// the data chunk, with the metadata pointer adjusted by offset
+func newMetadataGapFile(gap int, offset int64) []byte {
+	metadata := []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	c := newTestFile(1, 1, 1, 4096, make([]byte, 4096), nil)
+	pointer := uint64(len(c) + gap)
+	c = append(c, make([]byte, gap)...)
+	c = append(c, metadata...)
+	binary.LittleEndian.PutUint64(c[12:], uint64(len(c)))
+	binary.LittleEndian.PutUint64(c[20:], uint64(int64(pointer)+offset))
+	return c
+}
+
+// The metadata pointer should match the end of the data chunk
+func TestMetadataPointer(t *testing.T) {
+	// A pointer within the data chunk should result in an error
+	description := "A metadata pointer within the data chunk should result in an error"
+	c := newMetadataGapFile(0, -100)
+	if _, err := Decode(bytes.NewReader(c), nil); err == nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 1: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	// Even in lenient mode, naming both the pointer and the end of the data chunk
+	description = "A metadata pointer within the data chunk should result in an error in lenient mode"
+	_, err := Decode(bytes.NewReader(c), nil, WithLenient())
+	if err == nil || !strings.Contains(err.Error(), "4088") || !strings.Contains(err.Error(), "4188") {
+		t.Errorf("FAIL Test 2: %v:\nWant: error naming 4088 and 4188\nActual: %v", description, err)
+	} else {
+		t.Logf("PASS Test 2: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	// A gap before the metadata should result in an error
+	description = "A gap between the data chunk and the metadata should result in an error"
+	c = newMetadataGapFile(16, 0)
+	if _, err := Decode(bytes.NewReader(c), nil, WithStrictness(Strict)); err == nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 3: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	// A gap before the metadata should be skipped in lenient mode
+	description = "A gap between the data chunk and the metadata should be skipped in lenient mode"
+	decoders := []func(opts ...Option) (*audio.Audio, error){
+		func(opts ...Option) (*audio.Audio, error) { return Decode(bytes.NewReader(c), nil, opts...) },
+		func(opts ...Option) (*audio.Audio, error) {
+			return Decode(struct{ io.Reader }{bytes.NewReader(c)}, nil, opts...)
+		},
+		func(opts ...Option) (*audio.Audio, error) { return DecodeBytes(c, opts...) },
+	}
+	for i, decode := range decoders {
+		var warnings []Warning
+		a, err := decode(WithLenient(), WithWarnings(&warnings))
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+4, description, err.Error())
+		case !bytes.Equal(a.Metadata, c[len(c)-10:]):
+			t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x", i+4, description, c[len(c)-10:], a.Metadata)
+		case len(warnings) != 1 || warnings[0].Field != "dsd.MetadataPointer":
+			t.Errorf("FAIL Test %v: %v:\nWant: 1 warning\nActual: %v", i+4, description, warnings)
+		default:
+			t.Logf("PASS Test %v: %v", i+4, description)
+		}
+	}
+}
+
+// A reader that fails if it is ever read
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("the metadata should not be read")
+}
+
+// The metadata chunk should be skipped without being allocated or read
+func TestWithoutMetadata(t *testing.T) {
+	// An ID3v2 tag of 1MB
+	metadata := make([]byte, id3.HeaderSize+1<<20)
+	copy(metadata, []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x40, 0x00, 0x00})
+	c := newTestFile(1, 1, 1, 4096, make([]byte, 4096), metadata)
+	end := len(c) - len(metadata)
+
+	// The memory limit only allows the sample data to be allocated
+	description := "The metadata should not be allocated"
+	if _, err := Decode(bytes.NewReader(c), nil, WithMemoryLimit(64<<10)); err == nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: error without WithoutMetadata\nActual: nil", description)
+	}
+	r := bytes.NewReader(c)
+	a, err := Decode(r, nil, WithMemoryLimit(64<<10), WithoutMetadata())
+	if err != nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if a.Metadata != nil || r.Len() != 0 {
+		t.Errorf("FAIL Test 1: %v:\nWant: no metadata and the input skipped\nActual: %v bytes of metadata and %v bytes unread", description, len(a.Metadata), r.Len())
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	// Without an io.Seeker decoding should stop after the data chunk
+	description = "The metadata should not be read if the input is not an io.Seeker"
+	input := io.MultiReader(bytes.NewReader(c[:end]), failingReader{})
+	if a, err := Decode(input, nil, WithoutMetadata()); err != nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if a.Metadata != nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: nil\nActual: %v bytes", description, len(a.Metadata))
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	// A reused metadata buffer should not be kept
+	description = "A reused metadata buffer should not be kept"
+	a = &audio.Audio{Metadata: make([]byte, 0, 100)}
+	if err := DecodeInto(bytes.NewReader(c), a, WithoutMetadata()); err != nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if a.Metadata != nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: nil\nActual: %v bytes", description, len(a.Metadata))
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+
+	// Nor should the metadata be aliased when decoding bytes
+	description = "The metadata should not be aliased when decoding bytes"
+	if a, err := DecodeBytes(c, WithoutMetadata()); err != nil {
+		t.Errorf("FAIL Test 4: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if a.Metadata != nil {
+		t.Errorf("FAIL Test 4: %v:\nWant: nil\nActual: %v bytes", description, len(a.Metadata))
+	} else {
+		t.Logf("PASS Test 4: %v", description)
+	}
+}
+
+// An ID3v2 tag appended after the data chunk without a pointer to it should be
+// found unless decoding strictly
+func TestTrailingTag(t *testing.T) {
+	tag := []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 'T', 'A', 'G', 0}
+	c := append(newTestFile(1, 1, 1, 4096, make([]byte, 4096), nil), tag...)
+	end := len(c) - len(tag)
+
+	// The total file size may or may not have been updated by the tag editor
+	updated := append([]byte{}, c...)
+	binary.LittleEndian.PutUint64(updated[12:], uint64(len(updated)))
+
+	description := "A trailing ID3v2 tag should be read, with a warning for the missing pointer"
+	var warnings []Warning
+	a, err := Decode(struct{ io.Reader }{bytes.NewReader(c)}, nil, WithWarnings(&warnings))
+	switch {
+	case err != nil:
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	case !bytes.Equal(a.Metadata, tag):
+		t.Errorf("FAIL Test 1: %v:\nWant: % x\nActual: % x", description, tag, a.Metadata)
+	case len(warnings) != 1 || warnings[0].Field != "dsd.MetadataPointer" || warnings[0].Expected != fmt.Sprint(end):
+		t.Errorf("FAIL Test 1: %v:\nWant: dsd.MetadataPointer warning\nActual: %v", description, warnings)
+	default:
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "A trailing ID3v2 tag within the total file size should be read when decoding bytes"
+	if a, err := DecodeBytes(updated, WithWarnings(&warnings)); err != nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if !bytes.Equal(a.Metadata, tag) || len(warnings) != 1 {
+		t.Errorf("FAIL Test 2: %v:\nWant: % x and 1 warning\nActual: % x and %v", description, tag, a.Metadata, warnings)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	description = "A trailing ID3v2 tag should be ignored when decoding strictly"
+	if a, err := Decode(bytes.NewReader(updated), nil, WithStrictness(Strict)); err != nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if len(a.Metadata) != 0 {
+		t.Errorf("FAIL Test 3: %v:\nWant: no metadata\nActual: % x", description, a.Metadata)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+
+	description = "Trailing bytes that are not an ID3v2 tag should be ignored"
+	junk := append(c[:end:end], "junk after the data chunk"...)
+	if a, err := Decode(struct{ io.Reader }{bytes.NewReader(junk)}, nil, WithWarnings(&warnings)); err != nil {
+		t.Errorf("FAIL Test 4: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if len(a.Metadata) != 0 || len(warnings) != 0 {
+		t.Errorf("FAIL Test 4: %v:\nWant: no metadata or warnings\nActual: % x and %v", description, a.Metadata, warnings)
+	} else {
+		t.Logf("PASS Test 4: %v", description)
+	}
+
+	description = "A truncated trailing ID3v2 tag should be kept, with a warning"
+	if a, err := Decode(struct{ io.Reader }{bytes.NewReader(c[:len(c)-2])}, nil, WithWarnings(&warnings)); err != nil {
+		t.Errorf("FAIL Test 5: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if !bytes.Equal(a.Metadata, tag[:len(tag)-2]) || len(warnings) != 2 || warnings[1].Field != "metadata.Size" {
+		t.Errorf("FAIL Test 5: %v:\nWant: % x and a metadata.Size warning\nActual: % x and %v", description, tag[:len(tag)-2], a.Metadata, warnings)
+	} else {
+		t.Logf("PASS Test 5: %v", description)
+	}
+
+	// Encoding the decoded audio writes the pointer that the tag editor did not
+	description = "Encoding the decoded audio should repair the pointer to the metadata chunk"
+	a, err = Decode(struct{ io.Reader }{bytes.NewReader(c)}, nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 6: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	var b bytes.Buffer
+	if err := Encode(a, &b, nil); err != nil {
+		t.Fatalf("FAIL Test 6: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	var dsd DsdChunk
+	dsd.decode(b.Bytes())
+	if details := dsd.Details(); details.MetadataPointer != uint64(end) || details.TotalFileSize != uint64(len(c)) {
+		t.Errorf("FAIL Test 6: %v:\nWant: pointer %v and total file size %v\nActual: %v and %v", description, end, len(c), details.MetadataPointer, details.TotalFileSize)
+	} else {
+		t.Logf("PASS Test 6: %v", description)
+	}
+}
+
+// Table structure for a single metadata encoding test
+type encodeMetadataTest struct {
+	// Description for the test
+	description string
+	// Metadata to encode
+	metadata []byte
+	// Options to encode with
+	opts []Option
+	// Is an error expected to be thrown?
+	expectError bool
+	// Expected number of warnings
+	warnings int
+}
+
+// Table of all metadata encoding tests
+var encodeMetadataTests = []encodeMetadataTest{
+	{"A valid ID3v2 tag should be embedded", id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x00Title"))), nil, false, 0},
+	{"A valid ID3v2 tag with a footer should be embedded", append(id3Tag(4, id3.FooterFlag), make([]byte, id3.FooterSize)...), nil, false, 0},
+	{"A truncated ID3v2 tag should result in an error", id3Tag(3, 0)[:20], nil, true, 0},
+	{"An ID3v2 tag followed by other bytes should result in an error", append(id3Tag(3, 0), "junk"...), nil, true, 0},
+	{"Metadata that is not an ID3v2 tag should result in an error", []byte("APETAGEX junk bytes"), nil, true, 0},
+	{"Metadata that is not an ID3v2 tag should result in an error when strict", []byte("APETAGEX junk bytes"), []Option{WithStrictness(Strict)}, true, 0},
+	{"Metadata that is not an ID3v2 tag should result in a warning when permissive", []byte("APETAGEX junk bytes"), []Option{WithStrictness(Permissive)}, false, 1},
+	{"A truncated ID3v2 tag should result in a warning when permissive", id3Tag(3, 0)[:20], []Option{WithStrictness(Permissive)}, false, 1},
+	{"Metadata that is not an ID3v2 tag should be embedded if requested", []byte("APETAGEX junk bytes"), []Option{WithRawMetadata()}, false, 0},
+}
+
+// Run all metadata encoding tests, checking that the metadata is embedded
+// verbatim unless it results in an error, in which case nothing is written
+func TestEncodeMetadata(t *testing.T) {
+	for i, test := range encodeMetadataTests {
+		a := audio.Audio{Encoding: audio.DSD, NumChannels: 1, ChannelOrder: []audio.Channel{audio.Center},
+			SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096, SampleCount: 4096 * 8,
+			EncodedSamples: make([]byte, 4096), Metadata: test.metadata}
+		var warnings []Warning
+		var b bytes.Buffer
+		err := Encode(&a, &b, nil, append(test.opts, WithWarnings(&warnings))...)
+		switch {
+		case test.expectError && (err == nil || b.Len() != 0):
+			t.Errorf("FAIL Test %v: %v:\nWant: error and 0 bytes\nActual: %v and %v bytes", i+1, test.description, err, b.Len())
+		case !test.expectError && err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case !test.expectError && !bytes.HasSuffix(b.Bytes(), test.metadata):
+			t.Errorf("FAIL Test %v: %v:\nWant: metadata % x\nActual: % x", i+1, test.description, test.metadata, b.Bytes()[b.Len()-len(test.metadata):])
+		case len(warnings) != test.warnings:
+			t.Errorf("FAIL Test %v: %v:\nWant: %v warnings\nActual: %v", i+1, test.description, test.warnings, warnings)
+		default:
+			t.Logf("PASS Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.expectError, err)
+		}
+	}
+}
+
+// Padding reserved after the tag when encoding lets a larger tag be written in
+// place, but a tag larger than the tag and its padding does not fit
+func TestMetadataPadding(t *testing.T) {
+	tag := id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x00Title")))
+	a := audio.Audio{Encoding: audio.DSD, NumChannels: 1, ChannelOrder: []audio.Channel{audio.Center},
+		SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096, SampleCount: 4096 * 8,
+		EncodedSamples: make([]byte, 4096), Metadata: tag}
+	var b bytes.Buffer
+	if err := Encode(&a, &b, nil, WithMetadataPadding(64)); err != nil {
+		t.Fatalf("FAIL Test 1: Encoding with padding:\nWant: nil\nActual: %v", err.Error())
+	}
+
+	description := "Encoding with padding should add it to the tag"
+	decoded, err := Decode(bytes.NewReader(b.Bytes()), nil, WithStrictness(Strict), WithParsedTags())
+	switch {
+	case err != nil:
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	case len(decoded.Metadata) != len(tag)+64 || !bytes.Equal(decoded.Metadata[id3.HeaderSize:len(tag)], tag[id3.HeaderSize:]) || !bytes.Equal(decoded.Metadata[len(tag):], make([]byte, 64)):
+		t.Errorf("FAIL Test 1: %v:\nWant: % x followed by 64 zero bytes\nActual: % x", description, tag, decoded.Metadata)
+	case decoded.Tags == nil || decoded.Tags.Title != "Title":
+		t.Errorf("FAIL Test 1: %v:\nWant: title Title\nActual: %+v", description, decoded.Tags)
+	default:
+		if size, ok := id3.ParseHeader(decoded.Metadata); !ok || size != uint64(len(decoded.Metadata)) {
+			t.Errorf("FAIL Test 1: %v:\nWant: ID3v2 tag of %v bytes\nActual: %v bytes", description, len(decoded.Metadata), size)
+		} else {
+			t.Logf("PASS Test 1: %v", description)
+		}
+	}
+
+	// Write the file to update in place
+	name := t.TempDir() + "/padded.dsf"
+	if err := ioutil.WriteFile(name, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	description = "A larger tag that fits within the padding should be written in place"
+	grown := id3Tag(4, 0, id3Frame(4, "TIT2", 0, []byte("\x03A much longer title")), id3Frame(4, "TPE1", 0, []byte("\x03Artist")))
+	err = UpdateMetadataInPlace(f, grown)
+	updated, _ := ioutil.ReadFile(name)
+	decoded, derr := Decode(bytes.NewReader(updated), nil, WithStrictness(Strict), WithParsedTags())
+	switch {
+	case len(grown) <= len(tag) || len(grown) > len(tag)+64:
+		t.Fatalf("FAIL Test 2: %v:\nWant: a tag of %v to %v bytes\nActual: %v bytes", description, len(tag)+1, len(tag)+64, len(grown))
+	case err != nil || derr != nil:
+		t.Errorf("FAIL Test 2: %v:\nWant: nil\nActual: %v, %v", description, err, derr)
+	case len(updated) != b.Len() || !bytes.Equal(updated[:b.Len()-len(tag)-64], b.Bytes()[:b.Len()-len(tag)-64]):
+		t.Errorf("FAIL Test 2: %v:\nWant: %v bytes, unchanged before the metadata\nActual: %v bytes", description, b.Len(), len(updated))
+	case decoded.Tags == nil || decoded.Tags.Title != "A much longer title" || decoded.Tags.Artist != "Artist":
+		t.Errorf("FAIL Test 2: %v:\nWant: title A much longer title, artist Artist\nActual: %+v", description, decoded.Tags)
+	default:
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	description = "A tag larger than the tag and its padding should result in an error"
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	err = UpdateMetadataInPlace(f, id3Tag(3, 0, id3Frame(3, "TIT2", 0, append([]byte{0}, bytes.Repeat([]byte("Title"), 20)...))))
+	if after, _ := ioutil.ReadFile(name); err == nil || !bytes.Equal(after, updated) {
+		t.Errorf("FAIL Test 3: %v:\nWant: error and the file unchanged\nActual: %v", description, err)
+	} else {
+		t.Logf("PASS Test 3: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	description = "Padding a tag with a footer should result in an error"
+	a.Metadata = append(id3Tag(4, id3.FooterFlag), '3', 'D', 'I', 4, 0, id3.FooterFlag, 0, 0, 0, 16)
+	b.Reset()
+	if err := Encode(&a, &b, nil, WithMetadataPadding(64)); err == nil || b.Len() != 0 {
+		t.Errorf("FAIL Test 4: %v:\nWant: error and 0 bytes\nActual: %v and %v bytes", description, err, b.Len())
+	} else {
+		t.Logf("PASS Test 4: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	description = "Updating a file without metadata in place should result in an error"
+	a.Metadata = nil
+	b.Reset()
+	if err := Encode(&a, &b, nil, WithMetadataPadding(64)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateMetadataInPlace(f, grown); err == nil {
+		t.Errorf("FAIL Test 5: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 5: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// Updating in place should refuse a file whose pointer to the metadata chunk
+// does not point to an ID3v2 tag after the data chunk, leaving it unchanged
+func TestUpdateMetadataInPlaceBadPointer(t *testing.T) {
+	tag := id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x00Title")))
+	a := audio.Audio{Encoding: audio.DSD, NumChannels: 1, ChannelOrder: []audio.Channel{audio.Center},
+		SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096, SampleCount: 4096 * 8,
+		EncodedSamples: bytes.Repeat([]byte{0x55}, 4096), Metadata: tag}
+	var b bytes.Buffer
+	if err := Encode(&a, &b, nil, WithMetadataPadding(64)); err != nil {
+		t.Fatal(err)
+	}
+	end := uint64(b.Len() - len(tag) - 64)
+
+	for i, test := range []struct {
+		description string
+		pointer     uint64
+	}{
+		{"A pointer to the metadata chunk within the data chunk should result in an error", dataChunkOffset + dataChunkSize + 100},
+		{"A pointer to the metadata chunk that is not an ID3v2 tag should result in an error", end + 1},
+	} {
+		c := bytes.Clone(b.Bytes())
+		binary.LittleEndian.PutUint64(c[dsdMetadataPointerOffset:], test.pointer)
+		name := t.TempDir() + "/bad.dsf"
+		if err := ioutil.WriteFile(name, c, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = UpdateMetadataInPlace(f, id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x00New"))))
+		f.Close()
+		if after, _ := ioutil.ReadFile(name); err == nil || !bytes.Equal(after, c) {
+			t.Errorf("FAIL Test %v: %v:\nWant: error and the file unchanged\nActual: %v", i+1, test.description, err)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
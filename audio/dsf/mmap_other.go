@@ -0,0 +1,22 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package dsf
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile always fails, as memory-mapping is not supported on this platform.
+func mmapFile(f *os.File) ([]byte, error) {
+	return nil, errors.New("dsf: memory-mapping is not supported")
+}
+
+// munmapFile does nothing, as memory-mapping is not supported on this platform.
+func munmapFile(m []byte) error {
+	return nil
+}
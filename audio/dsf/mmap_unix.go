@@ -0,0 +1,33 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package dsf
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"syscall"
+)
+
+// mmapFile maps the whole of f into memory privately, so that writes to the
+// mapping are not written to the file.
+func mmapFile(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size <= 0 || uint64(size) > math.MaxInt {
+		return nil, fmt.Errorf("dsf: cannot map file of %v bytes", size)
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE)
+}
+
+// munmapFile unmaps a mapping returned by mmapFile.
+func munmapFile(m []byte) error {
+	return syscall.Munmap(m)
+}
@@ -0,0 +1,399 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"github.com/snmoore/go/audio"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// Option configures how a DSD stream file is decoded or encoded.
+type Option func(*options)
+
+// DefaultMemoryLimit is the default limit on the size in bytes of the sample
+// data and of the metadata that will be read into memory.
+const DefaultMemoryLimit = 2 << 30
+
+// DefaultBlockBufferSize is the default size in bytes of each buffer that the
+// sample data is read into if requested by WithBlockBuffers.
+const DefaultBlockBufferSize = 4 << 20
+
+// SilencePadByte is DSD silence, the idle pattern of alternating bits, which the
+// final block for each channel is padded with when encoding unless WithPadByte
+// is given.
+const SilencePadByte = audio.Silence
+
+// options is the configuration built from a list of Option.
+type options struct {
+	// Limit on the size of the sample data and of the metadata read into memory.
+	memoryLimit uint64
+
+	// How strictly the specification is enforced.
+	strictness Strictness
+
+	// Whether to accept any sampling frequency above a minimum.
+	anyFrequency bool
+
+	// Where to store any warnings about tolerated violations.
+	warnings *[]Warning
+
+	// Time range of the sample data to read, where a limit of 0 means to the
+	// end.
+	start time.Duration
+	limit time.Duration
+
+	// Number of workers reading the sample data in parallel.
+	workers int
+
+	// Channel order to use instead of that implied by the channel type when
+	// decoding, and the channel type to use instead of that implied by the
+	// channel order when encoding, or 0 to infer it.
+	channelOrder []audio.Channel
+	channelType  uint32
+
+	// Whether to skip the metadata chunk rather than reading it.
+	withoutMetadata bool
+
+	// Whether to parse the tags in the metadata chunk.
+	parsedTags bool
+
+	// Where to log to, instead of the io.Writer given to Decode or Encode.
+	logger *slog.Logger
+
+	// Called periodically whilst the sample data is read.
+	progress func(readBytes, totalBytes uint64)
+
+	// Algorithm with which to checksum the sample data, and where to store the
+	// checksum.
+	checksumType Checksum
+	checksum     *[]byte
+
+	// Where to store statistics about decoding or encoding.
+	stats *Stats
+
+	// Whether to keep the sample data read from a truncated data chunk.
+	recovery bool
+
+	// Called to accept or reject the format once the fmt chunk is read.
+	fmtValidator func(Info) error
+
+	// Size of each buffer to read the sample data into, or 0 to read it into
+	// one buffer.
+	blockBuffers uint64
+
+	// Whether to reference the sample data in the input rather than reading
+	// it.
+	lazySamples bool
+
+	// Block size per channel to encode with if the audio.Audio does not set
+	// one, and the byte to pad the final block for each channel with.
+	blockSize uint
+	padByte   byte
+
+	// Whether to embed the metadata verbatim when encoding, without checking
+	// that it is an ID3v2 tag.
+	rawMetadata bool
+
+	// Metadata to replace that of the input when remuxing, or nil to keep it.
+	newMetadata []byte
+
+	// Number of bytes of padding to reserve after the metadata when encoding.
+	metadataPadding uint64
+}
+
+// newOptions applies each of opts in turn to the default configuration.
+func newOptions(opts []Option) options {
+	o := options{
+		memoryLimit: DefaultMemoryLimit,
+		strictness:  Normal,
+		workers:     runtime.GOMAXPROCS(0),
+		padByte:     SilencePadByte,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithProgress sets a function to be called periodically whilst the sample data
+// is read, with the number of bytes of sample data read so far and the total
+// number of bytes of sample data in the data chunk. It is called at least once
+// per MB and once upon completion, always from the goroutine that is decoding.
+// When encoding it is instead called whilst the sample data and metadata are
+// written, with the number of bytes of the file written so far and the total
+// file size, always from the goroutine calling Encode and never after Encode
+// returns.
+func WithProgress(fn func(readBytes, totalBytes uint64)) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// WithMemoryLimit sets the limit on the size in bytes of the sample data and of
+// the metadata that will be read into memory, instead of DefaultMemoryLimit.
+// This guards against huge allocations caused by corrupt or malicious headers.
+// A limit of 0 means no limit.
+func WithMemoryLimit(limit uint64) Option {
+	return func(o *options) {
+		o.memoryLimit = limit
+	}
+}
+
+// WithStrictness sets how strictly the specification is enforced when decoding
+// or encoding, instead of Normal. It is the encoder's strict switch as well as
+// the decoder's, as there is no separate option for encoding. Violations that
+// are tolerated are recorded as warnings rather than resulting in an error, see
+// WithWarnings. Fatal problems such as bad chunk headers or truncated sample
+// data still result in an error. When encoding, Strict rejects a nonstandard
+// block size and any sampling frequency other than the 2822400 and 5644800
+// defined by the specification, and Permissive permits a nonstandard sampling
+// frequency as WithAnyFrequency does and metadata that is not an ID3v2 tag,
+// with a warning.
+func WithStrictness(s Strictness) Option {
+	return func(o *options) {
+		o.strictness = s
+	}
+}
+
+// WithLenient tolerates violations of the specification that are commonly found
+// in real-world files. It is equivalent to WithStrictness(Normal), which is now
+// the default.
+func WithLenient() Option {
+	return func(o *options) {
+		o.strictness = Normal
+	}
+}
+
+// WithWarnings sets where to store the warnings about violations that were
+// tolerated e.g. by WithLenient.
+func WithWarnings(warnings *[]Warning) Option {
+	return func(o *options) {
+		o.warnings = warnings
+	}
+}
+
+// WithAnyFrequency accepts any sampling frequency of at least 1MHz, rather than
+// only the standard DSD sampling frequencies. A nonstandard sampling frequency
+// is recorded as a warning when decoding, and permitted when encoding.
+func WithAnyFrequency() Option {
+	return func(o *options) {
+		o.anyFrequency = true
+	}
+}
+
+// WithStart skips the sample data before the given time from the start of the
+// audio. As the samples for each channel are stored in blocks, this is rounded
+// down to the start of a block, so slightly earlier samples may be included.
+// The preceding sample data is skipped by seeking if the input is an io.Seeker,
+// otherwise it is read and discarded.
+func WithStart(start time.Duration) Option {
+	return func(o *options) {
+		o.start = start
+	}
+}
+
+// WithLimit stops reading the sample data after the given duration from the
+// start selected by WithStart. This is rounded up to the end of a block, so
+// slightly later samples may be included.
+func WithLimit(limit time.Duration) Option {
+	return func(o *options) {
+		o.limit = limit
+	}
+}
+
+// WithWorkers sets the number of workers that read the sample data in parallel
+// when the input is an io.ReaderAt and an io.Seeker, such as an *os.File. The
+// default is GOMAXPROCS. A value of 1 always reads the sample data serially.
+func WithWorkers(n int) Option {
+	return func(o *options) {
+		o.workers = n
+	}
+}
+
+// WithChecksum computes a checksum of the sample data using the algorithm c as
+// it is read or written, and stores it in sum once all of the sample data has
+// been read or written. The padding of the final block for each channel is
+// excluded, so files that differ only in their padding have the same checksum.
+// Where only a time range of the sample data is read, the checksum covers only
+// that range.
+func WithChecksum(c Checksum, sum *[]byte) Option {
+	return func(o *options) {
+		o.checksumType = c
+		o.checksum = sum
+	}
+}
+
+// WithLogger sets the logger to log to, instead of the io.Writer given to Decode
+// or Encode. The fields of each chunk are logged at Debug level with "chunk",
+// "field" and "value" attributes, and violations of the specification that are
+// tolerated are logged at Warn level with "field", "expected" and "actual"
+// attributes.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithChannelOrder sets the order of the channels when decoding, instead of that
+// implied by the channel type in the fmt chunk. This is for files that declare
+// a standard channel type but hold a different layout. The number of channels
+// must match the channel num in the fmt chunk.
+func WithChannelOrder(order []audio.Channel) Option {
+	return func(o *options) {
+		o.channelOrder = order
+	}
+}
+
+// WithChannelType sets the channel type written to the fmt chunk when encoding,
+// instead of that inferred from the ChannelOrder of the Audio. This allows a
+// channel order that does not match any of the standard channel types to be
+// written, as long as the number of channels matches the channel type.
+func WithChannelType(channelType uint32) Option {
+	return func(o *options) {
+		o.channelType = channelType
+	}
+}
+
+// WithoutMetadata skips the metadata chunk rather than reading it, leaving the
+// Metadata of the Audio nil. No memory is allocated for the metadata, which may
+// be large if it includes artwork. If the input is an io.Seeker the metadata is
+// skipped by seeking, otherwise decoding stops after the data chunk. Remux
+// leaves the metadata out of its output.
+func WithoutMetadata() Option {
+	return func(o *options) {
+		o.withoutMetadata = true
+	}
+}
+
+// WithParsedTags parses the ID3v2.3 or ID3v2.4 tag in the metadata chunk into
+// the Tags of the Audio as audio.ParseID3 does, with the common text frames
+// such as the title and artist in its fields and every other frame kept in
+// Other. The Metadata still holds the raw tag. A malformed tag is recorded as a
+// warning rather than resulting in an error, with the Tags holding whatever
+// could be parsed.
+func WithParsedTags() Option {
+	return func(o *options) {
+		o.parsedTags = true
+	}
+}
+
+// WithStats collects statistics about decoding or encoding into s, such as the
+// bytes read or written and time spent for each chunk. These are only collected
+// by Decode, DecodeBytes, DecodeInto, DecodeWithDetails, Decoder and Encode.
+// Without this option no statistics are collected, at no cost.
+func WithStats(s *Stats) Option {
+	return func(o *options) {
+		o.stats = s
+	}
+}
+
+// WithRecovery keeps whatever sample data can be read from a file that is
+// truncated within the data chunk, rather than returning no audio at all. The
+// EncodedSamples are cut down to the whole groups of blocks that were read, one
+// block for each channel, so that the channels stay aligned, and the
+// SampleCount is reduced to match. Decode then returns the Audio together with
+// an error that wraps io.ErrUnexpectedEOF and states how much was recovered.
+// Truncation anywhere else is still an error without any Audio.
+func WithRecovery() Option {
+	return func(o *options) {
+		o.recovery = true
+	}
+}
+
+// WithFmtValidator sets a function to be called with the format of the audio
+// once the fmt chunk has been read, before any memory is allocated for the
+// sample data. Returning an error aborts decoding with an error that wraps it.
+// This allows a policy such as only accepting stereo DSD64 to be enforced
+// without the cost of decoding unacceptable files.
+func WithFmtValidator(fn func(Info) error) Option {
+	return func(o *options) {
+		o.fmtValidator = fn
+	}
+}
+
+// WithBlockBuffers reads the sample data into EncodedBlocks, a sequence of
+// buffers of about sizeHint bytes each, rather than into EncodedSamples, so
+// that a long recording does not need one large allocation. Each buffer holds
+// whole groups of blocks, one block for each channel, so only the final buffer
+// may be shorter. A sizeHint of 0 or less uses DefaultBlockBufferSize. The
+// sample data is then read serially. This has no effect where the sample data
+// is aliased rather than read, such as by DecodeBytes.
+func WithBlockBuffers(sizeHint int) Option {
+	return func(o *options) {
+		if sizeHint <= 0 {
+			sizeHint = DefaultBlockBufferSize
+		}
+		o.blockBuffers = uint64(sizeHint)
+	}
+}
+
+// WithLazySamples sets the EncodedSection of the Audio to the selected range of
+// the sample data in the input, rather than reading the sample data into
+// memory, when the input is an io.ReaderAt and an io.Seeker such as an
+// *os.File. The samples are then read on demand through Samples or
+// SamplesReader, so the input must be kept open for as long as the Audio is
+// used, and Encode reads them from the input as it writes them. DecodeFile
+// leaves the file open for this, and Close on the Audio closes it. The sample
+// data is read as usual if the input is not an io.ReaderAt and an io.Seeker,
+// if any of the sample data is missing from the input, or if WithChecksum is
+// also given. This has no effect on DecodeBytes, DecodeBlocks or Decoder.
+func WithLazySamples() Option {
+	return func(o *options) {
+		o.lazySamples = true
+	}
+}
+
+// WithBlockSize sets the block size per channel in bytes to encode with when
+// the Audio does not set one, instead of the usual 4096 bytes. The sample data
+// must already be interleaved in blocks of this size.
+func WithBlockSize(n uint) Option {
+	return func(o *options) {
+		o.blockSize = n
+	}
+}
+
+// WithRawMetadata embeds the Metadata of the Audio verbatim when encoding,
+// without checking that it is an ID3v2 tag as the specification requires.
+func WithRawMetadata() Option {
+	return func(o *options) {
+		o.rawMetadata = true
+	}
+}
+
+// WithNewMetadata sets the metadata chunk written by Remux in place of that of
+// the input. It must be an ID3v2 tag unless WithRawMetadata is also given.
+func WithNewMetadata(metadata []byte) Option {
+	return func(o *options) {
+		o.newMetadata = metadata
+	}
+}
+
+// WithMetadataPadding appends n zero bytes of padding to the Metadata of the
+// Audio when encoding, which are added to the size in the ID3v2 tag header, so
+// that the tag can later grow in place by UpdateMetadataInPlace without
+// rewriting the file. A tag with a footer cannot be padded. The padding is
+// appended without changing the metadata if WithRawMetadata is also given,
+// and nothing is appended if there is no metadata.
+func WithMetadataPadding(n int) Option {
+	return func(o *options) {
+		o.metadataPadding = 0
+		if n > 0 {
+			o.metadataPadding = uint64(n)
+		}
+	}
+}
+
+// WithPadByte sets the byte to pad the final block for each channel with when
+// encoding, instead of SilencePadByte. The specification says that the padding
+// should be zero, as WithPadByte(0) gives, but zero is a full scale negative
+// offset in DSD, which some players render as a click or thump at the end of
+// the audio.
+func WithPadByte(b byte) Option {
+	return func(o *options) {
+		o.padByte = b
+	}
+}
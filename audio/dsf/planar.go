@@ -0,0 +1,88 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/snmoore/go/audio"
+	"io"
+)
+
+// EncodePlanar writes a DSD stream file to w as Encode does, from the samples
+// for each channel in the channel order of format as one contiguous slice per
+// channel. The channels are interleaved in blocks per the specification
+// without being copied, other than the final block for each channel, which is
+// padded. All of the channels must be the same length. The number of channels
+// and the sample count are set from the channels if format does not give them,
+// otherwise they must match. The file has no metadata.
+func EncodePlanar(channels [][]byte, format Info, w io.Writer, logTo io.Writer, opts ...Option) error {
+	a := audio.Audio{
+		Encoding:          audio.DSD,
+		NumChannels:       format.NumChannels,
+		ChannelOrder:      format.ChannelOrder,
+		SamplingFrequency: format.SamplingFrequency,
+		BitsPerSample:     format.BitsPerSample,
+		BlockSize:         format.BlockSize,
+		SampleCount:       format.SampleCount,
+	}
+	e := newEncoder(logTo, opts)
+	e.audio = &a
+	if err := e.interleaveBlocks(channels); err != nil {
+		return err
+	}
+
+	return e.encode(context.Background(), &a, w)
+}
+
+// interleaveBlocks sets EncodedBlocks in the audio.Audio in e to the blocks of
+// each channel in turn, aliasing all but the final block for each channel,
+// which is copied and padded.
+func (e *encoder) interleaveBlocks(channels [][]byte) error {
+	a := e.audio
+	if len(channels) == 0 || a.BitsPerSample == 0 {
+		return fmt.Errorf("fmt: cannot interleave %v channels of %v bits per sample", len(channels), a.BitsPerSample)
+	}
+	if a.NumChannels == 0 {
+		a.NumChannels = uint(len(channels))
+	}
+	if a.NumChannels != uint(len(channels)) {
+		return fmt.Errorf("fmt: mismatch between number of channels %v and the %v channels given", a.NumChannels, len(channels))
+	}
+	if len(a.ChannelOrder) > 0 && len(a.ChannelOrder) != len(channels) {
+		return fmt.Errorf("fmt: mismatch between channel order %v and the %v channels given", a.ChannelOrder, len(channels))
+	}
+	size := len(channels[0])
+	for c, channel := range channels {
+		if len(channel) != size {
+			return fmt.Errorf("data: channel %v has %v bytes of samples but channel 0 has %v", c, len(channel), size)
+		}
+	}
+
+	// Number of samples per channel, which may leave the final byte part used
+	sampleCount := uint64(size) * 8 / uint64(a.BitsPerSample)
+	if a.SampleCount == 0 {
+		a.SampleCount = sampleCount
+	}
+	if a.SampleCount > sampleCount || a.SampleCount+8/uint64(a.BitsPerSample) <= sampleCount {
+		return fmt.Errorf("fmt: mismatch between sample count %v and the %v bytes of samples for each channel", a.SampleCount, size)
+	}
+
+	// Alias each whole block, and pad the final block for each channel
+	blockSize := int(e.blockSize())
+	blocks := make([][]byte, 0, (size+blockSize-1)/blockSize*len(channels))
+	for offset := 0; offset < size; offset += blockSize {
+		for _, channel := range channels {
+			block := channel[offset:min(offset+blockSize, size)]
+			if len(block) < blockSize {
+				block = append(block[:len(block):len(block)], bytes.Repeat([]byte{e.padByte}, blockSize-len(block))...)
+			}
+			blocks = append(blocks, block)
+		}
+	}
+	a.EncodedBlocks = blocks
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"github.com/snmoore/go/audio"
+	"testing"
+)
+
+// Build the sample data of a stereo DSD64 file by hand, interleaving the given
+// channels in blocks of 4096 bytes with the final block for each channel
+// padded with pad
+func interleavedFixture(left, right []byte, pad byte) []byte {
+	var b []byte
+	for offset := 0; offset < len(left); offset += 4096 {
+		for _, channel := range [][]byte{left, right} {
+			block := bytes.Repeat([]byte{pad}, 4096)
+			copy(block, channel[offset:])
+			b = append(b, block...)
+		}
+	}
+	return b
+}
+
+// Table structure for a single planar encoding test
+type planarTest struct {
+	// Description for the test
+	description string
+	// Number of bytes of samples for each channel
+	size int
+	// Sample count to give, or 0 to set it from the channels
+	sampleCount uint64
+	// Options to encode with
+	opts []Option
+	// Byte that the final block for each channel should be padded with
+	pad byte
+}
+
+// Table of all planar encoding tests
+var planarTests = []planarTest{
+	{"Channels of whole blocks should be interleaved", 2 * 4096, 0, nil, SilencePadByte},
+	{"Channels ending in a partial block should be interleaved and padded", 5000, 0, nil, SilencePadByte},
+	{"Channels ending in a partial block should be padded with the pad byte", 5000, 0, []Option{WithPadByte(0)}, 0},
+	{"Channels whose final byte is part used should be interleaved", 5000, 5000*8 - 3, nil, SilencePadByte},
+	{"Channels of less than one block should be interleaved and padded", 10, 0, nil, SilencePadByte},
+}
+
+// Run all planar encoding tests, checking the sample data written against that
+// interleaved by hand, and that the file is identical to that written by Encode
+func TestEncodePlanar(t *testing.T) {
+	format := Info{ChannelOrder: paddingChannelOrders[1], SamplingFrequency: 2822400, BitsPerSample: 1}
+	for i, test := range planarTests {
+		left, right := make([]byte, test.size), make([]byte, test.size)
+		for j := range left {
+			left[j], right[j] = byte(j), byte(j*3+1)
+		}
+		samples := interleavedFixture(left, right, test.pad)
+		f := format
+		f.SampleCount = test.sampleCount
+		var b bytes.Buffer
+		if err := EncodePlanar([][]byte{left, right}, f, &b, nil, test.opts...); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+		sampleCount := test.sampleCount
+		if sampleCount == 0 {
+			sampleCount = uint64(test.size) * 8
+		}
+		a := audio.Audio{Encoding: audio.DSD, NumChannels: 2, ChannelOrder: f.ChannelOrder, SamplingFrequency: f.SamplingFrequency,
+			BitsPerSample: 1, SampleCount: sampleCount, EncodedSamples: samples}
+		var want bytes.Buffer
+		if err := Encode(&a, &want, nil, test.opts...); err != nil {
+			t.Fatalf("FAIL Test %v: %v:\n%v", i+1, test.description, err.Error())
+		}
+		actual := b.Bytes()
+		switch {
+		case len(actual) != 92+len(samples) || !bytes.Equal(actual[92:], samples):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v bytes of sample data interleaved by hand\nActual: %v bytes of file", i+1, test.description, len(samples), len(actual))
+		case !bytes.Equal(actual, want.Bytes()):
+			t.Errorf("FAIL Test %v: %v:\nWant: the file written by Encode\nActual: a different file", i+1, test.description)
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// Planar encoding errors
+func TestEncodePlanarError(t *testing.T) {
+	format := Info{ChannelOrder: paddingChannelOrders[1], SamplingFrequency: 2822400, BitsPerSample: 1}
+	tests := []struct {
+		description string
+		channels    [][]byte
+		format      func(f Info) Info
+	}{
+		{"Channels of unequal length should result in an error", [][]byte{make([]byte, 5000), make([]byte, 4999)}, nil},
+		{"No channels should result in an error", nil, nil},
+		{"A number of channels that does not match the channels given should result in an error", [][]byte{make([]byte, 10), make([]byte, 10)},
+			func(f Info) Info { f.NumChannels = 1; return f }},
+		{"A sample count larger than the channels should result in an error", [][]byte{make([]byte, 10), make([]byte, 10)},
+			func(f Info) Info { f.SampleCount = 81; return f }},
+		{"A sample count that leaves a byte unused should result in an error", [][]byte{make([]byte, 10), make([]byte, 10)},
+			func(f Info) Info { f.SampleCount = 72; return f }},
+		{"A channel order that does not match the channels should result in an error", [][]byte{make([]byte, 10)}, nil},
+	}
+	for i, test := range tests {
+		f := format
+		if test.format != nil {
+			f = test.format(f)
+		}
+		var b bytes.Buffer
+		if err := EncodePlanar(test.channels, f, &b, nil); err == nil || b.Len() != 0 {
+			t.Errorf("FAIL Test %v: %v:\nWant: error and 0 bytes\nActual: %v and %v bytes", i+1, test.description, err, b.Len())
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
@@ -5,16 +5,18 @@
 package dsf
 
 import (
+	"fmt"
 	"github.com/snmoore/go/audio"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math"
 )
 
 // decoder is the type used to decode a DSD stream file.
 type decoder struct {
 	// Where to log to.
-	logger *log.Logger
+	logger *slog.Logger
 
 	// Input.
 	reader io.Reader
@@ -22,55 +24,622 @@ type decoder struct {
 	// Output.
 	audio *audio.Audio
 
+	// Configuration.
+	options
+
 	// DSD stream file chunks.
 	dsd  DsdChunk
 	fmt  FmtChunk
 	data DataChunk
+
+	// Space to read the largest chunk into before decoding its fields.
+	buffer [fmtChunkSize]byte
+
+	// Number of samples per channel, from the fmt chunk.
+	sampleCount uint64
+
+	// Number of bytes of sample data expected in the data chunk, including any
+	// padding of the final block.
+	sampleDataSize uint64
+
+	// Current position within the sample data, and the position at which to
+	// stop reading.
+	position uint64
+	end      uint64
+
+	// Number of bytes of the final block for each channel that are present in
+	// the data chunk, which is less than the block size if the data chunk
+	// excludes the padding.
+	tailSize uint64
+
+	// Total file size and pointer to the metadata chunk, from the DSD chunk.
+	totalFileSize   uint64
+	metadataPointer uint64
+
+	// Bytes after the Reserved field of a fmt chunk larger than fmtChunkSize.
+	fmtExtension []byte
+
+	// Number and total size in bytes of unknown chunks skipped before the data
+	// chunk.
+	unknownChunks int
+	unknownSize   uint64
+
+	// Number of bytes of metadata expected after the data chunk, and the
+	// number of bytes between the two that are tolerated.
+	metadataSize uint64
+	metadataGap  uint64
+
+	// Violations of the specification tolerated.
+	warnings []Warning
+
+	// Checksum of the sample data, if selected by WithChecksum.
+	hasher *sampleHasher
+
+	// Input wrapped to collect statistics, if requested by WithStats.
+	statsReader *statsReader
+
+	// Whether the sample data was recovered from a truncated data chunk, as
+	// requested by WithRecovery.
+	recovered bool
 }
 
-// decode reads a DSD stream file from r and stores the result in d.
-func (d *decoder) decode(r io.Reader, logTo io.Writer) error {
-	d.logger = log.New(logTo, "", 0)
-	d.reader = r
-	d.audio = new(audio.Audio)
+// reset clears any state left from a previous DSD stream file, ready to read r
+// into a. The configuration and logger are kept.
+func (d *decoder) reset(r io.Reader, a *audio.Audio) {
+	*d = decoder{
+		logger:  d.logger,
+		reader:  r,
+		audio:   a,
+		options: d.options,
+	}
+	if a != nil {
+		a.Metadata = a.Metadata[:0]
+		a.Tags = nil
+		a.EncodedSection = nil
+		if d.options.blockBuffers == 0 {
+			a.EncodedBlocks = nil
+		}
+	}
+	if d.options.warnings != nil {
+		*d.options.warnings = nil
+	}
+	if d.options.checksum != nil {
+		*d.options.checksum = nil
+	}
+	if d.options.stats != nil {
+		*d.options.stats = Stats{}
+		d.reader, d.statsReader = newStatsReader(r, d.options.stats)
+	}
+}
 
+// readHeaders reads the DSD, fmt and data chunk headers, leaving the input
+// positioned at the start of the selected range of the sample data.
+func (d *decoder) readHeaders() error {
 	// 1st chunk should be DSD
+	d.startChunk("dsd")
 	if err := d.readDSDChunk(); err != nil {
 		return err
 	}
 
 	// 2nd chunk should be fmt
+	d.startChunk("fmt")
 	if err := d.readFmtChunk(); err != nil {
 		return err
 	}
 
+	// The sample data and metadata should fit within the file
+	if err := d.checkSizes(); err != nil {
+		return err
+	}
+
 	// 3rd chunk should be data
+	d.startChunk("data")
 	if err := d.readDataChunk(); err != nil {
 		return err
 	}
 
+	// The metadata should follow immediately after the data chunk
+	if err := d.checkMetadataPointer(); err != nil {
+		return err
+	}
+
+	// Only read the selected range of the sample data
+	return d.selectRange()
+}
+
+// checkSizes checks that the sample data implied by the fmt chunk, and any
+// metadata, fit within the total file size given by the DSD chunk.
+func (d *decoder) checkSizes() error {
+	headers := uint64(dsdChunkSize+fmtChunkSize+dataChunkSize) + uint64(len(d.fmtExtension))
+	if d.sampleDataSize > math.MaxInt64-headers {
+		return fmt.Errorf("data: data chunk of %v bytes is too large", d.sampleDataSize)
+	}
+	if d.sampleDataSize > d.totalFileSize-headers-d.metadataSize {
+		return d.violation(Normal,
+			fmt.Errorf("data: data chunk of %v bytes exceeds total file size %v", d.sampleDataSize, d.totalFileSize),
+			Warning{
+				Field:    "dsd.TotalFileSize",
+				Expected: fmt.Sprint(headers + d.sampleDataSize + d.metadataSize),
+				Actual:   fmt.Sprint(d.totalFileSize),
+				Message:  "total file size is too small for the data chunk",
+			})
+	}
+	return nil
+}
+
+// checkMetadataPointer checks that the pointer to the metadata chunk, if any, is
+// the end of the data chunk. Unless decoding strictly, a gap between the two is
+// tolerated and skipped when reading the metadata.
+func (d *decoder) checkMetadataPointer() error {
+	if d.metadataPointer == 0 {
+		return nil
+	}
+	end := d.dataOffset() + d.data.Details().Size
+	switch {
+	case d.metadataPointer < end:
+		err := d.violation(Permissive,
+			fmt.Errorf("dsd: pointer to metadata chunk %v is within the data chunk, which ends at %v", d.metadataPointer, end),
+			Warning{
+				Field:    "dsd.MetadataPointer",
+				Expected: fmt.Sprint(end),
+				Actual:   fmt.Sprint(d.metadataPointer),
+				Message:  "pointer to metadata chunk is within the data chunk, so the metadata is ignored",
+			})
+		if err != nil {
+			return err
+		}
+		d.metadataPointer, d.metadataSize = 0, 0
+	case d.metadataPointer > end:
+		err := d.violation(Normal,
+			fmt.Errorf("dsd: pointer to metadata chunk %v does not match the end of the data chunk at %v", d.metadataPointer, end),
+			Warning{
+				Field:    "dsd.MetadataPointer",
+				Expected: fmt.Sprint(end),
+				Actual:   fmt.Sprint(d.metadataPointer),
+				Message:  "gap between the data chunk and the metadata chunk",
+			})
+		if err != nil {
+			return err
+		}
+		d.metadataGap = d.metadataPointer - end
+	}
+	return nil
+}
+
+// skipMetadataGap skips over any gap between the data chunk and the metadata
+// chunk, once all of the sample data has been read or skipped.
+func (d *decoder) skipMetadataGap() error {
+	if d.metadataGap == 0 {
+		return nil
+	}
+	gap := d.metadataGap
+	n, err := io.CopyN(ioutil.Discard, d.reader, int64(gap))
+	d.metadataGap -= uint64(n)
+	if err != nil {
+		return d.shortRead("metadata", "gap before the metadata chunk", d.metadataPointer-gap, gap, uint64(n), err)
+	}
+	return nil
+}
+
+// shortRead returns an error for a short read of the named part of a chunk,
+// which should have been size bytes from offset in the file but of which only n
+// bytes were found. The error wraps io.ErrUnexpectedEOF, or io.EOF if nothing
+// at all could be read from the start of the file. Errors other than these are
+// returned unchanged.
+func (d *decoder) shortRead(chunk, part string, offset, size, n uint64, err error) error {
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if err == io.EOF && offset+n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	at := fmt.Sprint(offset + n)
+	if d.totalFileSize > 0 {
+		at += fmt.Sprintf(" of %v", d.totalFileSize)
+	}
+	return fmt.Errorf("%v: file is truncated at offset %v: expected %v bytes of %v from offset %v but found %v: %w",
+		chunk, at, size, part, offset, n, err)
+}
+
+// readMetadata reads the metadata chunk, if any, skipping any sample data that
+// has not yet been read.
+func (d *decoder) readMetadata() error {
+	if d.withoutMetadata {
+		return d.skipMetadata()
+	}
+
+	// Skip the remainder of the sample data
+	if d.position < d.sampleDataSize {
+		if err := d.skipSamples(d.sampleDataSize - d.position); err != nil {
+			return err
+		}
+	}
+
 	// 4th chunk should be metadata, but may be omitted
-	if len(d.audio.Metadata) > 0 {
-		if err := d.readMetadataChunk(); err != nil {
+	d.startChunk("metadata")
+	if d.metadataSize == 0 {
+		return d.readTrailingTag()
+	}
+	if err := d.skipMetadataGap(); err != nil {
+		return err
+	}
+	return d.readMetadataChunk()
+}
+
+// skipMetadata skips over any sample data that has not yet been read and the
+// metadata chunk, without reading the metadata, leaving the metadata of the
+// audio.Audio in d nil. If the input is not an io.Seeker there is no need to
+// skip anything, so the input is left where it is.
+func (d *decoder) skipMetadata() error {
+	d.audio.Metadata = nil
+	s, ok := d.reader.(io.Seeker)
+	if !ok {
+		return nil
+	}
+	if d.position < d.sampleDataSize {
+		if err := d.skipSamples(d.sampleDataSize - d.position); err != nil {
+			return err
+		}
+	}
+	if d.metadataSize > 0 {
+		d.startChunk("metadata")
+		if _, err := s.Seek(int64(d.metadataGap+d.metadataSize), io.SeekCurrent); err != nil {
 			return err
 		}
+		d.metadataGap = 0
+		if d.stats != nil {
+			d.stats.Seeker = true
+		}
 	}
+	return nil
+}
 
+// allocate returns a buffer of n bytes for the named chunk, reusing buf if it
+// has sufficient capacity. It returns an error rather than allocating more than
+// the memory limit, or more than can be addressed on this platform.
+func (d *decoder) allocate(chunk string, buf []byte, n uint64) ([]byte, error) {
+	if err := d.checkAllocation(chunk, n); err != nil {
+		return nil, err
+	}
+	if uint64(cap(buf)) >= n {
+		return buf[:n], nil
+	}
+	return make([]byte, n), nil
+}
+
+// checkAllocation returns an error if n bytes for the named chunk would exceed
+// the memory limit, or could not be addressed on this platform.
+func (d *decoder) checkAllocation(chunk string, n uint64) error {
+	if d.memoryLimit > 0 && n > d.memoryLimit {
+		return fmt.Errorf("%v: %v chunk of %v bytes exceeds limit %v", chunk, chunk, n, d.memoryLimit)
+	}
+	if n > math.MaxInt {
+		return fmt.Errorf("%v: %v chunk of %v bytes is too large for this platform", chunk, chunk, n)
+	}
 	return nil
 }
 
+// readUpTo reads the next n bytes of the named chunk, reusing buf if it has
+// sufficient capacity, returning those read together with io.EOF or
+// io.ErrUnexpectedEOF if there are fewer, as io.ReadFull does. As a malformed
+// header may overstate n, no more is allocated than the input holds: no more
+// than remains of an io.Seeker, and otherwise the buffer grows as it is read.
+// A new buffer is never larger than the bytes read, so that an overstatement
+// does not keep memory that is not used.
+func (d *decoder) readUpTo(chunk string, buf []byte, n uint64) ([]byte, error) {
+	if err := d.checkAllocation(chunk, n); err != nil {
+		return nil, err
+	}
+	remaining, seekable := d.remaining()
+	var b []byte
+	var err error
+	switch {
+	case uint64(cap(buf)) >= n:
+		b = buf[:n]
+		var m int
+		m, err = io.ReadFull(d.reader, b)
+		b = b[:m]
+	case seekable:
+		b = make([]byte, min(n, remaining))
+		var m int
+		m, err = io.ReadFull(d.reader, b)
+		if m < len(b) {
+			b = exactCopy(b[:m])
+		}
+	default:
+		b, err = io.ReadAll(io.LimitReader(d.reader, int64(n)))
+		if len(b) < cap(b) {
+			b = exactCopy(b)
+		}
+	}
+	switch {
+	case err != nil && err != io.EOF && err != io.ErrUnexpectedEOF:
+		return b, err
+	case len(b) == 0 && n > 0:
+		return b, io.EOF
+	case uint64(len(b)) < n:
+		return b, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+// exactCopy returns a copy of b whose capacity is its length.
+func exactCopy(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// remaining returns the number of bytes that remain of the input, and whether
+// this is known because it is an io.Seeker, leaving it where it is.
+func (d *decoder) remaining() (uint64, bool) {
+	s, ok := d.reader.(io.Seeker)
+	if !ok {
+		return 0, false
+	}
+	position, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+	length, err := seekLength(s)
+	if err != nil || length < position {
+		return 0, false
+	}
+	return uint64(length - position), true
+}
+
+// decode reads a DSD stream file from r into a.
+func (d *decoder) decode(r io.Reader, a *audio.Audio) error {
+	d.reset(r, a)
+	defer d.startChunk("")
+
+	// Note where the file starts, so that its length can be checked once it
+	// has been decoded
+	s, seekable := r.(io.Seeker)
+	var start int64
+	if seekable {
+		var err error
+		if start, err = s.Seek(0, io.SeekCurrent); err != nil {
+			seekable = false
+		}
+	}
+
+	// Read the DSD, fmt and data chunk headers
+	if err := d.readHeaders(); err != nil {
+		return err
+	}
+
+	// Reference the sample data in the input, or read it directly into the
+	// audio.Audio, reusing its buffers if large enough
+	if ok, err := d.referenceSamples(); ok {
+		if err != nil {
+			return err
+		}
+	} else if d.blockBuffers > 0 {
+		if err := d.readBlockBuffers(); err != nil {
+			return d.recoverSamples(err)
+		}
+	} else {
+		samples, err := d.allocate("data", a.EncodedSamples, d.end-d.position)
+		if err != nil {
+			return err
+		}
+		a.EncodedSamples = samples
+		if err := d.readAllSamples(a.EncodedSamples); err != nil {
+			return d.recoverSamples(err)
+		}
+	}
+	d.logSamples()
+
+	// Read the metadata, if any
+	if err := d.readMetadata(); err != nil {
+		return err
+	}
+
+	// The total file size should match the length of the file
+	if !seekable {
+		return nil
+	}
+	length, err := seekLength(s)
+	if err != nil {
+		return err
+	}
+	return d.checkFileLength(uint64(length - start))
+}
+
+// seekLength returns the length of s, leaving it at its current position.
+func seekLength(s io.Seeker) (int64, error) {
+	position, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	length, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.Seek(position, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// newDecoder returns a decoder configured by opts, logging to logTo unless a
+// logger is given by WithLogger.
+func newDecoder(logTo io.Writer, opts []Option) *decoder {
+	o := newOptions(opts)
+	logger := o.logger
+	if logger == nil {
+		logger = newLogger(logTo)
+	}
+	return &decoder{
+		logger:  logger,
+		options: o,
+	}
+}
+
+// Decode reads a DSD stream file from r and returns it as an Audio.
+// logTo is the optional destination to log the fields of each chunk to as text,
+// see WithLogger for structured logging instead. If r is an io.Seeker the total
+// file size from the DSD chunk is checked against the length of r. The channel
+// order of mono audio is center, which is a convention of this package as the
+// specification does not say.
+func Decode(r io.Reader, logTo io.Writer, opts ...Option) (*audio.Audio, error) {
+	a := new(audio.Audio)
+	d := newDecoder(logTo, opts)
+	if err := d.decode(r, a); err != nil {
+		if d.recovered {
+			return a, err
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// DecodeResult is the result of decoding a DSD stream file, including the raw
+// values of the DSD, fmt and data chunks for diagnostic purposes.
+type DecodeResult struct {
+	// The decoded audio.
+	Audio *audio.Audio
+
+	// The DSD, fmt and data chunks as read from the file.
+	Dsd  DsdDetails
+	Fmt  FmtDetails
+	Data DataDetails
+
+	// Violations of the specification tolerated.
+	Warnings []Warning
+
+	// Checksum of the sample data, if selected by WithChecksum.
+	Checksum []byte
+
+	// Bytes after the Reserved field of a fmt chunk larger than the 52 bytes
+	// defined by the specification, or nil if there are none.
+	FmtExtension []byte
+}
+
+// DecodeWithDetails reads a DSD stream file from r as per Decode, and returns
+// the decoded audio together with the raw values of its chunks.
+func DecodeWithDetails(r io.Reader, logTo io.Writer, opts ...Option) (*DecodeResult, error) {
+	a := new(audio.Audio)
+	d := newDecoder(logTo, opts)
+	err := d.decode(r, a)
+	if err != nil && !d.recovered {
+		return nil, err
+	}
+	result := &DecodeResult{
+		Audio:        a,
+		Dsd:          d.dsd.Details(),
+		Fmt:          d.fmt.Details(),
+		Data:         d.data.Details(),
+		Warnings:     d.warnings,
+		FmtExtension: d.fmtExtension,
+	}
+	if d.checksum != nil {
+		result.Checksum = *d.checksum
+	}
+	return result, err
+}
+
+// DecodeInto reads a DSD stream file from r into a, overwriting all of its
+// fields. The existing EncodedSamples and Metadata buffers are reused if they
+// have sufficient capacity, otherwise new buffers are allocated. Either way the
+// length of EncodedSamples is set to the size of the sample data including the
+// padding of the final block. This avoids an allocation per file when decoding
+// many files in turn.
+func DecodeInto(r io.Reader, a *audio.Audio, opts ...Option) error {
+	return newDecoder(nil, opts).decode(r, a)
+}
+
+// Decoder decodes DSD stream files, reusing its configuration, logger and chunk
+// structures from one file to the next. This avoids repeated setup when
+// decoding many files in turn. A Decoder must not be used concurrently.
+type Decoder struct {
+	d decoder
+}
+
+// NewDecoder returns a Decoder configured by opts.
+func NewDecoder(opts ...Option) *Decoder {
+	return &Decoder{d: *newDecoder(nil, opts)}
+}
+
 // Decode reads a DSD stream file from r and returns it as an Audio.
-// logTo is the optional destination to log to.
-func Decode(r io.Reader, logTo io.Writer) (*audio.Audio, error) {
-	var d decoder
+func (dec *Decoder) Decode(r io.Reader) (*audio.Audio, error) {
+	a := new(audio.Audio)
+	if err := dec.DecodeInto(r, a); err != nil {
+		if dec.d.recovered {
+			return a, err
+		}
+		return nil, err
+	}
+	return a, nil
+}
+
+// DecodeInto reads a DSD stream file from r into a, reusing its buffers as per
+// the DecodeInto function.
+func (dec *Decoder) DecodeInto(r io.Reader, a *audio.Audio) error {
+	return dec.d.decode(r, a)
+}
+
+// Reset clears any state left from the previous DSD stream file, including
+// after a failed decode, so that nothing can leak into the next result. The
+// configuration is kept.
+func (dec *Decoder) Reset() {
+	dec.d.reset(nil, nil)
+}
+
+// Reader reads a DSD stream file incrementally. The DSD, fmt and data chunk
+// headers are read when the Reader is created, after which the sample data can
+// be read in pieces of any size rather than all at once.
+type Reader struct {
+	// The format of the audio samples.
+	Info
 
-	if logTo == nil {
-		logTo = ioutil.Discard
+	// The decoder doing the actual work.
+	d decoder
+}
+
+// NewReader reads the DSD, fmt and data chunk headers from r and returns a
+// Reader positioned at the start of the sample data.
+func NewReader(r io.Reader, opts ...Option) (*Reader, error) {
+	reader := &Reader{d: *newDecoder(nil, opts)}
+	reader.d.reset(r, new(audio.Audio))
+	if err := reader.d.readHeaders(); err != nil {
+		return nil, err
 	}
 
-	if err := d.decode(r, logTo); err != nil {
+	// Expose the format of the audio samples
+	reader.Info = reader.d.info()
+
+	return reader, nil
+}
+
+// Read reads up to len(p) bytes of interleaved sample data into p. The samples
+// are stored as blocks of BlockSize bytes for each channel in turn, with the
+// final block for each channel padded with whatever the file holds, which is
+// zero per the specification, or SilencePadByte from Encode by default. Read
+// returns io.EOF at the end of the sample data, without reading any of the
+// metadata chunk that follows.
+func (r *Reader) Read(p []byte) (int, error) {
+	position := r.d.position
+	n, err := r.d.readSamples(p)
+	r.d.hashSamples(p[:n], position)
+	return n, err
+}
+
+// Metadata reads the metadata chunk e.g. an ID3v2 tag, skipping any sample data
+// that has not yet been read. It returns nil if the file has no metadata.
+func (r *Reader) Metadata() ([]byte, error) {
+	if err := r.d.readMetadata(); err != nil {
 		return nil, err
 	}
+	if len(r.d.audio.Metadata) == 0 {
+		return nil, nil
+	}
+	return r.d.audio.Metadata, nil
+}
 
-	return d.audio, nil
+// Warnings returns the violations of the specification that have been tolerated
+// so far.
+func (r *Reader) Warnings() []Warning {
+	return r.d.warnings
 }
@@ -5,9 +5,17 @@
 package dsf
 
 import (
+	"bytes"
+	"errors"
+	"github.com/snmoore/go/audio"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 )
 
 // Table structure for a single reader test
@@ -31,6 +39,9 @@ var readerTests = []readerTest{
 	{"Reading a DSD stream file that has missing chunks (missing data) should result in an error", "test/invalid_missing_data.dsf", true},
 	{"Reading a DSD stream file that has missing chunks (missing metadata) should result in an error", "test/invalid_missing_metadata.dsf", true},
 
+	// Reserved bytes in the fmt chunk: should be zero
+	{"Reading a DSD stream file that has non-zero reserved bytes should result in an error", "test/invalid_nonzero_reserved.dsf", true},
+
 	// Valid DSD stream file
 	{"Reading a valid DSD stream file (without metadata) should not result in an error", "test/valid_without_metadata.dsf", false},
 	{"Reading a valid DSD stream file (with metadata) should not result in an error", "test/valid_with_metadata.dsf", false},
@@ -53,7 +64,7 @@ func TestReader(t *testing.T) {
 		}
 
 		// Read and decode the DSD stream file
-		_, err = Decode(file, logTo)
+		_, err = Decode(file, logTo, WithStrictness(Strict))
 
 		// Check the result from reading the chunk
 		if test.expectError {
@@ -78,3 +89,586 @@ func TestReader(t *testing.T) {
 		}
 	}
 }
+
+// Sample data and metadata are read incrementally by a Reader
+func TestReaderIncremental(t *testing.T) {
+	description := "Sample data and metadata are read incrementally by a Reader"
+
+	// Open the DSD stream file
+	file, err := os.Open("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	defer file.Close()
+
+	// Read the DSD, fmt and data chunk headers
+	r, err := NewReader(file)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	if r.NumChannels != 1 || r.SamplingFrequency != 2822400 || r.BitsPerSample != 1 || r.BlockSize != 4096 || r.SampleCount != 1 {
+		t.Errorf("FAIL Test 1: %v:\nIncorrect format: %+v", description, r)
+	}
+
+	// Read the sample data in small pieces until the end
+	var total int
+	p := make([]byte, 1000)
+	for {
+		n, err := r.Read(p)
+		total += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+		}
+	}
+	if total != 4096 {
+		t.Errorf("FAIL Test 1: %v:\nWant: 4096 bytes of sample data\nActual: %v", description, total)
+	}
+
+	// The metadata should still be available afterwards
+	metadata, err := r.Metadata()
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	if len(metadata) != 10 || string(metadata[:3]) != "ID3" {
+		t.Errorf("FAIL Test 1: %v:\nWant: 10 bytes of ID3 metadata\nActual: % x", description, metadata)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+}
+
+// The progress function is called whilst the sample data is read
+func TestReaderProgress(t *testing.T) {
+	description := "The progress function is called whilst the sample data is read"
+
+	// Open the DSD stream file
+	file, err := os.Open("test/valid_without_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	defer file.Close()
+
+	// Record each call of the progress function
+	var calls [][2]uint64
+	progress := func(readBytes, totalBytes uint64) {
+		calls = append(calls, [2]uint64{readBytes, totalBytes})
+	}
+
+	// Read and decode the DSD stream file
+	if _, err = Decode(file, nil, WithProgress(progress)); err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+
+	// The progress function should have been called once upon completion
+	if len(calls) != 1 || calls[0] != [2]uint64{4096, 4096} {
+		t.Errorf("FAIL Test 1: %v:\nWant: [[4096 4096]]\nActual: %v", description, calls)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+}
+
+// Decoding random data should result in an error rather than a panic or a huge
+// allocation
+func FuzzDecode(f *testing.F) {
+	// Seed with each of the test files
+	for _, test := range readerTests {
+		b, err := ioutil.ReadFile(test.filename)
+		if err != nil {
+			f.Fatalf("%v:\n%v", test.description, err.Error())
+		}
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		Decode(bytes.NewReader(b), nil, WithMemoryLimit(1<<24))
+	})
+}
+
+// Sample data that exceeds the memory limit should result in an error
+func TestReaderMemoryLimit(t *testing.T) {
+	description := "Sample data that exceeds the memory limit should result in an error"
+
+	// Open the DSD stream file
+	file, err := os.Open("test/valid_without_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	defer file.Close()
+
+	// The 4096 bytes of sample data exceed a limit of 4095 bytes
+	_, err = Decode(file, nil, WithMemoryLimit(4095))
+	if err == nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 1: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// A total file size that overstates the size of the metadata should result in
+// an error, or a warning when decoding in lenient mode
+func TestReaderLenient(t *testing.T) {
+	description := "A total file size that overstates the size of the metadata should result in an error, or a warning when decoding in lenient mode"
+
+	// Read the whole DSD stream file into memory
+	b, err := ioutil.ReadFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+
+	// Overstate the total file size by 4 bytes
+	b[12] += 4
+
+	// Decoding strictly should result in an error
+	_, err = Decode(bytes.NewReader(b), nil, WithStrictness(Strict))
+	if err == nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 1: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	// Decoding in lenient mode should result in a warning
+	var warnings []Warning
+	a, err := Decode(bytes.NewReader(b), nil, WithLenient(), WithWarnings(&warnings))
+	if err != nil {
+		t.Fatalf("FAIL Test 2: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	if len(warnings) != 1 || warnings[0].Field != "dsd.TotalFileSize" || len(a.Metadata) != 10 {
+		t.Errorf("FAIL Test 2: %v:\nWant: 1 warning and 10 bytes of metadata\nActual: %v and %v bytes of metadata", description, warnings, len(a.Metadata))
+	} else {
+		t.Logf("PASS Test 2: %v:\nWant: 1 warning\nActual: %v", description, warnings)
+	}
+}
+
+// A total file size that overstates the size of the metadata by far more than
+// the size of the input should allocate no more than the metadata that is there
+func TestReaderOverstatedMetadata(t *testing.T) {
+	description := "A total file size that overstates the size of the metadata should allocate no more than the metadata that is there"
+
+	// Read the whole DSD stream file into memory
+	b, err := ioutil.ReadFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+
+	// Overstate the total file size by 1GiB
+	b[15] += 0x40
+
+	decoders := []struct {
+		description string
+		decode      func() (*audio.Audio, error)
+	}{
+		{"seekable", func() (*audio.Audio, error) { return Decode(bytes.NewReader(b), nil) }},
+		{"non-seekable", func() (*audio.Audio, error) { return Decode(struct{ io.Reader }{bytes.NewReader(b)}, nil) }},
+		{"bytes", func() (*audio.Audio, error) { return DecodeBytes(b) }},
+	}
+	for i, test := range decoders {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		a, err := test.decode()
+		runtime.ReadMemStats(&after)
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v: %v:\nWant: nil\nActual: %v", i+1, description, test.description, err)
+		case len(a.Metadata) != 10 || cap(a.Metadata) != 10:
+			t.Errorf("FAIL Test %v: %v: %v:\nWant: 10 bytes of metadata\nActual: %v bytes with capacity %v", i+1, description, test.description, len(a.Metadata), cap(a.Metadata))
+		case after.TotalAlloc-before.TotalAlloc > 1<<20:
+			t.Errorf("FAIL Test %v: %v: %v:\nWant: less than 1MiB allocated\nActual: %v bytes", i+1, description, test.description, after.TotalAlloc-before.TotalAlloc)
+		default:
+			t.Logf("PASS Test %v: %v: %v", i+1, description, test.description)
+		}
+	}
+}
+
+// Non-zero reserved bytes should result in a warning when decoding in lenient
+// mode
+func TestReaderLenientReserved(t *testing.T) {
+	description := "Non-zero reserved bytes should result in a warning when decoding in lenient mode"
+
+	// Open the DSD stream file
+	file, err := os.Open("test/invalid_nonzero_reserved.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	defer file.Close()
+
+	// Decoding in lenient mode should result in a warning
+	var warnings []Warning
+	_, err = Decode(file, nil, WithLenient(), WithWarnings(&warnings))
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	if len(warnings) != 1 || warnings[0].Field != "fmt.Reserved" {
+		t.Errorf("FAIL Test 1: %v:\nWant: 1 warning\nActual: %v", description, warnings)
+	} else {
+		t.Logf("PASS Test 1: %v:\nWant: 1 warning\nActual: %v", description, warnings)
+	}
+}
+
+// Only the groups of blocks covering the selected time range are decoded, from
+// both seekable and non-seekable input
+func TestReaderTimeRange(t *testing.T) {
+	description := "Only the groups of blocks covering the selected time range are decoded"
+
+	// Prepare 3 groups of stereo blocks, with each block filled with its index
+	var samples []byte
+	for i := 0; i < 6; i++ {
+		samples = append(samples, bytes.Repeat([]byte{byte(i)}, 4096)...)
+	}
+	c := newTestFile(2, 2, 3*4096*8, uint64(len(samples)), samples, nil)
+
+	// Select from 12ms to 13ms i.e. within the 2nd group of blocks at DSD64
+	opts := []Option{WithStart(12 * time.Millisecond), WithLimit(time.Millisecond)}
+	inputs := []io.Reader{
+		bytes.NewReader(c),
+		struct{ io.Reader }{bytes.NewReader(c)},
+	}
+	for i, input := range inputs {
+		a, err := Decode(input, nil, opts...)
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		} else if !bytes.Equal(a.EncodedSamples, samples[2*4096:4*4096]) {
+			t.Errorf("FAIL Test %v: %v:\nIncorrect sample data", i+1, description)
+		} else if a.SampleCount != 4096*8 {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v samples\nActual: %v samples", i+1, description, 4096*8, a.SampleCount)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+
+	// A start beyond the end of the audio should result in an error
+	_, err := Decode(bytes.NewReader(c), nil, WithStart(time.Second))
+	if err == nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 3: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
+
+// newBenchmarkFile returns a stereo DSD stream file with 1MB of sample data
+func newBenchmarkFile() []byte {
+	samples := make([]byte, 2*128*4096)
+	return newTestFile(2, 2, 128*4096*8, uint64(len(samples)), samples, nil)
+}
+
+// Decode allocates a new buffer for the sample data of each file
+func BenchmarkDecode(b *testing.B) {
+	c := newBenchmarkFile()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(c)))
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(bytes.NewReader(c), nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// DecodeInto reuses the buffer for the sample data of each file
+func BenchmarkDecodeInto(b *testing.B) {
+	c := newBenchmarkFile()
+	a := new(audio.Audio)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(c)))
+	for i := 0; i < b.N; i++ {
+		if err := DecodeInto(bytes.NewReader(c), a); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Build a DSD stream file large enough to be read in parallel, with distinct
+// sample data in every block
+func newParallelFile() []byte {
+	samples := make([]byte, 2*640*4096)
+	for i := range samples {
+		samples[i] = byte(i*7 + i/4096)
+	}
+	return newTestFile(2, 2, 640*4096*8, uint64(len(samples)), samples, []byte{'I', 'D', '3', 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xff})
+}
+
+// Write a DSD stream file large enough to be read in parallel to a temporary
+// file
+func newParallelTempFile(b *testing.B) *os.File {
+	name := filepath.Join(b.TempDir(), "parallel.dsf")
+	if err := ioutil.WriteFile(name, newParallelFile(), 0644); err != nil {
+		b.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { f.Close() })
+	return f
+}
+
+// Decode a file serially
+func BenchmarkDecodeFileSerial(b *testing.B) {
+	benchmarkDecodeFile(b, 1)
+}
+
+// Decode a file in parallel
+func BenchmarkDecodeFileParallel(b *testing.B) {
+	benchmarkDecodeFile(b, 4)
+}
+
+func benchmarkDecodeFile(b *testing.B, workers int) {
+	f := newParallelTempFile(b)
+	info, err := f.Stat()
+	if err != nil {
+		b.Fatal(err)
+	}
+	dec := NewDecoder(WithWorkers(workers))
+	a := new(audio.Audio)
+	b.SetBytes(info.Size())
+	for i := 0; i < b.N; i++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		if err := dec.DecodeInto(f, a); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// A ReaderAt that fails when reading beyond an offset
+type failingReaderAt struct {
+	*bytes.Reader
+	offset int64
+}
+
+var errReadAt = errors.New("read failed")
+
+func (r failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > r.offset {
+		return 0, errReadAt
+	}
+	return r.Reader.ReadAt(p, off)
+}
+
+// Reading in parallel from an io.ReaderAt should give the same result as
+// reading serially, and a failure in any worker should be returned
+func TestReaderParallel(t *testing.T) {
+	description := "Reading in parallel should give the same result as reading serially"
+	c := newParallelFile()
+	want, err := Decode(bytes.NewReader(c), nil, WithWorkers(1))
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+
+	// Vary the number of workers, including one that does not divide the
+	// sample data evenly, and check that progress is reported in order
+	for i, workers := range []int{2, 3, 4, 16} {
+		var last, total uint64
+		progress := func(readBytes, totalBytes uint64) {
+			if readBytes <= last {
+				t.Errorf("FAIL Test %v: %v:\nWant: progress > %v\nActual: %v", i+1, description, last, readBytes)
+			}
+			last, total = readBytes, totalBytes
+		}
+		a, err := Decode(bytes.NewReader(c), nil, WithWorkers(workers), WithProgress(progress))
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		case !reflect.DeepEqual(a, want):
+			t.Errorf("FAIL Test %v: %v:\nWant: identical audio\nActual: different audio with %v workers", i+1, description, workers)
+		case last != total || total != uint64(len(want.EncodedSamples)):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v of %v bytes\nActual: %v of %v bytes", i+1, description, len(want.EncodedSamples), len(want.EncodedSamples), last, total)
+		default:
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+
+	// A failure part way through the sample data should be returned
+	description = "A failure when reading in parallel should be returned"
+	r := failingReaderAt{bytes.NewReader(c), int64(len(c) / 2)}
+	if _, err := Decode(r, nil, WithWorkers(4)); err != errReadAt {
+		t.Errorf("FAIL Test 5: %v:\nWant: %v\nActual: %v", description, errReadAt, err)
+	} else {
+		t.Logf("PASS Test 5: %v", description)
+	}
+
+	// A truncated file should fail as it would when reading serially
+	description = "A truncated file should fail when reading in parallel"
+	if _, err := Decode(bytes.NewReader(c[:len(c)/2]), nil, WithWorkers(4)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("FAIL Test 6: %v:\nWant: %v\nActual: %v", description, io.ErrUnexpectedEOF, err)
+	} else {
+		t.Logf("PASS Test 6: %v", description)
+	}
+}
+
+// Table of truncated files and the errors that should describe them
+var truncatedTests = []struct {
+	// Description for the test
+	description string
+	// Number of bytes of the DSD stream file to keep
+	truncate int
+	// Expected error, and the error it should wrap
+	want    string
+	wantErr error
+}{
+	{"An empty file should be reported as such", 0,
+		"dsd: file is truncated at offset 0: expected 28 bytes of DSD chunk from offset 0 but found 0: EOF", io.EOF},
+	{"A file truncated within the DSD chunk should be reported", 10,
+		"dsd: file is truncated at offset 10: expected 28 bytes of DSD chunk from offset 0 but found 10: unexpected EOF", io.ErrUnexpectedEOF},
+	{"A file truncated within the fmt chunk should be reported", 50,
+		"fmt: file is truncated at offset 50 of 4198: expected 52 bytes of fmt chunk from offset 28 but found 22: unexpected EOF", io.ErrUnexpectedEOF},
+	{"A file truncated within the data chunk should be reported", 85,
+		"data: file is truncated at offset 85 of 4198: expected 12 bytes of data chunk from offset 80 but found 5: unexpected EOF", io.ErrUnexpectedEOF},
+	{"A file truncated within the sample data should be reported", 1000,
+		"data: file is truncated at offset 1000 of 4198: expected 4096 bytes of sample data from offset 92 but found 908, so 0 of 1 blocks per channel (0s of 0s) are complete: unexpected EOF", io.ErrUnexpectedEOF},
+	{"A file truncated within the metadata chunk should be reported", 4190,
+		"metadata: file is truncated at offset 4190 of 4198: expected 10 bytes of metadata chunk from offset 4188 but found 2: unexpected EOF", io.ErrUnexpectedEOF},
+}
+
+// Run all truncated tests
+func TestDecodeTruncated(t *testing.T) {
+	b, err := ioutil.ReadFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL: %v", err.Error())
+	}
+	for i, test := range truncatedTests {
+		_, err := Decode(bytes.NewReader(b[:test.truncate]), nil, WithStrictness(Strict))
+		if err == nil || err.Error() != test.want || !errors.Is(err, test.wantErr) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.want, err)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+
+		// Decoding bytes should report the truncation in the same way
+		_, err = DecodeBytes(b[:test.truncate], WithStrictness(Strict))
+		if err == nil || err.Error() != test.want || !errors.Is(err, test.wantErr) {
+			t.Errorf("FAIL Test %v: %v when decoding bytes:\nWant: %v\nActual: %v", i+1, test.description, test.want, err)
+		} else {
+			t.Logf("PASS Test %v: %v when decoding bytes", i+1, test.description)
+		}
+	}
+
+	// The complete blocks and duration of audio should be reported
+	description := "A truncated file should be reported with the audio that is complete"
+	c := newParallelFile()
+	want := "data: file is truncated at offset 819292 of 5242983: expected 5242880 bytes of sample data from offset 92 but found 819200, so 100 of 640 blocks per channel (1.161s of 7.43s) are complete: unexpected EOF"
+	if _, err := Decode(bytes.NewReader(c[:92+2*4096*100]), nil); err == nil || err.Error() != want {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", len(truncatedTests)+1, description, want, err)
+	} else {
+		t.Logf("PASS Test %v: %v", len(truncatedTests)+1, description)
+	}
+}
+
+// DecodeInto overwrites the fields of an Audio, reusing its buffers
+func TestDecodeInto(t *testing.T) {
+	description := "DecodeInto overwrites the fields of an Audio, reusing its buffers"
+
+	// Decode a file with metadata, then one without, into the same Audio
+	a := &audio.Audio{EncodedSamples: make([]byte, 8192), NumChannels: 6}
+	buffer := &a.EncodedSamples[0]
+	for i, filename := range []string{"test/valid_with_metadata.dsf", "test/valid_without_metadata.dsf"} {
+		file, err := os.Open(filename)
+		if err != nil {
+			t.Fatalf("FAIL Test %v: %v:\n%v", i+1, description, err.Error())
+		}
+		err = DecodeInto(file, a)
+		file.Close()
+		if err != nil {
+			t.Fatalf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		}
+	}
+
+	// The sample data buffer should have been reused, and no metadata remain
+	if a.NumChannels != 1 || len(a.EncodedSamples) != 4096 || &a.EncodedSamples[0] != buffer || len(a.Metadata) != 0 {
+		t.Errorf("FAIL Test 3: %v:\nIncorrect audio: %v channels, %v bytes of samples, %v bytes of metadata",
+			description, a.NumChannels, len(a.EncodedSamples), len(a.Metadata))
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+}
+
+// A Decoder that is reused after a failed decode should not leak any state into
+// the next result
+func TestDecoderReuse(t *testing.T) {
+	description := "A Decoder that is reused after a failed decode should not leak any state into the next result"
+
+	// Read the DSD stream files into memory
+	corrupt, err := ioutil.ReadFile("test/invalid_missing_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	valid, err := ioutil.ReadFile("test/valid_without_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	want, err := Decode(bytes.NewReader(valid), nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+
+	// Decode the corrupt file then the valid file on the same decoder, with
+	// and without an explicit reset
+	var warnings []Warning
+	dec := NewDecoder(WithLenient(), WithWarnings(&warnings))
+	for i, reset := range []bool{false, true} {
+		if _, err := dec.Decode(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", i+1, description)
+		}
+		if reset {
+			dec.Reset()
+		}
+		a, err := dec.Decode(bytes.NewReader(valid))
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		} else if !reflect.DeepEqual(a, want) || len(warnings) != 0 {
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v, %v", i+1, description, want, a, warnings)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+}
+
+// The raw values of the chunks should be returned with the decoded audio
+func TestDecodeWithDetails(t *testing.T) {
+	description := "The raw values of the chunks should be returned with the decoded audio"
+
+	file, err := os.Open("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	defer file.Close()
+	result, err := DecodeWithDetails(file, nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+
+	want := DecodeResult{
+		Audio: result.Audio,
+		Dsd:   DsdDetails{Header: "DSD ", Size: 28, TotalFileSize: 4198, MetadataPointer: 4188},
+		Fmt: FmtDetails{Header: "fmt ", Size: 52, Version: 1, Identifier: 0, ChannelType: 1, ChannelNum: 1,
+			SamplingFrequency: 2822400, BitsPerSample: 1, SampleCount: 1, BlockSize: 4096, Reserved: 0},
+		Data: DataDetails{Header: "data", Size: 12 + 4096},
+	}
+	if !reflect.DeepEqual(*result, want) {
+		t.Errorf("FAIL Test 1: %v:\nWant: %+v\nActual: %+v", description, want, *result)
+	} else if len(result.Audio.EncodedSamples) != 4096 || len(result.Audio.Metadata) != 10 {
+		t.Errorf("FAIL Test 1: %v:\nWant: 4096 bytes of samples, 10 bytes of metadata\nActual: %v, %v", description, len(result.Audio.EncodedSamples), len(result.Audio.Metadata))
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+}
+
+// Read the DSD, fmt and data chunk headers
+func BenchmarkReadHeaders(b *testing.B) {
+	c, err := ioutil.ReadFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		b.Fatal(err)
+	}
+	d := newDecoder(nil, nil)
+	a := new(audio.Audio)
+	r := bytes.NewReader(c)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(c)
+		d.reset(r, a)
+		if err := d.readHeaders(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"fmt"
+	"github.com/snmoore/go/audio"
+	"io"
+)
+
+// Remux copies the DSD stream file read from r to w without decoding the sample
+// data, which is copied byte for byte through a buffer of fixed size, so the
+// memory used does not depend on the size of the file. The DSD chunk is
+// rewritten with the new total file size and pointer to the metadata chunk, and
+// the metadata chunk is kept, replaced as given by WithNewMetadata, or left out
+// as given by WithoutMetadata. The fmt chunk keeps the channel type, format and
+// sample count of the input but is otherwise written as Encode would write it,
+// and any padding missing from the data chunk is filled with zero as when
+// decoding. Only metadata pointed to by the DSD chunk is kept. WithStart,
+// WithLimit, WithChecksum and WithStats are ignored.
+func Remux(r io.Reader, w io.Writer, opts ...Option) error {
+	d := newDecoder(nil, opts)
+	d.start, d.limit, d.checksum, d.stats = 0, 0, nil, nil
+	e := newEncoder(nil, opts)
+	e.checksum, e.stats, e.progress, e.options.warnings = nil, nil, nil, nil
+
+	// Read the DSD, fmt and data chunk headers of the input
+	in := new(audio.Audio)
+	d.reset(r, in)
+	if err := d.readHeaders(); err != nil {
+		return err
+	}
+
+	// The output has the same format and sample data, with the new metadata, if
+	// any, which is checked before anything is written
+	out := &audio.Audio{
+		Encoding:          in.Encoding,
+		NumChannels:       in.NumChannels,
+		ChannelOrder:      in.ChannelOrder,
+		SamplingFrequency: in.SamplingFrequency,
+		BitsPerSample:     in.BitsPerSample,
+		BlockSize:         in.BlockSize,
+		SampleCount:       in.SampleCount,
+	}
+	e.reset(w, out)
+	e.sampleDataSize = d.sampleDataSize
+	e.channelType = d.fmt.Details().ChannelType
+	switch {
+	case d.newMetadata != nil:
+		out.Metadata = d.newMetadata
+		if err := e.checkMetadata(); err != nil {
+			return err
+		}
+	case !d.withoutMetadata && d.metadataSize > 0:
+		// The metadata of the input is read into this buffer once the sample
+		// data has been copied
+		metadata, err := d.allocate("metadata", nil, d.metadataSize)
+		if err != nil {
+			return err
+		}
+		in.Metadata, out.Metadata = metadata, metadata
+	}
+	if err := e.prepareHeaders(); err != nil {
+		return err
+	}
+
+	// Copy the sample data, which is never held in memory all at once
+	if err := e.writeHeaders(); err != nil {
+		return err
+	}
+	buf := make([]byte, min(d.end, progressInterval))
+	for {
+		n, err := d.readSamples(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return d.shortRead("data", "sample data", d.sampleOffset(0), d.sampleDataSize, d.position, err)
+		}
+		if err := e.writeSamples(buf[:n]); err != nil {
+			return err
+		}
+	}
+	if err := e.writePadding(); err != nil {
+		return err
+	}
+
+	// Copy the metadata of the input, unless replacing or leaving it out
+	if d.newMetadata == nil && len(out.Metadata) > 0 {
+		if err := d.readMetadata(); err != nil {
+			return err
+		}
+		if len(in.Metadata) != len(out.Metadata) {
+			return fmt.Errorf("metadata: read %v bytes of metadata but the metadata chunk is %v bytes", len(in.Metadata), len(out.Metadata))
+		}
+		copy(out.Metadata, in.Metadata)
+	}
+	if err := e.writeMetadataChunk(); err != nil {
+		return err
+	}
+
+	return e.checkWritten()
+}
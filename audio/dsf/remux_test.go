@@ -0,0 +1,128 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// Table structure for a single remux test
+type remuxTest struct {
+	// Description for the test
+	description string
+	// Options for Remux
+	opts []Option
+	// Expected metadata of the output, or nil to keep that of the input
+	metadata []byte
+	// Whether the output should have no metadata
+	stripped bool
+}
+
+// An ID3v2 tag holding a different title to goldenTag
+var remuxTag = id3Tag(4, 0, id3Frame(4, "TIT2", 0, []byte("\x03Another title")))
+
+// Table of all remux tests
+var remuxTests = []remuxTest{
+	{"Remuxing should keep the metadata", nil, nil, false},
+	{"Remuxing with new metadata should replace the metadata", []Option{WithNewMetadata(remuxTag)}, remuxTag, false},
+	{"Remuxing without metadata should strip the metadata", []Option{WithoutMetadata()}, nil, true},
+}
+
+// Run all remux tests on every golden file, checking that the sample data is
+// copied byte for byte and that the output decodes strictly
+func TestRemux(t *testing.T) {
+	n := 0
+	for _, golden := range goldenTests {
+		input, err := ioutil.ReadFile("test/" + golden.golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dataSize := binary.LittleEndian.Uint64(input[84:92])
+		for _, test := range remuxTests {
+			n++
+			description := test.description + ": " + golden.golden
+			var b bytes.Buffer
+			if err := Remux(bytes.NewReader(input), &b, test.opts...); err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", n, description, err.Error())
+				continue
+			}
+			output := b.Bytes()
+
+			// Work out the expected metadata
+			metadata := test.metadata
+			if metadata == nil && !test.stripped {
+				metadata = golden.metadata
+			}
+
+			a, err := Decode(bytes.NewReader(output), nil, WithStrictness(Strict))
+			switch {
+			case err != nil:
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", n, description, err.Error())
+			case uint64(len(output)) < 92+dataSize-12 || !bytes.Equal(output[28:92+dataSize-12], input[28:92+dataSize-12]):
+				t.Errorf("FAIL Test %v: %v:\nWant: the fmt and data chunks of the input\nActual: %v different bytes", n, description, len(output))
+			case !bytes.Equal(a.Metadata, metadata):
+				t.Errorf("FAIL Test %v: %v:\nWant: metadata % x\nActual: % x", n, description, metadata, a.Metadata)
+			case test.opts == nil && !bytes.Equal(output, input):
+				t.Errorf("FAIL Test %v: %v:\nWant: the input unchanged\nActual: %v different bytes", n, description, len(output))
+			default:
+				t.Logf("PASS Test %v: %v", n, description)
+			}
+		}
+	}
+
+	// A large file read without seeking, which is copied in pieces
+	n++
+	description := "Remuxing a large file from a pipe should copy the sample data unchanged"
+	input := newParallelFile()
+	var b bytes.Buffer
+	if err := Remux(io.MultiReader(bytes.NewReader(input)), &b, WithNewMetadata(remuxTag)); err != nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", n, description, err.Error())
+	} else if want, err := Decode(bytes.NewReader(input), nil); err != nil {
+		t.Fatal(err)
+	} else if a, err := Decode(bytes.NewReader(b.Bytes()), nil, WithStrictness(Strict)); err != nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", n, description, err.Error())
+	} else if !bytes.Equal(a.EncodedSamples, want.EncodedSamples) || !bytes.Equal(a.Metadata, remuxTag) {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v bytes of sample data and metadata % x\nActual: %v bytes and metadata % x", n, description,
+			len(want.EncodedSamples), remuxTag, len(a.EncodedSamples), a.Metadata)
+	} else {
+		t.Logf("PASS Test %v: %v", n, description)
+	}
+}
+
+// Remuxing a file that cannot be read, or to metadata that is not an ID3v2 tag,
+// results in an error
+func TestRemuxError(t *testing.T) {
+	input, err := ioutil.ReadFile("test/golden_stereo_dsd64_tag.dsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		description string
+		input       []byte
+		opts        []Option
+		written     bool
+	}{
+		{"Remuxing with new metadata that is not an ID3v2 tag should result in an error", input, []Option{WithNewMetadata([]byte("not a tag"))}, false},
+		{"Remuxing a file truncated in the data chunk should result in an error", input[:1000], nil, true},
+		{"Remuxing a file truncated in the metadata chunk should result in an error", input[:len(input)-1], nil, true},
+		{"Remuxing a file that is not a DSD stream file should result in an error", []byte("RIFF"), nil, false},
+	}
+	for i, test := range tests {
+		var b bytes.Buffer
+		err := Remux(bytes.NewReader(test.input), &b, test.opts...)
+		switch {
+		case err == nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", i+1, test.description)
+		case !test.written && b.Len() > 0:
+			t.Errorf("FAIL Test %v: %v:\nWant: nothing written\nActual: %v bytes", i+1, test.description, b.Len())
+		default:
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
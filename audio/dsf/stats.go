@@ -0,0 +1,169 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are statistics about decoding or encoding a DSD stream file, collected
+// if requested by WithStats. These are for performance debugging.
+type Stats struct {
+	// Bytes read or written, and time spent, for each chunk. Any unknown
+	// chunks before the data chunk are included in the data chunk, and any gap
+	// before the metadata chunk is included in the metadata chunk. Bytes
+	// skipped by seeking, or aliased by DecodeBytes, are not counted.
+	Dsd      ChunkStats
+	Fmt      ChunkStats
+	Data     ChunkStats
+	Metadata ChunkStats
+
+	// Number of calls to Read and ReadAt on the input when decoding, and to
+	// Write on the output when encoding.
+	Reads  uint64
+	Writes uint64
+
+	// Whether the sample data was read in parallel using io.ReaderAt, and
+	// whether any of the file was skipped using io.Seeker rather than read.
+	ReaderAt bool
+	Seeker   bool
+}
+
+// ChunkStats are the statistics for a single chunk.
+type ChunkStats struct {
+	// Bytes read or written.
+	Bytes uint64
+
+	// Wall-clock time spent reading or writing the chunk.
+	Duration time.Duration
+}
+
+// chunkTimer accumulates the time spent on each chunk in turn.
+type chunkTimer struct {
+	// Chunk currently being read or written, and when it was started.
+	chunk *ChunkStats
+	start time.Time
+}
+
+// next adds the time spent on the current chunk, if any, and starts timing c.
+// A nil c stops timing.
+func (t *chunkTimer) next(c *ChunkStats) {
+	now := time.Now()
+	if t.chunk != nil {
+		t.chunk.Duration += now.Sub(t.start)
+	}
+	t.chunk, t.start = c, now
+}
+
+// statsReader is an io.Reader that counts the calls to Read and the bytes read
+// for the current chunk.
+type statsReader struct {
+	r     io.Reader
+	stats *Stats
+	chunkTimer
+}
+
+// Read reads from the underlying io.Reader.
+func (r *statsReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.count(n)
+	return n, err
+}
+
+// count counts a call that read n bytes. This is safe to call concurrently.
+func (r *statsReader) count(n int) {
+	atomic.AddUint64(&r.stats.Reads, 1)
+	if r.chunk != nil {
+		atomic.AddUint64(&r.chunk.Bytes, uint64(n))
+	}
+}
+
+// statsReadSeeker is a statsReader for an io.ReadSeeker, so that seeking is
+// still possible.
+type statsReadSeeker struct {
+	*statsReader
+	io.Seeker
+}
+
+// statsReadSeekerAt is a statsReader for an io.ReadSeeker that is also an
+// io.ReaderAt, so that the sample data can still be read in parallel.
+type statsReadSeekerAt struct {
+	*statsReader
+	io.Seeker
+	ra io.ReaderAt
+}
+
+// ReadAt reads from the underlying io.ReaderAt.
+func (r statsReadSeekerAt) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := r.ra.ReadAt(p, offset)
+	r.count(n)
+	return n, err
+}
+
+// newStatsReader returns an io.Reader that reads from r, collecting stats, and
+// which is an io.Seeker and io.ReaderAt if r is. The returned statsReader is
+// used to time each chunk.
+func newStatsReader(r io.Reader, stats *Stats) (io.Reader, *statsReader) {
+	sr := &statsReader{r: r, stats: stats}
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return sr, sr
+	}
+	if ra, ok := r.(io.ReaderAt); ok {
+		return statsReadSeekerAt{sr, s, ra}, sr
+	}
+	return statsReadSeeker{sr, s}, sr
+}
+
+// statsWriter is an io.Writer that counts the calls to Write and the bytes
+// written for the current chunk.
+type statsWriter struct {
+	w     io.Writer
+	stats *Stats
+	chunkTimer
+}
+
+// Write writes to the underlying io.Writer.
+func (w *statsWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.stats.Writes++
+	if w.chunk != nil {
+		w.chunk.Bytes += uint64(n)
+	}
+	return n, err
+}
+
+// chunk returns the stats for the named chunk, or nil for any other name.
+func (s *Stats) chunk(name string) *ChunkStats {
+	switch name {
+	case "dsd":
+		return &s.Dsd
+	case "fmt":
+		return &s.Fmt
+	case "data":
+		return &s.Data
+	case "metadata":
+		return &s.Metadata
+	}
+	return nil
+}
+
+// startChunk starts timing the named chunk, if stats were requested by
+// WithStats. An empty name stops timing.
+func (d *decoder) startChunk(name string) {
+	if d.statsReader != nil {
+		d.statsReader.next(d.statsReader.stats.chunk(name))
+	}
+}
+
+// startChunk starts timing the named chunk, if stats were requested by
+// WithStats. An empty name stops timing.
+func (e *encoder) startChunk(name string) {
+	if e.statsWriter != nil {
+		e.statsWriter.next(e.statsWriter.stats.chunk(name))
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// Table structure for a single decode statistics test
+type statsTest struct {
+	// Description for the test
+	description string
+	// Decode the file, collecting statistics into s
+	decode func(b []byte, s *Stats) error
+	// Expected bytes read for the data and metadata chunks
+	data, metadata uint64
+	// Expected use of the fast paths
+	readerAt, seeker bool
+}
+
+// Run all decode statistics tests against a file large enough to read in
+// parallel, with 11 bytes of metadata
+func TestStats(t *testing.T) {
+	c := newParallelFile()
+	samples := uint64(len(c)) - dsdChunkSize - fmtChunkSize - dataChunkSize - 11
+	tests := []statsTest{
+		{"Decoding from an io.Reader should read every chunk",
+			func(b []byte, s *Stats) error {
+				_, err := Decode(struct{ io.Reader }{bytes.NewReader(b)}, nil, WithStats(s))
+				return err
+			},
+			dataChunkSize + samples, 11, false, false},
+		{"Decoding from an io.ReaderAt should read the sample data in parallel",
+			func(b []byte, s *Stats) error {
+				_, err := Decode(bytes.NewReader(b), nil, WithStats(s), WithWorkers(4))
+				return err
+			},
+			dataChunkSize + samples, 11, true, false},
+		{"Decoding from an io.Seeker without the metadata should skip it by seeking",
+			func(b []byte, s *Stats) error {
+				_, err := Decode(bytes.NewReader(b), nil, WithStats(s), WithWorkers(1), WithoutMetadata())
+				return err
+			},
+			dataChunkSize + samples, 0, false, true},
+		{"Decoding bytes should not count the sample data or metadata that is aliased",
+			func(b []byte, s *Stats) error {
+				_, err := DecodeBytes(b, WithStats(s))
+				return err
+			},
+			dataChunkSize, 0, false, false},
+	}
+	for i, test := range tests {
+		var s Stats
+		if err := test.decode(c, &s); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+		want := Stats{
+			Dsd:      ChunkStats{Bytes: dsdChunkSize},
+			Fmt:      ChunkStats{Bytes: fmtChunkSize},
+			Data:     ChunkStats{Bytes: test.data},
+			Metadata: ChunkStats{Bytes: test.metadata},
+			ReaderAt: test.readerAt,
+			Seeker:   test.seeker,
+		}
+		actual := s
+		actual.Dsd.Duration, actual.Fmt.Duration, actual.Data.Duration, actual.Metadata.Duration = 0, 0, 0, 0
+		actual.Reads = 0
+		if actual != want || s.Reads == 0 || s.Data.Duration <= 0 {
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v", i+1, test.description, want, s)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// Encoding should collect the bytes written for each chunk
+func TestStatsEncode(t *testing.T) {
+	description := "Encoding should collect the bytes written for each chunk"
+	a, err := Decode(bytes.NewReader(newTestFile(1, 1, 1, 4096, make([]byte, 4096), nil)), nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	var s Stats
+	if err := Encode(a, io.Discard, nil, WithStats(&s)); err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	if s.Dsd.Bytes != dsdChunkSize || s.Fmt.Bytes != fmtChunkSize || s.Data.Bytes != dataChunkSize+4096 || s.Writes != 4 || s.Reads != 0 {
+		t.Errorf("FAIL Test 1: %v:\nWant: %v, %v and %v bytes in 4 writes\nActual: %+v", description, dsdChunkSize, fmtChunkSize, dataChunkSize+4096, s)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+}
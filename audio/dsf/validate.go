@@ -0,0 +1,152 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"github.com/snmoore/go/audio"
+	"io"
+)
+
+// Size in bytes of the scratch buffer through which the sample data is read
+// when validating.
+const validateBufferSize = 32 << 10
+
+// Check is the outcome of checking one part of a DSD stream file.
+type Check struct {
+	// The part of the file checked e.g. "fmt chunk".
+	Name string
+
+	// Offset in bytes of the start of the part from the start of the file, and
+	// the number of bytes of it that were read.
+	Offset uint64
+	Size   uint64
+
+	// The violation that caused the check to fail, or nil if it passed.
+	Err error
+
+	// Violations of the specification tolerated.
+	Warnings []Warning
+}
+
+// Report describes the checks performed when validating a DSD stream file.
+type Report struct {
+	// The checks performed, in the order in which the parts were read.
+	Checks []Check
+
+	// Total number of bytes read.
+	BytesRead uint64
+}
+
+// Valid returns whether all of the checks passed, although there may have been
+// warnings.
+func (r *Report) Valid() bool {
+	for _, c := range r.Checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// countingReader counts the bytes read from an io.Reader.
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+// Read reads from the underlying io.Reader, counting the bytes read.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// Validate reads a DSD stream file from r and checks every chunk header, size
+// and field, and that the file contains all of the sample data and metadata
+// that it declares and nothing more, in the same order as Decode. The sample
+// data is read through a small scratch buffer and is never held in memory. The
+// returned Report lists each check performed with its byte offset, up to and
+// including any that failed, in which case the error from that check is also
+// returned.
+func Validate(r io.Reader, opts ...Option) (*Report, error) {
+	d := newDecoder(nil, opts)
+	input := &countingReader{r: r}
+	d.reset(input, new(audio.Audio))
+	report := new(Report)
+
+	// Perform a check, recording its outcome and any warnings in the report
+	check := func(name string, f func() error) error {
+		offset, warnings := input.n, len(d.warnings)
+		err := f()
+		c := Check{Name: name, Offset: offset, Size: input.n - offset, Err: err}
+		if len(d.warnings) > warnings {
+			c.Warnings = d.warnings[warnings:]
+		}
+		report.Checks = append(report.Checks, c)
+		report.BytesRead = input.n
+		return err
+	}
+
+	// 1st chunk should be DSD
+	if err := check("DSD chunk", d.readDSDChunk); err != nil {
+		return report, err
+	}
+
+	// 2nd chunk should be fmt
+	if err := check("fmt chunk", d.readFmtChunk); err != nil {
+		return report, err
+	}
+
+	// The sample data and metadata should fit within the file
+	if err := check("chunk sizes", d.checkSizes); err != nil {
+		return report, err
+	}
+
+	// 3rd chunk should be data
+	if err := check("data chunk", d.readDataChunk); err != nil {
+		return report, err
+	}
+
+	// The metadata should follow immediately after the data chunk
+	if err := check("metadata pointer", d.checkMetadataPointer); err != nil {
+		return report, err
+	}
+
+	// All of the sample data should be present
+	err := check("sample data", func() error {
+		start := d.position
+		buf := make([]byte, validateBufferSize)
+		for {
+			position := d.position
+			n, err := d.readSamples(buf)
+			d.hashSamples(buf[:n], position)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return d.truncatedSamples(start, err)
+			}
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// 4th chunk should be metadata, but may be omitted
+	if d.metadataSize > 0 {
+		if err := check("metadata chunk", d.readMetadata); err != nil {
+			return report, err
+		}
+	}
+
+	// The total file size should match the length of the file
+	err = check("file length", func() error {
+		if _, err := io.Copy(io.Discard, input); err != nil {
+			return err
+		}
+		return d.checkFileLength(input.n)
+	})
+	return report, err
+}
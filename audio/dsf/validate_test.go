@@ -0,0 +1,191 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// Table structure for a single validate test
+type validateTest struct {
+	// Description for the test
+	description string
+	// Name of the DSD stream file to validate
+	filename string
+	// Number of bytes to truncate the file to, or 0 to leave it whole
+	truncate int
+	// Expected names and offsets of the checks performed
+	names   []string
+	offsets []uint64
+	// Is an error expected to be thrown?
+	expectError bool
+}
+
+// Table of all validate tests
+var validateTests = []validateTest{
+	{"Validating a valid DSD stream file (without metadata) should perform every check", "test/valid_without_metadata.dsf", 0,
+		[]string{"DSD chunk", "fmt chunk", "chunk sizes", "data chunk", "metadata pointer", "sample data", "file length"}, []uint64{0, 28, 80, 80, 92, 92, 4188}, false},
+	{"Validating a valid DSD stream file (with metadata) should perform every check", "test/valid_with_metadata.dsf", 0,
+		[]string{"DSD chunk", "fmt chunk", "chunk sizes", "data chunk", "metadata pointer", "sample data", "metadata chunk", "file length"}, []uint64{0, 28, 80, 80, 92, 92, 4188, 4198}, false},
+	{"Validating a file that is truncated within the fmt chunk should result in an error", "test/valid_with_metadata.dsf", 50,
+		[]string{"DSD chunk", "fmt chunk"}, []uint64{0, 28}, true},
+	{"Validating a file that is truncated within the sample data should result in an error", "test/valid_with_metadata.dsf", 1000,
+		[]string{"DSD chunk", "fmt chunk", "chunk sizes", "data chunk", "metadata pointer", "sample data"}, []uint64{0, 28, 80, 80, 92, 92}, true},
+	{"Validating a file that is truncated within the metadata should result in an error", "test/valid_with_metadata.dsf", 4190,
+		[]string{"DSD chunk", "fmt chunk", "chunk sizes", "data chunk", "metadata pointer", "sample data", "metadata chunk"}, []uint64{0, 28, 80, 80, 92, 92, 4188}, true},
+	{"Validating a file that has non-zero reserved bytes should result in an error", "test/invalid_nonzero_reserved.dsf", 0,
+		[]string{"DSD chunk", "fmt chunk"}, []uint64{0, 28}, true},
+}
+
+// Run all validate tests
+func TestValidate(t *testing.T) {
+	for i, test := range validateTests {
+		// Read the whole DSD stream file into memory
+		b, err := ioutil.ReadFile(test.filename)
+		if err != nil {
+			t.Fatalf("FAIL Test %v: %v:\n%v", i+1, test.description, err.Error())
+		}
+		if test.truncate > 0 {
+			b = b[:test.truncate]
+		}
+
+		// Validate the DSD stream file
+		report, err := Validate(bytes.NewReader(b), WithStrictness(Strict))
+
+		// Check the checks performed
+		var names []string
+		var offsets []uint64
+		for _, c := range report.Checks {
+			names = append(names, c.Name)
+			offsets = append(offsets, c.Offset)
+		}
+		switch {
+		case test.expectError && (err == nil || report.Valid()):
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err)
+		case !test.expectError && (err != nil || !report.Valid()):
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err)
+		case (test.truncate > 0 || !test.expectError) && report.BytesRead != uint64(len(b)):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v bytes read\nActual: %v bytes read", i+1, test.description, len(b), report.BytesRead)
+		case !reflect.DeepEqual(names, test.names) || !reflect.DeepEqual(offsets, test.offsets):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v at %v\nActual: %v at %v", i+1, test.description, test.names, test.offsets, names, offsets)
+		default:
+			t.Logf("PASS Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.expectError, err)
+		}
+	}
+}
+
+// A truncated file should be reported with the offsets of the missing bytes
+func TestValidateTruncated(t *testing.T) {
+	description := "A truncated file should be reported with the offsets of the missing bytes"
+
+	// Read the whole DSD stream file into memory
+	b, err := ioutil.ReadFile("test/valid_without_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+
+	// Remove all but 100 bytes of the sample data
+	_, err = Validate(bytes.NewReader(b[:92+100]))
+	want := "data: file is truncated at offset 192 of 4188: expected 4096 bytes of sample data from offset 92 but found 100, so 0 of 1 blocks per channel (0s of 0s) are complete: unexpected EOF"
+	if err == nil || err.Error() != want || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("FAIL Test 1: %v:\nWant: %v\nActual: %v", description, want, err)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+}
+
+// Violations tolerated in lenient mode should be listed against the check in
+// which they were found
+func TestValidateLenient(t *testing.T) {
+	description := "Violations tolerated in lenient mode should be listed against their check"
+
+	// Read the whole DSD stream file into memory
+	b, err := ioutil.ReadFile("test/invalid_nonzero_reserved.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+
+	report, err := Validate(bytes.NewReader(b), WithLenient())
+	if err != nil || !report.Valid() {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err)
+	}
+	for _, c := range report.Checks {
+		want := 0
+		if c.Name == "fmt chunk" {
+			want = 1
+		}
+		if len(c.Warnings) != want || (want == 1 && c.Warnings[0].Field != "fmt.Reserved") {
+			t.Errorf("FAIL Test 1: %v:\nWant: %v warnings for %v\nActual: %v", description, want, c.Name, c.Warnings)
+			return
+		}
+	}
+	t.Logf("PASS Test 1: %v", description)
+}
+
+// Table structure for a single test of a file altered after the sample data
+type validateAlteredTest struct {
+	// Description for the test
+	description string
+	// Alters the contents of a valid DSD stream file with metadata
+	alter func(b []byte) []byte
+	// Name of the check expected to fail when validating strictly
+	failed string
+}
+
+// Table of all tests of files altered after the sample data
+var validateAlteredTests = []validateAlteredTest{
+	{"A gap before the metadata should fail the metadata pointer check, and be skipped otherwise",
+		func(b []byte) []byte {
+			b = append(b[:4188:4188], append(make([]byte, 16), b[4188:]...)...)
+			b[12] += 16
+			b[20] += 16
+			return b
+		}, "metadata pointer"},
+	{"Bytes after the metadata should fail the file length check",
+		func(b []byte) []byte { return append(b, make([]byte, 16)...) }, "file length"},
+}
+
+// Run all tests of files altered after the sample data, which should be
+// rejected strictly by both Validate and Decode, and otherwise tolerated
+func TestValidateAltered(t *testing.T) {
+	for i, test := range validateAlteredTests {
+		// Read the whole DSD stream file into memory, and alter it
+		b, err := ioutil.ReadFile("test/valid_with_metadata.dsf")
+		if err != nil {
+			t.Fatalf("FAIL Test %v: %v:\n%v", i+1, test.description, err.Error())
+		}
+		b = test.alter(b)
+
+		// Validating strictly should fail the expected check, as should decoding
+		report, err := Validate(bytes.NewReader(b), WithStrictness(Strict))
+		last := report.Checks[len(report.Checks)-1]
+		_, decodeErr := Decode(bytes.NewReader(b), nil, WithStrictness(Strict))
+		switch {
+		case err == nil || decodeErr == nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v and %v", i+1, test.description, err, decodeErr)
+			continue
+		case last.Name != test.failed || last.Err == nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: %v failed\nActual: %v failed: %v", i+1, test.description, test.failed, last.Name, err)
+			continue
+		}
+
+		// Validating normally should tolerate it, with a warning
+		report, err = Validate(bytes.NewReader(b))
+		var warnings int
+		for _, c := range report.Checks {
+			warnings += len(c.Warnings)
+		}
+		if err != nil || !report.Valid() || warnings != 1 || report.BytesRead != uint64(len(b)) {
+			t.Errorf("FAIL Test %v: %v:\nWant: 1 warning\nActual: %v warnings, %v", i+1, test.description, warnings, err)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"fmt"
+)
+
+// Strictness is how strictly the specification is enforced when decoding.
+type Strictness int
+
+// Strictness levels, from the most to the least strict.
+const (
+	// Strict rejects any violation of the specification.
+	Strict Strictness = iota
+
+	// Normal tolerates violations that are commonly found in real-world files
+	// but do not prevent the audio from being decoded, such as a data chunk
+	// size that excludes the padding or non-zero reserved bytes, recording them
+	// as warnings. This is the default.
+	Normal
+
+	// Permissive additionally tolerates violations that leave some doubt over
+	// the file, such as an unknown format version or a bad metadata chunk, to
+	// recover whatever audio is readable. A bad metadata chunk is ignored.
+	Permissive
+)
+
+// String returns the name of the strictness level.
+func (s Strictness) String() string {
+	switch s {
+	case Strict:
+		return "Strict"
+	case Normal:
+		return "Normal"
+	case Permissive:
+		return "Permissive"
+	default:
+		return fmt.Sprintf("Strictness(%d)", int(s))
+	}
+}
+
+// Warning describes a violation of the specification that was tolerated when
+// decoding or encoding at the Normal or Permissive strictness level, such as a
+// nonstandard sampling frequency permitted when encoding permissively.
+type Warning struct {
+	// The chunk and field concerned e.g. "fmt.Reserved".
+	Field string
+
+	// The expected and actual values of the field.
+	Expected string
+	Actual   string
+
+	// Description of the violation.
+	Message string
+}
+
+// String returns a description of the Warning.
+func (w Warning) String() string {
+	return fmt.Sprintf("%v: %v (expected %v, actual %v)", w.Field, w.Message, w.Expected, w.Actual)
+}
+
+// violation handles a violation of the specification that is tolerated at the
+// given strictness level and any more permissive level. If tolerated it is
+// recorded and logged as the Warning w and nil is returned, otherwise err is
+// returned.
+func (d *decoder) violation(level Strictness, err error, w Warning) error {
+	if d.strictness < level {
+		return err
+	}
+
+	d.warn(w)
+	return nil
+}
+
+// warn records the Warning w and logs it at Warn level.
+func (d *decoder) warn(w Warning) {
+	d.warnings = append(d.warnings, w)
+	if d.options.warnings != nil {
+		*d.options.warnings = d.warnings
+	}
+	logWarning(d.logger, w)
+}
+
+// warn records the Warning w and logs it at Warn level, for a violation that
+// is tolerated when encoding. A Warning is recorded only once, however often
+// the chunk concerned is prepared.
+func (e *encoder) warn(w Warning) {
+	for _, warning := range e.warnings {
+		if warning == w {
+			return
+		}
+	}
+	e.warnings = append(e.warnings, w)
+	if e.options.warnings != nil {
+		*e.options.warnings = e.warnings
+	}
+	logWarning(e.logger, w)
+}
+
+// warned returns whether a violation of the named field has been tolerated.
+func (d *decoder) warned(field string) bool {
+	for _, w := range d.warnings {
+		if w.Field == field {
+			return true
+		}
+	}
+	return false
+}
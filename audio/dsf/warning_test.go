@@ -0,0 +1,106 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+// Table structure for a single strictness test
+type strictnessTest struct {
+	// Description for the test
+	description string
+	// Modification to make to a valid DSD stream file (with metadata)
+	modify func(b []byte) []byte
+	// Is an error expected at the Strict, Normal and Permissive levels?
+	expectError [3]bool
+	// Field of the warning expected when the violation is tolerated
+	field string
+}
+
+// Table of all strictness tests
+var strictnessTests = []strictnessTest{
+	{"A valid file should be accepted at every level",
+		func(b []byte) []byte { return b },
+		[3]bool{false, false, false}, ""},
+	{"Non-zero reserved bytes should be tolerated unless decoding strictly",
+		func(b []byte) []byte { b[76] = 1; return b },
+		[3]bool{true, false, false}, "fmt.Reserved"},
+	{"An overstated total file size should be tolerated unless decoding strictly",
+		func(b []byte) []byte { b[12] += 4; return b },
+		[3]bool{true, false, false}, "dsd.TotalFileSize"},
+	{"A gap before the metadata chunk should be tolerated unless decoding strictly",
+		func(b []byte) []byte {
+			b = append(b[:4188:4188], append(make([]byte, 8), b[4188:]...)...)
+			binary.LittleEndian.PutUint64(b[12:], 4206)
+			binary.LittleEndian.PutUint64(b[20:], 4196)
+			return b
+		},
+		[3]bool{true, false, false}, "dsd.MetadataPointer"},
+	{"A bad DSD chunk size should only be tolerated when decoding permissively",
+		func(b []byte) []byte { b[4] = 30; return b },
+		[3]bool{true, true, false}, "dsd.Size"},
+	{"A bad pointer to the metadata chunk should only be tolerated when decoding permissively",
+		func(b []byte) []byte { binary.LittleEndian.PutUint64(b[20:], 5000); return b },
+		[3]bool{true, true, false}, "dsd.MetadataPointer"},
+	{"An unknown format version should only be tolerated when decoding permissively",
+		func(b []byte) []byte { b[40] = 2; return b },
+		[3]bool{true, true, false}, "fmt.Version"},
+	{"An unknown format id should only be tolerated when decoding permissively",
+		func(b []byte) []byte { b[44] = 1; return b },
+		[3]bool{true, true, false}, "fmt.Identifier"},
+	{"A nonstandard sampling frequency should only be tolerated when decoding permissively",
+		func(b []byte) []byte { binary.LittleEndian.PutUint32(b[56:], 3000000); return b },
+		[3]bool{true, true, false}, "fmt.SamplingFrequency"},
+	{"A metadata chunk that is another chunk should only be tolerated when decoding permissively",
+		func(b []byte) []byte { copy(b[4188:], "DSD "); return b },
+		[3]bool{true, true, false}, "metadata.Header"},
+	{"Truncated sample data should not be tolerated at any level",
+		func(b []byte) []byte { return b[:1000] },
+		[3]bool{true, true, true}, ""},
+	{"A bad chunk header should not be tolerated at any level",
+		func(b []byte) []byte { b[28] = 'x'; return b },
+		[3]bool{true, true, true}, ""},
+}
+
+// Run all strictness tests at every level
+func TestStrictness(t *testing.T) {
+	valid, err := ioutil.ReadFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL: %v", err.Error())
+	}
+	for i, test := range strictnessTests {
+		for _, level := range []Strictness{Strict, Normal, Permissive} {
+			b := test.modify(append([]byte{}, valid...))
+			var warnings []Warning
+			_, err := Decode(bytes.NewReader(b), nil, WithStrictness(level), WithWarnings(&warnings))
+			switch {
+			case test.expectError[level] && err == nil:
+				t.Errorf("FAIL Test %v: %v at level %v:\nWant: error\nActual: nil", i+1, test.description, level)
+			case !test.expectError[level] && err != nil:
+				t.Errorf("FAIL Test %v: %v at level %v:\nWant: nil\nActual: %v", i+1, test.description, level, err.Error())
+			case !test.expectError[level] && test.field != "" && (len(warnings) == 0 || warnings[len(warnings)-1].Field != test.field):
+				t.Errorf("FAIL Test %v: %v at level %v:\nWant: %v warning\nActual: %v", i+1, test.description, level, test.field, warnings)
+			case !test.expectError[level] && test.field == "" && len(warnings) > 0:
+				t.Errorf("FAIL Test %v: %v at level %v:\nWant: no warnings\nActual: %v", i+1, test.description, level, warnings)
+			default:
+				t.Logf("PASS Test %v: %v at level %v", i+1, test.description, level)
+			}
+		}
+	}
+}
+
+// Normal should be the default level
+func TestStrictnessDefault(t *testing.T) {
+	description := "Normal should be the default strictness level"
+	if o := newOptions(nil); o.strictness != Normal {
+		t.Errorf("FAIL Test 1: %v:\nWant: %v\nActual: %v", description, Normal, o.strictness)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+}
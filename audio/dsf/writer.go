@@ -5,16 +5,18 @@
 package dsf
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
 	"github.com/snmoore/go/audio"
 	"io"
-	"log"
+	"log/slog"
 )
 
 // encoder is the type used to encode a DSD stream file.
 type encoder struct {
 	// Where to log to.
-	logger *log.Logger
+	logger *slog.Logger
 
 	// Input.
 	audio *audio.Audio
@@ -22,50 +24,482 @@ type encoder struct {
 	// Output.
 	writer io.Writer
 
+	// Configuration.
+	options
+
+	// Sizes and offsets of the chunks, from which they are prepared.
+	layout Layout
+
 	// DSD stream file chunks.
 	dsd  DsdChunk
 	fmt  FmtChunk
 	data DataChunk
+
+	// Output wrapped to collect statistics, if requested by WithStats.
+	statsWriter *statsWriter
+
+	// Size in bytes of the sample data, excluding the padding of the final
+	// block for each channel.
+	sampleDataSize uint64
+
+	// Number of bytes written so far.
+	written uint64
+
+	// Violations of the specification that have been tolerated.
+	warnings []Warning
+
+	// Context given to EncodeContext, checked between chunks and between
+	// pieces of the sample data, or nil if none.
+	ctx context.Context
+
+	// Buffer for writing padding, kept from one DSD stream file to the next.
+	scratch []byte
+
+	// Checksum of the sample data written so far, if requested by
+	// WithChecksum.
+	hasher *sampleHasher
 }
 
-// encode writes a DSD stream file to r.
-func (e *encoder) encode(a *audio.Audio, w io.Writer, logTo io.Writer) error {
-	e.logger = log.New(logTo, "", 0)
-	e.audio = a
-	e.writer = w
+// newEncoder returns an encoder configured by opts, logging to logTo unless
+// WithLogger is given.
+func newEncoder(logTo io.Writer, opts []Option) *encoder {
+	o := newOptions(opts)
+	logger := o.logger
+	if logger == nil {
+		logger = newLogger(logTo)
+	}
+	return &encoder{
+		logger:  logger,
+		options: o,
+	}
+}
 
-	// Audio samples should be a multiple of the block size, padded with zero
-	remainder := uint(len(e.audio.EncodedSamples)) % e.audio.BlockSize
-	if remainder > 0 {
-		e.logger.Printf("Padding the audio samples with %v zero bytes\n", remainder)
-		padding := make([]byte, remainder, 0)
-		e.audio.EncodedSamples = append(e.audio.EncodedSamples, padding...)
+// reset prepares e to encode a to w, clearing all state left from any previous
+// DSD stream file but keeping the configuration and logger.
+func (e *encoder) reset(w io.Writer, a *audio.Audio) {
+	*e = encoder{
+		logger:  e.logger,
+		audio:   a,
+		writer:  w,
+		options: e.options,
+		scratch: e.scratch,
+	}
+	if a != nil {
+		e.sampleDataSize = a.EncodedSize()
+	}
+	if e.options.warnings != nil {
+		*e.options.warnings = nil
+	}
+	if e.options.checksum != nil {
+		*e.options.checksum = nil
+	}
+	if e.options.stats != nil {
+		*e.options.stats = Stats{}
+		e.statsWriter = &statsWriter{w: w, stats: e.options.stats}
+		e.writer = e.statsWriter
+	}
+}
+
+// encode writes a DSD stream file to w. Every chunk is prepared from the
+// audio.Audio before anything is written, and the chunks are then written in a
+// single pass without seeking, stopping early if ctx is done.
+func (e *encoder) encode(ctx context.Context, a *audio.Audio, w io.Writer) error {
+	e.reset(w, a)
+	e.ctx = ctx
+	if e.statsWriter != nil {
+		defer e.startChunk("")
+	}
+
+	// Check the audio.Audio and prepare the chunk headers, so that an
+	// audio.Audio that cannot be encoded leaves w untouched
+	if err := e.prepare(); err != nil {
+		return err
 	}
 
 	// Write the DSD stream file chunks
+	if err := e.canceled(); err != nil {
+		return err
+	}
+	e.startChunk("dsd")
 	if err := e.writeDSDChunk(); err != nil {
 		return err
 	}
 
+	if err := e.canceled(); err != nil {
+		return err
+	}
+	e.startChunk("fmt")
 	if err := e.writeFmtChunk(); err != nil {
 		return err
 	}
 
+	if err := e.canceled(); err != nil {
+		return err
+	}
+	e.startChunk("data")
+	if err := e.writeDataChunk(); err != nil {
+		return err
+	}
+
+	if err := e.canceled(); err != nil {
+		return err
+	}
+	e.startChunk("metadata")
+	if err := e.writeMetadataChunk(); err != nil {
+		return err
+	}
+
+	// Store the checksum of the sample data, if requested
+	e.storeChecksum()
+
+	return e.checkWritten()
+}
+
+// canceled returns the error of the context given to EncodeContext, if any,
+// once it is done.
+func (e *encoder) canceled() error {
+	if e.ctx == nil {
+		return nil
+	}
+	return e.ctx.Err()
+}
+
+// write writes p, counting the bytes written.
+func (e *encoder) write(p []byte) error {
+	n, err := e.writer.Write(p)
+	e.written += uint64(n)
+	return err
+}
+
+// writeRepeated writes n copies of the byte c as writeSamples does, from a
+// scratch buffer of at most progressInterval bytes that is reused rather than
+// allocating n bytes.
+func (e *encoder) writeRepeated(c byte, n uint64) error {
+	if n == 0 {
+		return nil
+	}
+	size := int(min(n, progressInterval))
+	if cap(e.scratch) < size {
+		e.scratch = make([]byte, size)
+	}
+	buf := e.scratch[:size]
+	for i := range buf {
+		buf[i] = c
+	}
+	for n > 0 {
+		p := buf[:min(n, uint64(size))]
+		if err := e.writeSamples(p); err != nil {
+			return err
+		}
+		n -= uint64(len(p))
+	}
+	return nil
+}
+
+// reportProgress calls the function given by WithProgress, if any, with the
+// number of bytes written so far and the total file size.
+func (e *encoder) reportProgress() {
+	if e.progress != nil {
+		e.progress(e.written, binary.LittleEndian.Uint64(e.dsd.TotalFileSize[:]))
+	}
+}
+
+// prepareHeaders plans the layout of the file from the sizes of the sample data
+// and metadata, which must not change once they are written, and prepares the
+// DSD, fmt and data chunk headers from it.
+func (e *encoder) prepareHeaders() error {
+	e.planLayout()
+	e.prepareDSDChunk()
+	if err := e.prepareFmtChunk(); err != nil {
+		return err
+	}
+	e.prepareDataHeader()
 	return nil
 }
 
-// Encode writes the Audio a to w as a DSD stream file.
-// logTo is the optional destination to log to.
-func Encode(a *audio.Audio, w io.Writer, logTo io.Writer) error {
-	var e encoder
+// writeHeaders writes the DSD, fmt and data chunk headers, which must already be
+// prepared.
+func (e *encoder) writeHeaders() error {
+	if err := e.writeDSDChunk(); err != nil {
+		return err
+	}
+	if err := e.writeFmtChunk(); err != nil {
+		return err
+	}
+	return e.writeDataHeader()
+}
+
+// checkWritten checks that the number of bytes written matches the total file
+// size in the DSD chunk, as a check of the internal consistency of the encoder.
+func (e *encoder) checkWritten() error {
+	total := binary.LittleEndian.Uint64(e.dsd.TotalFileSize[:])
+	if e.written != total {
+		return fmt.Errorf("dsd: %v bytes were written but the total file size is %v", e.written, total)
+	}
+	return nil
+}
+
+// blockSize returns the block size per channel in bytes, which is that given by
+// WithBlockSize, or the usual 4096 bytes, if not set.
+func (e *encoder) blockSize() uint {
+	switch {
+	case e.audio.BlockSize != 0:
+		return e.audio.BlockSize
+	case e.options.blockSize != 0:
+		return e.options.blockSize
+	}
+	return fmtBlockSize
+}
+
+// paddedSize returns the size in bytes of the sample data that is written,
+// including the padding of the final block for each channel.
+func (e *encoder) paddedSize() uint64 {
+	size := e.sampleDataSize
+	groupSize := uint64(e.audio.NumChannels) * uint64(e.blockSize())
+	if groupSize == 0 || size%groupSize == 0 {
+		return size
+	}
+	return size + groupSize - size%groupSize
+}
+
+// Encode writes the Audio a to w as a DSD stream file. The sample data is padded
+// with DSD silence to complete the final block for every channel, see
+// WithPadByte, but a itself is not modified. The file is written in a single
+// pass without seeking, so w may be a pipe, and nothing is written if a cannot
+// be encoded, including if its fields are inconsistent, see
+// audio.Audio.Validate, in which case every inconsistency is reported.
+// logTo is the optional destination to log the fields of each chunk to as text,
+// see WithLogger for structured logging instead.
+func Encode(a *audio.Audio, w io.Writer, logTo io.Writer, opts ...Option) error {
+	_, err := EncodeCount(a, w, logTo, opts...)
+	return err
+}
+
+// EncodeCount is Encode, but also returns the number of bytes written, which
+// is checked against the total file size in the DSD chunk. If the two differ
+// then an error is returned.
+func EncodeCount(a *audio.Audio, w io.Writer, logTo io.Writer, opts ...Option) (int64, error) {
+	return EncodeContext(context.Background(), a, w, logTo, opts...)
+}
+
+// EncodeContext is EncodeCount, but stops early if ctx is done, returning the
+// error of ctx together with the number of bytes already written so that the
+// caller can clean up the partial file. The context is checked between chunks
+// and between pieces of the sample data of at most 1 MB.
+func EncodeContext(ctx context.Context, a *audio.Audio, w io.Writer, logTo io.Writer, opts ...Option) (int64, error) {
+	e := newEncoder(logTo, opts)
+	err := e.encode(ctx, a, w)
+	return int64(e.written), err
+}
+
+// Encoder encodes DSD stream files, reusing its configuration and logger from
+// one file to the next. This avoids repeated setup when encoding many files in
+// turn. An Encoder must not be used concurrently.
+type Encoder struct {
+	e encoder
+}
+
+// NewEncoder returns an Encoder configured by opts.
+func NewEncoder(opts ...Option) *Encoder {
+	return &Encoder{e: *newEncoder(nil, opts)}
+}
+
+// Encode writes the Audio a to w as a DSD stream file, as per the Encode
+// function.
+func (enc *Encoder) Encode(a *audio.Audio, w io.Writer) error {
+	return enc.e.encode(context.Background(), a, w)
+}
+
+// Reset clears any state left from the previous DSD stream file, including
+// after a failed encode, so that nothing can leak into the next file. The
+// configuration is kept.
+func (enc *Encoder) Reset() {
+	enc.e.reset(nil, nil)
+}
 
-	if a.Encoding != audio.DSD {
-		return fmt.Errorf("unsupported audio encoding: %v\n", a.Encoding)
+// Writer writes a DSD stream file incrementally, for sample data that is
+// generated on the fly rather than held in an audio.Audio. The DSD, fmt and
+// data chunk headers are written before the first sample data, and the sizes in
+// them are fixed up by Close once all of the sample data has been written.
+type Writer struct {
+	// The encoder doing the actual work, encoding an audio.Audio that holds
+	// the format and metadata but not the sample data.
+	e encoder
+	a audio.Audio
+
+	// The output if it can seek back to fix up the headers, and the offset of
+	// the start of the file within it.
+	seeker io.WriteSeeker
+	start  int64
+
+	// Size in bytes of the sample data written so far.
+	written uint64
+
+	// Whether the headers have been written, and whether the Writer is closed.
+	started bool
+	closed  bool
+}
+
+// NewWriter returns a Writer that writes a DSD stream file to w, in the given
+// format. The NumChannels, ChannelOrder, SamplingFrequency, BitsPerSample,
+// BlockSize and SampleCount of format are used, and the other fields ignored.
+// If w is an io.WriteSeeker then SampleCount may be 0, in which case it is
+// found from the sample data written, otherwise it must be given up front. The
+// options configure logging and the channel type as for Encode.
+func NewWriter(w io.Writer, format Info, opts ...Option) (*Writer, error) {
+	wr := &Writer{
+		e: *newEncoder(nil, opts),
+		a: audio.Audio{
+			Encoding:          audio.DSD,
+			NumChannels:       format.NumChannels,
+			ChannelOrder:      format.ChannelOrder,
+			SamplingFrequency: format.SamplingFrequency,
+			BitsPerSample:     format.BitsPerSample,
+			BlockSize:         format.BlockSize,
+			SampleCount:       format.SampleCount,
+		},
 	}
+	wr.e.progress = nil // the total file size is not known up front
+	wr.e.audio = &wr.a
 
-	if err := e.encode(a, w, logTo); err != nil {
+	// Note where the file starts, so that the headers can be fixed up
+	if s, ok := w.(io.WriteSeeker); ok {
+		if start, err := s.Seek(0, io.SeekCurrent); err == nil {
+			wr.seeker, wr.start = s, start
+		}
+	}
+	if wr.seeker == nil && format.SampleCount == 0 {
+		return nil, fmt.Errorf("fmt: sample count must be given when the output cannot seek")
+	}
+
+	// Size of the sample data declared by the sample count, if any
+	if format.SampleCount > 0 {
+		bytesPerChannel := format.SampleCount
+		if format.BitsPerSample == 1 {
+			bytesPerChannel = bytesPerChannel/8 + (bytesPerChannel%8+7)/8 // up to 8 samples per byte
+		}
+		wr.e.sampleDataSize = bytesPerChannel * uint64(format.NumChannels)
+	}
+
+	// Check the format up front, by preparing the headers
+	if err := wr.e.prepareHeaders(); err != nil {
+		return nil, err
+	}
+	wr.e.writer = w
+
+	return wr, nil
+}
+
+// writeHeaders prepares and writes the DSD, fmt and data chunk headers.
+func (wr *Writer) writeHeaders() error {
+	if err := wr.e.prepareHeaders(); err != nil {
 		return err
 	}
+	return wr.e.writeHeaders()
+}
 
+// WriteSamples writes p as the next part of the sample data. The samples are
+// interleaved as blocks of BlockSize bytes for each channel in turn, as held by
+// audio.Audio. The final block for each channel may be left incomplete, and is
+// padded by Close, see WithPadByte.
+func (wr *Writer) WriteSamples(p []byte) error {
+	if wr.closed {
+		return fmt.Errorf("data: write to closed Writer")
+	}
+	if !wr.started {
+		if err := wr.writeHeaders(); err != nil {
+			return err
+		}
+		wr.started = true
+	}
+	if wr.seeker == nil && wr.written+uint64(len(p)) > wr.e.paddedSize() {
+		return fmt.Errorf("data: %v bytes of sample data exceeds the %v bytes declared by the sample count %v",
+			wr.written+uint64(len(p)), wr.e.paddedSize(), wr.a.SampleCount)
+	}
+	if wr.written == 0 {
+		wr.e.logSamples(p)
+	}
+	if err := wr.e.writeSamples(p); err != nil {
+		return err
+	}
+	wr.written += uint64(len(p))
 	return nil
 }
+
+// SetMetadata sets the metadata e.g. an ID3v2 tag to write after the sample
+// data. If the output cannot seek then this must be called before any sample
+// data is written, as the headers depend on it. The metadata is written as is
+// by Close, so must not be modified until then. It must be an ID3v2 tag unless
+// the Writer is permissive or WithRawMetadata is given.
+func (wr *Writer) SetMetadata(metadata []byte) error {
+	if wr.closed {
+		return fmt.Errorf("metadata: set on closed Writer")
+	}
+	if wr.started && wr.seeker == nil {
+		return fmt.Errorf("metadata: must be set before the sample data when the output cannot seek")
+	}
+	previous := wr.a.Metadata
+	wr.a.Metadata = metadata
+	if err := wr.e.checkMetadata(); err != nil {
+		wr.a.Metadata = previous
+		return err
+	}
+	return nil
+}
+
+// Close pads the sample data to complete the final block for every channel,
+// writes the metadata, and if the output can seek, fixes up the total file
+// size, sample count, data chunk size and metadata pointer in the headers. If
+// the sample count was given up front then the sample data written must match
+// it. Close does not close the underlying io.Writer.
+func (wr *Writer) Close() error {
+	if wr.closed {
+		return nil
+	}
+	wr.closed = true
+	if !wr.started {
+		if err := wr.writeHeaders(); err != nil {
+			return err
+		}
+	}
+
+	// The sample data written must match the sample count, if given up front,
+	// once padded
+	declared := wr.e.paddedSize()
+	wr.e.sampleDataSize = wr.written
+	if padded := wr.e.paddedSize(); wr.a.SampleCount > 0 && padded != declared {
+		return fmt.Errorf("data: %v bytes of sample data were written, or %v once padded, but the sample count %v needs %v",
+			wr.written, padded, wr.a.SampleCount, declared)
+	}
+	if err := wr.e.writePadding(); err != nil {
+		return err
+	}
+
+	if err := wr.e.writeMetadataChunk(); err != nil {
+		return err
+	}
+
+	// Without seeking the headers were written up front, otherwise fix them
+	// up, leaving the output at the end of the file
+	if wr.seeker == nil {
+		return wr.e.checkWritten()
+	}
+	if err := wr.e.prepareHeaders(); err != nil {
+		return err
+	}
+	if err := wr.e.checkWritten(); err != nil {
+		return err
+	}
+	end, err := wr.seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := wr.seeker.Seek(wr.start, io.SeekStart); err != nil {
+		return err
+	}
+	if err := wr.e.writeHeaders(); err != nil {
+		return err
+	}
+	_, err = wr.seeker.Seek(end, io.SeekStart)
+	return err
+}
@@ -0,0 +1,742 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package dsf
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/snmoore/go/audio"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Table structure for a single round trip test
+type roundTripTest struct {
+	// Description for the test
+	description string
+	// DSD stream file to decode, encode and decode again
+	file func() []byte
+}
+
+// mustNew returns DSD audio with the given sampling frequency and channel order
+// from audio.New, panicking if they are invalid.
+func mustNew(samplingFrequency uint, order []audio.Channel, opts ...audio.NewOption) *audio.Audio {
+	a, err := audio.New(audio.DSD, samplingFrequency, order, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// stereoTestFile returns a stereo DSD64 file of 2 blocks per channel, with the
+// final block for each channel part filled.
+func stereoTestFile() []byte {
+	samples := make([]byte, 2*2*4096)
+	for i := range samples {
+		samples[i] = byte(i*3 + i/4096)
+	}
+	return newTestFile(2, 2, 4096*8+1000, uint64(len(samples)), samples, nil)
+}
+
+// withSamplingFrequency returns the DSD stream file c with the sampling
+// frequency in its fmt chunk replaced
+func withSamplingFrequency(c []byte, samplingFrequency uint32) []byte {
+	binary.LittleEndian.PutUint32(c[fmtChunkOffset+fmtSamplingFrequencyOffset:], samplingFrequency)
+	return c
+}
+
+// Table of all round trip tests, using DSD64 files unless stated
+var roundTripTests = []roundTripTest{
+	{"A mono DSD64 file should survive a round trip", func() []byte {
+		c, _ := ioutil.ReadFile("test/valid_without_metadata.dsf")
+		return c
+	}},
+	{"A stereo DSD64 file should survive a round trip", stereoTestFile},
+	{"A mono DSD64 file with an ID3v2 tag should survive a round trip, including the tag", func() []byte {
+		c, _ := ioutil.ReadFile("test/valid_with_metadata.dsf")
+		return c
+	}},
+	{"A stereo DSD64 file with an ID3v2 tag should survive a round trip, including the tag", func() []byte {
+		return newTestFile(2, 2, 1000, 2*4096, stereoSamples(4096), id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x00Title"))))
+	}},
+	{"A stereo DSD64 file larger than the pieces it is written in should survive a round trip", func() []byte {
+		samples := make([]byte, 2*640*4096)
+		for i := range samples {
+			samples[i] = byte(i*7 + i/4096)
+		}
+		return newTestFile(2, 2, 640*4096*8, uint64(len(samples)), samples, nil)
+	}},
+	{"A stereo DSD512 file should survive a round trip", func() []byte {
+		return withSamplingFrequency(stereoTestFile(), 22579200)
+	}},
+	{"A stereo DSD1024 file should survive a round trip", func() []byte {
+		return withSamplingFrequency(stereoTestFile(), 45158400)
+	}},
+	{"A stereo DSD128/48k file of 6144000 Hz should survive a round trip", func() []byte {
+		return withSamplingFrequency(stereoTestFile(), 6144000)
+	}},
+}
+
+// Run all round trip tests, checking that decoding the encoded file gives the
+// same Audio and that the encoded file is identical to the original
+func TestEncodeRoundTrip(t *testing.T) {
+	for i, test := range roundTripTests {
+		c := test.file()
+		a, err := Decode(bytes.NewReader(c), nil)
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+		// Embed the metadata verbatim, as the ID3v2 tag header in the test
+		// file overstates the size of the tag
+		var b bytes.Buffer
+		if err := Encode(a, &b, nil, WithRawMetadata()); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+		actual, err := Decode(bytes.NewReader(b.Bytes()), nil, WithStrictness(Strict))
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case !reflect.DeepEqual(actual, a):
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v", i+1, test.description, a, actual)
+		case !bytes.Equal(b.Bytes(), c):
+			t.Errorf("FAIL Test %v: %v:\nWant: the original %v bytes\nActual: %v different bytes", i+1, test.description, len(c), b.Len())
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// Channel orders for 1, 2 and 6 channels
+var paddingChannelOrders = [][]audio.Channel{
+	{audio.Center},
+	{audio.FrontLeft, audio.FrontRight},
+	{audio.FrontLeft, audio.FrontRight, audio.Center, audio.LowFrequency, audio.BackLeft, audio.BackRight},
+}
+
+// Table structure for a single padding test
+type paddingTest struct {
+	// Description for the test
+	description string
+	// Block size, and number of bytes of samples for each channel relative to
+	// a whole number of blocks
+	blockSize uint
+	offset    int
+	// Expected size of the padded sample data, in groups of blocks
+	groups int
+}
+
+// Table of all padding tests, each run for 1, 2 and 6 channels
+var paddingTests = []paddingTest{
+	{"Sample data that is an exact multiple of the blocks should not be padded", 4096, 0, 2},
+	{"Sample data one byte short of the blocks should be padded by one byte", 4096, -1, 2},
+	{"Sample data one byte over the blocks should be padded to complete the final block for every channel", 4096, 1, 3},
+	{"Sample data with a block size that is not set should be padded to blocks of 4096 bytes", 0, -1, 2},
+}
+
+// Run all padding tests, checking the size of the data chunk and that the
+// encoded file can be decoded strictly
+func TestEncodePadding(t *testing.T) {
+	for i, test := range paddingTests {
+		for _, order := range paddingChannelOrders {
+			description := fmt.Sprintf("%v (%v channels)", test.description, len(order))
+			// The sample data ends with the final sample of the final channel
+			groupSize := len(order) * 4096
+			sampleBytes := 2*4096 + test.offset
+			blocks := (sampleBytes + 4095) / 4096
+			length := (blocks-1)*groupSize + (len(order)-1)*4096 + sampleBytes - (blocks-1)*4096
+			a := audio.Audio{
+				NumChannels:       uint(len(order)),
+				ChannelOrder:      order,
+				SamplingFrequency: 2822400,
+				BitsPerSample:     1,
+				BlockSize:         test.blockSize,
+				SampleCount:       uint64(sampleBytes) * 8,
+				EncodedSamples:    bytes.Repeat([]byte{0x55}, length),
+			}
+			var b bytes.Buffer
+			if err := Encode(&a, &b, nil); err != nil {
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+				continue
+			}
+			want := uint64(test.groups * groupSize)
+			size := binary.LittleEndian.Uint64(b.Bytes()[dataChunkOffset+dataSizeOffset:])
+			decoded, err := Decode(bytes.NewReader(b.Bytes()), nil, WithStrictness(Strict))
+			switch {
+			case size != dataChunkSize+want || uint64(b.Len()) != dsdChunkSize+fmtChunkSize+dataChunkSize+want:
+				t.Errorf("FAIL Test %v: %v:\nWant: %v bytes of sample data\nActual: data chunk size %v in a file of %v bytes", i+1, description, want, size, b.Len())
+			case err != nil:
+				t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+			case !bytes.Equal(decoded.EncodedSamples[:length], bytes.Repeat([]byte{0x55}, length)) ||
+				!bytes.Equal(decoded.EncodedSamples[length:], bytes.Repeat([]byte{SilencePadByte}, int(want)-length)):
+				t.Errorf("FAIL Test %v: %v:\nWant: the sample data followed by DSD silence\nActual: different", i+1, description)
+			default:
+				t.Logf("PASS Test %v: %v", i+1, description)
+			}
+		}
+	}
+}
+
+// Encoding should leave the Audio untouched, however it holds the sample data,
+// so that encoding it again gives the same file
+func TestEncodeUnchanged(t *testing.T) {
+	samples := bytes.Repeat([]byte{0x69, 0x96}, 3000)
+	blocks := [][]byte{samples[:4096:4096], samples[4096:]}
+	tests := []struct {
+		description string
+		audio       audio.Audio
+	}{
+		{"Encoding should not modify EncodedSamples", audio.Audio{EncodedSamples: samples[:len(samples):len(samples)]}},
+		{"Encoding should not modify EncodedSamples with spare capacity", audio.Audio{EncodedSamples: append(make([]byte, 0, 4*4096), samples...)}},
+		{"Encoding should not modify EncodedBlocks", audio.Audio{EncodedBlocks: blocks[:2:2]}},
+	}
+	for i, test := range tests {
+		a := test.audio
+		a.NumChannels, a.ChannelOrder = 2, paddingChannelOrders[1]
+		a.SamplingFrequency, a.BitsPerSample, a.BlockSize = 2822400, 1, 4096
+		length, capacity, sum := len(a.EncodedSamples), cap(a.EncodedSamples), md5.Sum(a.EncodedSamples)
+		buffers := len(a.EncodedBlocks)
+
+		var first, second bytes.Buffer
+		err := Encode(&a, &first, nil)
+		if err == nil {
+			err = Encode(&a, &second, nil)
+		}
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case len(a.EncodedSamples) != length || cap(a.EncodedSamples) != capacity || md5.Sum(a.EncodedSamples) != sum || len(a.EncodedBlocks) != buffers:
+			t.Errorf("FAIL Test %v: %v:\nWant: length %v, capacity %v and %v buffers\nActual: length %v, capacity %v and %v buffers", i+1, test.description,
+				length, capacity, buffers, len(a.EncodedSamples), cap(a.EncodedSamples), len(a.EncodedBlocks))
+		case a.EncodedSize() != uint64(len(samples)) || (a.EncodedBlocks == nil && !bytes.Equal(a.EncodedSamples, samples)) || a.SampleCount != 0:
+			t.Errorf("FAIL Test %v: %v:\nWant: the original sample data\nActual: %v bytes, sample count %v", i+1, test.description, a.EncodedSize(), a.SampleCount)
+		case !bytes.Equal(first.Bytes(), second.Bytes()) || first.Len() != dsdChunkSize+fmtChunkSize+dataChunkSize+2*4096:
+			t.Errorf("FAIL Test %v: %v:\nWant: the same %v bytes from each encoding\nActual: %v and %v bytes", i+1, test.description, dsdChunkSize+fmtChunkSize+dataChunkSize+2*4096, first.Len(), second.Len())
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// seekBuffer is an in-memory io.WriteSeeker.
+type seekBuffer struct {
+	b      []byte
+	offset int
+}
+
+// Write writes p at the current offset, extending the buffer as needed.
+func (s *seekBuffer) Write(p []byte) (int, error) {
+	if end := s.offset + len(p); end > len(s.b) {
+		s.b = append(s.b, make([]byte, end-len(s.b))...)
+	}
+	copy(s.b[s.offset:], p)
+	s.offset += len(p)
+	return len(p), nil
+}
+
+// Seek sets the offset for the next Write.
+func (s *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		s.offset = int(offset)
+	case io.SeekCurrent:
+		s.offset += int(offset)
+	case io.SeekEnd:
+		s.offset = len(s.b) + int(offset)
+	}
+	return int64(s.offset), nil
+}
+
+// Table structure for a single streaming encoder test
+type writerTest struct {
+	// Description for the test
+	description string
+	// Whether the output can seek, and whether the sample count is given up
+	// front
+	seekable, declared bool
+}
+
+// Table of all streaming encoder tests
+var writerTests = []writerTest{
+	{"Writing to an io.WriteSeeker without a sample count should fix up the headers", true, false},
+	{"Writing to an io.WriteSeeker with a sample count should fix up the headers", true, true},
+	{"Writing to an io.Writer with a sample count should write the headers up front", false, true},
+}
+
+// Run all streaming encoder tests, writing the sample data in pieces that leave
+// the final block for each channel incomplete, and comparing the file with that
+// written by Encode
+func TestWriter(t *testing.T) {
+	tag := id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x00Title")))
+	samples := stereoSamples(4096)
+	format := Info{NumChannels: 2, ChannelOrder: paddingChannelOrders[1], SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096}
+	for i, test := range writerTests {
+		f := format
+		if test.declared {
+			f.SampleCount = 1000
+		}
+		a := audio.Audio{NumChannels: f.NumChannels, ChannelOrder: f.ChannelOrder, SamplingFrequency: f.SamplingFrequency,
+			BitsPerSample: f.BitsPerSample, BlockSize: f.BlockSize, SampleCount: f.SampleCount, EncodedSamples: samples[:len(samples)-500], Metadata: tag}
+		var want bytes.Buffer
+		if err := Encode(&a, &want, nil); err != nil {
+			t.Fatalf("FAIL Test %v: %v:\n%v", i+1, test.description, err.Error())
+		}
+
+		// Write the metadata last unless it must be first
+		var b seekBuffer
+		var w io.Writer = &b
+		if !test.seekable {
+			w = struct{ io.Writer }{&b}
+		}
+		wr, err := NewWriter(w, f)
+		if err == nil && !test.seekable {
+			err = wr.SetMetadata(tag)
+		}
+		for p := samples[:len(samples)-500]; err == nil && len(p) > 0; p = p[min(len(p), 1000):] {
+			err = wr.WriteSamples(p[:min(len(p), 1000)])
+		}
+		if err == nil && test.seekable {
+			err = wr.SetMetadata(tag)
+		}
+		if err == nil {
+			err = wr.Close()
+		}
+
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case !bytes.Equal(b.b, want.Bytes()):
+			t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x", i+1, test.description, want.Bytes()[:92], b.b[:min(len(b.b), 92)])
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// Misuse of the streaming encoder should result in an error
+func TestWriterError(t *testing.T) {
+	format := Info{NumChannels: 2, ChannelOrder: paddingChannelOrders[1], SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096, SampleCount: 1000}
+	tests := []struct {
+		description string
+		run         func(w io.Writer) error
+	}{
+		{"Writing to an io.Writer without a sample count should result in an error", func(w io.Writer) error {
+			f := format
+			f.SampleCount = 0
+			_, err := NewWriter(w, f)
+			return err
+		}},
+		{"Writing an unsupported format should result in an error", func(w io.Writer) error {
+			f := format
+			f.SamplingFrequency = 44100
+			_, err := NewWriter(w, f)
+			return err
+		}},
+		{"Writing more sample data than the sample count needs should result in an error", func(w io.Writer) error {
+			wr, err := NewWriter(w, format)
+			if err != nil {
+				return nil
+			}
+			return wr.WriteSamples(make([]byte, 2*4096+1))
+		}},
+		{"Writing less sample data than the sample count needs should result in an error", func(w io.Writer) error {
+			f := format
+			f.SampleCount = 4096*8 + 1000
+			wr, err := NewWriter(w, f)
+			if err != nil {
+				return nil
+			}
+			if err := wr.WriteSamples(make([]byte, 100)); err != nil {
+				return nil
+			}
+			return wr.Close()
+		}},
+		{"Setting the metadata after the sample data for an io.Writer should result in an error", func(w io.Writer) error {
+			wr, err := NewWriter(w, format)
+			if err != nil {
+				return nil
+			}
+			if err := wr.WriteSamples(make([]byte, 2*4096)); err != nil {
+				return nil
+			}
+			return wr.SetMetadata([]byte("ID3"))
+		}},
+		{"Setting metadata that is not an ID3v2 tag should result in an error", func(w io.Writer) error {
+			wr, err := NewWriter(w, format)
+			if err != nil {
+				return nil
+			}
+			return wr.SetMetadata([]byte("APETAGEX junk bytes"))
+		}},
+		{"Writing sample data after closing should result in an error", func(w io.Writer) error {
+			wr, err := NewWriter(w, format)
+			if err != nil {
+				return nil
+			}
+			if err := wr.WriteSamples(make([]byte, 2*4096)); err != nil {
+				return nil
+			}
+			if err := wr.Close(); err != nil {
+				return nil
+			}
+			return wr.WriteSamples(make([]byte, 1))
+		}},
+	}
+	for i, test := range tests {
+		if err := test.run(new(bytes.Buffer)); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", i+1, test.description)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
+
+// Encoding should write the file in a single pass, so that it can be decoded
+// from the other end of a pipe as it is written
+func TestEncodeSinglePass(t *testing.T) {
+	c, err := ioutil.ReadFile("test/valid_with_metadata.dsf")
+	if err != nil {
+		t.Fatalf("FAIL Test 1: Reading the test file:\n%v", err.Error())
+	}
+	a, err := Decode(bytes.NewReader(c), nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: Decoding the test file:\n%v", err.Error())
+	}
+
+	description := "Encoding to a pipe should give a file that can be decoded from the pipe"
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(Encode(a, w, nil, WithRawMetadata()))
+	}()
+	actual, err := Decode(r, nil, WithStrictness(Strict))
+	r.Close()
+	if err != nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	} else if !reflect.DeepEqual(actual, a) {
+		t.Errorf("FAIL Test 1: %v:\nWant: %+v\nActual: %+v", description, a, actual)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "Encoding audio that cannot be encoded should write nothing"
+	var b bytes.Buffer
+	a.SamplingFrequency = 44100
+	if err := Encode(a, &b, nil); err == nil || b.Len() != 0 {
+		t.Errorf("FAIL Test 2: %v:\nWant: an error and 0 bytes\nActual: %v and %v bytes", description, err, b.Len())
+	} else {
+		t.Logf("PASS Test 2: %v:\n%v", description, err.Error())
+	}
+}
+
+// Table structure for a single encoding options test
+type encodeOptionsTest struct {
+	// Description for the test
+	description string
+	// Modification to make to mono audio of 1000 samples, with no block size
+	// set
+	modify func(a *audio.Audio)
+	// Options to encode with
+	opts []Option
+	// Check the encoded file, returning what was expected if it is wrong, or
+	// nil to expect an error
+	check func(b []byte) string
+}
+
+// checkEncoded returns a check of the block size, and the padding of the final
+// block, of an encoded file
+func checkEncoded(blockSize int, pad byte) func(b []byte) string {
+	return func(b []byte) string {
+		want := fmt.Sprintf("block size %v padded with %#x", blockSize, pad)
+		padding := b[len(b)-blockSize+125:]
+		if binary.LittleEndian.Uint32(b[fmtChunkOffset+fmtBlockSizeOffset:]) != uint32(blockSize) ||
+			len(b) != dsdChunkSize+fmtChunkSize+dataChunkSize+blockSize || !bytes.Equal(padding, bytes.Repeat([]byte{pad}, len(padding))) {
+			return want
+		}
+		return ""
+	}
+}
+
+// Table of all encoding options tests
+var encodeOptionsTests = []encodeOptionsTest{
+	{"Encoding by default should use blocks of 4096 bytes padded with DSD silence", nil, nil, checkEncoded(4096, SilencePadByte)},
+	{"Encoding with a block size should use it when the audio does not set one", nil, []Option{WithBlockSize(8192)}, checkEncoded(8192, SilencePadByte)},
+	{"Encoding with a block size should not override that set by the audio", func(a *audio.Audio) { a.BlockSize = 4096 }, []Option{WithBlockSize(8192)}, checkEncoded(4096, SilencePadByte)},
+	{"Encoding with a pad byte should pad the final block for each channel with it", nil, []Option{WithPadByte(0x96)}, checkEncoded(4096, 0x96)},
+	{"Encoding with a pad byte of zero should pad the final block for each channel with zero", nil, []Option{WithPadByte(0)}, checkEncoded(4096, 0)},
+	{"Encoding strictly should reject a nonstandard block size", nil, []Option{WithBlockSize(8192), WithStrictness(Strict)}, nil},
+	{"Encoding should reject an invalid block size", nil, []Option{WithBlockSize(5000), WithStrictness(Permissive)}, nil},
+	{"Encoding should reject a nonstandard sampling frequency", func(a *audio.Audio) { a.SamplingFrequency = 3000000 }, nil, nil},
+	{"Encoding permissively should permit a nonstandard sampling frequency", func(a *audio.Audio) { a.SamplingFrequency = 3000000 }, []Option{WithStrictness(Permissive)},
+		func(b []byte) string {
+			if binary.LittleEndian.Uint32(b[fmtChunkOffset+fmtSamplingFrequencyOffset:]) != 3000000 {
+				return "sampling frequency 3000000"
+			}
+			return ""
+		}},
+	{"Encoding with any frequency should permit a nonstandard sampling frequency", func(a *audio.Audio) { a.SamplingFrequency = 3000000 }, []Option{WithAnyFrequency()}, checkEncoded(4096, SilencePadByte)},
+	{"Encoding with any frequency should reject a sampling frequency below the minimum", func(a *audio.Audio) { a.SamplingFrequency = 44100 }, []Option{WithAnyFrequency()}, nil},
+	{"Encoding strictly should permit a sampling frequency defined by the specification", func(a *audio.Audio) { a.SamplingFrequency = 5644800 }, []Option{WithStrictness(Strict)}, checkEncoded(4096, SilencePadByte)},
+	{"Encoding strictly should reject a sampling frequency not defined by the specification", func(a *audio.Audio) { a.SamplingFrequency = 11289600 }, []Option{WithStrictness(Strict)}, nil},
+	{"Encoding strictly should reject a nonstandard sampling frequency even with any frequency", func(a *audio.Audio) { a.SamplingFrequency = 3000000 }, []Option{WithStrictness(Strict), WithAnyFrequency()}, nil},
+	{"Encoding should reject metadata that is not an ID3v2 tag", func(a *audio.Audio) { a.Metadata = []byte("not a tag") }, nil, nil},
+	{"Encoding permissively should permit metadata that is not an ID3v2 tag", func(a *audio.Audio) { a.Metadata = []byte("not a tag") }, []Option{WithStrictness(Permissive)},
+		func(b []byte) string {
+			if !bytes.HasSuffix(b, []byte("not a tag")) {
+				return "metadata not a tag"
+			}
+			return ""
+		}},
+	{"Encoding should permit a DSD512 sampling frequency", func(a *audio.Audio) { a.SamplingFrequency = 22579200 }, nil, checkEncoded(4096, SilencePadByte)},
+	{"Encoding should permit a 48 kHz family sampling frequency", func(a *audio.Audio) { a.SamplingFrequency = 6144000 }, nil, checkEncoded(4096, SilencePadByte)},
+}
+
+// Run all encoding options tests, checking that each option affects the bytes
+// written
+func TestEncodeOptions(t *testing.T) {
+	for i, test := range encodeOptionsTests {
+		a := audio.Audio{NumChannels: 1, ChannelOrder: paddingChannelOrders[0], SamplingFrequency: 2822400, BitsPerSample: 1,
+			SampleCount: 1000, EncodedSamples: bytes.Repeat([]byte{0x55}, 125)}
+		if test.modify != nil {
+			test.modify(&a)
+		}
+		var b bytes.Buffer
+		err := Encode(&a, &b, nil, test.opts...)
+		switch {
+		case test.check == nil && err == nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", i+1, test.description)
+		case test.check != nil && err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case test.check != nil && test.check(b.Bytes()) != "":
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: % x", i+1, test.description, test.check(b.Bytes()), b.Bytes()[:dataChunkOffset])
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+
+	description := "Encoding with a logger should log the fields of each chunk to it"
+	var log bytes.Buffer
+	a := audio.Audio{NumChannels: 1, ChannelOrder: paddingChannelOrders[0], SamplingFrequency: 2822400, BitsPerSample: 1, EncodedSamples: make([]byte, 4096)}
+	logger := slog.New(slog.NewTextHandler(&log, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if err := Encode(&a, io.Discard, nil, WithLogger(logger)); err != nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", len(encodeOptionsTests)+1, description, err.Error())
+	} else if s := log.String(); !strings.Contains(s, "chunk=dsd") || !strings.Contains(s, "chunk=fmt") || !strings.Contains(s, "chunk=data") {
+		t.Errorf("FAIL Test %v: %v:\nWant: the dsd, fmt and data chunks\nActual: %v", len(encodeOptionsTests)+1, description, s)
+	} else {
+		t.Logf("PASS Test %v: %v", len(encodeOptionsTests)+1, description)
+	}
+}
+
+// Encoding should report progress whilst the sample data and metadata are
+// written, ending with the total file size
+func TestEncodeProgress(t *testing.T) {
+	description := "Encoding should report progress up to the total file size"
+	a, err := Decode(bytes.NewReader(newParallelFile()), nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	var calls [][2]uint64
+	var b bytes.Buffer
+	err = Encode(a, &b, nil, WithProgress(func(written, total uint64) {
+		calls = append(calls, [2]uint64{written, total})
+	}))
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\nWant: nil\nActual: %v", description, err.Error())
+	}
+	total := uint64(b.Len())
+	ok := len(calls) > 5 && calls[len(calls)-1] == [2]uint64{total, total}
+	for i, call := range calls {
+		ok = ok && call[1] == total && call[0] > dsdChunkSize+fmtChunkSize+dataChunkSize && (i == 0 || call[0] >= calls[i-1][0])
+	}
+	if !ok {
+		t.Errorf("FAIL Test 1: %v:\nWant: increasing up to %v of %v\nActual: %v", description, total, total, calls)
+	} else {
+		t.Logf("PASS Test 1: %v: %v calls", description, len(calls))
+	}
+}
+
+// shortWriter is an io.Writer that silently drops the last byte of each write,
+// without returning an error.
+type shortWriter struct {
+	bytes.Buffer
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return s.Buffer.Write(p[:len(p)-1])
+}
+
+func TestEncodeCount(t *testing.T) {
+	description := "EncodeCount should return the number of bytes written"
+	a, err := Decode(bytes.NewReader(newParallelFile()), nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: %v:\n%v", description, err.Error())
+	}
+	var b bytes.Buffer
+	n, err := EncodeCount(a, &b, nil)
+	total := int64(binary.LittleEndian.Uint64(b.Bytes()[12:20]))
+	if err != nil || n != int64(b.Len()) || n != total {
+		t.Errorf("FAIL Test 1: %v:\nWant: %v, %v, nil\nActual: %v, %v, %v", description, b.Len(), b.Len(), n, total, err)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "EncodeCount should return an error if the bytes written do not match the total file size"
+	var s shortWriter
+	n, err = EncodeCount(a, &s, nil)
+	if err == nil || !strings.Contains(err.Error(), "total file size") || n != int64(s.Len()) {
+		t.Errorf("FAIL Test 2: %v:\nWant: %v, total file size error\nActual: %v, %v", description, s.Len(), n, err)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	description = "Writer should return an error if the bytes written do not match the total file size"
+	info := Info{NumChannels: a.NumChannels, ChannelOrder: a.ChannelOrder, SamplingFrequency: a.SamplingFrequency,
+		BitsPerSample: a.BitsPerSample, BlockSize: a.BlockSize, SampleCount: a.SampleCount}
+	s.Reset()
+	wr, err := NewWriter(&s, info)
+	if err == nil {
+		if err = wr.WriteSamples(a.EncodedSamples); err == nil {
+			err = wr.Close()
+		}
+	}
+	if err == nil || !strings.Contains(err.Error(), "total file size") {
+		t.Errorf("FAIL Test 3: %v:\nWant: total file size error\nActual: %v", description, err)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+}
+
+// An Encoder should encode files of different sizes back to back, each the same
+// as if encoded alone, without any of the sizes or metadata pointer of one
+// leaking into the next
+func TestEncoder(t *testing.T) {
+	large, err := Decode(bytes.NewReader(newTestFile(2, 2, 3*4096*8, 2*3*4096, make([]byte, 2*3*4096),
+		id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x00Title"))))), nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: Decoding the large file:\n%v", err.Error())
+	}
+	small, err := Decode(bytes.NewReader(newTestFile(1, 1, 1000, 4096, make([]byte, 4096), nil)), nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: Decoding the small file:\n%v", err.Error())
+	}
+	invalid := &audio.Audio{Encoding: audio.DSD, NumChannels: 1, BitsPerSample: 1, SamplingFrequency: 44100}
+
+	enc := NewEncoder()
+	tests := []struct {
+		description string
+		audio       *audio.Audio
+		reset       bool
+	}{
+		{"Encoding a large file with metadata should give the same file as Encode", large, false},
+		{"Encoding a small file without metadata next should give the same file as Encode", small, false},
+		{"Encoding the large file again should give the same file as Encode", large, false},
+		{"Encoding audio that cannot be encoded should result in an error", invalid, false},
+		{"Encoding the small file after a failure and a reset should give the same file as Encode", small, true},
+	}
+	for i, test := range tests {
+		if test.reset {
+			enc.Reset()
+		}
+		var want, actual bytes.Buffer
+		wantErr := Encode(test.audio, &want, nil)
+		err := enc.Encode(test.audio, &actual)
+		if wantErr != nil {
+			if err == nil || actual.Len() != 0 {
+				t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v and %v bytes", i+1, test.description, wantErr, err, actual.Len())
+			} else {
+				t.Logf("PASS Test %v: %v:\n%v", i+1, test.description, err.Error())
+			}
+			continue
+		}
+		decoded, decodeErr := Decode(bytes.NewReader(actual.Bytes()), nil, WithStrictness(Strict))
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case !bytes.Equal(actual.Bytes(), want.Bytes()):
+			t.Errorf("FAIL Test %v: %v:\nWant: the %v bytes written by Encode\nActual: %v different bytes", i+1, test.description, want.Len(), actual.Len())
+		case decodeErr != nil || !reflect.DeepEqual(decoded, test.audio):
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v, %v", i+1, test.description, test.audio, decoded, decodeErr)
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// Encoding with a context should stop early once it is done, returning the
+// number of bytes already written
+func TestEncodeContext(t *testing.T) {
+	a, err := Decode(bytes.NewReader(newParallelFile()), nil)
+	if err != nil {
+		t.Fatalf("FAIL Test 1: Decoding the test file:\n%v", err.Error())
+	}
+	var want bytes.Buffer
+	if err := Encode(a, &want, nil); err != nil {
+		t.Fatalf("FAIL Test 1: Encoding the test file:\n%v", err.Error())
+	}
+
+	description := "Encoding with a context that is never done should give the same file as Encode"
+	var b bytes.Buffer
+	n, err := EncodeContext(context.Background(), a, &b, nil)
+	if err != nil || n != int64(want.Len()) || !bytes.Equal(b.Bytes(), want.Bytes()) {
+		t.Errorf("FAIL Test 1: %v:\nWant: %v bytes, nil\nActual: %v bytes, %v", description, want.Len(), n, err)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "Encoding with a context that is already done should write nothing"
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b.Reset()
+	n, err = EncodeContext(ctx, a, &b, nil)
+	if !errors.Is(err, context.Canceled) || n != 0 || b.Len() != 0 {
+		t.Errorf("FAIL Test 2: %v:\nWant: 0 bytes, %v\nActual: %v bytes, %v", description, context.Canceled, n, err)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	description = "Encoding with a context that is done part way through the sample data should stop within 1 MB"
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	b.Reset()
+	n, err = EncodeContext(ctx, a, &b, nil, WithProgress(func(written, total uint64) { cancel() }))
+	if !errors.Is(err, context.Canceled) || n != int64(b.Len()) || n != dsdChunkSize+fmtChunkSize+dataChunkSize+progressInterval {
+		t.Errorf("FAIL Test 3: %v:\nWant: %v bytes, %v\nActual: %v bytes of %v written, %v", description,
+			dsdChunkSize+fmtChunkSize+dataChunkSize+progressInterval, context.Canceled, n, b.Len(), err)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+}
+
+// Encode writes the sample data in pieces without copying it, so should make
+// the same number of allocations whatever the size of the file
+func BenchmarkEncode(b *testing.B) {
+	for _, mb := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("%vMB", mb), func(b *testing.B) {
+			// Stereo ending part way through a block, to be padded
+			samples := make([]byte, mb<<20-100)
+			a := &audio.Audio{Encoding: audio.DSD, NumChannels: 2, ChannelOrder: paddingChannelOrders[1],
+				SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096, EncodedSamples: samples}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(samples)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := Encode(a, ioutil.Discard, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Trim returns a new Audio holding the samples of each channel from start up
+// to end, without transcoding, with the metadata carried over unchanged. The
+// samples are rebuilt as blocks of BlockSize bytes for each channel in turn,
+// with the final block for each channel padded with Silence, and SampleCount
+// is set to suit. For 1 bit per sample the cuts round to the nearest byte i.e.
+// 8 samples, about 2.8 µs for DSD64. It is an error if start is not before end
+// or the range is beyond the end of the audio.
+func (a *Audio) Trim(start, end time.Duration) (*Audio, error) {
+	if a.SamplingFrequency == 0 || (a.BitsPerSample != 1 && a.BitsPerSample != 8) {
+		return nil, fmt.Errorf("audio: cannot trim audio of %v Hz and %v bits per sample", a.SamplingFrequency, a.BitsPerSample)
+	}
+	if start < 0 || start >= end {
+		return nil, fmt.Errorf("audio: cannot trim from %v to %v", start, end)
+	}
+	sampleCount := a.sampleCount()
+	if duration := a.Duration(); end > duration {
+		return nil, fmt.Errorf("audio: cannot trim from %v to %v of audio lasting %v", start, end, duration)
+	}
+
+	// Sample offsets rounded to the nearest byte, within the samples
+	perByte := uint64(8 / a.BitsPerSample)
+	first := (a.samplesAt(start) + perByte/2) / perByte
+	last := (a.samplesAt(end) + perByte/2) / perByte
+	count := min(last*perByte, sampleCount) - min(first*perByte, sampleCount)
+	if count == 0 {
+		return nil, fmt.Errorf("audio: cannot trim from %v to %v as it is less than a byte of samples", start, end)
+	}
+
+	channels, err := a.Deinterleave()
+	if err != nil {
+		return nil, err
+	}
+	for c, channel := range channels {
+		channels[c] = channel[first:min(last, uint64(len(channel)))]
+	}
+	return a.withChannels(channels, count)
+}
+
+// samplesAt returns the number of samples per channel in the duration d,
+// rounded to the nearest sample.
+func (a *Audio) samplesAt(d time.Duration) uint64 {
+	f := uint64(a.SamplingFrequency)
+
+	// Split into whole seconds and a remainder to avoid overflow
+	seconds, remainder := uint64(d/time.Second), uint64(d%time.Second)
+	return seconds*f + (remainder*f+uint64(time.Second)/2)/uint64(time.Second)
+}
+
+// withChannels returns a new Audio of the same format and metadata as a, with
+// the samples for each channel interleaved into blocks padded with Silence, or
+// with zero for 8 bits per sample, and the given sample count. NumChannels is
+// set to the number of channels, but the channel order is that of a.
+func (a *Audio) withChannels(channels [][]byte, sampleCount uint64) (*Audio, error) {
+	b := &Audio{
+		Encoding:          a.Encoding,
+		NumChannels:       a.NumChannels,
+		ChannelOrder:      slices.Clone(a.ChannelOrder),
+		SamplingFrequency: a.SamplingFrequency,
+		BitsPerSample:     a.BitsPerSample,
+		BlockSize:         a.BlockSize,
+		Metadata:          bytes.Clone(a.Metadata),
+		Tags:              a.Tags.clone(),
+	}
+	pad := byte(0)
+	if b.BitsPerSample == 1 {
+		pad = Silence
+	}
+	if err := b.interleave(channels, pad); err != nil {
+		return nil, err
+	}
+	b.SampleCount = sampleCount
+	return b, nil
+}
+
+// Concat returns a new Audio holding the samples of each part in turn, as for
+// gapless playback, without transcoding. The parts must share the encoding,
+// sampling frequency, bits per sample, number of channels and channel order.
+// The padding of each part is dropped, so for 1 bit per sample a part ending
+// part way through a byte is joined to the next part at that bit. The samples
+// are rebuilt as blocks of the BlockSize of the first part for each channel in
+// turn, with the final block for each channel padded with Silence. The
+// metadata of the first part is kept; see ConcatWithoutMetadata.
+func Concat(parts ...*Audio) (*Audio, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("audio: nothing to concatenate")
+	}
+	first := parts[0]
+	for i, part := range parts[1:] {
+		var field string
+		var want, actual interface{}
+		switch {
+		case part.Encoding != first.Encoding:
+			field, want, actual = "encoding", first.Encoding, part.Encoding
+		case part.SamplingFrequency != first.SamplingFrequency:
+			field, want, actual = "sampling frequency", first.SamplingFrequency, part.SamplingFrequency
+		case part.BitsPerSample != first.BitsPerSample:
+			field, want, actual = "bits per sample", first.BitsPerSample, part.BitsPerSample
+		case part.NumChannels != first.NumChannels:
+			field, want, actual = "number of channels", first.NumChannels, part.NumChannels
+		case !slices.Equal(part.ChannelOrder, first.ChannelOrder):
+			field, want, actual = "channel order", first.ChannelOrder, part.ChannelOrder
+		default:
+			continue
+		}
+		return nil, fmt.Errorf("audio: part %v has %v %v but part 0 has %v", i+1, field, actual, want)
+	}
+	if first.BitsPerSample != 1 && first.BitsPerSample != 8 {
+		return nil, fmt.Errorf("audio: cannot concatenate audio of %v bits per sample", first.BitsPerSample)
+	}
+
+	// Append the samples of each part to each channel
+	var channels [][]byte
+	var sampleCount uint64
+	for i, part := range parts {
+		samples, err := part.Deinterleave()
+		if err != nil {
+			return nil, fmt.Errorf("%v in part %v", err, i)
+		}
+		count := part.sampleCount()
+		if channels == nil {
+			channels = make([][]byte, len(samples))
+		}
+		for c := range channels {
+			if first.BitsPerSample == 1 {
+				channels[c] = appendBits(channels[c], sampleCount, samples[c], count)
+			} else {
+				channels[c] = append(channels[c], samples[c][:count]...)
+			}
+		}
+		sampleCount += count
+	}
+	if sampleCount == 0 {
+		return nil, fmt.Errorf("audio: no samples to concatenate")
+	}
+	return first.withChannels(channels, sampleCount)
+}
+
+// ConcatWithoutMetadata is Concat without keeping the metadata and tags of the
+// first part.
+func ConcatWithoutMetadata(parts ...*Audio) (*Audio, error) {
+	a, err := Concat(parts...)
+	if err != nil {
+		return nil, err
+	}
+	a.Metadata, a.Tags = nil, nil
+	return a, nil
+}
+
+// appendBits appends the first n bits of src to the first m bits of dst, with
+// the first bit in the least significant bit of each byte, returning dst with
+// any unused bits of its final byte cleared.
+func appendBits(dst []byte, m uint64, src []byte, n uint64) []byte {
+	dst = dst[:(m+7)/8]
+	src = src[:(n+7)/8]
+	if shift := m % 8; shift == 0 {
+		dst = append(dst, src...)
+	} else {
+		for _, b := range src {
+			dst[len(dst)-1] |= b << shift
+			dst = append(dst, b>>(8-shift))
+		}
+		dst = dst[:(m+n+7)/8]
+	}
+	if used := (m + n) % 8; used != 0 {
+		dst[len(dst)-1] &= 1<<used - 1
+	}
+	return dst
+}
+
+// SplitChannels returns a new mono Audio for each channel, in the channel
+// order, each with the same format and metadata and that channel as its
+// channel order, if the channel order is set. The samples are rebuilt as
+// blocks of BlockSize bytes padded with Silence, as by Trim.
+func (a *Audio) SplitChannels() ([]*Audio, error) {
+	channels, err := a.Deinterleave()
+	if err != nil {
+		return nil, err
+	}
+	split := make([]*Audio, len(channels))
+	for c, channel := range channels {
+		if split[c], err = a.withChannels([][]byte{channel}, a.sampleCount()); err != nil {
+			return nil, err
+		}
+		if len(a.ChannelOrder) == len(channels) {
+			split[c].ChannelOrder = []Channel{a.ChannelOrder[c]}
+		}
+	}
+	return split, nil
+}
+
+// ExtractChannel returns a new mono Audio of the given channel as
+// SplitChannels does. It is an error if the channel is not in the channel
+// order.
+func (a *Audio) ExtractChannel(c Channel) (*Audio, error) {
+	i := slices.Index(a.ChannelOrder, c)
+	if i < 0 || uint(len(a.ChannelOrder)) != a.NumChannels {
+		return nil, fmt.Errorf("audio: no %v channel in channel order %v", c, a.ChannelOrder)
+	}
+	// Only the blocks of the channel are read
+	blocks, size, err := a.blockLayout()
+	if err != nil {
+		return nil, err
+	}
+	channel := make([]byte, 0, size)
+	r := a.Samples()
+	var buf []byte
+	for index := 0; uint64(index) < blocks; index++ {
+		block, err := a.block(r, buf, i, index, size)
+		if err != nil {
+			return nil, err
+		}
+		channel = append(channel, block.Samples[:block.Size]...)
+		buf = block.Samples
+	}
+	b, err := a.withChannels([][]byte{channel}, a.sampleCount())
+	if err != nil {
+		return nil, err
+	}
+	b.ChannelOrder = []Channel{c}
+	return b, nil
+}
+
+// MergeChannels returns a new Audio with the given channel order holding the
+// samples of each mono Audio as the channel at the same position, which is the
+// inverse of SplitChannels. The channels must share the encoding, sampling
+// frequency, bits per sample and sample count, and the channel order must not
+// repeat a channel, but may be nil to leave it unset. The samples are rebuilt
+// as blocks of the BlockSize of the first channel for each channel in turn,
+// with the final block for each channel padded with Silence, and the metadata
+// of the first channel is kept.
+func MergeChannels(order []Channel, channels ...*Audio) (*Audio, error) {
+	return mergeChannels(order, channels, false)
+}
+
+// MergeChannelsPadded is MergeChannels, but channels with fewer samples than
+// the longest are padded with Silence to its sample count, as long as they are
+// short by no more than one block.
+func MergeChannelsPadded(order []Channel, channels ...*Audio) (*Audio, error) {
+	return mergeChannels(order, channels, true)
+}
+
+// mergeChannels implements MergeChannels and MergeChannelsPadded.
+func mergeChannels(order []Channel, channels []*Audio, padded bool) (*Audio, error) {
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("audio: no channels to merge")
+	}
+	if order != nil && len(order) != len(channels) {
+		return nil, fmt.Errorf("audio: channel order %v does not match the %v channels to merge", order, len(channels))
+	}
+	if _, err := OrderToMask(order); err != nil {
+		return nil, err
+	}
+	first := channels[0]
+	if first.BitsPerSample != 1 && first.BitsPerSample != 8 {
+		return nil, fmt.Errorf("audio: cannot merge audio of %v bits per sample", first.BitsPerSample)
+	}
+
+	// Longest sample count, and the most samples a channel may be short by
+	sampleCount := uint64(0)
+	for _, a := range channels {
+		sampleCount = max(sampleCount, a.sampleCount())
+	}
+	var slack uint64
+	if padded {
+		slack = uint64(first.BlockSize) * 8 / uint64(first.BitsPerSample)
+	}
+
+	samples := make([][]byte, len(channels))
+	for i, a := range channels {
+		var field string
+		var want, actual interface{}
+		switch {
+		case a.NumChannels != 1:
+			field, want, actual = "number of channels", 1, a.NumChannels
+		case a.Encoding != first.Encoding:
+			field, want, actual = "encoding", first.Encoding, a.Encoding
+		case a.SamplingFrequency != first.SamplingFrequency:
+			field, want, actual = "sampling frequency", first.SamplingFrequency, a.SamplingFrequency
+		case a.BitsPerSample != first.BitsPerSample:
+			field, want, actual = "bits per sample", first.BitsPerSample, a.BitsPerSample
+		case a.sampleCount()+slack < sampleCount:
+			field, want, actual = "sample count", sampleCount, a.sampleCount()
+		}
+		if field != "" {
+			return nil, fmt.Errorf("audio: channel %v has %v %v but expected %v", i, field, actual, want)
+		}
+
+		channel, err := a.Deinterleave()
+		if err != nil {
+			return nil, fmt.Errorf("%v in channel %v", err, i)
+		}
+		samples[i] = channel[0]
+		if count := a.sampleCount(); count < sampleCount {
+			if a.BitsPerSample == 1 {
+				silence := bytes.Repeat([]byte{Silence}, int(sampleCount-count+7)/8)
+				samples[i] = appendBits(samples[i], count, silence, sampleCount-count)
+			} else {
+				samples[i] = append(samples[i][:count], make([]byte, sampleCount-count)...)
+			}
+		}
+	}
+
+	b, err := first.withChannels(samples, sampleCount)
+	if err != nil {
+		return nil, err
+	}
+	b.ChannelOrder = slices.Clone(order)
+	return b, nil
+}
+
+// RemapChannels reorders the channels to newOrder, which must hold the same
+// channels as the channel order in any order, permuting the blocks for each
+// channel in place and setting ChannelOrder. For example a recording in the
+// order front left, back left, front right, back right may be remapped to
+// front left, front right, back left, back right, the order of a DSD stream
+// file of 4 channels. If the encoded samples end with the final sample of the
+// last channel rather than with its padding then they are padded first, with
+// Silence, or with zero for 8 bits per sample.
+func (a *Audio) RemapChannels(newOrder []Channel) error {
+	if uint(len(a.ChannelOrder)) != a.NumChannels || a.BlockSize == 0 {
+		return fmt.Errorf("audio: cannot remap channel order %v of %v channels of %v byte blocks", a.ChannelOrder, a.NumChannels, a.BlockSize)
+	}
+	mask, err := OrderToMask(newOrder)
+	if err != nil {
+		return err
+	}
+	if current, err := OrderToMask(a.ChannelOrder); err != nil || current != mask || len(newOrder) != len(a.ChannelOrder) {
+		return fmt.Errorf("audio: channel order %v is not a reordering of %v", newOrder, a.ChannelOrder)
+	}
+
+	if err := a.loadSection(); err != nil {
+		return err
+	}
+
+	// Position in the current order of each channel in the new order
+	perm := make([]int, len(newOrder))
+	for i, c := range newOrder {
+		perm[i] = slices.Index(a.ChannelOrder, c)
+	}
+
+	// Buffers that are each one block can be permuted without copying
+	blockSize := int(a.BlockSize)
+	if a.EncodedBlocks != nil && len(a.EncodedBlocks)%len(perm) == 0 &&
+		!slices.ContainsFunc(a.EncodedBlocks, func(b []byte) bool { return len(b) != blockSize }) {
+		group := make([][]byte, len(perm))
+		for offset := 0; offset < len(a.EncodedBlocks); offset += len(perm) {
+			copy(group, a.EncodedBlocks[offset:])
+			for i, p := range perm {
+				a.EncodedBlocks[offset+i] = group[p]
+			}
+		}
+		a.ChannelOrder = slices.Clone(newOrder)
+		return nil
+	}
+
+	// Otherwise the samples are permuted as one slice, padded to whole blocks
+	groupSize := len(perm) * blockSize
+	samples := a.EncodedSamples
+	if a.EncodedBlocks != nil {
+		samples = slices.Concat(a.EncodedBlocks...)
+	}
+	if len(samples)%groupSize != 0 {
+		if a.SampleCount == 0 || a.validateSize() != nil {
+			return fmt.Errorf("audio: %v bytes of samples is not a whole number of %v byte blocks for %v channels", len(samples), a.BlockSize, a.NumChannels)
+		}
+		pad := byte(0)
+		if a.BitsPerSample == 1 {
+			pad = Silence
+		}
+		samples = append(samples, bytes.Repeat([]byte{pad}, groupSize-len(samples)%groupSize)...)
+	}
+	group := make([]byte, groupSize)
+	for offset := 0; offset < len(samples); offset += groupSize {
+		copy(group, samples[offset:])
+		for i, p := range perm {
+			copy(samples[offset+i*blockSize:], group[p*blockSize:(p+1)*blockSize])
+		}
+	}
+	a.EncodedSamples, a.EncodedBlocks = samples, nil
+	a.ChannelOrder = slices.Clone(newOrder)
+	return nil
+}
+
+// InvertPolarity inverts the polarity of the given channels, or of every
+// channel if none are given, in place. For 1 bit per sample every sample bit
+// is inverted, and for 8 bits per sample each sample of 0 becomes 1 and any
+// other becomes 0. Only the samples are changed, not the padding of the final
+// block for each channel. It is an error if a channel is not in the channel
+// order.
+func (a *Audio) InvertPolarity(channels ...Channel) error {
+	if a.NumChannels == 0 || a.BlockSize == 0 || (a.BitsPerSample != 1 && a.BitsPerSample != 8) {
+		return fmt.Errorf("audio: cannot invert %v channels of %v byte blocks and %v bits per sample", a.NumChannels, a.BlockSize, a.BitsPerSample)
+	}
+	selected := make([]bool, a.NumChannels)
+	for _, c := range channels {
+		i := slices.Index(a.ChannelOrder, c)
+		if i < 0 || i >= len(selected) {
+			return fmt.Errorf("audio: no %v channel in channel order %v", c, a.ChannelOrder)
+		}
+		selected[i] = true
+	}
+	if len(channels) == 0 {
+		for i := range selected {
+			selected[i] = true
+		}
+	}
+	if err := a.loadSection(); err != nil {
+		return err
+	}
+
+	// Number of bytes of samples for each channel, and the bits of the final
+	// byte that are used
+	count := a.sampleCount()
+	size, used := count, byte(1)
+	if a.BitsPerSample == 1 {
+		size, used = (count+7)/8, byte(1<<(count%8)-1)
+	}
+
+	// Walk the samples a run of one block at most at a time, as the buffers of
+	// EncodedBlocks need not line up with the blocks
+	buffers := a.EncodedBlocks
+	if buffers == nil {
+		buffers = [][]byte{a.EncodedSamples}
+	}
+	blockSize := uint64(a.BlockSize)
+	groupSize := uint64(a.NumChannels) * blockSize
+	var position uint64
+	for _, b := range buffers {
+		for k := uint64(0); k < uint64(len(b)); {
+			within := (position + k) % groupSize
+			n := min(blockSize-within%blockSize, uint64(len(b))-k)
+			if selected[within/blockSize] {
+				// Offset in the channel of the start of the run
+				offset := (position+k)/groupSize*blockSize + within%blockSize
+				for i := uint64(0); i < n && offset+i < size; i++ {
+					switch {
+					case a.BitsPerSample == 8 && b[k+i] == 0:
+						b[k+i] = 1
+					case a.BitsPerSample == 8:
+						b[k+i] = 0
+					case offset+i == size-1 && used != 0:
+						b[k+i] ^= used
+					default:
+						b[k+i] ^= 0xff
+					}
+				}
+			}
+			k += n
+		}
+		position += uint64(len(b))
+	}
+	return nil
+}
@@ -0,0 +1,464 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// editAudio returns stereo audio at 8 kHz, so 1 ms is a byte of samples for
+// each channel, of 10 bytes per channel in blocks of 4 bytes with the final
+// byte part used. Byte i of the front left channel is i, and of the front
+// right channel is 0x80+i.
+func editAudio() *Audio {
+	channels := [][]byte{make([]byte, 10), make([]byte, 10)}
+	for i := range channels[0] {
+		channels[0][i], channels[1][i] = byte(i), byte(0x80+i)
+	}
+	a := &Audio{Encoding: DSD, ChannelOrder: []Channel{FrontLeft, FrontRight}, SamplingFrequency: 8000, BitsPerSample: 1, BlockSize: 4,
+		Metadata: []byte("ID3\x03\x00\x00\x00\x00\x00\x00"), Tags: &Tags{Title: "Title"}}
+	a.Interleave(channels)
+	a.SampleCount = 10*8 - 3
+	return a
+}
+
+// checkChannels returns whether the audio holds the given samples for each
+// channel, with the given sample count, and with each channel padded with
+// Silence to a whole number of blocks.
+func checkChannels(a *Audio, channels [][]byte, sampleCount uint64) bool {
+	actual, err := a.Deinterleave()
+	if err != nil || a.SampleCount != sampleCount || a.NumChannels != uint(len(channels)) || len(actual) != len(channels) {
+		return false
+	}
+	for c := range channels {
+		if !bytes.Equal(actual[c], channels[c]) {
+			return false
+		}
+	}
+	blockSize := int(a.BlockSize)
+	blocks := (len(channels[0]) + blockSize - 1) / blockSize
+	padding := blocks*blockSize - len(channels[0])
+	if a.EncodedSize() != uint64(blocks*len(channels)*blockSize) {
+		return false
+	}
+	for c := range channels {
+		final := ((blocks-1)*len(channels) + c + 1) * blockSize
+		if !bytes.Equal(a.EncodedSamples[final-padding:final], bytes.Repeat([]byte{Silence}, padding)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Table structure for a single trim test
+type trimTest struct {
+	// Description for the test
+	description string
+	// The range to trim to
+	start, end time.Duration
+	// Expected range of bytes of each channel, and sample count
+	first, last int
+	sampleCount uint64
+}
+
+// Table of all trim tests
+var trimTests = []trimTest{
+	{"Trimming whole bytes should keep those bytes", 2 * time.Millisecond, 5 * time.Millisecond, 2, 5, 24},
+	{"Trimming to the end should keep the part used final byte", 7 * time.Millisecond, 9625 * time.Microsecond, 7, 10, 21},
+	{"Trimming the whole audio should keep all of it", 0, 9625 * time.Microsecond, 0, 10, 77},
+	{"Trimming should round to the nearest byte", 2400 * time.Microsecond, 5500 * time.Microsecond, 2, 6, 32},
+	{"Trimming within a block should result in a single padded block", 5 * time.Millisecond, 6 * time.Millisecond, 5, 6, 8},
+}
+
+// Run all trim tests
+func TestTrim(t *testing.T) {
+	a := editAudio()
+	want, _ := a.Deinterleave()
+	for i, test := range trimTests {
+		b, err := a.Trim(test.start, test.end)
+		channels := [][]byte{want[0][test.first:test.last], want[1][test.first:test.last]}
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case !checkChannels(b, channels, test.sampleCount):
+			t.Errorf("FAIL Test %v: %v:\nWant: % x, %v samples\nActual: % x, %v samples", i+1, test.description, channels, test.sampleCount, b.EncodedSamples, b.SampleCount)
+		case !bytes.Equal(b.Metadata, a.Metadata) || b.Tags == a.Tags || !reflect.DeepEqual(b.Tags, a.Tags) || b.Validate() != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: a copy of the metadata and tags\nActual: %q, %v, %v", i+1, test.description, b.Metadata, b.Tags, b.Validate())
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// Table of all trim error tests
+var trimErrorTests = []trimTest{
+	{"Trimming from after the end should result in an error", 5 * time.Millisecond, 2 * time.Millisecond, 0, 0, 0},
+	{"Trimming to the start should result in an error", time.Millisecond, time.Millisecond, 0, 0, 0},
+	{"Trimming from before the start should result in an error", -time.Millisecond, time.Millisecond, 0, 0, 0},
+	{"Trimming beyond the end should result in an error", 0, 11 * time.Millisecond, 0, 0, 0},
+	{"Trimming less than a byte should result in an error", 100 * time.Microsecond, 200 * time.Microsecond, 0, 0, 0},
+}
+
+// Run all trim error tests
+func TestTrimError(t *testing.T) {
+	a := editAudio()
+	for i, test := range trimErrorTests {
+		if b, err := a.Trim(test.start, test.end); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v samples", i+1, test.description, b.SampleCount)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
+
+// unpacked returns a copy of the audio at 8 bits per sample.
+func unpacked(a *Audio) *Audio {
+	b := *a
+	b.UnpackTo8Bit()
+	return &b
+}
+
+// Run all concatenation tests, checking that joins part way through a byte
+// match joining the same audio at 8 bits per sample
+func TestConcat(t *testing.T) {
+	a := editAudio()
+	duration := a.Duration()
+
+	description := "Concatenating trimmed parts should give the original audio"
+	first, _ := a.Trim(0, 3*time.Millisecond)
+	second, _ := a.Trim(3*time.Millisecond, duration)
+	if b, err := Concat(first, second); err != nil || !b.Equal(a) {
+		t.Errorf("FAIL Test 1: %v:\nWant: %v\nActual: %v, %v", description, a, b, err)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "Parts ending part way through a byte should be joined at that bit"
+	parts := []*Audio{editAudio(), editAudio(), first}
+	parts[1].SampleCount = 10*8 - 5
+	b, err := Concat(parts...)
+	want, _ := Concat(unpacked(parts[0]), unpacked(parts[1]), unpacked(parts[2]))
+	if err != nil || b.SampleCount != 77+75+24 || !b.Equal(want) || !checkChannels(b, mustDeinterleave(b), b.SampleCount) {
+		t.Errorf("FAIL Test 2: %v:\nWant: %v\nActual: %v, %v\n%v", description, want, b, err, b.EqualReport(want))
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	description = "The metadata of the first part should be kept unless dropped"
+	first.Metadata, first.Tags = []byte("ID3\x04\x00\x00\x00\x00\x00\x00"), nil
+	b, err = Concat(first, second)
+	c, cerr := ConcatWithoutMetadata(first, second)
+	if err != nil || cerr != nil || !bytes.Equal(b.Metadata, first.Metadata) || b.Tags != nil || c.Metadata != nil || c.Tags != nil {
+		t.Errorf("FAIL Test 3: %v:\nWant: %q then none\nActual: %q, %q, %v, %v", description, first.Metadata, b.Metadata, c.Metadata, err, cerr)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+}
+
+// mustDeinterleave returns the samples for each channel, or nil on error.
+func mustDeinterleave(a *Audio) [][]byte {
+	channels, _ := a.Deinterleave()
+	return channels
+}
+
+// Table structure for a single concatenation error test
+type concatErrorTest struct {
+	// Description for the test
+	description string
+	// Changes to the final part
+	change func(a *Audio)
+	// Expected text in the error
+	text string
+}
+
+// Table of all concatenation error tests, each concatenating three parts
+var concatErrorTests = []concatErrorTest{
+	{"A different encoding should result in an error", func(a *Audio) { a.Encoding = DST }, "part 2 has encoding"},
+	{"A different sampling frequency should result in an error", func(a *Audio) { a.SamplingFrequency = 16000 }, "part 2 has sampling frequency 16000"},
+	{"A different number of bits per sample should result in an error", func(a *Audio) { a.UnpackTo8Bit() }, "part 2 has bits per sample 8"},
+	{"A different number of channels should result in an error", func(a *Audio) { a.NumChannels = 1 }, "part 2 has number of channels 1"},
+	{"A different channel order should result in an error", func(a *Audio) { a.ChannelOrder = []Channel{FrontRight, FrontLeft} }, "part 2 has channel order"},
+	{"Samples that cannot be deinterleaved should result in an error", func(a *Audio) { a.EncodedSamples = a.EncodedSamples[:5] }, "in part 2"},
+}
+
+// Run all concatenation error tests
+func TestConcatError(t *testing.T) {
+	for i, test := range concatErrorTests {
+		parts := []*Audio{editAudio(), editAudio(), editAudio()}
+		test.change(parts[2])
+		if b, err := Concat(parts...); err == nil || !strings.Contains(err.Error(), test.text) {
+			t.Errorf("FAIL Test %v: %v:\nWant: error containing %q\nActual: %v, %v", i+1, test.description, test.text, b, err)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+
+	n := len(concatErrorTests)
+	description := "Concatenating nothing should result in an error"
+	if b, err := Concat(); err == nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v", n+1, description, b)
+	} else {
+		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", n+1, description, err.Error())
+	}
+}
+
+// Run all channel splitting tests, on 3 channels
+func TestSplitChannels(t *testing.T) {
+	a := editAudio()
+	want := mustDeinterleave(a)
+	want = append(want, bytes.Repeat([]byte{0x55}, len(want[0])))
+	a.ChannelOrder = append(a.ChannelOrder, Center)
+	a.Interleave(want)
+	a.SampleCount = 10*8 - 3
+
+	split, err := a.SplitChannels()
+	if err != nil || len(split) != 3 {
+		t.Fatalf("FAIL Test 1: Audio should be split into each channel:\nWant: 3 channels\nActual: %v, %v", len(split), err)
+	}
+	for c, b := range split {
+		description := fmt.Sprintf("Channel %v should be split into mono audio", c)
+		if !checkChannels(b, want[c:c+1], a.SampleCount) || !reflect.DeepEqual(b.ChannelOrder, a.ChannelOrder[c:c+1]) || b.Validate() != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x, %v\nActual: % x, %v, %v", c+1, description, want[c], a.ChannelOrder[c], b.EncodedSamples, b.ChannelOrder, b.Validate())
+		} else {
+			t.Logf("PASS Test %v: %v", c+1, description)
+		}
+
+		description = fmt.Sprintf("Extracting channel %v should match splitting it", c)
+		if e, err := a.ExtractChannel(a.ChannelOrder[c]); err != nil || !reflect.DeepEqual(e, b) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v, %v", c+1, description, b, e, err)
+		} else {
+			t.Logf("PASS Test %v: %v", c+1, description)
+		}
+	}
+
+	description := "Extracting a channel not in the channel order should result in an error"
+	if b, err := a.ExtractChannel(LowFrequency); err == nil {
+		t.Errorf("FAIL Test 4: %v:\nWant: error\nActual: %v", description, b)
+	} else {
+		t.Logf("PASS Test 4: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	description = "Audio without a channel order should be split without one"
+	a.ChannelOrder = nil
+	if split, err := a.SplitChannels(); err != nil || len(split) != 3 || split[2].ChannelOrder != nil || !checkChannels(split[2], want[2:], a.SampleCount) {
+		t.Errorf("FAIL Test 5: %v:\nWant: 3 channels without a channel order\nActual: %v, %v", description, split, err)
+	} else {
+		t.Logf("PASS Test 5: %v", description)
+	}
+}
+
+// Run all channel merging tests
+func TestMergeChannels(t *testing.T) {
+	// Rebuild the stereo audio so that it is padded with silence
+	a, _ := Concat(editAudio())
+	split, _ := a.SplitChannels()
+
+	description := "Merging split channels should give the same samples byte for byte"
+	if b, err := MergeChannels(a.ChannelOrder, split...); err != nil || !bytes.Equal(b.EncodedSamples, a.EncodedSamples) || !reflect.DeepEqual(b, a) {
+		t.Errorf("FAIL Test 1: %v:\nWant: % x\nActual: %v, %v", description, a.EncodedSamples, b, err)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "Merging in a different channel order should swap the channels"
+	want := mustDeinterleave(a)
+	if b, err := MergeChannels(nil, split[1], split[0]); err != nil || b.ChannelOrder != nil || !checkChannels(b, [][]byte{want[1], want[0]}, a.SampleCount) {
+		t.Errorf("FAIL Test 2: %v:\nWant: % x\nActual: %v, %v", description, [][]byte{want[1], want[0]}, b, err)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+
+	description = "A channel short by up to a block should be padded with silence when requested"
+	short, _ := split[1].Trim(0, 6*time.Millisecond)
+	b, err := MergeChannelsPadded(a.ChannelOrder, split[0], short)
+	// The final byte holds only 5 samples, the rest of it being cleared
+	padded := append(append([]byte{}, want[1][:6]...), Silence, Silence, Silence, Silence&0x1f)
+	if err != nil || !checkChannels(b, [][]byte{want[0], padded}, a.SampleCount) {
+		t.Errorf("FAIL Test 3: %v:\nWant: % x\nActual: %v, %v", description, [][]byte{want[0], padded}, b, err)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+}
+
+// Table structure for a single channel merging error test
+type mergeErrorTest struct {
+	// Description for the test
+	description string
+	// Channel order, and changes to the second channel
+	order  []Channel
+	change func(a *Audio)
+	// Whether to pad short channels
+	padded bool
+}
+
+// Table of all channel merging error tests, each merging two channels
+var mergeErrorTests = []mergeErrorTest{
+	{"A channel order of the wrong length should result in an error", []Channel{FrontLeft}, func(a *Audio) {}, false},
+	{"A channel order with a duplicate should result in an error", []Channel{FrontLeft, FrontLeft}, func(a *Audio) {}, false},
+	{"A channel that is not mono should result in an error", nil, func(a *Audio) { a.NumChannels = 2 }, false},
+	{"A different sampling frequency should result in an error", nil, func(a *Audio) { a.SamplingFrequency = 16000 }, false},
+	{"A different number of bits per sample should result in an error", nil, func(a *Audio) { a.UnpackTo8Bit() }, false},
+	{"A different sample count should result in an error", nil, func(a *Audio) { a.SampleCount -= 8 }, false},
+	{"A channel short by more than a block should result in an error when padded", nil, func(a *Audio) { a.SampleCount -= 4*8 + 1 }, true},
+}
+
+// Run all channel merging error tests
+func TestMergeChannelsError(t *testing.T) {
+	for i, test := range mergeErrorTests {
+		split, _ := editAudio().SplitChannels()
+		test.change(split[1])
+		merge := MergeChannels
+		if test.padded {
+			merge = MergeChannelsPadded
+		}
+		if b, err := merge(test.order, split...); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, b)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
+
+// quadAudio returns 4 channels in the order front left, back left, front
+// right, back right, with the samples of each channel in blocks of 4 bytes,
+// of which the second is padded. Byte i of channel c is 0x10*(c+1)+i.
+func quadAudio() (*Audio, [][]byte) {
+	channels := make([][]byte, 4)
+	for c := range channels {
+		channels[c] = make([]byte, 6)
+		for i := range channels[c] {
+			channels[c][i] = byte(0x10*(c+1) + i)
+		}
+	}
+	a := &Audio{Encoding: DSD, ChannelOrder: []Channel{FrontLeft, BackLeft, FrontRight, BackRight}, SamplingFrequency: 8000, BitsPerSample: 1, BlockSize: 4}
+	a.Interleave(channels)
+	a.SampleCount = 6 * 8
+	return a, channels
+}
+
+// Run all channel remapping tests, on samples held in each way
+func TestRemapChannels(t *testing.T) {
+	order := []Channel{FrontLeft, FrontRight, BackLeft, BackRight}
+	for i, layout := range []string{"EncodedSamples", "EncodedSamples ending with the final sample", "EncodedBlocks of one block each", "EncodedBlocks of other sizes"} {
+		description := fmt.Sprintf("Channels held in %v should be remapped", layout)
+		a, channels := quadAudio()
+		switch i {
+		case 1:
+			a.EncodedSamples = a.EncodedSamples[:len(a.EncodedSamples)-2]
+		case 2:
+			a.EncodedBlocks = splitBlocks(a.EncodedSamples, 4)
+		case 3:
+			a.EncodedBlocks = splitBlocks(a.EncodedSamples, 5)
+		}
+		want := [][]byte{channels[0], channels[2], channels[1], channels[3]}
+		if err := a.RemapChannels(order); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		} else if actual := mustDeinterleave(a); !reflect.DeepEqual(actual, want) || !reflect.DeepEqual(a.ChannelOrder, order) {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v % x\nActual: %v % x", i+1, description, order, want, a.ChannelOrder, actual)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+}
+
+// Table of channel orders that the quad audio cannot be remapped to
+var remapErrorTests = []maskTest{
+	{"A channel order with a missing channel should result in an error", []Channel{FrontLeft, FrontRight, BackLeft}, 0, nil},
+	{"A channel order with a duplicate channel should result in an error", []Channel{FrontLeft, FrontRight, BackLeft, BackLeft}, 0, nil},
+	{"A channel order with a different channel should result in an error", []Channel{FrontLeft, FrontRight, BackLeft, Center}, 0, nil},
+}
+
+// Run all channel remapping error tests
+func TestRemapChannelsError(t *testing.T) {
+	for i, test := range remapErrorTests {
+		a, _ := quadAudio()
+		if err := a.RemapChannels(test.order); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, a.ChannelOrder)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+
+	n := len(remapErrorTests)
+	description := "Remapping audio without a channel order should result in an error"
+	a, _ := quadAudio()
+	a.ChannelOrder = nil
+	if err := a.RemapChannels([]Channel{FrontLeft, FrontRight, BackLeft, BackRight}); err == nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", n+1, description)
+	} else {
+		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", n+1, description, err.Error())
+	}
+}
+
+// Run all polarity inversion tests, on samples held in each way
+func TestInvertPolarity(t *testing.T) {
+	for i, layout := range []string{"EncodedSamples", "EncodedBlocks"} {
+		a := editAudio()
+		if i == 1 {
+			a.EncodedBlocks = splitBlocks(a.EncodedSamples, 3)
+		}
+		original := slices.Concat(mustDeinterleave(a)...)
+		want := mustDeinterleave(a)
+		for j := range want[1] {
+			want[1][j] ^= 0xff
+		}
+		want[1][9] ^= 0xe0 // only 5 samples of the final byte
+		padding := slices.Concat(a.EncodedBlocks...)
+		if i == 0 {
+			padding = slices.Clone(a.EncodedSamples)
+		}
+
+		description := fmt.Sprintf("Inverting one channel held in %v should invert only its samples", layout)
+		err := a.InvertPolarity(FrontRight)
+		samples := a.EncodedSamples
+		if i == 1 {
+			samples = slices.Concat(a.EncodedBlocks...)
+		}
+		if actual := mustDeinterleave(a); err != nil || !reflect.DeepEqual(actual, want) || !bytes.Equal(samples[4*2*2+2:4*2*2+4], padding[4*2*2+2:4*2*2+4]) || !bytes.Equal(samples[4*2*2+6:], padding[4*2*2+6:]) {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x, %v", i+1, description, want, actual, err)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+
+		description = fmt.Sprintf("Inverting every channel held in %v twice should restore them", layout)
+		a.InvertPolarity(FrontRight)
+		a.InvertPolarity()
+		a.InvertPolarity(FrontLeft, FrontRight)
+		if actual := slices.Concat(mustDeinterleave(a)...); !bytes.Equal(actual, original) {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x", i+1, description, original, actual)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+
+	description := "Inverting 8 bits per sample should swap 0 and 1"
+	a := editAudio()
+	a.UnpackTo8Bit()
+	want := unpacked(editAudio())
+	want.InvertPolarity(FrontLeft)
+	a.InvertPolarity(FrontLeft)
+	packed := *a
+	packed.PackTo1Bit()
+	b := editAudio()
+	b.InvertPolarity(FrontLeft)
+	if !reflect.DeepEqual(mustDeinterleave(a), mustDeinterleave(want)) || !packed.Equal(b) {
+		t.Errorf("FAIL Test 3: %v:\nWant: %v\nActual: %v", description, b.EncodedSamples, packed.EncodedSamples)
+	} else {
+		t.Logf("PASS Test 3: %v", description)
+	}
+
+	description = "Inverting a channel not in the channel order should result in an error"
+	if err := editAudio().InvertPolarity(Center); err == nil {
+		t.Errorf("FAIL Test 4: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 4: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
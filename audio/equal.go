@@ -0,0 +1,182 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// EqualOption configures the comparison made by Equal and EqualReport.
+type EqualOption func(*equalOptions)
+
+// Configuration of the comparison made by Equal and EqualReport.
+type equalOptions struct {
+	// Whether to ignore the Metadata and Tags.
+	ignoreMetadata bool
+}
+
+// IgnoreMetadata compares audio without regard to its Metadata and Tags, e.g.
+// after converting to a format that cannot hold them.
+func IgnoreMetadata() EqualOption {
+	return func(o *equalOptions) {
+		o.ignoreMetadata = true
+	}
+}
+
+// Equal reports whether a and b hold the same audio, as compared by
+// EqualReport.
+func (a *Audio) Equal(b *Audio, opts ...EqualOption) bool {
+	return a.EqualReport(b, opts...) == ""
+}
+
+// EqualReport compares a and b, returning a description of each difference
+// found, one per line, or "" if there are none. The encoding, number of
+// channels, channel order, sampling frequency and sample count must match, as
+// must the samples for each channel up to the sample count, whatever the block
+// size and padding and whether they are packed at 1 or 8 bits per sample. A
+// sample of 8 bits is 1 if it is non-zero, as per PackTo1Bit. The samples are
+// only compared if everything else matches, and then only the first
+// difference for each channel is described. The Metadata and Tags must also
+// match unless IgnoreMetadata is given.
+func (a *Audio) EqualReport(b *Audio, opts ...EqualOption) string {
+	var o equalOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var diffs []string
+	diff := func(field string, x, y any) {
+		diffs = append(diffs, fmt.Sprintf("%v: %v != %v", field, x, y))
+	}
+	if a.Encoding != b.Encoding {
+		diff("Encoding", a.Encoding, b.Encoding)
+	}
+	if a.NumChannels != b.NumChannels {
+		diff("NumChannels", a.NumChannels, b.NumChannels)
+	}
+	if !slices.Equal(a.ChannelOrder, b.ChannelOrder) {
+		diff("ChannelOrder", a.ChannelOrder, b.ChannelOrder)
+	}
+	if a.SamplingFrequency != b.SamplingFrequency {
+		diff("SamplingFrequency", a.SamplingFrequency, b.SamplingFrequency)
+	}
+	sampleCount := a.sampleCount()
+	if sampleCount != b.sampleCount() {
+		diff("SampleCount", sampleCount, b.sampleCount())
+	}
+	if !o.ignoreMetadata {
+		if !bytes.Equal(a.Metadata, b.Metadata) {
+			diff("Metadata", fmt.Sprintf("% x", a.Metadata), fmt.Sprintf("% x", b.Metadata))
+		}
+		if !reflect.DeepEqual(a.Tags, b.Tags) {
+			diff("Tags", fmt.Sprintf("%+v", a.Tags), fmt.Sprintf("%+v", b.Tags))
+		}
+	}
+	if len(diffs) == 0 {
+		diffs = a.diffSamples(b, sampleCount)
+	}
+	return strings.Join(diffs, "\n")
+}
+
+// diffSamples compares the first sampleCount samples for each channel of a and
+// b, which must have the same number of channels, returning a description of
+// the first difference for each channel.
+func (a *Audio) diffSamples(b *Audio, sampleCount uint64) []string {
+	as, err := a.sampleSource()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	bs, err := b.sampleSource()
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var diffs []string
+	for c := uint64(0); c < uint64(a.NumChannels); c++ {
+		for i := uint64(0); i < sampleCount; i++ {
+			x, xok := as.at(c, i)
+			y, yok := bs.at(c, i)
+			if !xok || !yok || x != y {
+				channel := fmt.Sprint(c)
+				if c < uint64(len(a.ChannelOrder)) {
+					channel = fmt.Sprintf("%v (%v)", c, a.ChannelOrder[c])
+				}
+				diffs = append(diffs, fmt.Sprintf("channel %v sample %v: %v != %v", channel, i, sampleString(x, xok), sampleString(y, yok)))
+				break
+			}
+		}
+	}
+	return diffs
+}
+
+// sampleString returns a sample for EqualReport, or "missing" if there is none.
+func sampleString(sample byte, ok bool) string {
+	if !ok {
+		return "missing"
+	}
+	return fmt.Sprint(sample)
+}
+
+// sampleSource gives random access to the individual samples of an Audio.
+type sampleSource struct {
+	samples       []byte
+	numChannels   uint64
+	blockSize     uint64
+	bitsPerSample uint64
+}
+
+// sampleSource returns a sampleSource for the encoded samples of a, which are
+// copied into one slice if held in EncodedBlocks or EncodedSection.
+func (a *Audio) sampleSource() (*sampleSource, error) {
+	if a.BitsPerSample != 1 && a.BitsPerSample != 8 {
+		return nil, fmt.Errorf("audio: cannot compare samples of %v bits", a.BitsPerSample)
+	}
+	if a.BlockSize == 0 {
+		return nil, fmt.Errorf("audio: cannot compare samples without a block size")
+	}
+	samples := a.EncodedSamples
+	if a.EncodedBlocks != nil || a.EncodedSection != nil {
+		var err error
+		if samples, err = io.ReadAll(a.SamplesReader()); err != nil {
+			return nil, err
+		}
+	}
+	return &sampleSource{
+		samples:       samples,
+		numChannels:   uint64(a.NumChannels),
+		blockSize:     uint64(a.BlockSize),
+		bitsPerSample: uint64(a.BitsPerSample),
+	}, nil
+}
+
+// at returns sample i of channel c as 0 or 1, or false if it is beyond the end
+// of the encoded samples.
+func (s *sampleSource) at(c, i uint64) (byte, bool) {
+	// Find the byte holding the sample, within the block for the channel
+	offset := i
+	if s.bitsPerSample == 1 {
+		offset = i / 8
+	}
+	block := offset / s.blockSize
+	offset = (block*s.numChannels+c)*s.blockSize + offset%s.blockSize
+	if offset >= uint64(len(s.samples)) {
+		return 0, false
+	}
+
+	// Samples of 1 bit are packed with the first in the least significant bit
+	sample := s.samples[offset]
+	if s.bitsPerSample == 1 {
+		return sample >> (i % 8) & 1, true
+	}
+	if sample != 0 {
+		return 1, true
+	}
+	return 0, true
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"strings"
+	"testing"
+)
+
+// Table structure for a single equality test
+type equalTest struct {
+	// Description for the test
+	description string
+	// The audio to compare with equalAudio(8, 2, packTests[1].eightBit)
+	audio *Audio
+	// Options for the comparison
+	opts []EqualOption
+	// Expected part of the report for each difference, or none if equal
+	diffs []string
+}
+
+// equalAudio returns stereo audio of 19 samples per channel with the given
+// bits per sample, block size and encoded samples, as per packTests[1]
+func equalAudio(bitsPerSample, blockSize uint, samples []byte) *Audio {
+	return &Audio{Encoding: DSD, NumChannels: 2, ChannelOrder: []Channel{FrontLeft, FrontRight}, SamplingFrequency: 2822400,
+		BitsPerSample: bitsPerSample, BlockSize: blockSize, SampleCount: 19, EncodedSamples: append([]byte(nil), samples...),
+		Metadata: []byte("ID3")}
+}
+
+// modifyAudio returns a modified by f
+func modifyAudio(a *Audio, f func(a *Audio)) *Audio {
+	f(a)
+	return a
+}
+
+// Table of all equality tests
+var equalTests = []equalTest{
+	{"The same audio should be equal", equalAudio(8, 2, packTests[1].eightBit), nil, nil},
+	{"The same audio packed at 1 bit per sample should be equal", equalAudio(1, 2, packTests[1].oneBit), nil, nil},
+	{"The same audio in blocks of a different size should be equal",
+		equalAudio(1, 4, []byte{0x0d, 0x0f, 0x04, 0x00, 0xff, 0xff, 0x07, 0x00}), nil, nil},
+	{"The same audio with different padding and unused bits should be equal",
+		modifyAudio(equalAudio(1, 2, packTests[1].oneBit), func(a *Audio) { a.EncodedSamples[4] |= 0x80; a.EncodedSamples[5] = 0x69 }), nil, nil},
+	{"The same audio without the padding should be equal",
+		modifyAudio(equalAudio(1, 2, packTests[1].oneBit), func(a *Audio) { a.EncodedSamples = a.EncodedSamples[:7] }), nil, nil},
+	{"The same audio held in blocks should be equal",
+		modifyAudio(equalAudio(1, 2, packTests[1].oneBit), func(a *Audio) {
+			a.EncodedBlocks = [][]byte{a.EncodedSamples[:3], a.EncodedSamples[3:]}
+			a.EncodedSamples = nil
+		}), nil, nil},
+	{"A different sample should be reported",
+		modifyAudio(equalAudio(1, 2, packTests[1].oneBit), func(a *Audio) { a.EncodedSamples[6] = 0x05 }), nil,
+		[]string{"channel 1 (front right) sample 17: 1 != 0"}},
+	{"Missing samples should be reported",
+		modifyAudio(equalAudio(1, 2, packTests[1].oneBit), func(a *Audio) { a.EncodedSamples = a.EncodedSamples[:6] }), nil,
+		[]string{"channel 1 (front right) sample 16: 1 != missing"}},
+	{"A different sample count should be reported, without comparing the samples",
+		modifyAudio(equalAudio(8, 2, packTests[1].eightBit), func(a *Audio) { a.SampleCount = 18; a.EncodedSamples[0] = 0 }), nil,
+		[]string{"SampleCount: 19 != 18"}},
+	{"A different format should be reported",
+		modifyAudio(equalAudio(8, 2, packTests[1].eightBit), func(a *Audio) {
+			a.ChannelOrder = []Channel{FrontRight, FrontLeft}
+			a.SamplingFrequency = 5644800
+		}), nil,
+		[]string{"ChannelOrder: [front left front right] != [front right front left]", "SamplingFrequency: 2822400 != 5644800"}},
+	{"Different metadata should be reported",
+		modifyAudio(equalAudio(8, 2, packTests[1].eightBit), func(a *Audio) { a.Metadata = nil; a.Tags = &Tags{Title: "Title"} }), nil,
+		[]string{"Metadata: 49 44 33 != ", "Tags: <nil> != &{Title:Title"}},
+	{"Different metadata should be ignored if requested",
+		modifyAudio(equalAudio(8, 2, packTests[1].eightBit), func(a *Audio) { a.Metadata = nil; a.Tags = &Tags{Title: "Title"} }),
+		[]EqualOption{IgnoreMetadata()}, nil},
+}
+
+// Run all equality tests, checking the report of each difference
+func TestEqual(t *testing.T) {
+	for i, test := range equalTests {
+		a := equalAudio(8, 2, packTests[1].eightBit)
+		report := a.EqualReport(test.audio, test.opts...)
+		equal := a.Equal(test.audio, test.opts...)
+		switch {
+		case equal != (report == ""):
+			t.Errorf("FAIL Test %v: %v:\nWant: Equal to agree with EqualReport\nActual: %v and %q", i+1, test.description, equal, report)
+		case len(test.diffs) == 0 && report != "":
+			t.Errorf("FAIL Test %v: %v:\nWant: equal\nActual: %v", i+1, test.description, report)
+		case len(test.diffs) > 0 && len(strings.Split(report, "\n")) != len(test.diffs):
+			t.Errorf("FAIL Test %v: %v:\nWant: %q\nActual: %v", i+1, test.description, test.diffs, report)
+		default:
+			failed := false
+			for _, diff := range test.diffs {
+				if !strings.Contains(report, diff) {
+					t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, diff, report)
+					failed = true
+				}
+			}
+			if !failed {
+				t.Logf("PASS Test %v: %v", i+1, test.description)
+			}
+		}
+	}
+}
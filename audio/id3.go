@@ -0,0 +1,307 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/snmoore/go/audio/internal/id3"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Size in bytes of an ID3v2.3 or ID3v2.4 frame header.
+const id3FrameHeaderSize = 10
+
+// Flags in an ID3v2 tag header.
+const (
+	id3UnsynchronisationFlag = 0x80
+	id3ExtendedHeaderFlag    = 0x40
+)
+
+// Flags in the second byte of the flags of an ID3v2.3 frame header.
+const (
+	id3v23CompressionFlag = 0x80
+	id3v23EncryptionFlag  = 0x40
+)
+
+// Flags in the second byte of the flags of an ID3v2.4 frame header.
+const (
+	id3v24CompressionFlag         = 0x08
+	id3v24EncryptionFlag          = 0x04
+	id3v24UnsynchronisationFlag   = 0x02
+	id3v24DataLengthIndicatorFlag = 0x01
+)
+
+// Text encodings of ID3v2 text frames.
+const (
+	id3ISO88591 = 0
+	id3UTF16    = 1
+	id3UTF16BE  = 2
+	id3UTF8     = 3
+)
+
+// ParseID3 parses the ID3v2.3 or ID3v2.4 tag at the start of b, such as the
+// Metadata of an Audio, into Tags. The common text frames are parsed into the
+// fields of the Tags, as is the first comment without a description, and the
+// data of every other frame is kept in Other. Compressed and encrypted frames
+// are kept in Other as they are. If the structure of the tag is malformed then
+// an error is returned together with the tags parsed before the problem was
+// found, unless the tag header itself is bad.
+func ParseID3(b []byte) (*Tags, error) {
+	if len(b) < id3.HeaderSize || string(b[:3]) != id3.Identifier {
+		return nil, fmt.Errorf("audio: bad ID3v2 tag header")
+	}
+	version, flags := b[3], b[5]
+	if version != 3 && version != 4 {
+		return nil, fmt.Errorf("audio: unsupported ID3v2.%v tag", version)
+	}
+	for _, c := range b[6:10] {
+		if c&0x80 != 0 {
+			return nil, fmt.Errorf("audio: bad ID3v2 tag header")
+		}
+	}
+	size := id3.HeaderSize + id3.Syncsafe(b[6:10])
+	if flags&id3.FooterFlag != 0 {
+		size += id3.FooterSize
+	}
+	if size > uint64(len(b)) {
+		return nil, fmt.Errorf("audio: ID3v2 tag of %v bytes exceeds the metadata of %v bytes", size, len(b))
+	}
+
+	// Frames follow the header, excluding any footer
+	frames := b[id3.HeaderSize:size]
+	if flags&id3.FooterFlag != 0 {
+		frames = frames[:len(frames)-id3.FooterSize]
+	}
+	if version == 3 && flags&id3UnsynchronisationFlag != 0 {
+		frames = removeUnsynchronisation(frames)
+	}
+
+	// Skip the extended header, if any
+	if flags&id3ExtendedHeaderFlag != 0 {
+		if len(frames) < 4 {
+			return nil, fmt.Errorf("audio: ID3v2 extended header is truncated")
+		}
+		n := uint64(binary.BigEndian.Uint32(frames))
+		if version == 3 {
+			n += 4 // the size excludes itself
+		} else {
+			n = id3.Syncsafe(frames[:4])
+		}
+		if n > uint64(len(frames)) {
+			return nil, fmt.Errorf("audio: ID3v2 extended header of %v bytes exceeds the tag", n)
+		}
+		frames = frames[n:]
+	}
+
+	// Read each frame until the padding or the end of the tag
+	tags := new(Tags)
+	for len(frames) >= id3FrameHeaderSize && frames[0] != 0 {
+		id := string(frames[:4])
+		n := uint64(binary.BigEndian.Uint32(frames[4:]))
+		if version == 4 {
+			n = id3.Syncsafe(frames[4:8])
+		}
+		formatFlags := frames[9]
+		if n > uint64(len(frames)-id3FrameHeaderSize) {
+			return tags, fmt.Errorf("audio: ID3v2 frame %q of %v bytes exceeds the tag", id, n)
+		}
+		data := frames[id3FrameHeaderSize : id3FrameHeaderSize+n]
+		frames = frames[id3FrameHeaderSize+n:]
+
+		// Compressed and encrypted frames are kept as they are
+		if version == 3 && formatFlags&(id3v23CompressionFlag|id3v23EncryptionFlag) != 0 ||
+			version == 4 && formatFlags&(id3v24CompressionFlag|id3v24EncryptionFlag) != 0 {
+			tags.addOther(id, data)
+			continue
+		}
+		if version == 4 && formatFlags&id3v24UnsynchronisationFlag != 0 {
+			data = removeUnsynchronisation(data)
+		}
+		if version == 4 && formatFlags&id3v24DataLengthIndicatorFlag != 0 {
+			if len(data) < 4 {
+				return tags, fmt.Errorf("audio: ID3v2 frame %q is truncated", id)
+			}
+			data = data[4:]
+		}
+		ok, err := tags.parseFrame(id, data)
+		if err != nil {
+			return tags, fmt.Errorf("audio: ID3v2 frame %q: %v", id, err)
+		}
+		if !ok {
+			tags.addOther(id, data)
+		}
+	}
+	return tags, nil
+}
+
+// parseFrame parses the data of the ID3v2 frame id into the field of the tags
+// that holds it, if any, returning false if there is none or it is already
+// set.
+func (t *Tags) parseFrame(id string, data []byte) (bool, error) {
+	var field *string
+	var numbers [2]*int
+	switch id {
+	case "TIT2":
+		field = &t.Title
+	case "TPE1":
+		field = &t.Artist
+	case "TALB":
+		field = &t.Album
+	case "TPE2":
+		field = &t.AlbumArtist
+	case "TRCK":
+		numbers = [2]*int{&t.TrackNumber, &t.TrackTotal}
+	case "TPOS":
+		numbers = [2]*int{&t.DiscNumber, &t.DiscTotal}
+	case "TYER", "TDRC":
+		field = &t.Year
+	case "TCON":
+		field = &t.Genre
+	case "COMM":
+		return t.parseComment(data)
+	default:
+		return false, nil
+	}
+	text, err := decodeID3Text(data)
+	if err != nil {
+		return false, err
+	}
+
+	// A position is a number optionally followed by a total e.g. "3/12"
+	if field == nil {
+		number, total, ok := parsePosition(text)
+		if !ok || *numbers[0] != 0 {
+			return false, nil
+		}
+		*numbers[0], *numbers[1] = number, total
+		return true, nil
+	}
+	if *field != "" {
+		return false, nil
+	}
+	*field = text
+	return true, nil
+}
+
+// parseComment parses the data of an ID3v2 comment frame into the Comment of
+// the tags, if it has no description and the Comment is not already set. The
+// data is the text encoding, a 3 byte language, the description and then the
+// comment.
+func (t *Tags) parseComment(data []byte) (bool, error) {
+	if len(data) < 4 {
+		return false, fmt.Errorf("comment frame is truncated")
+	}
+	text, err := decodeID3Strings(append([]byte{data[0]}, data[4:]...))
+	if err != nil {
+		return false, err
+	}
+	if len(text) < 2 || text[0] != "" || t.Comment != "" {
+		return false, nil
+	}
+	t.Comment = text[1]
+	return true, nil
+}
+
+// addOther adds the data of the ID3v2 frame id to Other.
+func (t *Tags) addOther(id string, data []byte) {
+	if t.Other == nil {
+		t.Other = make(map[string][][]byte)
+	}
+	t.Other[id] = append(t.Other[id], bytes.Clone(data))
+}
+
+// parsePosition parses a position such as "3" or "3/12", returning false if it
+// is not one.
+func parsePosition(s string) (number, total int, ok bool) {
+	s, t, found := strings.Cut(s, "/")
+	number, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || number < 0 {
+		return 0, 0, false
+	}
+	if found {
+		if total, err = strconv.Atoi(strings.TrimSpace(t)); err != nil || total < 0 {
+			return 0, 0, false
+		}
+	}
+	return number, total, true
+}
+
+// decodeID3Text decodes the first string of an ID3v2 text frame.
+func decodeID3Text(data []byte) (string, error) {
+	text, err := decodeID3Strings(data)
+	if err != nil {
+		return "", err
+	}
+	return text[0], nil
+}
+
+// decodeID3Strings decodes the null separated strings of an ID3v2 text frame,
+// which start with the text encoding. There is always at least one string.
+func decodeID3Strings(data []byte) ([]string, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty text frame")
+	}
+	encoding, data := data[0], data[1:]
+	var s string
+	switch encoding {
+	case id3ISO88591:
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+		}
+		s = string(runes)
+	case id3UTF16, id3UTF16BE:
+		if len(data)%2 != 0 {
+			data = data[:len(data)-1]
+		}
+		order := binary.ByteOrder(binary.BigEndian)
+		if encoding == id3UTF16 {
+			switch {
+			case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+				order, data = binary.LittleEndian, data[2:]
+			case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+				data = data[2:]
+			default:
+				return nil, fmt.Errorf("missing UTF-16 byte order mark")
+			}
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		s = string(utf16.Decode(units))
+	case id3UTF8:
+		s = string(data)
+	default:
+		return nil, fmt.Errorf("bad text encoding %v", encoding)
+	}
+
+	// Each string after the first in UTF-16 has its own byte order mark
+	text := strings.Split(strings.TrimRight(s, "\x00"), "\x00")
+	for i := 1; i < len(text); i++ {
+		text[i] = strings.TrimPrefix(text[i], "\ufeff")
+	}
+	return text, nil
+}
+
+// removeUnsynchronisation reverses the unsynchronisation scheme of ID3v2, which
+// inserts a zero byte after every 0xff byte.
+func removeUnsynchronisation(b []byte) []byte {
+	if bytes.IndexByte(b, 0xff) < 0 {
+		return b
+	}
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		out = append(out, b[i])
+		if b[i] == 0xff && i+1 < len(b) && b[i+1] == 0 {
+			i++
+		}
+	}
+	return out
+}
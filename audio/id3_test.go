@@ -0,0 +1,112 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// Build an ID3v2 frame, with a syncsafe size for ID3v2.4
+func id3Frame(version byte, id string, flags byte, data []byte) []byte {
+	f := append([]byte(id), 0, 0, 0, 0, 0, flags)
+	n := uint32(len(data))
+	if version == 4 {
+		n = n&0x7f | n>>7&0x7f<<8 | n>>14&0x7f<<16 | n>>21&0x7f<<24
+	}
+	binary.BigEndian.PutUint32(f[4:], n)
+	return append(f, data...)
+}
+
+// Build an ID3v2 tag holding the given frames followed by some padding
+func id3Tag(version, flags byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	body = append(body, make([]byte, 16)...)
+	n := len(body)
+	return append([]byte{'I', 'D', '3', version, 0, flags,
+		byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}, body...)
+}
+
+// Table structure for a single ID3v2 parsing test
+type parseID3Test struct {
+	// Description for the test
+	description string
+	// The ID3v2 tag
+	tag []byte
+	// Expected tags
+	tags *Tags
+	// Is an error expected?
+	expectError bool
+}
+
+// Table of all ID3v2 parsing tests
+var parseID3Tests = []parseID3Test{
+	{"Every field should be parsed",
+		id3Tag(3, 0,
+			id3Frame(3, "TIT2", 0, []byte("\x00Title")),
+			id3Frame(3, "TPE1", 0, []byte("\x00Artist")),
+			id3Frame(3, "TALB", 0, []byte("\x00Album")),
+			id3Frame(3, "TPE2", 0, []byte("\x00Album Artist")),
+			id3Frame(3, "TRCK", 0, []byte("\x003/12")),
+			id3Frame(3, "TPOS", 0, []byte("\x001 / 2")),
+			id3Frame(3, "TYER", 0, []byte("\x002015")),
+			id3Frame(3, "TCON", 0, []byte("\x00Classical")),
+			id3Frame(3, "COMM", 0, []byte("\x00eng\x00Comment"))),
+		&Tags{Title: "Title", Artist: "Artist", Album: "Album", AlbumArtist: "Album Artist", TrackNumber: 3, TrackTotal: 12,
+			DiscNumber: 1, DiscTotal: 2, Year: "2015", Genre: "Classical", Comment: "Comment"}, false},
+	{"A position without a total should be parsed",
+		id3Tag(4, 0, id3Frame(4, "TRCK", 0, []byte("\x037"))),
+		&Tags{TrackNumber: 7}, false},
+	{"A comment in UTF-16 should be parsed",
+		id3Tag(3, 0, id3Frame(3, "COMM", 0, []byte{1, 'e', 'n', 'g', 0xff, 0xfe, 0, 0, 0xff, 0xfe, 'H', 0, 'i', 0})),
+		&Tags{Comment: "Hi"}, false},
+	{"Other frames should be kept in order",
+		id3Tag(4, 0,
+			id3Frame(4, "TXXX", 0, []byte("\x03KEY\x00value")),
+			id3Frame(4, "APIC", 0, []byte("\x00image/png\x00\x03\x00\x89PNG")),
+			id3Frame(4, "TXXX", 0, []byte("\x03OTHER\x00value"))),
+		&Tags{Other: map[string][][]byte{"TXXX": {[]byte("\x03KEY\x00value"), []byte("\x03OTHER\x00value")},
+			"APIC": {[]byte("\x00image/png\x00\x03\x00\x89PNG")}}}, false},
+	{"Frames that do not fit a field should be kept",
+		id3Tag(3, 0,
+			id3Frame(3, "TIT2", 0, []byte("\x00Title")),
+			id3Frame(3, "TIT2", 0, []byte("\x00Second")),
+			id3Frame(3, "TRCK", 0, []byte("\x00A1")),
+			id3Frame(3, "COMM", 0, []byte("\x00engiTunNORM\x00 0000")),
+			id3Frame(3, "TALB", 0x80, []byte("compressed"))),
+		&Tags{Title: "Title", Other: map[string][][]byte{"TIT2": {[]byte("\x00Second")}, "TRCK": {[]byte("\x00A1")},
+			"COMM": {[]byte("\x00engiTunNORM\x00 0000")}, "TALB": {[]byte("compressed")}}}, false},
+	{"An ID3v2.4 frame with unsynchronisation and a data length indicator should be kept without them",
+		id3Tag(4, 0, id3Frame(4, "PRIV", 0x03, []byte{0, 0, 0, 2, 0xff, 0x00, 0xfe})),
+		&Tags{Other: map[string][][]byte{"PRIV": {{0xff, 0xfe}}}}, false},
+	{"A frame that exceeds the tag should result in an error, keeping the earlier frames",
+		func() []byte {
+			t := id3Tag(3, 0, id3Frame(3, "TIT2", 0, []byte("\x00Title")), id3Frame(3, "TPE1", 0, []byte("\x00Artist")))
+			t[10+10+6+7] = 0x7f
+			return t
+		}(),
+		&Tags{Title: "Title"}, true},
+	{"A truncated comment should result in an error", id3Tag(3, 0, id3Frame(3, "COMM", 0, []byte("\x00en"))), &Tags{}, true},
+	{"An ID3v2.2 tag should result in an error", id3Tag(2, 0), nil, true},
+	{"A tag that exceeds the metadata should result in an error", id3Tag(3, 0)[:12], nil, true},
+	{"Metadata that is not an ID3v2 tag should result in an error", []byte("APETAGEX"), nil, true},
+}
+
+// Run all ID3v2 parsing tests
+func TestParseID3(t *testing.T) {
+	for i, test := range parseID3Tests {
+		tags, err := ParseID3(test.tag)
+		switch {
+		case test.expectError != (err != nil):
+			t.Errorf("FAIL Test %v: %v:\nWant: error %v\nActual: %v", i+1, test.description, test.expectError, err)
+		case !reflect.DeepEqual(tags, test.tags):
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v", i+1, test.description, test.tags, tags)
+		default:
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
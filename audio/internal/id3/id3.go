@@ -0,0 +1,67 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+// Package id3 implements the primitives of the ID3v2 tag header shared by
+// package audio, which parses the tags, and package dsf, which embeds them.
+package id3
+
+// Identifier and size in bytes of an ID3v2 tag header, and the size in bytes of
+// the optional footer.
+const (
+	Identifier = "ID3"
+	HeaderSize = 10
+	FooterSize = 10
+)
+
+// Flag in an ID3v2 tag header indicating that a footer is present.
+const FooterFlag = 0x10
+
+// Largest size of an ID3v2 tag excluding the header and footer, which must fit
+// in a syncsafe integer.
+const MaxSize = 1<<28 - 1
+
+// ParseHeader parses the ID3v2 tag header at the start of b, returning the
+// total size of the tag including the header and any footer, or false if b
+// does not start with a plausible ID3v2 tag header.
+func ParseHeader(b []byte) (uint64, bool) {
+	if len(b) < HeaderSize || string(b[:3]) != Identifier {
+		return 0, false
+	}
+
+	// Major version 2, 3 or 4, with the revision never 0xff
+	if b[3] < 2 || b[3] > 4 || b[4] == 0xff {
+		return 0, false
+	}
+
+	// Size of the tag excluding the header and footer, as a syncsafe integer
+	for _, c := range b[6:10] {
+		if c&0x80 != 0 {
+			return 0, false
+		}
+	}
+	size := Syncsafe(b[6:10]) + HeaderSize
+	if b[5]&FooterFlag != 0 {
+		size += FooterSize
+	}
+	return size, true
+}
+
+// Syncsafe returns the value of a 4 byte syncsafe integer, which has 7 bits in
+// each byte.
+func Syncsafe(b []byte) uint64 {
+	var n uint64
+	for _, c := range b[:4] {
+		n = n<<7 | uint64(c&0x7f)
+	}
+	return n
+}
+
+// PutSyncsafe sets the 4 byte syncsafe integer b to n, which must be less than
+// 1<<28.
+func PutSyncsafe(b []byte, n uint64) {
+	for i := 3; i >= 0; i-- {
+		b[i] = byte(n & 0x7f)
+		n >>= 7
+	}
+}
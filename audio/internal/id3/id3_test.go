@@ -0,0 +1,29 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package id3
+
+import (
+	"bytes"
+	"testing"
+)
+
+// A syncsafe integer should hold 7 bits in each byte, and round trip
+func TestSyncsafe(t *testing.T) {
+	description := "A syncsafe integer should hold 7 bits in each byte"
+	b := make([]byte, 4)
+	PutSyncsafe(b, 1<<28-1)
+	if !bytes.Equal(b, []byte{0x7f, 0x7f, 0x7f, 0x7f}) || Syncsafe(b) != 1<<28-1 {
+		t.Errorf("FAIL Test 1: %v:\nWant: 7f 7f 7f 7f\nActual: % x", description, b)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	PutSyncsafe(b, 0x101)
+	if !bytes.Equal(b, []byte{0, 0, 0x02, 0x01}) || Syncsafe(b) != 0x101 {
+		t.Errorf("FAIL Test 2: %v:\nWant: 00 00 02 01\nActual: % x", description, b)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// ChannelMask is a set of channels, with bit n set if Channel n is present, as
+// used for channel layouts by e.g. WAVE_FORMAT_EXTENSIBLE. Unlike a channel
+// order it does not say which order the channels are in.
+type ChannelMask uint32
+
+// OrderToMask returns the set of channels in the channel order. An unknown or
+// duplicated channel is an error.
+func OrderToMask(order []Channel) (ChannelMask, error) {
+	var mask ChannelMask
+	for _, c := range order {
+		if c < FrontLeft || c > BackCenter {
+			return 0, fmt.Errorf("audio: unknown channel %d in channel order %v", int(c), order)
+		}
+		if mask.Has(c) {
+			return 0, fmt.Errorf("audio: duplicate channel %v in channel order %v", c, order)
+		}
+		mask |= 1 << uint(c)
+	}
+	return mask, nil
+}
+
+// MaskToOrder returns the channels in the set in the canonical order i.e. that
+// of the Channel constants, from FrontLeft to BackCenter. Bits that are not a
+// known channel are ignored.
+func MaskToOrder(m ChannelMask) []Channel {
+	order := make([]Channel, 0, m.Count())
+	for c := FrontLeft; c <= BackCenter; c++ {
+		if m.Has(c) {
+			order = append(order, c)
+		}
+	}
+	return order
+}
+
+// Count returns the number of known channels in the set.
+func (m ChannelMask) Count() int {
+	return bits.OnesCount32(uint32(m & (1<<uint(BackCenter+1) - 1)))
+}
+
+// Has returns whether the channel is in the set.
+func (m ChannelMask) Has(c Channel) bool {
+	return c >= FrontLeft && c <= BackCenter && m&(1<<uint(c)) != 0
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Table structure for a single channel mask test
+type maskTest struct {
+	// Description for the test
+	description string
+	// The channel order
+	order []Channel
+	// Expected mask
+	mask ChannelMask
+	// Expected order when converted back from the mask
+	canonical []Channel
+}
+
+// Table of all channel mask tests
+var maskTests = []maskTest{
+	{"An empty channel order should have an empty mask", nil, 0, []Channel{}},
+	{"Mono should have only center", []Channel{Center}, 0x4, []Channel{Center}},
+	{"Stereo should have front left and front right", []Channel{FrontLeft, FrontRight}, 0x3, []Channel{FrontLeft, FrontRight}},
+	{"5.1 should have the first six channels",
+		[]Channel{FrontLeft, FrontRight, Center, LowFrequency, BackLeft, BackRight}, 0x3f,
+		[]Channel{FrontLeft, FrontRight, Center, LowFrequency, BackLeft, BackRight}},
+	{"A non-canonical order should convert back in the canonical order",
+		[]Channel{BackCenter, FrontRight, SideLeft, FrontLeft}, 0x243,
+		[]Channel{FrontLeft, FrontRight, SideLeft, BackCenter}},
+}
+
+// Run all channel mask tests in both directions
+func TestChannelMask(t *testing.T) {
+	for i, test := range maskTests {
+		mask, err := OrderToMask(test.order)
+		order := MaskToOrder(mask)
+		switch {
+		case err != nil || mask != test.mask:
+			t.Errorf("FAIL Test %v: %v:\nWant: %#x\nActual: %#x, %v", i+1, test.description, test.mask, mask, err)
+		case mask.Count() != len(test.order):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v channels\nActual: %v", i+1, test.description, len(test.order), mask.Count())
+		case !reflect.DeepEqual(order, test.canonical):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.canonical, order)
+		default:
+			for c := FrontLeft; c <= BackCenter; c++ {
+				want := false
+				for _, channel := range test.order {
+					want = want || channel == c
+				}
+				if mask.Has(c) != want {
+					t.Errorf("FAIL Test %v: %v:\nWant: has %v %v\nActual: %v", i+1, test.description, c, want, mask.Has(c))
+				}
+			}
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+
+	n := len(maskTests)
+	description := "Bits that are not a known channel should be ignored"
+	mask := ChannelMask(0xffff0003)
+	if order := MaskToOrder(mask); mask.Count() != 2 || mask.Has(Channel(16)) || !reflect.DeepEqual(order, []Channel{FrontLeft, FrontRight}) {
+		t.Errorf("FAIL Test %v: %v:\nWant: 2 channels %v\nActual: %v channels %v", n+1, description, []Channel{FrontLeft, FrontRight}, mask.Count(), order)
+	} else {
+		t.Logf("PASS Test %v: %v", n+1, description)
+	}
+}
+
+// Table of channel orders that cannot be converted to a mask
+var maskErrorTests = []maskTest{
+	{"A duplicate channel should result in an error", []Channel{FrontLeft, FrontRight, FrontLeft}, 0, nil},
+	{"An unknown channel should result in an error", []Channel{FrontLeft, Channel(99)}, 0, nil},
+	{"A negative channel should result in an error", []Channel{Channel(-1)}, 0, nil},
+}
+
+// Run all channel mask error tests
+func TestChannelMaskError(t *testing.T) {
+	for i, test := range maskErrorTests {
+		if mask, err := OrderToMask(test.order); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %#x", i+1, test.description, mask)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
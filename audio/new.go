@@ -0,0 +1,128 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// DefaultBlockSize is the block size per channel in bytes of the audio returned
+// by New unless WithBlockSize is given, that required of a DSD stream file.
+const DefaultBlockSize = 4096
+
+// NewOption configures the audio returned by New.
+type NewOption func(*newOptions)
+
+// Configuration of the audio returned by New.
+type newOptions struct {
+	// Bits per sample and block size per channel in bytes.
+	bitsPerSample uint
+	blockSize     uint
+
+	// Duration of the samples to allocate, or 0 for none.
+	duration time.Duration
+}
+
+// WithBitsPerSample sets the number of bits per sample, which must be 1 or 8,
+// instead of 1.
+func WithBitsPerSample(n uint) NewOption {
+	return func(o *newOptions) {
+		o.bitsPerSample = n
+	}
+}
+
+// WithBlockSize sets the block size per channel in bytes instead of
+// DefaultBlockSize.
+func WithBlockSize(n uint) NewOption {
+	return func(o *newOptions) {
+		o.blockSize = n
+	}
+}
+
+// WithDuration allocates EncodedSamples to hold d of samples for each channel,
+// filled with Silence, and sets SampleCount to suit. For 1 bit per sample a
+// duration that does not end on a whole byte of samples is rounded up to one
+// that does.
+func WithDuration(d time.Duration) NewOption {
+	return func(o *newOptions) {
+		o.duration = d
+	}
+}
+
+// New returns audio of the given encoding and sampling frequency with a channel
+// for each in the channel order, checked by Validate. NumChannels is that of
+// the channel order, there is 1 bit per sample and the block size is
+// DefaultBlockSize, unless set by opts. There are no samples unless allocated
+// by WithDuration. It is an error if the channel order is empty or holds a
+// channel more than once, or the combination is otherwise invalid, such as 16
+// bits per sample.
+func New(encoding Encoding, samplingFrequency uint, order []Channel, opts ...NewOption) (*Audio, error) {
+	o := newOptions{bitsPerSample: 1, blockSize: DefaultBlockSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if encoding != DSD && encoding != DST {
+		return nil, fmt.Errorf("audio: unknown encoding %d", int(encoding))
+	}
+	if len(order) == 0 {
+		return nil, fmt.Errorf("audio: no channels in the channel order")
+	}
+	if _, err := OrderToMask(order); err != nil {
+		return nil, err
+	}
+	switch {
+	case o.duration < 0:
+		return nil, fmt.Errorf("audio: cannot allocate a negative duration %v of samples", o.duration)
+	case o.duration > 0 && encoding == DST:
+		return nil, fmt.Errorf("audio: cannot allocate samples of compressed DST audio")
+	}
+
+	a := &Audio{
+		Encoding:          encoding,
+		NumChannels:       uint(len(order)),
+		ChannelOrder:      slices.Clone(order),
+		SamplingFrequency: samplingFrequency,
+		BitsPerSample:     o.bitsPerSample,
+		BlockSize:         o.blockSize,
+	}
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	if o.duration > 0 {
+		a.allocate(o.duration)
+	}
+	return a, nil
+}
+
+// allocate sets EncodedSamples to blocks holding d of samples for each channel
+// filled with Silence, and sets SampleCount to suit.
+func (a *Audio) allocate(d time.Duration) {
+	// Number of samples rounded up to a whole number of bytes
+	f := uint64(a.SamplingFrequency)
+	seconds, remainder := uint64(d/time.Second), uint64(d%time.Second)
+	a.SampleCount = seconds*f + (remainder*f+uint64(time.Second)-1)/uint64(time.Second)
+	if a.BitsPerSample == 1 {
+		a.SampleCount = (a.SampleCount + 7) / 8 * 8
+	}
+
+	// Silence of 8 bits per sample is its bits one per byte, least
+	// significant first
+	pattern := []byte{Silence}
+	if a.BitsPerSample == 8 {
+		pattern = make([]byte, 8)
+		for i := range pattern {
+			pattern[i] = Silence >> i & 1
+		}
+	}
+	blockSize := uint64(a.BlockSize)
+	blocks := (a.sampleBytes() + blockSize - 1) / blockSize
+	a.EncodedSamples = make([]byte, blocks*uint64(a.NumChannels)*blockSize)
+	for i := range a.EncodedSamples {
+		sample := uint64(i)/blockSize/uint64(a.NumChannels)*blockSize + uint64(i)%blockSize
+		a.EncodedSamples[i] = pattern[sample%uint64(len(pattern))]
+	}
+}
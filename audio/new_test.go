@@ -0,0 +1,91 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Table structure for a single constructor test
+type newTest struct {
+	// Description for the test
+	description string
+	// Arguments to New
+	encoding          Encoding
+	samplingFrequency uint
+	order             []Channel
+	opts              []NewOption
+	// Expected audio, excluding the samples
+	expected *Audio
+}
+
+// Table of all constructor tests
+var newTests = []newTest{
+	{"Stereo DSD64 should have the defaults", DSD, 2822400, []Channel{FrontLeft, FrontRight}, nil,
+		&Audio{Encoding: DSD, NumChannels: 2, ChannelOrder: []Channel{FrontLeft, FrontRight}, SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096}},
+	{"DST should have the defaults", DST, 2822400, []Channel{Center}, nil,
+		&Audio{Encoding: DST, NumChannels: 1, ChannelOrder: []Channel{Center}, SamplingFrequency: 2822400, BitsPerSample: 1, BlockSize: 4096}},
+	{"The bits per sample and block size should be set", DSD, 5644800, []Channel{FrontLeft, FrontRight, Center}, []NewOption{WithBitsPerSample(8), WithBlockSize(512)},
+		&Audio{Encoding: DSD, NumChannels: 3, ChannelOrder: []Channel{FrontLeft, FrontRight, Center}, SamplingFrequency: 5644800, BitsPerSample: 8, BlockSize: 512}},
+	{"A duration should allocate whole bytes of samples", DSD, 8000, []Channel{FrontLeft, FrontRight}, []NewOption{WithBlockSize(4), WithDuration(1100 * time.Microsecond)},
+		&Audio{Encoding: DSD, NumChannels: 2, ChannelOrder: []Channel{FrontLeft, FrontRight}, SamplingFrequency: 8000, BitsPerSample: 1, BlockSize: 4, SampleCount: 16}},
+	{"A duration should allocate samples of 8 bits", DSD, 8000, []Channel{Center}, []NewOption{WithBitsPerSample(8), WithBlockSize(16), WithDuration(1100 * time.Microsecond)},
+		&Audio{Encoding: DSD, NumChannels: 1, ChannelOrder: []Channel{Center}, SamplingFrequency: 8000, BitsPerSample: 8, BlockSize: 16, SampleCount: 9}},
+}
+
+// Run all constructor tests, checking that the audio is valid
+func TestNew(t *testing.T) {
+	for i, test := range newTests {
+		a, err := New(test.encoding, test.samplingFrequency, test.order, test.opts...)
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+			continue
+		}
+		b := *a
+		b.EncodedSamples = nil
+		if !reflect.DeepEqual(&b, test.expected) || a.Validate() != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: %+v\nActual: %+v, %v", i+1, test.description, test.expected, a, a.Validate())
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+
+	n := len(newTests)
+	description := "Allocated samples of 1 bit should be silence, as when packed from 8 bits"
+	opts := []NewOption{WithBlockSize(4), WithDuration(2 * time.Millisecond)}
+	a, _ := New(DSD, 8000, []Channel{FrontLeft, FrontRight}, opts...)
+	b, _ := New(DSD, 8000, []Channel{FrontLeft, FrontRight}, append(opts, WithBitsPerSample(8))...)
+	if err := b.PackTo1Bit(); err != nil || !a.Equal(b) || a.EncodedSamples[0] != Silence {
+		t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x, %v", n+1, description, a.EncodedSamples, b.EncodedSamples, err)
+	} else {
+		t.Logf("PASS Test %v: %v", n+1, description)
+	}
+}
+
+// Table of all constructor error tests
+var newErrorTests = []newTest{
+	{"16 bits per sample should result in an error", DSD, 2822400, []Channel{Center}, []NewOption{WithBitsPerSample(16)}, nil},
+	{"An empty channel order should result in an error", DSD, 2822400, nil, nil, nil},
+	{"A duplicate channel should result in an error", DSD, 2822400, []Channel{Center, Center}, nil, nil},
+	{"An unknown channel should result in an error", DSD, 2822400, []Channel{Channel(99)}, nil, nil},
+	{"An unknown encoding should result in an error", Encoding(7), 2822400, []Channel{Center}, nil, nil},
+	{"A sampling frequency of zero should result in an error", DSD, 0, []Channel{Center}, nil, nil},
+	{"A block size of zero should result in an error", DSD, 2822400, []Channel{Center}, []NewOption{WithBlockSize(0)}, nil},
+	{"A negative duration should result in an error", DSD, 2822400, []Channel{Center}, []NewOption{WithDuration(-time.Second)}, nil},
+	{"A duration of DST should result in an error", DST, 2822400, []Channel{Center}, []NewOption{WithDuration(time.Second)}, nil},
+}
+
+// Run all constructor error tests
+func TestNewError(t *testing.T) {
+	for i, test := range newErrorTests {
+		if a, err := New(test.encoding, test.samplingFrequency, test.order, test.opts...); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %+v", i+1, test.description, a)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"fmt"
+)
+
+// PackTo1Bit converts the encoded samples from 8 bits per sample, one sample
+// per byte, to 1 bit per sample, packing 8 samples into each byte with the
+// first sample in the least significant bit as the DSF specification requires.
+// A sample is 1 if its byte is non-zero. Each block for each channel keeps its
+// BlockSize, so holds 8 times as many samples, and the final block for each
+// channel is padded with zero. SampleCount is unchanged, unless it is zero in
+// which case it is set to include the padding.
+func (a *Audio) PackTo1Bit() error {
+	if a.BitsPerSample != 8 {
+		return fmt.Errorf("audio: cannot pack %v bits per sample to 1 bit per sample", a.BitsPerSample)
+	}
+	channels, err := a.Deinterleave()
+	if err != nil {
+		return err
+	}
+
+	// Pack the samples for each channel in turn
+	sampleCount := a.SampleCount
+	for c, channel := range channels {
+		packed := make([]byte, (len(channel)+7)/8)
+		for i, sample := range channel {
+			if sample != 0 {
+				packed[i/8] |= 1 << (i % 8)
+			}
+		}
+		channels[c] = packed
+		sampleCount = uint64(len(channel))
+	}
+
+	a.BitsPerSample = 1
+	if err := a.Interleave(channels); err != nil {
+		return err
+	}
+	a.SampleCount = sampleCount
+	return nil
+}
+
+// UnpackTo8Bit converts the encoded samples from 1 bit per sample, with the
+// first sample in the least significant bit of each byte, to 8 bits per
+// sample, one sample per byte of either 0 or 1. This is the inverse of
+// PackTo1Bit. Each block for each channel keeps its BlockSize, so holds an
+// eighth as many samples, and the final block for each channel is padded with
+// zero. SampleCount is unchanged, unless it is zero in which case it is set to
+// include the padding.
+func (a *Audio) UnpackTo8Bit() error {
+	if a.BitsPerSample != 1 {
+		return fmt.Errorf("audio: cannot unpack %v bits per sample to 8 bits per sample", a.BitsPerSample)
+	}
+	channels, err := a.Deinterleave()
+	if err != nil {
+		return err
+	}
+
+	// Unpack the samples for each channel in turn, excluding any unused bits
+	// of the final byte
+	for c, channel := range channels {
+		sampleCount := uint64(len(channel)) * 8
+		if a.SampleCount > 0 {
+			sampleCount = a.SampleCount
+		}
+		unpacked := make([]byte, sampleCount)
+		for i := range unpacked {
+			unpacked[i] = channel[i/8] >> (i % 8) & 1
+		}
+		channels[c] = unpacked
+	}
+
+	a.BitsPerSample = 8
+	return a.Interleave(channels)
+}
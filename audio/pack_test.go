@@ -0,0 +1,113 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Table structure for a single packing test
+type packTest struct {
+	// Description for the test
+	description string
+	// Number of channels, block size and sample count
+	numChannels uint
+	blockSize   uint
+	sampleCount uint64
+	// Interleaved samples at 8 bits per sample
+	eightBit []byte
+	// Interleaved samples at 1 bit per sample
+	oneBit []byte
+}
+
+// Table of all packing tests
+var packTests = []packTest{
+	{"A channel of whole bytes and whole blocks should be packed", 1, 1, 16,
+		[]byte{
+			1, 0, 0, 0, 0, 0, 0, 1, // block 0, center
+			0, 1, 1, 0, 1, 0, 0, 0, // block 1, center
+		},
+		[]byte{
+			0x81, // block 0, center
+			0x16, // block 1, center
+		}},
+	{"2 channels ending in a part used byte and a padded block should be packed", 2, 2, 19,
+		[]byte{
+			1, 0, 1, 1, // block 0, front left, front right
+			1, 1, 1, 1, // block 1, front left, front right
+			0, 0, 1, 1, // block 2, front left, front right
+			0, 0, 1, 1, // block 3, front left, front right
+			1, 1, 1, 1, // block 4, front left, front right
+			1, 1, 1, 1, // block 5, front left, front right
+			0, 0, 1, 1, // block 6, front left, front right
+			0, 0, 1, 1, // block 7, front left, front right
+			0, 0, 1, 1, // block 8, front left, front right
+			1, 0, 1, 0, // block 9, front left, front right, each padded
+		},
+		[]byte{
+			0x0d, 0x0f, // block 0, front left
+			0xff, 0xff, // block 0, front right
+			0x04, 0x00, // block 1, front left, padded
+			0x07, 0x00, // block 1, front right, padded
+		}},
+}
+
+// Run all packing tests in both directions, checking the samples bit for bit
+func TestPack(t *testing.T) {
+	for i, test := range packTests {
+		// Pack
+		a := Audio{NumChannels: test.numChannels, BitsPerSample: 8, BlockSize: test.blockSize, SampleCount: test.sampleCount, EncodedSamples: test.eightBit}
+		if err := a.PackTo1Bit(); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		} else if !bytes.Equal(a.EncodedSamples, test.oneBit) || a.BitsPerSample != 1 || a.SampleCount != test.sampleCount {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x, 1 bit, %v samples\nActual: % x, %v bit, %v samples", i+1, test.description,
+				test.oneBit, test.sampleCount, a.EncodedSamples, a.BitsPerSample, a.SampleCount)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+
+		// Pack any non-zero byte as 1
+		description := "Samples of any non-zero byte should be packed as 1"
+		eightBit := bytes.Replace(test.eightBit, []byte{1}, []byte{0xff}, -1)
+		a = Audio{NumChannels: test.numChannels, BitsPerSample: 8, BlockSize: test.blockSize, SampleCount: test.sampleCount, EncodedSamples: eightBit}
+		if err := a.PackTo1Bit(); err != nil || !bytes.Equal(a.EncodedSamples, test.oneBit) {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x, %v", i+1, description, test.oneBit, a.EncodedSamples, err)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+
+		// Unpack
+		description = "Unpacking should be the inverse of packing"
+		a = Audio{NumChannels: test.numChannels, BitsPerSample: 1, BlockSize: test.blockSize, SampleCount: test.sampleCount, EncodedSamples: test.oneBit}
+		if err := a.UnpackTo8Bit(); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		} else if !bytes.Equal(a.EncodedSamples, test.eightBit) || a.BitsPerSample != 8 || a.SampleCount != test.sampleCount {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x, 8 bit, %v samples\nActual: % x, %v bit, %v samples", i+1, description,
+				test.eightBit, test.sampleCount, a.EncodedSamples, a.BitsPerSample, a.SampleCount)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+}
+
+// Audio of the wrong number of bits per sample cannot be packed or unpacked
+func TestPackError(t *testing.T) {
+	description := "Packing audio of 1 bit per sample should result in an error"
+	a := Audio{NumChannels: 1, BitsPerSample: 1, BlockSize: 1, SampleCount: 8, EncodedSamples: make([]byte, 1)}
+	if err := a.PackTo1Bit(); err == nil {
+		t.Errorf("FAIL Test 1: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 1: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+
+	description = "Unpacking audio of 8 bits per sample should result in an error"
+	a = Audio{NumChannels: 1, BitsPerSample: 8, BlockSize: 1, SampleCount: 1, EncodedSamples: make([]byte, 1)}
+	if err := a.UnpackTo8Bit(); err == nil {
+		t.Errorf("FAIL Test 2: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 2: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"fmt"
+)
+
+// Deinterleave returns the samples for each channel in ChannelOrder as one
+// contiguous slice per channel. The encoded samples hold blocks of BlockSize bytes
+// for each channel in turn, with the final block for each channel padded. The
+// padding is excluded according to SampleCount, unless SampleCount is zero in
+// which case it is assumed to be unknown and the padding is included. If
+// SampleCount is set then the encoded samples may end with the final sample
+// of the last channel rather than with its padding.
+func (a *Audio) Deinterleave() ([][]byte, error) {
+	_, size, err := a.blockLayout()
+	if err != nil {
+		return nil, err
+	}
+
+	// Copy each block to its channel in turn, excluding the padding
+	blockSize := int(a.BlockSize)
+	channels := make([][]byte, a.NumChannels)
+	for c := range channels {
+		channels[c] = make([]byte, size)
+	}
+	for b, err := range a.Blocks() {
+		if err != nil {
+			return nil, err
+		}
+		copy(channels[b.Channel][b.Index*blockSize:], b.Samples[:b.Size])
+	}
+
+	return channels, nil
+}
+
+// Interleave sets EncodedSamples, and clears EncodedBlocks and EncodedSection,
+// from the samples for each channel in ChannelOrder, as blocks of BlockSize
+// bytes for each channel in turn with the final block for each channel padded
+// with zero. This is the inverse of Deinterleave. All of the channels must be
+// the same length. NumChannels is set to the number of channels, and
+// SampleCount is set assuming that every byte is fully used, so should be
+// reduced afterwards if this is not the case.
+func (a *Audio) Interleave(channels [][]byte) error {
+	return a.interleave(channels, 0)
+}
+
+// interleave is Interleave, padding the final block for each channel with pad.
+func (a *Audio) interleave(channels [][]byte, pad byte) error {
+	if len(channels) == 0 || a.BlockSize == 0 || a.BitsPerSample == 0 {
+		return fmt.Errorf("audio: cannot interleave %v channels of %v byte blocks", len(channels), a.BlockSize)
+	}
+	size := len(channels[0])
+	for c, channel := range channels {
+		if len(channel) != size {
+			return fmt.Errorf("audio: channel %v has %v bytes of samples but channel 0 has %v", c, len(channel), size)
+		}
+	}
+
+	// Copy each channel to its blocks, then pad the final block of each
+	blockSize := int(a.BlockSize)
+	blocks := (size + blockSize - 1) / blockSize
+	samples := make([]byte, blocks*len(channels)*blockSize)
+	for c, channel := range channels {
+		for offset := 0; offset < size; offset += blockSize {
+			block := (offset/blockSize*len(channels) + c) * blockSize
+			n := copy(samples[block:block+blockSize], channel[offset:])
+			if pad != 0 {
+				for i := block + n; i < block+blockSize; i++ {
+					samples[i] = pad
+				}
+			}
+		}
+	}
+
+	a.dropSection()
+	a.EncodedSamples, a.EncodedBlocks = samples, nil
+	a.NumChannels = uint(len(channels))
+	a.SampleCount = uint64(size) * 8 / uint64(a.BitsPerSample)
+	return nil
+}
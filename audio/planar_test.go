@@ -0,0 +1,146 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// Table structure for a single planar test
+type planarTest struct {
+	// Description for the test
+	description string
+	// Number of channels, block size and sample count
+	numChannels uint
+	blockSize   uint
+	sampleCount uint64
+	// Interleaved samples
+	interleaved []byte
+	// Expected samples for each channel
+	planar [][]byte
+}
+
+// Table of all planar tests, using 4 byte blocks and 1-bit samples
+var planarTests = []planarTest{
+	{"2 channels of whole blocks should be deinterleaved", 2, 4, 8 * 8,
+		[]byte{
+			0x10, 0x11, 0x12, 0x13, // block 0, front left
+			0x20, 0x21, 0x22, 0x23, // block 0, front right
+			0x14, 0x15, 0x16, 0x17, // block 1, front left
+			0x24, 0x25, 0x26, 0x27, // block 1, front right
+		},
+		[][]byte{
+			{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17},
+			{0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0x27},
+		}},
+	{"2 channels with a padded final block should be deinterleaved without the padding", 2, 4, 5*8 + 3,
+		[]byte{
+			0x10, 0x11, 0x12, 0x13, // block 0, front left
+			0x20, 0x21, 0x22, 0x23, // block 0, front right
+			0x14, 0x15, 0x00, 0x00, // block 1, front left
+			0x24, 0x25, 0x00, 0x00, // block 1, front right
+		},
+		[][]byte{
+			{0x10, 0x11, 0x12, 0x13, 0x14, 0x15},
+			{0x20, 0x21, 0x22, 0x23, 0x24, 0x25},
+		}},
+	{"6 channels with a padded final block should be deinterleaved without the padding", 6, 4, 7 * 8,
+		[]byte{
+			0x10, 0x11, 0x12, 0x13, 0x20, 0x21, 0x22, 0x23, 0x30, 0x31, 0x32, 0x33, // block 0, front left, front right, center
+			0x40, 0x41, 0x42, 0x43, 0x50, 0x51, 0x52, 0x53, 0x60, 0x61, 0x62, 0x63, // block 0, low frequency, back left, back right
+			0x14, 0x15, 0x16, 0x00, 0x24, 0x25, 0x26, 0x00, 0x34, 0x35, 0x36, 0x00, // block 1, front left, front right, center
+			0x44, 0x45, 0x46, 0x00, 0x54, 0x55, 0x56, 0x00, 0x64, 0x65, 0x66, 0x00, // block 1, low frequency, back left, back right
+		},
+		[][]byte{
+			{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16},
+			{0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26},
+			{0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36},
+			{0x40, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46},
+			{0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56},
+			{0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66},
+		}},
+}
+
+// Run all planar tests in both directions
+func TestPlanar(t *testing.T) {
+	for i, test := range planarTests {
+		// Deinterleave
+		a := Audio{NumChannels: test.numChannels, BitsPerSample: 1, BlockSize: test.blockSize, SampleCount: test.sampleCount, EncodedSamples: test.interleaved}
+		planar, err := a.Deinterleave()
+		if err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		} else if !reflect.DeepEqual(planar, test.planar) {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x", i+1, test.description, test.planar, planar)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+
+		// Deinterleave from buffers that do not line up with the blocks
+		description := "Samples in EncodedBlocks should be deinterleaved in the same way"
+		a = Audio{NumChannels: test.numChannels, BitsPerSample: 1, BlockSize: test.blockSize, SampleCount: test.sampleCount, EncodedBlocks: splitBlocks(test.interleaved, 5)}
+		if planar, err := a.Deinterleave(); err != nil || !reflect.DeepEqual(planar, test.planar) {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x, %v", i+1, description, test.planar, planar, err)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+
+		// Deinterleave without the padding of the final block of the last channel
+		description = "Samples ending with the final sample of the last channel should be deinterleaved in the same way"
+		unpadded := test.interleaved[:len(test.interleaved)-int(test.blockSize)+len(test.planar[0])%int(test.blockSize)]
+		if len(test.planar[0])%int(test.blockSize) == 0 {
+			unpadded = test.interleaved
+		}
+		a = Audio{NumChannels: test.numChannels, BitsPerSample: 1, BlockSize: test.blockSize, SampleCount: test.sampleCount, EncodedSamples: unpadded}
+		if planar, err := a.Deinterleave(); err != nil || !reflect.DeepEqual(planar, test.planar) {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x, %v", i+1, description, test.planar, planar, err)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+
+		// Interleave
+		description = "Interleaving should be the inverse of deinterleaving"
+		b := Audio{BitsPerSample: 1, BlockSize: test.blockSize}
+		if err := b.Interleave(test.planar); err != nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, description, err.Error())
+		} else if !bytes.Equal(b.EncodedSamples, test.interleaved) || b.NumChannels != test.numChannels {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x", i+1, description, test.interleaved, b.EncodedSamples)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+}
+
+// Table of invalid audio that cannot be deinterleaved
+var deinterleaveErrorTests = []struct {
+	description string
+	audio       Audio
+}{
+	{"Audio without any channels should result in an error", Audio{BlockSize: 4, EncodedSamples: make([]byte, 8)}},
+	{"Audio without a block size should result in an error", Audio{NumChannels: 2, EncodedSamples: make([]byte, 8)}},
+	{"Audio that is not a whole number of blocks should result in an error", Audio{NumChannels: 2, BlockSize: 4, EncodedSamples: make([]byte, 12)}},
+	{"Audio with a sample count exceeding the samples should result in an error", Audio{NumChannels: 2, BitsPerSample: 1, BlockSize: 4, SampleCount: 4*8 + 1, EncodedSamples: make([]byte, 8)}},
+}
+
+// Run all deinterleave error tests, and check that mismatched channels cannot
+// be interleaved
+func TestPlanarError(t *testing.T) {
+	for i, test := range deinterleaveErrorTests {
+		if _, err := test.audio.Deinterleave(); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", i+1, test.description)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+
+	description := "Channels of different lengths should result in an error"
+	a := Audio{BitsPerSample: 1, BlockSize: 4}
+	if err := a.Interleave([][]byte{make([]byte, 4), make([]byte, 5)}); err == nil {
+		t.Errorf("FAIL Test 5: %v:\nWant: error\nActual: nil", description)
+	} else {
+		t.Logf("PASS Test 5: %v:\nWant: error\nActual: %v", description, err.Error())
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// The raw sample stream written by WriteTo and read by ReadRaw holds no
+// container and no padding, only the bytes of samples for each channel
+// interleaved a byte at a time i.e. the first byte of each channel in the
+// channel order, then the second byte of each channel, and so on. For 1 bit
+// per sample each byte holds 8 consecutive samples with the first sample in
+// the least significant bit, as in a DSD stream file, which is the opposite of
+// the most significant bit first order of e.g. DSDIFF and ALSA's DSD formats,
+// so reverse the bits of each byte to interchange with those. For 8 bits per
+// sample each byte is one sample.
+
+// WriteTo implements io.WriterTo, writing the samples as a raw sample stream,
+// up to the final sample of each channel according to SampleCount i.e. without
+// the padding of the final block for each channel. For 1 bit per sample the
+// unused bits of the final byte of each channel, if any, are written as held.
+// It returns the number of bytes written.
+func (a *Audio) WriteTo(w io.Writer) (int64, error) {
+	return a.writeRaw(w, -1)
+}
+
+// WriteChannelTo writes the samples of one channel to w as WriteTo does, which
+// for a single channel are simply its bytes of samples in turn. It is an error
+// if the channel is not in the channel order.
+func (a *Audio) WriteChannelTo(w io.Writer, c Channel) (int64, error) {
+	i := slices.Index(a.ChannelOrder, c)
+	if i < 0 || uint(len(a.ChannelOrder)) != a.NumChannels {
+		return 0, fmt.Errorf("audio: no %v channel in channel order %v", c, a.ChannelOrder)
+	}
+	return a.writeRaw(w, i)
+}
+
+// writeRaw writes the samples of the channel at the given position in the
+// channel order, or of every channel if it is negative, a group of blocks at a
+// time.
+func (a *Audio) writeRaw(w io.Writer, channel int) (int64, error) {
+	if a.NumChannels == 0 || a.BlockSize == 0 || (a.BitsPerSample != 1 && a.BitsPerSample != 8) {
+		return 0, fmt.Errorf("audio: cannot write %v channels of %v byte blocks and %v bits per sample", a.NumChannels, a.BlockSize, a.BitsPerSample)
+	}
+	size := a.sampleCount()
+	if a.BitsPerSample == 1 {
+		size = (size + 7) / 8
+	}
+
+	channels, blockSize := int(a.NumChannels), int(a.BlockSize)
+	group := make([]byte, channels*blockSize)
+	out := make([]byte, len(group))
+	r := a.SamplesReader()
+	var written int64
+	for offset := uint64(0); offset < size; offset += uint64(blockSize) {
+		// The final group may end with the final sample of the last channel
+		n := int(min(uint64(blockSize), size-offset))
+		if m, err := io.ReadFull(r, group); err != nil && (err != io.ErrUnexpectedEOF || m < (channels-1)*blockSize+n) {
+			return written, fmt.Errorf("audio: samples end before the final sample at %v bytes for each channel", size)
+		}
+
+		var p []byte
+		if channel >= 0 {
+			p = group[channel*blockSize : channel*blockSize+n]
+		} else {
+			p = out[:n*channels]
+			for i := 0; i < n; i++ {
+				for c := 0; c < channels; c++ {
+					p[i*channels+c] = group[c*blockSize+i]
+				}
+			}
+		}
+		m, err := w.Write(p)
+		written += int64(m)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadRaw returns a new Audio of the given format, holding the samples read
+// from r to the end as a raw sample stream as written by WriteTo. The samples
+// are rebuilt as blocks of the BlockSize of format, or SilenceBlockSize if it
+// is not set, for each channel in turn, with the final block for each channel
+// padded with Silence, or with zero for 8 bits per sample. The sample count
+// is that of format if set, which must suit the number of bytes for each
+// channel, otherwise every byte is assumed to be fully used. Any samples in
+// format are ignored, but its metadata is kept.
+func ReadRaw(r io.Reader, format Audio) (*Audio, error) {
+	if format.NumChannels == 0 || (format.BitsPerSample != 1 && format.BitsPerSample != 8) {
+		return nil, fmt.Errorf("audio: cannot read %v channels of %v bits per sample", format.NumChannels, format.BitsPerSample)
+	}
+	if len(format.ChannelOrder) > 0 && uint(len(format.ChannelOrder)) != format.NumChannels {
+		return nil, fmt.Errorf("audio: %v channels but the channel order has %v: %v", format.NumChannels, len(format.ChannelOrder), format.ChannelOrder)
+	}
+	if format.BlockSize == 0 {
+		format.BlockSize = SilenceBlockSize
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	numChannels := int(format.NumChannels)
+	if len(raw) == 0 || len(raw)%numChannels != 0 {
+		return nil, fmt.Errorf("audio: %v bytes of raw samples is not a whole number of bytes for %v channels", len(raw), numChannels)
+	}
+
+	// Sample count, which must need the bytes of each channel
+	size := len(raw) / numChannels
+	sampleCount := uint64(size) * 8 / uint64(format.BitsPerSample)
+	if format.SampleCount > 0 {
+		format.EncodedSamples, format.EncodedBlocks = nil, nil
+		if format.sampleBytes() != uint64(size) {
+			return nil, fmt.Errorf("audio: sample count %v does not suit the %v bytes of raw samples for each channel", format.SampleCount, size)
+		}
+		sampleCount = format.SampleCount
+	}
+
+	channels := make([][]byte, numChannels)
+	for c := range channels {
+		channels[c] = make([]byte, size)
+		for i := range channels[c] {
+			channels[c][i] = raw[i*numChannels+c]
+		}
+	}
+	return format.withChannels(channels, sampleCount)
+}
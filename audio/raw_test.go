@@ -0,0 +1,125 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Run all raw sample stream tests, writing the stereo audio and reading it back
+func TestRaw(t *testing.T) {
+	a := editAudio()
+	channels := mustDeinterleave(a)
+	interleaved := make([]byte, 0, 20)
+	for i := range channels[0] {
+		interleaved = append(interleaved, channels[0][i], channels[1][i])
+	}
+
+	for i, layout := range []string{"EncodedSamples", "EncodedSamples ending with the final sample", "EncodedBlocks"} {
+		b := editAudio()
+		switch i {
+		case 1:
+			b.EncodedSamples = b.EncodedSamples[:len(b.EncodedSamples)-2]
+		case 2:
+			b.EncodedBlocks = splitBlocks(b.EncodedSamples, 3)
+		}
+		description := "Samples held in " + layout + " should be written interleaved a byte at a time without padding"
+		var w bytes.Buffer
+		if n, err := b.WriteTo(&w); err != nil || n != int64(len(interleaved)) || !bytes.Equal(w.Bytes(), interleaved) {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x, %v, %v", i+1, description, interleaved, w.Bytes(), n, err)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, description)
+		}
+	}
+
+	n := 3
+	for c, channel := range a.ChannelOrder {
+		description := "Writing the " + channel.String() + " channel should write only its samples"
+		var w bytes.Buffer
+		if m, err := a.WriteChannelTo(&w, channel); err != nil || m != 10 || !bytes.Equal(w.Bytes(), channels[c]) {
+			t.Errorf("FAIL Test %v: %v:\nWant: % x\nActual: % x, %v", n+c+1, description, channels[c], w.Bytes(), err)
+		} else {
+			t.Logf("PASS Test %v: %v", n+c+1, description)
+		}
+	}
+
+	n += 2
+	description := "Reading the raw samples should give the same audio"
+	format := *a
+	format.EncodedSamples = nil
+	if b, err := ReadRaw(bytes.NewReader(interleaved), format); err != nil || !b.Equal(a) || b.BlockSize != a.BlockSize {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v, %v", n+1, description, a, b, err)
+	} else {
+		t.Logf("PASS Test %v: %v", n+1, description)
+	}
+
+	description = "Reading the raw samples without a sample count or block size should use every byte in blocks of 4096 bytes"
+	format.SampleCount, format.BlockSize = 0, 0
+	if b, err := ReadRaw(bytes.NewReader(interleaved), format); err != nil || b.SampleCount != 80 || b.BlockSize != SilenceBlockSize || b.EncodedSize() != 2*SilenceBlockSize {
+		t.Errorf("FAIL Test %v: %v:\nWant: 80 samples in blocks of 4096 bytes\nActual: %v, %v", n+2, description, b, err)
+	} else {
+		t.Logf("PASS Test %v: %v", n+2, description)
+	}
+
+	description = "8 bits per sample should be written a sample at a time"
+	u := unpacked(a)
+	var w bytes.Buffer
+	u.WriteTo(&w)
+	format = *u
+	format.EncodedSamples = nil
+	if b, err := ReadRaw(&w, format); err != nil || !b.Equal(a) || w.Len() != 0 {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v, %v", n+3, description, a, b, err)
+	} else {
+		t.Logf("PASS Test %v: %v", n+3, description)
+	}
+}
+
+// Table structure for a single raw sample stream error test
+type rawErrorTest struct {
+	// Description for the test
+	description string
+	// Raw samples and format
+	raw    []byte
+	format Audio
+}
+
+// Table of all raw sample stream error tests
+var rawErrorTests = []rawErrorTest{
+	{"Reading without any channels should result in an error", make([]byte, 4), Audio{BitsPerSample: 1}},
+	{"Reading 2 bits per sample should result in an error", make([]byte, 4), Audio{NumChannels: 2, BitsPerSample: 2}},
+	{"Reading a channel order of the wrong length should result in an error", make([]byte, 4), Audio{NumChannels: 2, ChannelOrder: []Channel{Center}, BitsPerSample: 1}},
+	{"Reading nothing should result in an error", nil, Audio{NumChannels: 2, BitsPerSample: 1}},
+	{"Reading part of a byte for each channel should result in an error", make([]byte, 5), Audio{NumChannels: 2, BitsPerSample: 1}},
+	{"Reading more bytes than the sample count needs should result in an error", make([]byte, 6), Audio{NumChannels: 2, BitsPerSample: 1, SampleCount: 16}},
+}
+
+// Run all raw sample stream error tests
+func TestRawError(t *testing.T) {
+	for i, test := range rawErrorTests {
+		if a, err := ReadRaw(bytes.NewReader(test.raw), test.format); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, a)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+
+	n := len(rawErrorTests)
+	description := "Writing a channel not in the channel order should result in an error"
+	if _, err := editAudio().WriteChannelTo(&bytes.Buffer{}, Center); err == nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", n+1, description)
+	} else {
+		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", n+1, description, err.Error())
+	}
+
+	description = "Writing samples that end early should result in an error"
+	a := editAudio()
+	a.EncodedSamples = a.EncodedSamples[:len(a.EncodedSamples)-3]
+	if _, err := a.WriteTo(&bytes.Buffer{}); err == nil {
+		t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: nil", n+2, description)
+	} else {
+		t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", n+2, description, err.Error())
+	}
+}
@@ -0,0 +1,26 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"fmt"
+	"time"
+)
+
+// SilenceBlockSize is the block size of the audio returned by NewSilence, that
+// required of a DSD stream file.
+const SilenceBlockSize = DefaultBlockSize
+
+// NewSilence returns DSD audio of 1 bit per sample lasting d at the given
+// sampling frequency, with a channel for each in the channel order, holding
+// blocks of SilenceBlockSize bytes filled with Silence. A duration that does
+// not end on a whole byte of samples is rounded up to one that does. The audio
+// may be encoded as a DSD stream file, or joined to other audio by Concat.
+func NewSilence(d time.Duration, samplingFrequency uint, order []Channel) (*Audio, error) {
+	if d <= 0 || samplingFrequency == 0 || len(order) == 0 {
+		return nil, fmt.Errorf("audio: cannot generate %v of silence at %v Hz for channel order %v", d, samplingFrequency, order)
+	}
+	return New(DSD, samplingFrequency, order, WithBlockSize(SilenceBlockSize), WithDuration(d))
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Table structure for a single silence test
+type silenceTest struct {
+	// Description for the test
+	description string
+	// Duration, sampling frequency and channel order
+	duration          time.Duration
+	samplingFrequency uint
+	order             []Channel
+	// Expected sample count and number of blocks for each channel
+	sampleCount uint64
+	blocks      int
+}
+
+// Table of all silence tests
+var silenceTests = []silenceTest{
+	{"A second of stereo DSD64 should be whole bytes", time.Second, 2822400, []Channel{FrontLeft, FrontRight}, 2822400, 87},
+	{"A duration part way through a byte should round up", time.Millisecond, 2822400, []Channel{Center}, 2824, 1},
+	{"A duration part way through a sample should round up", time.Nanosecond, 2822400, []Channel{Center}, 8, 1},
+	{"A duration of several seconds should round up", 10*time.Second + time.Microsecond, 8000, []Channel{FrontLeft}, 80008, 3},
+	{"Silence should have a channel for each in the channel order", 10 * time.Millisecond, 5644800,
+		[]Channel{FrontLeft, FrontRight, Center, LowFrequency, BackLeft, BackRight}, 56448, 2},
+}
+
+// Run all silence tests, which are valid audio of DSD silence
+func TestNewSilence(t *testing.T) {
+	for i, test := range silenceTests {
+		a, err := NewSilence(test.duration, test.samplingFrequency, test.order)
+		switch {
+		case err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case a.SampleCount != test.sampleCount || a.EncodedSize() != uint64(test.blocks*len(test.order)*SilenceBlockSize):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v samples in %v blocks\nActual: %v samples in %v bytes", i+1, test.description,
+				test.sampleCount, test.blocks, a.SampleCount, a.EncodedSize())
+		case a.Validate() != nil || a.Duration() < test.duration || a.NumChannels != uint(len(test.order)):
+			t.Errorf("FAIL Test %v: %v:\nWant: valid audio lasting at least %v\nActual: %v, %v", i+1, test.description, test.duration, a, a.Validate())
+		case bytes.Count(a.EncodedSamples, []byte{Silence}) != len(a.EncodedSamples):
+			t.Errorf("FAIL Test %v: %v:\nWant: only DSD silence\nActual: % x", i+1, test.description, a.EncodedSamples[:16])
+		default:
+			t.Logf("PASS Test %v: %v: %v", i+1, test.description, a)
+		}
+	}
+
+	n := len(silenceTests)
+	description := "Silence should be joined to other audio"
+	a, _ := NewSilence(time.Second, 8000, []Channel{FrontLeft, FrontRight})
+	if b, err := Concat(a, editAudio()); err != nil || b.SampleCount != 8000+77 {
+		t.Errorf("FAIL Test %v: %v:\nWant: %v samples\nActual: %v, %v", n+1, description, 8000+77, b, err)
+	} else {
+		t.Logf("PASS Test %v: %v", n+1, description)
+	}
+}
+
+// Table of all silence error tests
+var silenceErrorTests = []silenceTest{
+	{"A duration of zero should result in an error", 0, 2822400, []Channel{Center}, 0, 0},
+	{"A negative duration should result in an error", -time.Second, 2822400, []Channel{Center}, 0, 0},
+	{"A sampling frequency of zero should result in an error", time.Second, 0, []Channel{Center}, 0, 0},
+	{"No channels should result in an error", time.Second, 2822400, nil, 0, 0},
+	{"A duplicate channel should result in an error", time.Second, 2822400, []Channel{Center, Center}, 0, 0},
+}
+
+// Run all silence error tests
+func TestNewSilenceError(t *testing.T) {
+	for i, test := range silenceErrorTests {
+		if a, err := NewSilence(test.duration, test.samplingFrequency, test.order); err == nil {
+			t.Errorf("FAIL Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, a)
+		} else {
+			t.Logf("PASS Test %v: %v:\nWant: error\nActual: %v", i+1, test.description, err.Error())
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Summary describes an Audio for people to read, whatever it was decoded from.
+type Summary struct {
+	// The number of channels and the channel order.
+	NumChannels  uint
+	ChannelOrder []Channel
+
+	// The sampling frequency in Hertz, and its name e.g. "DSD64", or "" if it
+	// is not a DSD sampling frequency.
+	SamplingFrequency uint
+	Rate              string
+
+	// The number of bits per sample.
+	BitsPerSample uint
+
+	// The duration and number of samples per channel.
+	Duration    time.Duration
+	SampleCount uint64
+
+	// The size in bytes of the encoded samples and the metadata.
+	DataSize     uint64
+	MetadataSize uint64
+
+	// The number of bytes of samples per second for all of the channels.
+	BytesPerSecond uint64
+
+	// Whether the metadata is an ID3v2 tag.
+	ID3 bool
+}
+
+// Summary returns a Summary of the audio.
+func (a *Audio) Summary() Summary {
+	return Summary{
+		NumChannels:       a.NumChannels,
+		ChannelOrder:      a.ChannelOrder,
+		SamplingFrequency: a.SamplingFrequency,
+		Rate:              rateName(a.SamplingFrequency),
+		BitsPerSample:     a.BitsPerSample,
+		Duration:          a.Duration(),
+		SampleCount:       a.sampleCount(),
+		DataSize:          a.EncodedSize(),
+		MetadataSize:      uint64(len(a.Metadata)),
+		BytesPerSecond:    a.BytesPerSecond(),
+		ID3:               bytes.HasPrefix(a.Metadata, []byte("ID3")),
+	}
+}
+
+// String returns the summary as aligned text, one field per line.
+func (s Summary) String() string {
+	var b strings.Builder
+	field := func(name string, format string, args ...any) {
+		fmt.Fprintf(&b, "%-27v"+format+"\n", append([]any{name + ":"}, args...)...)
+	}
+	channels := fmt.Sprint(s.NumChannels)
+	if len(s.ChannelOrder) > 0 {
+		names := make([]string, len(s.ChannelOrder))
+		for i, c := range s.ChannelOrder {
+			names[i] = c.String()
+		}
+		channels += " (" + strings.Join(names, ", ") + ")"
+	}
+	field("Channels", "%v", channels)
+	rate := fmt.Sprintf("%v Hz", s.SamplingFrequency)
+	if s.Rate != "" {
+		rate += " (" + s.Rate + ")"
+	}
+	field("Sampling frequency", "%v", rate)
+	field("Bits per sample", "%v", s.BitsPerSample)
+	field("Duration", "%v (%v)", durationString(s.Duration), s.Duration.Round(time.Millisecond))
+	field("Sample count", "%v", s.SampleCount)
+	field("Data size", "%v", sizeDetail(s.DataSize))
+	field("Data rate", "%v/s", sizeString(s.BytesPerSecond))
+	metadata := "none"
+	if s.MetadataSize > 0 {
+		metadata = sizeDetail(s.MetadataSize)
+		if s.ID3 {
+			metadata += ", ID3v2 tag"
+		}
+	}
+	field("Metadata size", "%v", metadata)
+	return b.String()
+}
+
+// String returns a compact summary of the audio on a single line e.g.
+// "2ch DSD64 1-bit, 4:32, 127.3 MB, ID3 tag 45.0 KB".
+func (a *Audio) String() string {
+	rate := rateName(a.SamplingFrequency)
+	if rate == "" {
+		rate = fmt.Sprintf("%v Hz", a.SamplingFrequency)
+	}
+	s := fmt.Sprintf("%vch %v %v-bit, %v, %v", a.NumChannels, rate, a.BitsPerSample, durationString(a.Duration()), sizeString(a.EncodedSize()))
+	switch {
+	case bytes.HasPrefix(a.Metadata, []byte("ID3")):
+		s += ", ID3 tag " + sizeString(uint64(len(a.Metadata)))
+	case len(a.Metadata) > 0:
+		s += ", metadata " + sizeString(uint64(len(a.Metadata)))
+	}
+	return s
+}
+
+// rateName returns the name of a DSD sampling frequency, being a power of two
+// multiple of 64 or more of 44.1 kHz e.g. "DSD64" for 2822400 Hz, or of 48 kHz
+// e.g. "DSD64/48k" for 3072000 Hz, or "" if it is neither.
+func rateName(f uint) string {
+	for _, base := range []struct {
+		rate   uint
+		suffix string
+	}{{44100, ""}, {48000, "/48k"}} {
+		if f == 0 || f%base.rate != 0 {
+			continue
+		}
+		if m := f / base.rate; m >= 64 && m&(m-1) == 0 {
+			return fmt.Sprintf("DSD%v%v", m, base.suffix)
+		}
+	}
+	return ""
+}
+
+// durationString returns d rounded to the nearest second as minutes and
+// seconds e.g. "4:32", or hours, minutes and seconds if an hour or more.
+func durationString(d time.Duration) string {
+	seconds := int64(d.Round(time.Second) / time.Second)
+	if seconds >= 3600 {
+		return fmt.Sprintf("%v:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%v:%02d", seconds/60, seconds%60)
+}
+
+// sizeDetail returns a size in bytes with a decimal unit and exactly e.g.
+// "127.3 MB (127312345 bytes)".
+func sizeDetail(n uint64) string {
+	if n < 1000 {
+		return fmt.Sprintf("%v bytes", n)
+	}
+	return fmt.Sprintf("%v (%v bytes)", sizeString(n), n)
+}
+
+// sizeString returns a size in bytes with a decimal unit e.g. "127.3 MB".
+func sizeString(n uint64) string {
+	if n < 1000 {
+		return fmt.Sprintf("%v B", n)
+	}
+	size, unit := float64(n)/1000, 0
+	for size >= 1000 && unit < 3 {
+		size /= 1000
+		unit++
+	}
+	return fmt.Sprintf("%.1f %v", size, []string{"KB", "MB", "GB", "TB"}[unit])
+}
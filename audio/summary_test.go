@@ -0,0 +1,90 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"testing"
+	"time"
+)
+
+// Table structure for a single summary test
+type summaryTest struct {
+	// Description for the test
+	description string
+	// The audio to summarise
+	audio Audio
+	// Expected single line summary
+	expected string
+}
+
+// sizedBlocks returns blocks holding n bytes of samples in total, all sharing
+// the same buffer to save memory
+func sizedBlocks(n int) [][]byte {
+	buf := make([]byte, 1<<20)
+	var blocks [][]byte
+	for n > 0 {
+		k := min(n, len(buf))
+		blocks = append(blocks, buf[:k])
+		n -= k
+	}
+	return blocks
+}
+
+// Table of all summary tests
+var summaryTests = []summaryTest{
+	{"Stereo DSD64 with an ID3v2 tag should be summarised", Audio{NumChannels: 2, ChannelOrder: []Channel{FrontLeft, FrontRight},
+		SamplingFrequency: 2822400, BitsPerSample: 1, SampleCount: 2822400 * 272, EncodedBlocks: sizedBlocks(127312345), Metadata: append([]byte("ID3"), make([]byte, 45000)...)},
+		"2ch DSD64 1-bit, 4:32, 127.3 MB, ID3 tag 45.0 KB"},
+	{"5.1 DSD128/48k of 8-bit samples lasting over an hour without metadata should be summarised", Audio{NumChannels: 6, SamplingFrequency: 6144000,
+		BitsPerSample: 8, SampleCount: 6144000*3723 + 3072000},
+		"6ch DSD128/48k 8-bit, 1:02:04, 0 B"},
+	{"Mono at a nonstandard rate with metadata that is not a tag should be summarised", Audio{NumChannels: 1, SamplingFrequency: 2000000,
+		BitsPerSample: 1, EncodedSamples: make([]byte, 999), Metadata: []byte("APETAGEX")},
+		"1ch 2000000 Hz 1-bit, 0:00, 999 B, metadata 8 B"},
+	{"DSD2048 should be named", Audio{NumChannels: 2, SamplingFrequency: 44100 * 2048, BitsPerSample: 1, EncodedBlocks: sizedBlocks(2 * 44100 * 256)},
+		"2ch DSD2048 1-bit, 0:01, 22.6 MB"},
+	{"An empty Audio should be summarised", Audio{}, "0ch 0 Hz 0-bit, 0:00, 0 B"},
+}
+
+// Run all summary tests
+func TestString(t *testing.T) {
+	for i, test := range summaryTests {
+		actual := test.audio.String()
+		if actual != test.expected {
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.expected, actual)
+		} else {
+			t.Logf("PASS Test %v: %v", i+1, test.description)
+		}
+	}
+}
+
+// The summary should hold every field, and print them aligned
+func TestSummary(t *testing.T) {
+	a := summaryTests[0].audio
+	description := "The summary should hold every field"
+	s := a.Summary()
+	want := Summary{NumChannels: 2, ChannelOrder: a.ChannelOrder, SamplingFrequency: 2822400, Rate: "DSD64", BitsPerSample: 1,
+		Duration: 272 * time.Second, SampleCount: 2822400 * 272, DataSize: 127312345, MetadataSize: 45003, BytesPerSecond: 705600, ID3: true}
+	if s.String() != want.String() || s.Rate != want.Rate || s.ID3 != want.ID3 || s.Duration != want.Duration || s.BytesPerSecond != want.BytesPerSecond {
+		t.Errorf("FAIL Test 1: %v:\nWant: %+v\nActual: %+v", description, want, s)
+	} else {
+		t.Logf("PASS Test 1: %v", description)
+	}
+
+	description = "The summary should print each field on its own line"
+	expected := "Channels:                  2 (front left, front right)\n" +
+		"Sampling frequency:        2822400 Hz (DSD64)\n" +
+		"Bits per sample:           1\n" +
+		"Duration:                  4:32 (4m32s)\n" +
+		"Sample count:              767692800\n" +
+		"Data size:                 127.3 MB (127312345 bytes)\n" +
+		"Data rate:                 705.6 KB/s\n" +
+		"Metadata size:             45.0 KB (45003 bytes), ID3v2 tag\n"
+	if actual := s.String(); actual != expected {
+		t.Errorf("FAIL Test 2: %v:\nWant: %v\nActual: %v", description, expected, actual)
+	} else {
+		t.Logf("PASS Test 2: %v", description)
+	}
+}
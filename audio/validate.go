@@ -0,0 +1,70 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Validate checks that the fields of the audio are consistent with each other,
+// returning an error listing every inconsistency found, or nil if there are
+// none. The number of channels must match the channel order, if set, the
+// sampling frequency and block size must be set, there must be 1 or 8 bits per
+// sample, the size of the encoded samples must suit the sample count, if set,
+// and the metadata, if any, must be an ID3v2 tag.
+func (a *Audio) Validate() error {
+	var errs []error
+	if len(a.ChannelOrder) > 0 && uint(len(a.ChannelOrder)) != a.NumChannels {
+		errs = append(errs, fmt.Errorf("audio: %v channels but the channel order has %v: %v", a.NumChannels, len(a.ChannelOrder), a.ChannelOrder))
+	}
+	if a.NumChannels == 0 {
+		errs = append(errs, fmt.Errorf("audio: no channels"))
+	}
+	if a.SamplingFrequency == 0 {
+		errs = append(errs, fmt.Errorf("audio: no sampling frequency"))
+	}
+	if a.BitsPerSample != 1 && a.BitsPerSample != 8 {
+		errs = append(errs, fmt.Errorf("audio: %v bits per sample, expected 1 or 8", a.BitsPerSample))
+	}
+	if a.BlockSize == 0 {
+		errs = append(errs, fmt.Errorf("audio: no block size"))
+	}
+	if err := a.validateSize(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(a.Metadata) > 0 && !bytes.HasPrefix(a.Metadata, []byte("ID3")) {
+		n := min(len(a.Metadata), 10)
+		errs = append(errs, fmt.Errorf("audio: metadata is not an ID3v2 tag: % x", a.Metadata[:n]))
+	}
+	return errors.Join(errs...)
+}
+
+// validateSize checks that the encoded samples reach the final sample of the
+// last channel, and do not extend beyond the final block for each channel.
+// Nothing is checked if the sample count, number of channels, bits per sample
+// or block size is not set or not valid.
+func (a *Audio) validateSize() error {
+	if a.SampleCount == 0 || a.NumChannels == 0 || a.BlockSize == 0 || (a.BitsPerSample != 1 && a.BitsPerSample != 8) {
+		return nil
+	}
+
+	// Sizes of the encoded samples with and without the padding of the final
+	// block for each channel
+	sampleBytes := a.sampleBytes()
+	blockSize := uint64(a.BlockSize)
+	blocks := (sampleBytes + blockSize - 1) / blockSize
+	padded := blocks * uint64(a.NumChannels) * blockSize
+	unpadded := padded - (blocks*blockSize - sampleBytes)
+
+	switch size := a.EncodedSize(); {
+	case size < unpadded:
+		return fmt.Errorf("audio: %v bytes of encoded samples is too short for a sample count of %v, expected at least %v", size, a.SampleCount, unpadded)
+	case size > padded:
+		return fmt.Errorf("audio: %v bytes of encoded samples is too long for a sample count of %v, expected at most %v", size, a.SampleCount, padded)
+	}
+	return nil
+}
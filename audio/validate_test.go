@@ -0,0 +1,83 @@
+// Copyright 2015 Simon Moore (simon@snmoore.net). All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be found
+// in the LICENSE file.
+
+package audio
+
+import (
+	"strings"
+	"testing"
+)
+
+// Table structure for a single validation test
+type validateTest struct {
+	// Description for the test
+	description string
+	// The audio to validate
+	audio Audio
+	// Expected part of the message for each violation, or none if valid
+	violations []string
+}
+
+// validAudio returns stereo audio of 1-bit samples in blocks of 4096 bytes,
+// ending part way through the final block, that is valid
+func validAudio() Audio {
+	return Audio{NumChannels: 2, ChannelOrder: []Channel{FrontLeft, FrontRight}, SamplingFrequency: 2822400, BitsPerSample: 1,
+		BlockSize: 4096, SampleCount: 5000 * 8, EncodedSamples: make([]byte, 3*4096+904), Metadata: []byte("ID3\x03\x00\x00\x00\x00\x00\x00")}
+}
+
+// modify returns validAudio modified by f
+func modify(f func(a *Audio)) Audio {
+	a := validAudio()
+	f(&a)
+	return a
+}
+
+// Table of all validation tests
+var validateTests = []validateTest{
+	{"Consistent audio should be valid", validAudio(), nil},
+	{"Audio with the padding should be valid", modify(func(a *Audio) { a.EncodedSamples = make([]byte, 4*4096) }), nil},
+	{"Audio without a channel order, sample count or metadata should be valid",
+		modify(func(a *Audio) { a.ChannelOrder, a.SampleCount, a.Metadata = nil, 0, nil }), nil},
+	{"Audio of 8-bit samples should be valid", modify(func(a *Audio) { a.BitsPerSample, a.SampleCount = 8, 5000 }), nil},
+	{"A channel order that does not match the number of channels should be invalid",
+		modify(func(a *Audio) { a.ChannelOrder = []Channel{Center} }), []string{"channel order"}},
+	{"Audio without any channels should be invalid", modify(func(a *Audio) { a.NumChannels, a.ChannelOrder = 0, nil }), []string{"no channels"}},
+	{"Audio without a sampling frequency should be invalid", modify(func(a *Audio) { a.SamplingFrequency = 0 }), []string{"sampling frequency"}},
+	{"Audio of 4 bits per sample should be invalid", modify(func(a *Audio) { a.BitsPerSample = 4 }), []string{"bits per sample"}},
+	{"Audio without a block size should be invalid", modify(func(a *Audio) { a.BlockSize = 0 }), []string{"block size"}},
+	{"Encoded samples too short for the sample count should be invalid",
+		modify(func(a *Audio) { a.EncodedSamples = a.EncodedSamples[:3*4096+903] }), []string{"too short"}},
+	{"Encoded samples beyond the final block should be invalid",
+		modify(func(a *Audio) { a.EncodedBlocks = [][]byte{make([]byte, 4*4096), make([]byte, 1)} }), []string{"too long"}},
+	{"Metadata that is not an ID3v2 tag should be invalid", modify(func(a *Audio) { a.Metadata = []byte("APETAGEX") }), []string{"ID3v2"}},
+	{"Every violation should be listed",
+		modify(func(a *Audio) { a.SamplingFrequency, a.BitsPerSample, a.BlockSize = 0, 2, 0 }),
+		[]string{"sampling frequency", "bits per sample", "block size"}},
+}
+
+// Run all validation tests, checking that every violation is listed
+func TestValidate(t *testing.T) {
+	for i, test := range validateTests {
+		err := test.audio.Validate()
+		switch {
+		case len(test.violations) == 0 && err != nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: nil\nActual: %v", i+1, test.description, err.Error())
+		case len(test.violations) > 0 && err == nil:
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: nil", i+1, test.description, test.violations)
+		case err != nil && len(strings.Split(err.Error(), "\n")) != len(test.violations):
+			t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, test.violations, err.Error())
+		default:
+			failed := false
+			for _, violation := range test.violations {
+				if !strings.Contains(err.Error(), violation) {
+					t.Errorf("FAIL Test %v: %v:\nWant: %v\nActual: %v", i+1, test.description, violation, err.Error())
+					failed = true
+				}
+			}
+			if !failed {
+				t.Logf("PASS Test %v: %v", i+1, test.description)
+			}
+		}
+	}
+}